@@ -3,8 +3,13 @@ package store
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"math"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/pebble"
@@ -17,7 +22,7 @@ import (
 //   - bucket id
 //   - bucket key
 //   - bucket access timestamp
-//   - lastIdx (last index of value table, cached but not stored in the pebble store)
+//   - lastIdx (highest index with a value in the value table, cached but not stored in the pebble store, loaded on first use)
 //   - the bucket values (stored in the value table)
 //
 // The bucket interface is thread-safe.
@@ -28,17 +33,163 @@ type Bucket interface {
 	// GetBucketKey returns the bucket key.
 	GetBucketKey() BucketKey
 
+	// IsAppendOnly returns whether the values of the bucket
+	// can only be appended.
+	IsAppendOnly() bool
+
+	// GetCreationTime returns the time the bucket was
+	// created.
+	GetCreationTime() time.Time
+
+	// GetValue retrieves a single value from the bucket.
+	GetValue(idx uint16) (BucketValue, bool, error)
+
+	// ValueSize returns the size of a single value without
+	// copying it.
+	ValueSize(idx uint16) (int, bool, error)
+
 	// GetValues retrieves values from the bucket.
 	GetValues(rng BucketRange) ([]BucketValue, error)
 
+	// GetValuesInto retrieves values from the bucket into
+	// dst, reusing its memory.
+	GetValuesInto(rng BucketRange, dst []BucketValue) ([]BucketValue, error)
+
+	// GetValuesWithMeta retrieves values from the bucket
+	// together with the lastIdx of the bucket.
+	GetValuesWithMeta(rng BucketRange) ([]BucketValue, uint16, error)
+
+	// GetValuesSince retrieves the values that are written
+	// after a sequence number, see StoreOptions.Sequences.
+	GetValuesSince(seq uint64) ([]BucketValue, uint64, error)
+
+	// GetValuesWithTombstones retrieves the values and the
+	// tombstones of freed values from a range of the bucket,
+	// see StoreOptions.Tombstones.
+	GetValuesWithTombstones(rng BucketRange) ([]BucketValue, error)
+
+	// GetValuesFiltered retrieves the values from the bucket
+	// for which keep returns true.
+	GetValuesFiltered(rng BucketRange, keep func(idx uint16, val []byte) bool) ([]BucketValue, error)
+
+	// GetValuesMap retrieves values from the bucket as a map
+	// from idx to value.
+	GetValuesMap(rng BucketRange) (map[uint16][]byte, error)
+
+	// GetValuesNoCopy calls fn for each value in a range of
+	// the bucket, without copying the values.
+	GetValuesNoCopy(rng BucketRange, fn func(idx uint16, val []byte) bool) error
+
+	// WriteValues writes the values in a range of the bucket
+	// to w.
+	WriteValues(rng BucketRange, w io.Writer) (int, error)
+
+	// GetValuesByIndices retrieves the values at the given
+	// indices from the bucket.
+	GetValuesByIndices(idxs []uint16) ([]BucketValue, error)
+
+	// FirstValue retrieves the value with the lowest idx.
+	FirstValue() (BucketValue, bool, error)
+
+	// LastValue retrieves the value with the highest idx.
+	LastValue() (BucketValue, bool, error)
+
+	// GetValueFromEnd retrieves the value at an offset from
+	// the end of the bucket.
+	GetValueFromEnd(offset uint16) (BucketValue, bool, error)
+
+	// OccupiedIndices returns the indices in a range of the
+	// bucket that have a value.
+	OccupiedIndices(rng BucketRange) ([]uint16, error)
+
 	// PutValues puts values into the bucket.
 	PutValues(values []BucketValue) error
 
+	// PutValuesIfAbsent puts values into the bucket without
+	// overwriting existing values.
+	PutValuesIfAbsent(values []BucketValue) error
+
 	// AppendValues adds values to the bucket.
 	AppendValues(values []BucketValue) error
 
+	// AppendValuesMaxSize adds values with a limited size
+	// to the bucket.
+	AppendValuesMaxSize(values []BucketValue, maxSize int) ([]uint16, error)
+
+	// TryAppend adds values to the bucket when the bucket is
+	// not busy and all values fit after the last value.
+	TryAppend(values []BucketValue) ([]uint16, error)
+
+	// AppendValuesIdempotent adds values to the bucket once
+	// for each request id.
+	AppendValuesIdempotent(requestID [RequestIDLength]byte, values []BucketValue) ([]uint16, error)
+
+	// BulkLoad appends a large amount of values to the
+	// bucket.
+	BulkLoad(values []BucketValue) error
+
+	// Free deletes the values at the given indices.
+	Free(idxs []uint16) error
+
+	// DeleteIndices deletes the values at the given
+	// indices in a single batch.
+	DeleteIndices(idxs []uint16) error
+
+	// SwapValues swaps the values at two indices.
+	SwapValues(a, b uint16) error
+
+	// DeleteValue deletes a single value from the bucket.
+	DeleteValue(idx uint16) (bool, error)
+
 	// DeleteValues deletes values from the bucket.
 	DeleteValues(rng BucketRange) error
+
+	// DeleteValuesPrune deletes values from the bucket, and
+	// deletes the bucket when it has no values left.
+	DeleteValuesPrune(rng BucketRange) (bool, error)
+
+	// DeleteValuesCount deletes values from the bucket and
+	// returns the amount of deleted values.
+	DeleteValuesCount(rng BucketRange) (int, error)
+
+	// ReplaceRange replaces all values in a range.
+	ReplaceRange(rng BucketRange, values []BucketValue) error
+
+	// Compact moves all values to contiguous indices.
+	Compact() (map[uint16]uint16, error)
+
+	// IncrementValue adds delta to a counter value.
+	IncrementValue(idx uint16, delta int64) error
+
+	// IncrementAudited adds delta to a counter value and
+	// appends an audit value.
+	IncrementAudited(counterIdx uint16, delta int64, auditValue []byte) (int64, error)
+
+	// MergeValue merges an operand into a value.
+	MergeValue(idx uint16, operand []byte) error
+
+	// CompareAndSwapValue replaces a value when it matches
+	// the expected value.
+	CompareAndSwapValue(idx uint16, old, new []byte) (bool, error)
+
+	// Stats returns statistics of the bucket.
+	Stats() (BucketStats, error)
+
+	// ValueSizeHistogram returns the size distribution of
+	// the values in a range of the bucket.
+	ValueSizeHistogram(rng BucketRange) (SizeHistogram, error)
+
+	// DebugString returns the state of the bucket in a
+	// human-readable form.
+	DebugString() string
+
+	// RemainingCapacity returns the amount of values that
+	// can still be appended to the bucket.
+	RemainingCapacity() int
+
+	// IsFull returns whether no values can be appended to
+	// the bucket.
+	IsFull() bool
 }
 
 const (
@@ -64,14 +215,65 @@ type BucketKey *[BucketKeyLength]byte
 // append to the bucket. Write permission is required for
 // deleting values from the store.
 type BucketPermissions struct {
-	Read   bool
-	Write  bool
-	Append bool
+	Read   bool `json:"read"`
+	Write  bool `json:"write"`
+	Append bool `json:"append"`
+}
+
+// BucketInfo contains the information that is packed in
+// a BucketID, see ParseBucketID. GetBucketInfo also sets
+// the state of the stored bucket.
+type BucketInfo struct {
+	ID         string            `json:"id,omitempty"` // Encoded BucketID, see EncodeBucketID.
+	Lifetime   byte              `json:"lifetime"`     // Lifetime in days, 0 for an infinite lifetime.
+	Public     BucketPermissions `json:"public"`       // Permissions without the BucketKey.
+	Protected  BucketPermissions `json:"protected"`    // Permissions with the BucketKey.
+	LastAccess time.Time         `json:"lastAccess"`   // Last access time, with an hour precision.
+	Created    time.Time         `json:"created"`      // Creation time, zero for buckets created before creation times were stored.
+	LastIdx    uint16            `json:"lastIdx"`      // Highest used idx.
+	Count      int               `json:"count"`        // Amount of values that are not expired.
+}
+
+// Permission bits in the 16th byte of a BucketID.
+const (
+	permPublicRead      = 1 << 0
+	permPublicWrite     = 1 << 1
+	permPublicAppend    = 1 << 2
+	permProtectedRead   = 1 << 3
+	permProtectedWrite  = 1 << 4
+	permProtectedAppend = 1 << 5
+	permReserved        = 1<<6 | 1<<7
+)
+
+// ParseBucketID returns the lifetime and permissions of a
+// bucket.
+//
+// ErrInvalidBucketID is returned when a reserved permission
+// bit is set, or when a write bit is set without its append
+// bit, because users that can write can always append.
+func ParseBucketID(id BucketID) (BucketInfo, error) {
+	perms := id[15]
+	if perms&permReserved != 0 {
+		return BucketInfo{}, fmt.Errorf("%w: reserved permission bits set", ErrInvalidBucketID)
+	} else if perms&permPublicWrite != 0 && perms&permPublicAppend == 0 {
+		return BucketInfo{}, fmt.Errorf("%w: public write without public append", ErrInvalidBucketID)
+	} else if perms&permProtectedWrite != 0 && perms&permProtectedAppend == 0 {
+		return BucketInfo{}, fmt.Errorf("%w: protected write without protected append", ErrInvalidBucketID)
+	}
+
+	return BucketInfo{
+		Lifetime:  GetBucketLifetime(id),
+		Public:    GetBucketPermissions(id, false),
+		Protected: GetBucketPermissions(id, true),
+	}, nil
 }
 
 // GetBucketLifetime returns the lifetime of a bucket, and 0
 // if bucket has an infinite lifetime.
 func GetBucketLifetime(id BucketID) byte {
+	if id == nil {
+		return 0
+	}
 	return id[14]
 }
 
@@ -80,17 +282,19 @@ func GetBucketLifetime(id BucketID) byte {
 // Authorized identifies whether the bucket is accessed by
 // an user that knows the BucketKey.
 func GetBucketPermissions(id BucketID, authorized bool) BucketPermissions {
-	if authorized {
+	if id == nil {
+		return BucketPermissions{}
+	} else if authorized {
 		return BucketPermissions{
-			Read:   id[15]&1 != 0 || id[15]&8 != 0,
-			Write:  id[15]&2 != 0 || id[15]&16 != 0,
-			Append: id[15]&2 != 0 || id[15]&32 != 0,
+			Read:   id[15]&permPublicRead != 0 || id[15]&permProtectedRead != 0,
+			Write:  id[15]&permPublicWrite != 0 || id[15]&permProtectedWrite != 0,
+			Append: id[15]&permPublicWrite != 0 || id[15]&permProtectedAppend != 0,
 		}
 	} else {
 		return BucketPermissions{
-			Read:   id[15]&1 != 0,
-			Write:  id[15]&2 != 0,
-			Append: id[15]&4 != 0,
+			Read:   id[15]&permPublicRead != 0,
+			Write:  id[15]&permPublicWrite != 0,
+			Append: id[15]&permPublicAppend != 0,
 		}
 	}
 }
@@ -101,25 +305,45 @@ func GetBucketPermissions(id BucketID, authorized bool) BucketPermissions {
 // value. The value is stored in the value table with the
 // BucketId + value idx as key.
 type BucketValue struct {
-	Idx   uint16 // If value is 0, append to the end of the bucket.
-	Value []byte
+	Idx       uint16 // If value is 0, append to the end of the bucket.
+	Value     []byte
+	Expires   uint32 // Hours since the unix epoch after which the value is expired, 0 if it never expires.
+	Tombstone bool   // Free the value at Idx instead of writing Value.
 }
 
 // BucketRange represents a range of values from a bucket
-// marked by a start / end idx.
+// marked by a start / end idx. The start idx is included,
+// the end idx is excluded, so a range with Start equal to
+// End is empty. A range with Start after End is invalid.
+//
+// Reverse and Limit are only used when reading values, and
+// are ignored by operations that delete a range.
 type BucketRange struct {
-	Start uint16
-	End   uint16
+	Start   uint16
+	End     uint16
+	Reverse bool   // Return values in descending idx order.
+	Limit   uint16 // Maximum amount of values returned, 0 for no limit.
+}
+
+// validate returns ErrInvalidRange when Start is after End.
+func (rng BucketRange) validate() error {
+	if rng.Start > rng.End {
+		return ErrInvalidRange
+	}
+	return nil
 }
 
 // pebbleBucket implements the Bucket interface.
 type pebbleBucket struct {
 	id   BucketID
-	data []byte // First 4 bytes contain the timestamp, last 32 are the key.
+	data []byte // Timestamp (4 bytes), key (32 bytes) and creation timestamp (4 bytes, optional).
 
-	mtx     sync.Mutex   // Mutex guarding the lastIdx field.
-	lastIdx uint16       // Highest index in the value table.
-	store   *pebbleStore // Parent store.
+	mtx           sync.Mutex   // Mutex guarding the lastIdx and data fields.
+	lastIdx       uint16       // Highest index with a value in the value table, see fetchLastIdx.
+	lastIdxLoaded atomic.Bool  // Whether lastIdx is loaded from the value table.
+	count         int          // Amount of values in the value table, see getCount.
+	countLoaded   bool         // Whether count is loaded, reset by writes that don't track it.
+	store         *pebbleStore // Parent store.
 }
 
 // GetBucketID returns the bucket id.
@@ -127,185 +351,2233 @@ func (bkt *pebbleBucket) GetBucketID() BucketID {
 	return bkt.id
 }
 
-// GetBucketKey returns the bucket key.
+// GetBucketKey returns the bucket key, or nil when the
+// bucket data doesn't contain a key.
 func (bkt *pebbleBucket) GetBucketKey() BucketKey {
-	return BucketKey(bkt.data[4:])
+	if len(bkt.data) < 4+BucketKeyLength {
+		return nil
+	}
+	return BucketKey(bkt.data[4 : 4+BucketKeyLength])
 }
 
-// GetValues retrieves values from the bucket.
-func (bkt *pebbleBucket) GetValues(rng BucketRange) ([]BucketValue, error) {
-	iter := bkt.store.db.NewIter(&pebble.IterOptions{
-		LowerBound: getPebbleValueKey(bkt.id, rng.Start),
-		UpperBound: getPebbleValueKey(bkt.id, rng.End),
-	})
+// bucketFlagAppendOnly is the flag of an append-only
+// bucket. The flags are stored after the creation time in
+// the bucket data.
+const bucketFlagAppendOnly = 1 << 0
 
-	values := make([]BucketValue, 0, int(math.Min(float64(rng.End-rng.Start), 2048)))
-	for iter.First(); iter.Valid(); iter.Next() {
-		values = append(values, BucketValue{
-			Idx:   binary.BigEndian.Uint16(iter.Key()[1+BucketIDLength:]),
-			Value: iter.Value(),
-		})
-	}
+// IsAppendOnly returns whether the bucket is append-only,
+// see BucketOptions.AppendOnly. Buckets that were created
+// before flags were stored are not append-only.
+func (bkt *pebbleBucket) IsAppendOnly() bool {
+	return len(bkt.data) > 8+BucketKeyLength && bkt.data[8+BucketKeyLength]&bucketFlagAppendOnly != 0
+}
 
-	if err := refreshTimestamp(bkt, bkt.store.db); err != nil {
-		_ = iter.Close()
-		return values, err
+// checkAppendOnly returns ErrAppendOnly when the bucket is
+// append-only and one of the values is not appended,
+// because it has an idx or is a tombstone.
+func checkAppendOnly(bkt *pebbleBucket, values []BucketValue) error {
+	if !bkt.IsAppendOnly() {
+		return nil
+	}
+	for _, value := range values {
+		if value.Idx != 0 || value.Tombstone {
+			return &BucketError{ID: bkt.id, Idx: value.Idx, Op: OpPut, Err: ErrAppendOnly}
+		}
 	}
+	return nil
+}
 
-	return values, iter.Close()
+// GetCreationTime returns the time the bucket was created.
+//
+// The creation time is set by CreateBucket and is not
+// changed when the bucket is accessed, see GetValues. Like
+// the access time it has an hour precision. Buckets that
+// were created before creation times were stored return
+// the zero time.
+func (bkt *pebbleBucket) GetCreationTime() time.Time {
+	created := getCreationTimestamp(bkt)
+	if created == 0 {
+		return time.Time{}
+	}
+	return fromTimestamp(created)
 }
 
-// PutValues puts values into the bucket.
+// RemainingCapacity returns the amount of values that can
+// still be appended to the bucket.
 //
-// Values with an idx of 0 are appended to the end of the
-// bucket, when the bucket is full ErrBucketFull is
-// returned. When a value is empty, the existing
-// bucket value at that idx is freed.
-func (bkt *pebbleBucket) PutValues(values []BucketValue) error {
-	if err := computeValues(bkt, values, false); err != nil {
-		return err
+// Freed indices are reused by appends once lastIdx reaches
+// math.MaxUint16, so the capacity is the amount of unused
+// indices. This requires a scan of the bucket values. An
+// AppendValues call with at most RemainingCapacity values
+// does not fail with ErrBucketIsFull, unless the bucket is
+// modified concurrently. Returns 0 when the store is
+// closed.
+func (bkt *pebbleBucket) RemainingCapacity() int {
+	done, err := bkt.store.beginOp()
+	if err != nil {
+		return 0
+	}
+	defer done()
+
+	lower, upper := bkt.store.getPebbleValueKeyRange(bkt.id)
+	values, err := bkt.store.countKeys(bkt.store.db, lower, upper)
+	if err != nil {
+		// Fall back to the indices after lastIdx, which are
+		// always available.
+		bkt.mtx.Lock()
+		defer bkt.mtx.Unlock()
+		lastIdx, _ := bkt.getLastIdx()
+		return math.MaxUint16 - int(lastIdx)
 	}
-	return insertValues(bkt, values)
+	return math.MaxUint16 - int(values)
 }
 
-// AppendValues adds values to the bucket.
+// IsFull returns whether no values can be appended to the
+// bucket, see RemainingCapacity.
+func (bkt *pebbleBucket) IsFull() bool {
+	return bkt.RemainingCapacity() == 0
+}
+
+// GetValue retrieves a single value from the bucket.
 //
-// The idx of the given values must be 0 or a valid idx. An
-// idx is valid when it is the lastIdx+1.
-func (bkt *pebbleBucket) AppendValues(values []BucketValue) error {
-	if err := computeValues(bkt, values, true); err != nil {
-		return err
+// Returns false when no value exists at idx, which is always
+// the case for the reserved idx 0. Pending merges of the
+// value are resolved.
+func (bkt *pebbleBucket) GetValue(idx uint16) (_ BucketValue, _ bool, err error) {
+	defer bkt.store.track(OpGet)(&err)
+	done, err := bkt.beginRead(OpGet)
+	if err != nil {
+		return BucketValue{}, false, err
+	}
+	defer done()
+
+	var expired []uint16
+	defer func() { _ = bkt.store.reapExpired(bkt.id, expired) }()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	// Expired values in the cache are read again, so they
+	// are reaped.
+	if value, found, ok := bkt.store.values.get(bkt.id, idx); ok && (!found || !isExpired(value.Expires, bkt.store.getCurrentTimestamp())) {
+		return value, found, refreshTimestamp(bkt, bkt.store.db)
+	}
+
+	version := bkt.store.values.begin()
+	data, closer, err := bkt.store.db.Get(bkt.store.getPebbleValueKey(bkt.id, idx))
+	if errors.Is(err, pebble.ErrNotFound) {
+		bkt.store.values.put(bkt.id, version, BucketValue{Idx: idx}, false)
+		return BucketValue{}, false, refreshTimestamp(bkt, bkt.store.db)
+	} else if err != nil {
+		return BucketValue{}, false, err
 	}
-	return insertValues(bkt, values)
+
+	decoded, expires, err := bkt.store.decodeValue(idx, data)
+	value := BucketValue{Idx: idx, Value: append([]byte(nil), decoded...), Expires: expires}
+	if closeErr := closer.Close(); closeErr != nil {
+		return value, true, closeErr
+	} else if err != nil {
+		return BucketValue{}, false, err
+	} else if isExpired(expires, bkt.store.getCurrentTimestamp()) {
+		expired = append(expired, idx)
+		return BucketValue{}, false, refreshTimestamp(bkt, bkt.store.db)
+	}
+	bkt.store.values.put(bkt.id, version, value, true)
+	return value, true, refreshTimestamp(bkt, bkt.store.db)
 }
 
-// DeleteValues deletes values from the bucket
-func (bkt *pebbleBucket) DeleteValues(rng BucketRange) error {
-	batch := bkt.store.db.NewBatch()
-	defer batch.Close()
-	if err := batch.DeleteRange(
-		getPebbleValueKey(bkt.id, rng.Start),
-		getPebbleValueKey(bkt.id, rng.End),
-		nil,
-	); err != nil {
-		return err
+// ValueSize returns the size in bytes of a single value,
+// excluding the value header.
+//
+// See GetValue, the value is not copied, so the size of a
+// large value can be checked before it is read. Returns
+// false when no value exists at idx.
+func (bkt *pebbleBucket) ValueSize(idx uint16) (_ int, _ bool, err error) {
+	defer bkt.store.track(OpGet)(&err)
+	done, err := bkt.beginRead(OpGet)
+	if err != nil {
+		return 0, false, err
 	}
+	defer done()
 
-	if err := refreshTimestamp(bkt, batch); err != nil {
-		return err
+	var expired []uint16
+	defer func() { _ = bkt.store.reapExpired(bkt.id, expired) }()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	data, closer, err := bkt.store.db.Get(bkt.store.getPebbleValueKey(bkt.id, idx))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return 0, false, refreshTimestamp(bkt, bkt.store.db)
+	} else if err != nil {
+		return 0, false, err
 	}
 
-	if err := bkt.store.db.Apply(batch, nil); err != nil {
-		return err
+	decoded, expires, err := bkt.store.decodeValue(idx, data)
+	size := len(decoded)
+	if closeErr := closer.Close(); closeErr != nil {
+		return 0, false, closeErr
+	} else if err != nil {
+		return 0, false, err
+	} else if isExpired(expires, bkt.store.getCurrentTimestamp()) {
+		expired = append(expired, idx)
+		return 0, false, refreshTimestamp(bkt, bkt.store.db)
+	}
+	return size, true, refreshTimestamp(bkt, bkt.store.db)
+}
+
+// GetValues retrieves values from the bucket.
+//
+// Values are returned in ascending idx order, or descending
+// order when rng.Reverse is set. When rng.Limit is set, at
+// most rng.Limit values are returned starting from the
+// first value in iteration order.
+func (bkt *pebbleBucket) GetValues(rng BucketRange) (_ []BucketValue, err error) {
+	defer bkt.store.track(OpGet)(&err)
+	done, err := bkt.beginRead(OpGet)
+	if err != nil {
+		return nil, err
 	}
+	defer done()
 
-	// Refresh lastIdx when delete removes the last value.
-	if rng.Start < bkt.lastIdx && rng.End > bkt.lastIdx {
-		bkt.mtx.Lock()
-		defer bkt.mtx.Unlock()
-		bkt.lastIdx = fetchLastIdx(bkt)
+	var expired []uint16
+	defer func() { _ = bkt.store.reapExpired(bkt.id, expired) }()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	cacheable := bkt.store.values != nil && rng.End > rng.Start && rng.End-rng.Start <= valueCacheRange
+	if cacheable {
+		if values, ok := bkt.getCachedValues(rng); ok {
+			return values, refreshTimestamp(bkt, bkt.store.db)
+		}
 	}
-	return nil
+
+	version := bkt.store.values.begin()
+	values, expired, err := bkt.store.readValues(bkt.store.db, bkt.id, rng, nil)
+	if err != nil {
+		return values, err
+	}
+	if cacheable && rng.Limit == 0 {
+		bkt.putCachedValues(rng, version, values, expired)
+	}
+	return values, refreshTimestamp(bkt, bkt.store.db)
 }
 
-// computeValues computes and verifies the idx values for
-// the given slice with values.
-func computeValues(bkt *pebbleBucket, values []BucketValue, appendOnly bool) error {
-	bkt.mtx.Lock()
-	defer bkt.mtx.Unlock()
-	for i := range values {
-		switch {
-		// When idx value is 0, this is an append operation.
-		// Increase and assign lastIdx. Return error when
-		// bucket overflows.
-		case values[i].Idx == 0:
-			if bkt.lastIdx == math.MaxUint16 {
-				return ErrBucketIsFull
-			}
-			bkt.lastIdx++
-			values[i].Idx = bkt.lastIdx
+// getCachedValues returns the values in a range from the
+// value cache, ok is false when one of the indices in the
+// range is not cached or expired.
+func (bkt *pebbleBucket) getCachedValues(rng BucketRange) (_ []BucketValue, ok bool) {
+	now := bkt.store.getCurrentTimestamp()
+	var values []BucketValue
+	for i := 0; i < int(rng.End-rng.Start); i++ {
+		idx := rng.Start + uint16(i)
+		if rng.Reverse {
+			idx = rng.End - 1 - uint16(i)
+		}
 
-		// For append only operation, verify that the given
-		// idx is equal to lastIdx+1. If not, return
-		// ErrInvalidAppend.
-		case appendOnly:
-			if bkt.lastIdx+1 == values[i].Idx {
-				bkt.lastIdx++
-			} else {
-				return ErrInvalidAppend
+		value, found, ok := bkt.store.values.get(bkt.id, idx)
+		if !ok || (found && isExpired(value.Expires, now)) {
+			return nil, false
+		} else if found {
+			values = append(values, value)
+			if rng.Limit != 0 && len(values) == int(rng.Limit) {
+				break
 			}
-
-		// When the operation is not append only, and
-		// the value idx is larger than lastIdx, update
-		// the lastIdx.
-		case values[i].Idx > bkt.lastIdx:
-			bkt.lastIdx = values[i].Idx
 		}
 	}
-	return nil
+	return values, true
 }
 
-// insertValues inserts the given slice of values into the
-// bucket.
-func insertValues(bkt *pebbleBucket, values []BucketValue) error {
-	batch := bkt.store.db.NewBatch()
-	defer batch.Close()
-	key := getPebbleValueKey(bkt.id, 0)
+// putCachedValues caches the values read from a range
+// without a limit. Indices without a value are cached as
+// not found, except for expired values that are reaped.
+func (bkt *pebbleBucket) putCachedValues(rng BucketRange, version uint64, values []BucketValue, expired []uint16) {
+	found := make(map[uint16]bool, len(values)+len(expired))
 	for _, value := range values {
-		binary.BigEndian.PutUint16(key[1+BucketIDLength:], value.Idx)
-		if len(value.Value) > 0 {
-			if err := batch.Set(key, value.Value, nil); err != nil {
-				return err
-			}
-		} else {
-			if err := batch.Delete(key, nil); err != nil {
-				return err
-			}
+		bkt.store.values.put(bkt.id, version, value, true)
+		found[value.Idx] = true
+	}
+	for _, idx := range expired {
+		found[idx] = true
+	}
+	for idx := int(rng.Start); idx < int(rng.End); idx++ {
+		if !found[uint16(idx)] {
+			bkt.store.values.put(bkt.id, version, BucketValue{Idx: uint16(idx)}, false)
 		}
 	}
+}
 
-	if err := refreshTimestamp(bkt, batch); err != nil {
+// GetValuesInto retrieves values from the bucket into dst.
+//
+// See GetValues. The values are appended to dst[:0], which
+// only grows when its capacity is too small. The Value
+// buffers of the elements of dst, up to its capacity, are
+// reused for the values at the same position. The returned
+// values therefore share memory with dst, and the values
+// previously stored in dst are overwritten. Reusing the
+// result of the previous call avoids allocations in a read
+// loop.
+func (bkt *pebbleBucket) GetValuesInto(rng BucketRange, dst []BucketValue) (_ []BucketValue, err error) {
+	defer bkt.store.track(OpGet)(&err)
+	done, err := bkt.beginRead(OpGet)
+	if err != nil {
+		return dst[:0], err
+	}
+	defer done()
+
+	var expired []uint16
+	defer func() { _ = bkt.store.reapExpired(bkt.id, expired) }()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	values := dst[:0]
+	expired, err = bkt.store.scanValues(bkt.store.db, bkt.id, rng, func(idx uint16, value []byte, expires uint32) bool {
+		var buf []byte
+		if len(values) < cap(values) {
+			buf = values[:len(values)+1][len(values)].Value[:0]
+		}
+		values = append(values, BucketValue{Idx: idx, Value: append(buf, value...), Expires: expires})
+		return rng.Limit == 0 || len(values) < int(rng.Limit)
+	})
+	if err != nil {
+		return values, err
+	}
+	return values, refreshTimestamp(bkt, bkt.store.db)
+}
+
+// GetValuesWithMeta retrieves values from the bucket
+// together with the lastIdx of the bucket.
+//
+// See GetValues. The values and lastIdx are read while
+// holding the bucket lock, so writes are not applied in
+// between and the lastIdx matches the returned values. A
+// client can compare lastIdx with the last returned value
+// to know whether it has the tail of the bucket.
+func (bkt *pebbleBucket) GetValuesWithMeta(rng BucketRange) (_ []BucketValue, _ uint16, err error) {
+	defer bkt.store.track(OpGet)(&err)
+	done, err := bkt.beginRead(OpGet)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer done()
+
+	var expired []uint16
+	defer func() { _ = bkt.store.reapExpired(bkt.id, expired) }()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	values, expired, err := bkt.store.readValues(bkt.store.db, bkt.id, rng, nil)
+	if err != nil {
+		return values, 0, err
+	}
+
+	bkt.mtx.Lock()
+	lastIdx, err := bkt.getLastIdx()
+	bkt.mtx.Unlock()
+	if err != nil {
+		return values, 0, err
+	}
+	return values, lastIdx, refreshTimestamp(bkt, bkt.store.db)
+}
+
+// GetValuesFiltered retrieves the values from the bucket
+// for which keep returns true.
+//
+// See GetValues. The predicate is called inside the
+// iterator loop with the value as stored by the iterator,
+// which is only valid during the call. Only kept values are
+// copied, and rng.Limit counts only kept values.
+func (bkt *pebbleBucket) GetValuesFiltered(rng BucketRange, keep func(idx uint16, val []byte) bool) (_ []BucketValue, err error) {
+	defer bkt.store.track(OpGet)(&err)
+	done, err := bkt.beginRead(OpGet)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	var expired []uint16
+	defer func() { _ = bkt.store.reapExpired(bkt.id, expired) }()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	values, expired, err := bkt.store.readValues(bkt.store.db, bkt.id, rng, keep)
+	if err != nil {
+		return values, err
+	}
+	return values, refreshTimestamp(bkt, bkt.store.db)
+}
+
+// GetValuesMap retrieves values from the bucket as a map
+// from idx to value.
+//
+// See GetValues, the map is preallocated in the same way
+// and indices without a value are not in the map.
+func (bkt *pebbleBucket) GetValuesMap(rng BucketRange) (_ map[uint16][]byte, err error) {
+	defer bkt.store.track(OpGet)(&err)
+	done, err := bkt.beginRead(OpGet)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	var expired []uint16
+	defer func() { _ = bkt.store.reapExpired(bkt.id, expired) }()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	values := make(map[uint16][]byte, bkt.store.getPreallocSize(rng))
+	expired, err = bkt.store.scanValues(bkt.store.db, bkt.id, rng, func(idx uint16, value []byte, _ uint32) bool {
+		values[idx] = append([]byte(nil), value...)
+		return rng.Limit == 0 || len(values) < int(rng.Limit)
+	})
+	if err != nil {
+		return values, err
+	}
+	return values, refreshTimestamp(bkt, bkt.store.db)
+}
+
+// GetValuesNoCopy calls fn for each value in a range of
+// the bucket until fn returns false.
+//
+// See GetValues, rng.Limit limits the amount of calls to
+// fn. Values are not copied: val is owned by the iterator
+// and is only valid until fn returns. It must not be
+// modified or retained, copy it when it is needed after
+// fn returns. The bucket is read locked while fn runs, so
+// fn must not write to the bucket.
+func (bkt *pebbleBucket) GetValuesNoCopy(rng BucketRange, fn func(idx uint16, val []byte) bool) (err error) {
+	defer bkt.store.track(OpGet)(&err)
+	done, err := bkt.beginRead(OpGet)
+	if err != nil {
 		return err
 	}
+	defer done()
+
+	var expired []uint16
+	defer func() { _ = bkt.store.reapExpired(bkt.id, expired) }()
 
-	return bkt.store.db.Apply(batch, nil)
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	var calls uint16
+	expired, err = bkt.store.scanValues(bkt.store.db, bkt.id, rng, func(idx uint16, value []byte, _ uint32) bool {
+		calls++
+		return fn(idx, value) && (rng.Limit == 0 || calls < rng.Limit)
+	})
+	if err != nil {
+		return err
+	}
+	return refreshTimestamp(bkt, bkt.store.db)
 }
 
-// fetchLastIdx returns the lastIdx in the value table for
-// a bucket.
-func fetchLastIdx(bkt *pebbleBucket) uint16 {
-	iter := bkt.store.db.NewIter(&pebble.IterOptions{
-		LowerBound: getPebbleValueKey(bkt.id, 0),
-		UpperBound: getPebbleValueKey(bkt.id, math.MaxUint16),
+// readValues reads the values in a range of a bucket from
+// the given reader, see GetValues. Values are skipped when
+// keep is set and returns false. Expired values are
+// skipped, their indices are returned.
+func (str *pebbleStore) readValues(reader pebble.Reader, id BucketID, rng BucketRange, keep func(idx uint16, val []byte) bool) ([]BucketValue, []uint16, error) {
+	if err := rng.validate(); err != nil {
+		return nil, nil, err
+	} else if rng.End-rng.Start <= directReadThreshold {
+		return str.readValuesDirect(reader, id, rng, keep)
+	}
+	return str.readValuesIter(reader, id, rng, keep)
+}
+
+// directReadThreshold is the largest range that is read
+// using a lookup for each idx instead of an iterator, see
+// readValuesDirect.
+//
+// Creating an iterator costs about two lookups, but each
+// next value is cheaper to read with an iterator than with
+// another lookup. BenchmarkReadValuesSmallRange shows a
+// single lookup at half the cost of an iterator, both paths
+// cost about the same for two values and the iterator wins
+// from four values.
+const directReadThreshold = 2
+
+// readValuesDirect reads the values in a small range using
+// a lookup for each idx, see readValues. Absent indices
+// are skipped.
+func (str *pebbleStore) readValuesDirect(reader pebble.Reader, id BucketID, rng BucketRange, keep func(idx uint16, val []byte) bool) ([]BucketValue, []uint16, error) {
+	var values []BucketValue
+	var expired []uint16
+	now := str.getCurrentTimestamp()
+	key := str.getPebbleValueKey(id, 0)
+	for i := uint16(0); i < rng.End-rng.Start; i++ {
+		idx := rng.Start + i
+		if rng.Reverse {
+			idx = rng.End - 1 - i
+		}
+
+		setKeyIdx(key, idx)
+		stored, closer, err := reader.Get(key)
+		if errors.Is(err, pebble.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return values, expired, err
+		}
+
+		// The stored value is only valid until the closer is
+		// closed, so it must be copied.
+		value, expires, err := str.decodeValue(idx, stored)
+		if err == nil && isExpired(expires, now) {
+			expired = append(expired, idx)
+		} else if err == nil && (keep == nil || keep(idx, value)) {
+			values = append(values, BucketValue{Idx: idx, Value: append([]byte(nil), value...), Expires: expires})
+		}
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return values, expired, err
+		} else if rng.Limit != 0 && len(values) >= int(rng.Limit) {
+			break
+		}
+	}
+	return values, expired, nil
+}
+
+// readValuesIter reads the values in a range using an
+// iterator, see readValues.
+func (str *pebbleStore) readValuesIter(reader pebble.Reader, id BucketID, rng BucketRange, keep func(idx uint16, val []byte) bool) ([]BucketValue, []uint16, error) {
+	// The value passed by scanValues is only valid until the
+	// iterator is moved, so it must be copied.
+	values := make([]BucketValue, 0, str.getPreallocSize(rng))
+	expired, err := str.scanValues(reader, id, rng, func(idx uint16, value []byte, expires uint32) bool {
+		if keep == nil || keep(idx, value) {
+			values = append(values, BucketValue{Idx: idx, Value: append([]byte(nil), value...), Expires: expires})
+		}
+		return rng.Limit == 0 || len(values) < int(rng.Limit)
 	})
-	defer iter.Close()
+	return values, expired, err
+}
 
-	if iter.Last() {
-		return binary.BigEndian.Uint16(iter.Key()[1+BucketIDLength:])
-	} else {
-		return 0
+// getPreallocSize returns the amount of values that is
+// preallocated for reading a range.
+func (str *pebbleStore) getPreallocSize(rng BucketRange) int {
+	size := math.Min(float64(rng.End-rng.Start), float64(str.getPreallocLimit()))
+	if rng.Limit > 0 {
+		size = math.Min(size, float64(rng.Limit))
 	}
+	return int(size)
 }
 
-// refreshTimestamp updates the timestamp in the bucket.
-func refreshTimestamp(bkt *pebbleBucket, writer pebble.Writer) error {
-	now := getCurrentTimestamp()
-	arr := make([]byte, 4)
-	binary.BigEndian.PutUint32(arr, now)
+// scanValues calls fn for each value in a range of a bucket
+// until fn returns false. The value passed to fn is owned
+// by the iterator. Expired values are skipped, their
+// indices are returned. rng.Limit is not applied.
+func (str *pebbleStore) scanValues(reader pebble.Reader, id BucketID, rng BucketRange, fn func(idx uint16, value []byte, expires uint32) bool) ([]uint16, error) {
+	if err := rng.validate(); err != nil {
+		return nil, err
+	}
 
-	if !bytes.Equal(bkt.data[:4], arr) {
-		copy(bkt.data[:4], arr)
-		return writer.Set(getPebbleBucketKey(bkt.id), bkt.data, pebble.NoSync)
+	opts := str.getValueIterOptions(id, rng.Start, rng.End, false)
+	defer opts.release()
+	iter := reader.NewIter(&opts.IterOptions)
+
+	// Walk the iterator backwards for reverse ranges.
+	var expired []uint16
+	now := str.getCurrentTimestamp()
+	valid := iter.First()
+	if rng.Reverse {
+		valid = iter.Last()
 	}
-	return nil
+	for ; valid; valid = nextValue(iter, rng.Reverse) {
+		idx := getKeyIdx(iter.Key())
+		value, expires, err := str.decodeValue(idx, iter.Value())
+		if err != nil {
+			_ = iter.Close()
+			return expired, err
+		} else if isExpired(expires, now) {
+			if !str.isTombstone(iter.Value()) {
+				expired = append(expired, idx)
+			}
+			continue
+		} else if !fn(idx, value, expires) {
+			break
+		}
+	}
+	return expired, iter.Close()
 }
 
-// getTimestamp returns the last access time of the bucket.
-func getTimestamp(bkt *pebbleBucket) uint32 {
-	return binary.BigEndian.Uint32(bkt.data)
+// nextValue moves the iterator to the next value, or the
+// previous value when reverse is true.
+func nextValue(iter *pebble.Iterator, reverse bool) bool {
+	if reverse {
+		return iter.Prev()
+	}
+	return iter.Next()
 }
 
-// getCurrentTimestamp returns the current timestamp.
-func getCurrentTimestamp() uint32 {
-	return uint32(time.Since(time.Unix(0, 0)) / (time.Hour))
+// GetValuesByIndices retrieves the values at the given
+// indices from the bucket.
+//
+// The values are returned in ascending idx order, missing
+// values are skipped. A single iterator is used that seeks
+// to each of the indices, which is cheaper than a separate
+// lookup for each idx.
+func (bkt *pebbleBucket) GetValuesByIndices(idxs []uint16) (_ []BucketValue, err error) {
+	defer bkt.store.track(OpGet)(&err)
+	done, err := bkt.beginRead(OpGet)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	var expired []uint16
+	defer func() { _ = bkt.store.reapExpired(bkt.id, expired) }()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	sorted := append([]uint16(nil), idxs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	lower, upper := bkt.store.getPebbleValueKeyRange(bkt.id)
+	iter := bkt.store.db.NewIter(&pebble.IterOptions{
+		LowerBound: lower,
+		UpperBound: upper,
+	})
+
+	values := make([]BucketValue, 0, len(sorted))
+	now := bkt.store.getCurrentTimestamp()
+	key := bkt.store.getPebbleValueKey(bkt.id, 0)
+	for i, idx := range sorted {
+		if i > 0 && sorted[i-1] == idx {
+			continue
+		}
+
+		setKeyIdx(key, idx)
+		if iter.SeekGE(key) && bytes.Equal(iter.Key(), key) {
+			value, expires, err := bkt.store.decodeValue(idx, iter.Value())
+			if err != nil {
+				_ = iter.Close()
+				return values, err
+			} else if isExpired(expires, now) {
+				expired = append(expired, idx)
+				continue
+			}
+			values = append(values, BucketValue{Idx: idx, Value: append([]byte(nil), value...), Expires: expires})
+		}
+	}
+
+	if err := refreshTimestamp(bkt, bkt.store.db); err != nil {
+		_ = iter.Close()
+		return values, err
+	}
+
+	return values, iter.Close()
+}
+
+// FirstValue retrieves the value with the lowest idx.
+//
+// Returns false when the bucket is empty.
+func (bkt *pebbleBucket) FirstValue() (_ BucketValue, _ bool, err error) {
+	defer bkt.store.track(OpGet)(&err)
+	return peekValue(bkt, false, 0)
+}
+
+// LastValue retrieves the value with the highest idx.
+//
+// Returns false when the bucket is empty. The idx of the
+// value is the same as the idx returned by fetchLastIdx.
+func (bkt *pebbleBucket) LastValue() (_ BucketValue, _ bool, err error) {
+	defer bkt.store.track(OpGet)(&err)
+	return peekValue(bkt, true, 0)
+}
+
+// GetValueFromEnd retrieves the value at an offset from
+// the end of the bucket.
+//
+// Offset 0 is the last value, see LastValue, offset 1 the
+// value before it. Only present values are counted, so
+// freed indices, tombstones and expired values are
+// skipped. Returns false when the bucket has no more than
+// offset values.
+func (bkt *pebbleBucket) GetValueFromEnd(offset uint16) (_ BucketValue, _ bool, err error) {
+	defer bkt.store.track(OpGet)(&err)
+	return peekValue(bkt, true, offset)
+}
+
+// OccupiedIndices returns the indices in a range of the
+// bucket that have a value.
+//
+// Only the keys are read, so the values are not decoded or
+// copied. Expired values occupy their idx until they are
+// reaped, tombstones don't occupy their idx. The indices
+// are sorted, in descending order when rng.Reverse is set,
+// and rng.Limit limits the amount of returned indices.
+func (bkt *pebbleBucket) OccupiedIndices(rng BucketRange) (_ []uint16, err error) {
+	defer bkt.store.track(OpGet)(&err)
+	done, err := bkt.beginRead(OpGet)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if err := rng.validate(); err != nil {
+		return nil, err
+	}
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	opts := bkt.store.getValueIterOptions(bkt.id, rng.Start, rng.End, false)
+	defer opts.release()
+	iter := bkt.store.db.NewIter(&opts.IterOptions)
+
+	var idxs []uint16
+	valid := iter.First()
+	if rng.Reverse {
+		valid = iter.Last()
+	}
+	for ; valid && (rng.Limit == 0 || len(idxs) < int(rng.Limit)); valid = nextValue(iter, rng.Reverse) {
+		if !bkt.store.isTombstone(iter.Value()) {
+			idxs = append(idxs, getKeyIdx(iter.Key()))
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return idxs, refreshTimestamp(bkt, bkt.store.db)
+}
+
+// PutValues puts values into the bucket.
+//
+// Values with an idx of 0 are appended to the end of the
+// bucket. When lastIdx is math.MaxUint16, appended values
+// reuse freed indices, so they are not ordered after the
+// existing values anymore. When no idx is left
+// ErrBucketIsFull is returned. When a value is a tombstone,
+// the existing bucket value at that idx is freed. Empty
+// values without a tombstone return ErrEmptyValue, so a
+// value is never freed by accident.
+func (bkt *pebbleBucket) PutValues(values []BucketValue) (err error) {
+	defer bkt.store.track(OpPut)(&err)
+	done, err := bkt.beginWrite(OpPut)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if err := checkAppendOnly(bkt, values); err != nil {
+		return err
+	}
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+	return writeValues(bkt, values, false)
+}
+
+// PutValuesIfAbsent puts values into the bucket, without
+// overwriting existing values.
+//
+// See PutValues. When a value with an idx already exists in
+// the bucket, or is used twice in values, an error wrapping
+// ErrValueExists is returned and none of the values are
+// added. Expired values don't exist. Values with an idx of
+// 0 are appended and always allowed.
+func (bkt *pebbleBucket) PutValuesIfAbsent(values []BucketValue) (err error) {
+	defer bkt.store.track(OpPut)(&err)
+	done, err := bkt.beginWrite(OpPut)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if err := checkAppendOnly(bkt, values); err != nil {
+		return err
+	}
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Check the indices before computeValues assigns the
+	// indices of appended values.
+	seen := make(map[uint16]bool, len(values))
+	for _, value := range values {
+		if value.Idx == 0 {
+			continue
+		}
+		exists, err := valueExists(bkt, value.Idx)
+		if err != nil {
+			return err
+		} else if exists || seen[value.Idx] {
+			return &BucketError{ID: bkt.id, Idx: value.Idx, Op: OpPut, Err: ErrValueExists}
+		}
+		seen[value.Idx] = true
+	}
+	return writeValues(bkt, values, false)
+}
+
+// valueExists returns whether a value that is not expired
+// exists at idx. Values that fail their checksum exist, so
+// they are not overwritten.
+func valueExists(bkt *pebbleBucket, idx uint16) (bool, error) {
+	stored, closer, err := bkt.store.db.Get(bkt.store.getPebbleValueKey(bkt.id, idx))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer closer.Close()
+
+	_, expires, err := bkt.store.decodeValue(idx, stored)
+	if err != nil && !errors.Is(err, ErrChecksumMismatch) {
+		return false, err
+	}
+	return !isExpired(expires, bkt.store.getCurrentTimestamp()), nil
+}
+
+// AppendValues adds values to the bucket.
+//
+// The idx of the given values must be 0 or a valid idx. An
+// idx is valid when it is the lastIdx+1. Values with an idx
+// of 0 reuse freed indices when lastIdx is math.MaxUint16,
+// see PutValues.
+func (bkt *pebbleBucket) AppendValues(values []BucketValue) (err error) {
+	defer bkt.store.track(OpAppend)(&err)
+	done, err := bkt.beginWrite(OpAppend)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+	return writeValues(bkt, values, true)
+}
+
+// writeValues computes the idx of the values and writes
+// them to the bucket, see computeValues and checkQuota.
+// The caller must hold the bucket write lock.
+func writeValues(bkt *pebbleBucket, values []BucketValue, appendOnly bool) error {
+	lastIdx, err := computeValues(bkt, values, appendOnly)
+	if err != nil {
+		return err
+	}
+
+	op := OpPut
+	if appendOnly {
+		op = OpAppend
+	}
+	count, err := checkQuota(bkt, op, values)
+	if err != nil {
+		return err
+	}
+
+	if err := insertValues(bkt, values); err != nil {
+		return err
+	}
+	if freesIdx(values, lastIdx) {
+		bkt.mtx.Lock()
+		bkt.refreshLastIdx()
+		bkt.mtx.Unlock()
+	} else {
+		bkt.setLastIdx(lastIdx)
+	}
+	bkt.setCount(count)
+	return nil
+}
+
+// freesIdx returns whether the values contain a tombstone
+// at idx.
+func freesIdx(values []BucketValue, idx uint16) bool {
+	for _, value := range values {
+		if value.Tombstone && value.Idx == idx {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendValuesMaxSize adds values with a limited size to
+// the bucket.
+//
+// When one of the values is larger than maxSize,
+// ErrValueTooLarge is returned and none of the values are
+// added. Otherwise the values are added using AppendValues
+// and the assigned idx of each value is returned.
+func (bkt *pebbleBucket) AppendValuesMaxSize(values []BucketValue, maxSize int) ([]uint16, error) {
+	for _, value := range values {
+		if len(value.Value) > maxSize {
+			return nil, ErrValueTooLarge
+		}
+	}
+
+	if err := bkt.AppendValues(values); err != nil {
+		return nil, err
+	}
+
+	idxs := make([]uint16, len(values))
+	for i, value := range values {
+		idxs[i] = value.Idx
+	}
+	return idxs, nil
+}
+
+// TryAppend adds values to the bucket without waiting for
+// the bucket lock, and returns the assigned idx of each
+// value.
+//
+// ErrBucketBusy is returned when the lock is held, the
+// locks are sharded so another bucket can hold it too. The
+// remaining capacity after lastIdx is checked before any
+// idx is assigned: when not all values fit,
+// ErrBucketIsFull is returned and the bucket is not
+// changed. Unlike AppendValues, freed indices are never
+// reused. Values with an idx must follow the last value,
+// see AppendValues.
+func (bkt *pebbleBucket) TryAppend(values []BucketValue) (_ []uint16, err error) {
+	defer bkt.store.track(OpAppend)(&err)
+	done, err := bkt.beginWrite(OpAppend)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	if !lock.TryLock() {
+		return nil, ErrBucketBusy
+	}
+	defer lock.Unlock()
+
+	bkt.mtx.Lock()
+	lastIdx, err := bkt.getLastIdx()
+	bkt.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	} else if len(values) > math.MaxUint16-int(lastIdx) {
+		return nil, &BucketError{ID: bkt.id, Op: OpAppend, Err: ErrBucketIsFull}
+	}
+
+	if err := writeValues(bkt, values, true); err != nil {
+		return nil, err
+	}
+	idxs := make([]uint16, len(values))
+	for i, value := range values {
+		idxs[i] = value.Idx
+	}
+	return idxs, nil
+}
+
+// DeleteValues deletes values from the bucket.
+//
+// The range includes Start and excludes End.
+func (bkt *pebbleBucket) DeleteValues(rng BucketRange) (err error) {
+	defer bkt.store.track(OpDelete)(&err)
+	if err := rng.validate(); err != nil {
+		return err
+	}
+	done, err := bkt.beginWrite(OpDelete)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if bkt.IsAppendOnly() {
+		return &BucketError{ID: bkt.id, Op: OpDelete, Err: ErrAppendOnly}
+	}
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+	_, err = deleteValues(bkt, rng, false)
+	return err
+}
+
+// DeleteValuesCount deletes values from the bucket, and
+// returns the amount of deleted values.
+//
+// See DeleteValues. The values are counted before they are
+// deleted while holding the bucket lock, using the same
+// range as the deletion. Counting requires a scan of the
+// range.
+func (bkt *pebbleBucket) DeleteValuesCount(rng BucketRange) (_ int, err error) {
+	defer bkt.store.track(OpDelete)(&err)
+	if err := rng.validate(); err != nil {
+		return 0, err
+	}
+	done, err := bkt.beginWrite(OpDelete)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	if bkt.IsAppendOnly() {
+		return 0, &BucketError{ID: bkt.id, Op: OpDelete, Err: ErrAppendOnly}
+	}
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	count, err := bkt.store.countKeys(bkt.store.db, bkt.store.getPebbleValueKey(bkt.id, rng.Start), bkt.store.getPebbleValueKey(bkt.id, rng.End))
+	if err != nil {
+		return 0, err
+	}
+	_, err = deleteValues(bkt, rng, false)
+	return int(count), err
+}
+
+// DeleteValuesPrune deletes values from the bucket like
+// DeleteValues, and deletes the bucket when it has no
+// values left.
+//
+// Whether the bucket is empty is checked in the same batch
+// as the deletion while holding the bucket lock, so the
+// values and the bucket are deleted atomically. Returns
+// whether the bucket is deleted, the bucket can't be used
+// afterwards. Use DeleteValues to keep empty buckets.
+func (bkt *pebbleBucket) DeleteValuesPrune(rng BucketRange) (_ bool, err error) {
+	defer bkt.store.track(OpDelete)(&err)
+	if err := rng.validate(); err != nil {
+		return false, err
+	}
+	done, err := bkt.beginWrite(OpDelete)
+	if err != nil {
+		return false, err
+	}
+	defer done()
+
+	if bkt.IsAppendOnly() {
+		return false, &BucketError{ID: bkt.id, Op: OpDelete, Err: ErrAppendOnly}
+	}
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+	return deleteValues(bkt, rng, true)
+}
+
+// deleteValues deletes a range of values from the bucket,
+// the caller must hold the bucket write lock. With prune
+// the bucket is deleted when no values are left, and
+// whether it is deleted is returned.
+func deleteValues(bkt *pebbleBucket, rng BucketRange, prune bool) (bool, error) {
+	// An indexed batch is needed to read the remaining
+	// values of the bucket before the batch is applied.
+	batch := bkt.store.db.NewBatch()
+	if prune {
+		batch = bkt.store.db.NewIndexedBatch()
+	}
+	defer batch.Close()
+	if err := batch.DeleteRange(
+		bkt.store.getPebbleValueKey(bkt.id, rng.Start),
+		bkt.store.getPebbleValueKey(bkt.id, rng.End),
+		nil,
+	); err != nil {
+		return false, err
+	}
+
+	var pruned bool
+	if prune {
+		lastIdx, err := bkt.store.readLastIdx(batch, bkt.id)
+		if err != nil {
+			return false, err
+		}
+		pruned = lastIdx == 0
+	}
+	if pruned {
+		if err := bkt.store.deleteBucket(batch, bkt.id); err != nil {
+			return false, err
+		}
+	} else if err := refreshTimestamp(bkt, batch); err != nil {
+		return false, err
+	}
+
+	if err := bkt.store.db.Apply(batch, nil); err != nil {
+		return false, err
+	}
+	bkt.store.notify(bkt.id, BucketChangeEvent{Kind: ChangeDeleteRange, Range: rng})
+	if pruned {
+		bkt.store.forgetBucket(bkt.id)
+	}
+
+	// Refresh lastIdx when delete removes the last value.
+	// The range includes Start but excludes End, so the last
+	// value is removed when Start <= lastIdx < End.
+	bkt.mtx.Lock()
+	defer bkt.mtx.Unlock()
+	bkt.countLoaded = false
+	if pruned {
+		bkt.lastIdx = 0
+	} else if bkt.lastIdx != 0 && rng.Start <= bkt.lastIdx && bkt.lastIdx < rng.End {
+		bkt.refreshLastIdx()
+	}
+	return pruned, nil
+}
+
+// Free deletes the values at the given indices from the
+// bucket.
+//
+// Free is the explicit form of putting tombstones, and
+// behaves like DeleteIndices.
+func (bkt *pebbleBucket) Free(idxs []uint16) error {
+	return bkt.DeleteIndices(idxs)
+}
+
+// DeleteIndices deletes the values at the given indices
+// from the bucket.
+//
+// The values are freed in a single batch, so sparse
+// indices are deleted without deleting the values between
+// them like DeleteValues. With StoreOptions.Tombstones a
+// tombstone is written for each idx, see freeValue.
+// Indices without a value are ignored, idx 0 returns
+// ErrInvalidIdx. lastIdx is only read again when the last
+// value is deleted.
+func (bkt *pebbleBucket) DeleteIndices(idxs []uint16) (err error) {
+	defer bkt.store.track(OpDelete)(&err)
+	done, err := bkt.beginWrite(OpDelete)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if bkt.IsAppendOnly() {
+		return &BucketError{ID: bkt.id, Op: OpDelete, Err: ErrAppendOnly}
+	}
+
+	values := make([]BucketValue, len(idxs))
+	for i, idx := range idxs {
+		if idx == 0 {
+			return ErrInvalidIdx
+		}
+		values[i] = BucketValue{Idx: idx, Tombstone: true}
+	}
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := applyValues(bkt, values); err != nil {
+		return err
+	}
+
+	// Refresh lastIdx when the last value is deleted.
+	bkt.mtx.Lock()
+	defer bkt.mtx.Unlock()
+	for _, idx := range idxs {
+		if idx == bkt.lastIdx {
+			bkt.refreshLastIdx()
+			break
+		}
+	}
+	return nil
+}
+
+// DeleteValue deletes the value at the given idx from the
+// bucket, and returns whether the value existed. Expired
+// values are deleted but reported as not existing.
+func (bkt *pebbleBucket) DeleteValue(idx uint16) (_ bool, err error) {
+	defer bkt.store.track(OpDelete)(&err)
+	done, err := bkt.beginWrite(OpDelete)
+	if err != nil {
+		return false, err
+	}
+	defer done()
+
+	if bkt.IsAppendOnly() {
+		return false, &BucketError{ID: bkt.id, Idx: idx, Op: OpDelete, Err: ErrAppendOnly}
+	}
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	key := bkt.store.getPebbleValueKey(bkt.id, idx)
+	stored, closer, err := bkt.store.db.Get(key)
+	found := err == nil
+	if found {
+		var expires uint32
+		_, expires, err = bkt.store.decodeValue(idx, stored)
+		found = !isExpired(expires, bkt.store.getCurrentTimestamp())
+		if closeErr := closer.Close(); closeErr != nil {
+			return false, closeErr
+		}
+	} else if errors.Is(err, pebble.ErrNotFound) {
+		err = nil
+	}
+	if err != nil && !errors.Is(err, ErrChecksumMismatch) {
+		return false, err
+	}
+
+	seq, err := bkt.store.nextSequence()
+	if err != nil {
+		return false, err
+	}
+	batch := bkt.store.db.NewBatch()
+	defer batch.Close()
+	if err := bkt.store.freeValue(batch, key, seq); err != nil {
+		return false, err
+	}
+	if err := refreshTimestamp(bkt, batch); err != nil {
+		return false, err
+	}
+	if err := bkt.store.db.Apply(batch, nil); err != nil {
+		return false, err
+	}
+	bkt.store.notifyValues(bkt.id, []BucketValue{{Idx: idx, Tombstone: true}})
+
+	// Refresh lastIdx when the last value is deleted.
+	bkt.mtx.Lock()
+	defer bkt.mtx.Unlock()
+	bkt.countLoaded = false
+	if idx == bkt.lastIdx {
+		bkt.refreshLastIdx()
+	}
+	return found, nil
+}
+
+// ReplaceRange replaces all values in a range.
+//
+// The existing values in the range are deleted and the
+// given values are written in a single batch, so readers
+// never see a mix of old and new values. The idx of each
+// value must be within the range, otherwise
+// ErrIdxOutOfRange is returned. Indices in the range
+// without a new value end up deleted.
+func (bkt *pebbleBucket) ReplaceRange(rng BucketRange, values []BucketValue) (err error) {
+	defer bkt.store.track(OpReplaceRange)(&err)
+	if err := rng.validate(); err != nil {
+		return err
+	}
+	done, err := bkt.beginWrite(OpReplaceRange)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if bkt.IsAppendOnly() {
+		return &BucketError{ID: bkt.id, Op: OpReplaceRange, Err: ErrAppendOnly}
+	}
+
+	for _, value := range values {
+		if value.Idx == 0 || value.Idx < rng.Start || value.Idx >= rng.End {
+			return &BucketError{ID: bkt.id, Idx: value.Idx, Op: OpReplaceRange, Err: ErrIdxOutOfRange}
+		}
+	}
+	if err := bkt.store.checkValues(bkt.id, OpReplaceRange, values); err != nil {
+		return err
+	}
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	count, err := checkReplaceQuota(bkt, rng, values)
+	if err != nil {
+		return err
+	}
+
+	batch := bkt.store.db.NewBatch()
+	defer batch.Close()
+	if err := batch.DeleteRange(
+		bkt.store.getPebbleValueKey(bkt.id, rng.Start),
+		bkt.store.getPebbleValueKey(bkt.id, rng.End),
+		nil,
+	); err != nil {
+		return err
+	}
+
+	if err := bkt.store.stageValues(batch, bkt.id, values); err != nil {
+		return err
+	}
+
+	if err := refreshTimestamp(bkt, batch); err != nil {
+		return err
+	}
+
+	if err := bkt.store.db.Apply(batch, nil); err != nil {
+		return err
+	}
+	bkt.store.notify(bkt.id, BucketChangeEvent{Kind: ChangeDeleteRange, Range: rng})
+	bkt.store.notifyValues(bkt.id, values)
+
+	// Refresh lastIdx when the range includes or extends
+	// past the last value.
+	bkt.mtx.Lock()
+	defer bkt.mtx.Unlock()
+	bkt.count, bkt.countLoaded = count, count >= 0
+	if rng.Start <= bkt.lastIdx && bkt.lastIdx < rng.End || len(values) > 0 && rng.End-1 > bkt.lastIdx {
+		bkt.refreshLastIdx()
+	}
+	return nil
+}
+
+// Compact moves all values to contiguous indices.
+//
+// The values are renumbered starting at idx 1 in a single
+// batch, the order of the values is kept. This changes the
+// idx of values after a gap, so external references to
+// these values break. The returned map contains the new idx
+// of each value by its old idx, to fix up references.
+// Tombstones are not moved, they are removed together with
+// the gaps they mark.
+func (bkt *pebbleBucket) Compact() (_ map[uint16]uint16, err error) {
+	defer bkt.store.track(OpCompact)(&err)
+	done, err := bkt.beginWrite(OpCompact)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if bkt.IsAppendOnly() {
+		return nil, &BucketError{ID: bkt.id, Op: OpCompact, Err: ErrAppendOnly}
+	}
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Read all values, including the value at
+	// math.MaxUint16 that is excluded by a BucketRange.
+	lower, upper := bkt.store.getPebbleValueKeyRange(bkt.id)
+	iter := bkt.store.db.NewIter(&pebble.IterOptions{
+		LowerBound: lower,
+		UpperBound: upper,
+	})
+	var values []BucketValue
+	for iter.First(); iter.Valid(); iter.Next() {
+		if bkt.store.isTombstone(iter.Value()) {
+			continue
+		}
+		values = append(values, BucketValue{
+			Idx:   getKeyIdx(iter.Key()),
+			Value: append([]byte(nil), iter.Value()...),
+		})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	batch := bkt.store.db.NewBatch()
+	defer batch.Close()
+	if err := batch.DeleteRange(lower, upper, nil); err != nil {
+		return nil, err
+	}
+
+	// The stored values are moved as is, including their
+	// value header.
+	mapping := make(map[uint16]uint16, len(values))
+	for i := range values {
+		mapping[values[i].Idx] = uint16(i + 1)
+		values[i].Idx = uint16(i + 1)
+		if err := batch.Set(bkt.store.getPebbleValueKey(bkt.id, values[i].Idx), values[i].Value, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := refreshTimestamp(bkt, batch); err != nil {
+		return nil, err
+	}
+
+	if err := bkt.store.db.Apply(batch, nil); err != nil {
+		return nil, err
+	}
+
+	bkt.mtx.Lock()
+	bkt.lastIdx = uint16(len(values))
+	bkt.mtx.Unlock()
+	bkt.store.notify(bkt.id, BucketChangeEvent{Kind: ChangeDeleteRange, Range: BucketRange{Start: 0, End: math.MaxUint16}})
+	bkt.store.notifyValues(bkt.id, values)
+	return mapping, nil
+}
+
+// IncrementValue adds delta to a counter value.
+//
+// The counter is updated using a pebble merge, so the
+// current value is never read. This requires the store to
+// be opened with the CounterMerger, see
+// StoreOptions.Merger, otherwise ErrCounterMergerRequired
+// is returned. A missing value is
+// treated as a counter with value 0, the materialized
+// counter can be decoded using DecodeCounter.
+func (bkt *pebbleBucket) IncrementValue(idx uint16, delta int64) error {
+	if !bkt.store.counters {
+		return ErrCounterMergerRequired
+	}
+	return bkt.MergeValue(idx, encodeCounter(delta))
+}
+
+// IncrementAudited adds delta to a counter value and
+// appends an audit value.
+//
+// The increment and the audit value are written in a single
+// batch, so the counter never changes without its audit
+// value. The audit value is appended after the highest idx
+// of the bucket, including counterIdx. Returns the total of
+// the counter after the increment. See IncrementValue.
+func (bkt *pebbleBucket) IncrementAudited(counterIdx uint16, delta int64, auditValue []byte) (_ int64, err error) {
+	defer bkt.store.track(OpMerge)(&err)
+	done, err := bkt.beginWrite(OpMerge)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	if bkt.IsAppendOnly() {
+		return 0, &BucketError{ID: bkt.id, Idx: counterIdx, Op: OpMerge, Err: ErrAppendOnly}
+	}
+
+	if !bkt.store.counters {
+		return 0, ErrCounterMergerRequired
+	} else if counterIdx == 0 {
+		return 0, ErrInvalidIdx
+	}
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	bkt.mtx.Lock()
+	lastIdx, err := bkt.getLastIdx()
+	bkt.mtx.Unlock()
+	if err != nil {
+		return 0, err
+	} else if counterIdx > lastIdx {
+		lastIdx = counterIdx
+	}
+
+	audit := []BucketValue{{Value: auditValue}}
+	if err := bkt.store.checkValues(bkt.id, OpAppend, audit); err != nil {
+		return 0, err
+	}
+	if err := computeIdxs(bkt.id, &lastIdx, nil, audit, true); err != nil {
+		return 0, err
+	}
+	count, err := checkQuota(bkt, OpMerge, []BucketValue{{Idx: counterIdx, Value: encodeCounter(delta)}, audit[0]})
+	if err != nil {
+		return 0, err
+	}
+
+	// Use an indexed batch, so the total can be read
+	// including the staged increment.
+	batch := bkt.store.db.NewIndexedBatch()
+	defer batch.Close()
+	counterKey := bkt.store.getPebbleValueKey(bkt.id, counterIdx)
+	if err := bkt.store.stageMerge(batch, counterKey, encodeCounter(delta)); err != nil {
+		return 0, err
+	}
+
+	if err := bkt.store.stageValues(batch, bkt.id, audit); err != nil {
+		return 0, err
+	}
+
+	data, closer, err := batch.Get(counterKey)
+	if err != nil {
+		return 0, err
+	}
+	total, decodeErr := DecodeCounter(data)
+	if err := closer.Close(); err != nil {
+		return 0, err
+	} else if decodeErr != nil {
+		return 0, decodeErr
+	}
+
+	if err := refreshTimestamp(bkt, batch); err != nil {
+		return 0, err
+	}
+
+	if err := bkt.store.db.Apply(batch, nil); err != nil {
+		return 0, err
+	}
+
+	bkt.mtx.Lock()
+	bkt.count, bkt.countLoaded = count, count >= 0
+	if lastIdx > bkt.lastIdx {
+		bkt.lastIdx = lastIdx
+	}
+	bkt.mtx.Unlock()
+	bkt.store.notify(bkt.id, BucketChangeEvent{Kind: ChangeSet, Idx: counterIdx})
+	bkt.store.notifyValues(bkt.id, audit)
+	return total, nil
+}
+
+// MergeValue merges an operand into a value.
+//
+// The operand is merged using the pebble merger of the
+// store, which concatenates values by default. Merges are
+// resolved when the value is read. Use the CounterMerger
+// for efficient counters, see IncrementValue. Values
+// written with a value header, see StoreOptions, can't be
+// merged into and return ErrMergeValueHeader.
+func (bkt *pebbleBucket) MergeValue(idx uint16, operand []byte) (err error) {
+	defer bkt.store.track(OpMerge)(&err)
+	done, err := bkt.beginWrite(OpMerge)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if bkt.IsAppendOnly() {
+		return &BucketError{ID: bkt.id, Idx: idx, Op: OpMerge, Err: ErrAppendOnly}
+	}
+
+	if idx == 0 {
+		return ErrInvalidIdx
+	}
+	merged := []BucketValue{{Idx: idx, Value: operand}}
+	if err := bkt.store.checkValues(bkt.id, OpMerge, merged); err != nil {
+		return err
+	}
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	count, err := checkQuota(bkt, OpMerge, merged)
+	if err != nil {
+		return err
+	}
+
+	batch := bkt.store.db.NewBatch()
+	defer batch.Close()
+	if err := bkt.store.stageMerge(batch, bkt.store.getPebbleValueKey(bkt.id, idx), operand); err != nil {
+		return err
+	}
+
+	if err := refreshTimestamp(bkt, batch); err != nil {
+		return err
+	}
+
+	if err := bkt.store.db.Apply(batch, nil); err != nil {
+		return err
+	}
+
+	bkt.mtx.Lock()
+	bkt.count, bkt.countLoaded = count, count >= 0
+	if idx > bkt.lastIdx {
+		bkt.lastIdx = idx
+	}
+	bkt.mtx.Unlock()
+	bkt.store.notify(bkt.id, BucketChangeEvent{Kind: ChangeSet, Idx: idx})
+	return nil
+}
+
+// CompareAndSwapValue replaces a value when it matches
+// the expected value.
+//
+// The current value at idx is compared with old, a missing
+// value is equal to an empty old value. When both values
+// are equal the value is replaced by new and true is
+// returned. An empty new value frees the value at idx.
+//
+// Pebble does not support compare and swap, so the read and
+// write are serialized with other writes using the bucket
+// lock.
+func (bkt *pebbleBucket) CompareAndSwapValue(idx uint16, old, new []byte) (_ bool, err error) {
+	defer bkt.store.track(OpPut)(&err)
+	done, err := bkt.beginWrite(OpPut)
+	if err != nil {
+		return false, err
+	}
+	defer done()
+
+	if bkt.IsAppendOnly() {
+		return false, &BucketError{ID: bkt.id, Idx: idx, Op: OpPut, Err: ErrAppendOnly}
+	}
+
+	if idx == 0 {
+		return false, ErrInvalidIdx
+	}
+	swapped := []BucketValue{{Idx: idx, Value: new, Tombstone: len(new) == 0}}
+	if err := bkt.store.checkValues(bkt.id, OpPut, swapped); err != nil {
+		return false, err
+	}
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	key := bkt.store.getPebbleValueKey(bkt.id, idx)
+	current, closer, err := bkt.store.db.Get(key)
+	switch {
+	case errors.Is(err, pebble.ErrNotFound):
+		current = nil
+	case err != nil:
+		return false, err
+	default:
+		defer closer.Close()
+		var expires uint32
+		if current, expires, err = bkt.store.decodeValue(idx, current); err != nil {
+			return false, err
+		} else if isExpired(expires, bkt.store.getCurrentTimestamp()) {
+			current = nil
+		}
+	}
+
+	if !bytes.Equal(current, old) {
+		return false, nil
+	}
+	count, err := checkQuota(bkt, OpPut, swapped)
+	if err != nil {
+		return false, err
+	}
+
+	seq, err := bkt.store.nextSequence()
+	if err != nil {
+		return false, err
+	}
+
+	batch := bkt.store.db.NewBatch()
+	defer batch.Close()
+	if len(new) > 0 {
+		err = batch.Set(key, bkt.store.encodeValue(new, 0, seq), nil)
+	} else {
+		err = bkt.store.freeValue(batch, key, seq)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := refreshTimestamp(bkt, batch); err != nil {
+		return false, err
+	}
+
+	if err := bkt.store.db.Apply(batch, nil); err != nil {
+		return false, err
+	}
+	bkt.store.notifyValues(bkt.id, swapped)
+
+	// Update lastIdx when the last value changed.
+	bkt.mtx.Lock()
+	defer bkt.mtx.Unlock()
+	bkt.count, bkt.countLoaded = count, count >= 0
+	if len(new) > 0 && idx > bkt.lastIdx {
+		bkt.lastIdx = idx
+	} else if len(new) == 0 && idx == bkt.lastIdx {
+		bkt.refreshLastIdx()
+	}
+	return true, nil
+}
+
+// SwapValues swaps the values at idx a and b.
+//
+// Both values are written in a single batch, so readers
+// never see a value twice or not at all. When one of the
+// values is missing or expired, the other value is moved
+// and its old idx is freed. The expiry of the values is
+// kept. Swapping an idx with itself does nothing.
+func (bkt *pebbleBucket) SwapValues(a, b uint16) (err error) {
+	defer bkt.store.track(OpPut)(&err)
+	done, err := bkt.beginWrite(OpPut)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if bkt.IsAppendOnly() {
+		return &BucketError{ID: bkt.id, Op: OpPut, Err: ErrAppendOnly}
+	}
+
+	if a == 0 || b == 0 {
+		return ErrInvalidIdx
+	} else if a == b {
+		return nil
+	}
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Read both values, the stored values are copied
+	// because they are only valid until the closer is
+	// closed.
+	now := bkt.store.getCurrentTimestamp()
+	read := func(idx uint16) ([]byte, uint32, error) {
+		stored, closer, err := bkt.store.db.Get(bkt.store.getPebbleValueKey(bkt.id, idx))
+		if errors.Is(err, pebble.ErrNotFound) {
+			return nil, 0, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+		defer closer.Close()
+
+		value, expires, err := bkt.store.decodeValue(idx, stored)
+		if err != nil || isExpired(expires, now) {
+			return nil, 0, err
+		}
+		return append([]byte(nil), value...), expires, nil
+	}
+	valueA, expiresA, err := read(a)
+	if err != nil {
+		return err
+	}
+	valueB, expiresB, err := read(b)
+	if err != nil {
+		return err
+	}
+	count, err := checkQuota(bkt, OpPut, []BucketValue{
+		{Idx: a, Value: valueB, Tombstone: valueB == nil},
+		{Idx: b, Value: valueA, Tombstone: valueA == nil},
+	})
+	if err != nil {
+		return err
+	}
+
+	batch := bkt.store.db.NewBatch()
+	defer batch.Close()
+	write := func(idx uint16, value []byte, expires uint32) error {
+		key := bkt.store.getPebbleValueKey(bkt.id, idx)
+		seq, err := bkt.store.nextSequence()
+		if err != nil {
+			return err
+		} else if value == nil {
+			return bkt.store.freeValue(batch, key, seq)
+		}
+		return batch.Set(key, bkt.store.encodeValue(value, expires, seq), nil)
+	}
+	if err := write(a, valueB, expiresB); err != nil {
+		return err
+	}
+	if err := write(b, valueA, expiresA); err != nil {
+		return err
+	}
+	if err := refreshTimestamp(bkt, batch); err != nil {
+		return err
+	}
+
+	if err := bkt.store.db.Apply(batch, nil); err != nil {
+		return err
+	}
+	bkt.store.notifyValues(bkt.id, []BucketValue{
+		{Idx: a, Value: valueB, Tombstone: valueB == nil},
+		{Idx: b, Value: valueA, Tombstone: valueA == nil},
+	})
+
+	// Update lastIdx when a value moved past it or the
+	// last value moved down.
+	high, highValue := b, valueA
+	if a > b {
+		high, highValue = a, valueB
+	}
+	bkt.mtx.Lock()
+	defer bkt.mtx.Unlock()
+	bkt.count, bkt.countLoaded = count, count >= 0
+	if lastIdx, err := bkt.getLastIdx(); err != nil {
+		bkt.lastIdxLoaded.Store(false)
+	} else if highValue != nil && high > lastIdx {
+		bkt.lastIdx = high
+	} else if highValue == nil && high == lastIdx {
+		bkt.refreshLastIdx()
+	}
+	return nil
+}
+
+// computeValues computes and verifies the idx values for
+// the given slice with values, and returns the new lastIdx
+// of the bucket. The lastIdx of the bucket isn't modified,
+// the caller must set it using setLastIdx once the values
+// are written. The caller must hold the bucket write lock.
+func computeValues(bkt *pebbleBucket, values []BucketValue, appendOnly bool) (uint16, error) {
+	op := OpPut
+	if appendOnly {
+		op = OpAppend
+	}
+	if err := bkt.store.checkValues(bkt.id, op, values); err != nil {
+		return 0, err
+	}
+
+	bkt.mtx.Lock()
+	defer bkt.mtx.Unlock()
+
+	lastIdx, err := bkt.getLastIdx()
+	if err != nil {
+		return 0, err
+	}
+
+	// An iterator error of free is returned instead of the
+	// ErrBucketIsFull it causes.
+	free := newFreeIdxs(bkt, values)
+	err = computeIdxs(bkt.id, &lastIdx, free, values, appendOnly)
+	if closeErr := free.close(); closeErr != nil {
+		return 0, closeErr
+	} else if err != nil {
+		return 0, err
+	}
+	return lastIdx, nil
+}
+
+// setLastIdx sets the lastIdx of the bucket.
+func (bkt *pebbleBucket) setLastIdx(lastIdx uint16) {
+	bkt.mtx.Lock()
+	defer bkt.mtx.Unlock()
+	bkt.lastIdx = lastIdx
+	bkt.lastIdxLoaded.Store(true)
+}
+
+// getLastIdx returns the lastIdx of the bucket. The lastIdx
+// is read from the value table the first time it is needed,
+// so loading a bucket doesn't scan its values. The caller
+// must hold bkt.mtx.
+//
+// Until lastIdx is loaded, it is only raised by writes and
+// refreshed when values are deleted, which is overwritten
+// by the first load.
+func (bkt *pebbleBucket) getLastIdx() (uint16, error) {
+	if !bkt.lastIdxLoaded.Load() {
+		lastIdx, err := fetchLastIdx(bkt)
+		if err != nil {
+			return 0, err
+		}
+		bkt.lastIdx = lastIdx
+		bkt.lastIdxLoaded.Store(true)
+	}
+	return bkt.lastIdx, nil
+}
+
+// refreshLastIdx reads the lastIdx of the bucket from the
+// value table after a write. When it can't be read, it is
+// read again when it is needed, see getLastIdx. The caller
+// must hold bkt.mtx.
+func (bkt *pebbleBucket) refreshLastIdx() {
+	if lastIdx, err := fetchLastIdx(bkt); err != nil {
+		bkt.lastIdxLoaded.Store(false)
+	} else {
+		bkt.lastIdx = lastIdx
+	}
+}
+
+// computeIdxs computes and verifies the idx values for the
+// given slice with values, lastIdx is updated while
+// computing the idx values. Free indices are taken from
+// free when the bucket is full, free can be nil. Errors
+// are returned as *BucketError.
+func computeIdxs(id BucketID, lastIdx *uint16, free *freeIdxs, values []BucketValue, appendOnly bool) error {
+	op := OpPut
+	if appendOnly {
+		op = OpAppend
+	}
+
+	for i := range values {
+		switch {
+		// When idx value is 0, this is an append operation.
+		// Increase and assign lastIdx. When the bucket
+		// overflows, reuse a freed idx or return an error.
+		case values[i].Idx == 0:
+			if *lastIdx == math.MaxUint16 {
+				idx, ok := free.take()
+				if !ok {
+					return &BucketError{ID: id, Op: op, Err: ErrBucketIsFull}
+				}
+				values[i].Idx = idx
+				continue
+			}
+			*lastIdx++
+			values[i].Idx = *lastIdx
+
+		// For append only operation, verify that the given
+		// idx is equal to lastIdx+1. If not, return an
+		// AppendConflictError with the expected idx.
+		case appendOnly:
+			if *lastIdx+1 == values[i].Idx {
+				*lastIdx++
+			} else {
+				conflict := &AppendConflictError{ExpectedIdx: *lastIdx + 1}
+				return &BucketError{ID: id, Idx: values[i].Idx, Op: op, Err: conflict}
+			}
+
+		// Tombstones don't add a value, so they never raise
+		// lastIdx. A tombstone at lastIdx lowers it, see
+		// freesIdx.
+		case values[i].Tombstone:
+
+		// When the operation is not append only, and
+		// the value idx is larger than lastIdx, update
+		// the lastIdx.
+		case values[i].Idx > *lastIdx:
+			*lastIdx = values[i].Idx
+		}
+	}
+	return nil
+}
+
+// freeIdxs finds the indices of a bucket that are not used.
+//
+// The free indices are derived from the value table, so
+// every path that frees a value makes room without keeping
+// a separate free-list up to date. The value table is only
+// read when a free idx is requested.
+type freeIdxs struct {
+	bkt      *pebbleBucket
+	iter     *pebble.Iterator
+	valid    bool            // Whether iter is positioned at a value.
+	next     int             // Next candidate idx.
+	reserved map[uint16]bool // Indices used by the values that are inserted.
+}
+
+// newFreeIdxs creates a new freeIdxs for the given values.
+func newFreeIdxs(bkt *pebbleBucket, values []BucketValue) *freeIdxs {
+	reserved := make(map[uint16]bool)
+	for _, value := range values {
+		if value.Idx != 0 {
+			reserved[value.Idx] = true
+		}
+	}
+	return &freeIdxs{bkt: bkt, next: 1, reserved: reserved}
+}
+
+// take returns the lowest free idx and marks it as used.
+// Returns false when no idx is free, or when free is nil.
+func (free *freeIdxs) take() (uint16, bool) {
+	if free == nil {
+		return 0, false
+	}
+
+	if free.iter == nil {
+		lower, upper := free.bkt.store.getPebbleValueKeyRange(free.bkt.id)
+		free.iter = free.bkt.store.db.NewIter(&pebble.IterOptions{
+			LowerBound: lower,
+			UpperBound: upper,
+		})
+		free.valid = free.iter.First()
+	}
+
+	for ; free.next <= math.MaxUint16; free.next++ {
+		// Move the iterator to the first value at or after
+		// the candidate idx.
+		for free.valid && int(getKeyIdx(free.iter.Key())) < free.next {
+			free.valid = free.iter.Next()
+		}
+
+		idx := uint16(free.next)
+		used := free.valid && getKeyIdx(free.iter.Key()) == idx &&
+			!free.bkt.store.isTombstone(free.iter.Value())
+		if !used && !free.reserved[idx] {
+			free.next++
+			return idx, true
+		}
+	}
+	return 0, false
+}
+
+// close closes the iterator used to find free indices, and
+// returns the error of the iterator.
+func (free *freeIdxs) close() error {
+	if free.iter != nil {
+		return free.iter.Close()
+	}
+	return nil
+}
+
+// insertValues inserts the given slice of values into the
+// bucket.
+//
+// When the estimated size of the values exceeds
+// StoreOptions.MaxBatchBytes, ErrBatchTooLarge is returned
+// before anything is written. With SplitBatches the values
+// are written in multiple batches of at most MaxBatchBytes
+// instead, a single value larger than the limit gets its
+// own batch. When a batch fails, the previous batches are
+// already written.
+func insertValues(bkt *pebbleBucket, values []BucketValue) error {
+	maxBytes := bkt.store.opts.MaxBatchBytes
+	if maxBytes <= 0 {
+		return applyValues(bkt, values)
+	}
+
+	// Split the values into chunks, the size of a value is
+	// estimated using its key and value without the header.
+	keySize := len(bkt.store.getPebbleValueKey(bkt.id, 0))
+	var chunks [][]BucketValue
+	start, size := 0, 0
+	for i, value := range values {
+		valueSize := keySize + len(value.Value)
+		if size+valueSize > maxBytes && i > start {
+			if !bkt.store.opts.SplitBatches {
+				return ErrBatchTooLarge
+			}
+			chunks = append(chunks, values[start:i])
+			start, size = i, 0
+		}
+		size += valueSize
+	}
+	if size > maxBytes && !bkt.store.opts.SplitBatches {
+		return ErrBatchTooLarge
+	}
+	chunks = append(chunks, values[start:])
+
+	for i, chunk := range chunks {
+		if err := applyValues(bkt, chunk); err != nil {
+			if i > 0 {
+				// Part of the values are written, so lastIdx is
+				// loaded again when it is needed.
+				bkt.mtx.Lock()
+				bkt.lastIdxLoaded.Store(false)
+				bkt.mtx.Unlock()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// applyValues writes the given slice of values to the
+// bucket in a single batch.
+func applyValues(bkt *pebbleBucket, values []BucketValue) error {
+	batch := bkt.store.db.NewBatch()
+	defer batch.Close()
+	if err := bkt.store.stageValues(batch, bkt.id, values); err != nil {
+		return err
+	}
+
+	if err := refreshTimestamp(bkt, batch); err != nil {
+		return err
+	}
+
+	if err := bkt.store.db.Apply(batch, nil); err != nil {
+		return err
+	}
+	bkt.setCount(-1)
+	bkt.store.notifyValues(bkt.id, values)
+	return nil
+}
+
+// checkValues verifies that the given values can be
+// written, before any of them is staged. Values larger
+// than StoreOptions.MaxValueSize return a *BucketError
+// wrapping ErrValueTooLarge.
+func (str *pebbleStore) checkValues(id BucketID, op string, values []BucketValue) error {
+	for _, value := range values {
+		if value.Expires != 0 && !str.opts.ValueTTL {
+			return ErrValueTTLDisabled
+		} else if len(value.Value) == 0 && !value.Tombstone {
+			return ErrEmptyValue
+		} else if str.opts.MaxValueSize > 0 && len(value.Value) > str.opts.MaxValueSize {
+			return &BucketError{ID: id, Idx: value.Idx, Op: op, Err: ErrValueTooLarge}
+		}
+	}
+	return nil
+}
+
+// stageValues adds the given slice of values to a batch.
+// Tombstones are freed, see freeValue. The values must be verified
+// using checkValues.
+func (str *pebbleStore) stageValues(batch *pebble.Batch, id BucketID, values []BucketValue) error {
+	seq, err := str.nextSequence()
+	if err != nil {
+		return err
+	}
+
+	key := str.getPebbleValueKey(id, 0)
+	for _, value := range values {
+		setKeyIdx(key, value.Idx)
+		if !value.Tombstone {
+			if err := batch.Set(key, str.encodeValue(value.Value, value.Expires, seq), nil); err != nil {
+				return err
+			}
+		} else {
+			if err := str.freeValue(batch, key, seq); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// stageMerge stages a merge of operand into the value at
+// key. A tombstone at key is deleted in the same batch, so
+// the operand starts a new value instead of being merged
+// into the tombstone. Returns ErrMergeValueHeader when the
+// value at key has a value header, merged values are stored
+// without one. The caller must hold the bucket write lock.
+func (str *pebbleStore) stageMerge(batch *pebble.Batch, key, operand []byte) error {
+	stored, closer, err := str.db.Get(key)
+	if err == nil {
+		tombstone := str.isTombstone(stored)
+		header := str.valueHeaders() && len(stored) >= 2 && stored[0] == valueHeaderMagic
+		if err := closer.Close(); err != nil {
+			return err
+		} else if tombstone {
+			if err := batch.Delete(key, nil); err != nil {
+				return err
+			}
+		} else if header {
+			return ErrMergeValueHeader
+		}
+	} else if !errors.Is(err, pebble.ErrNotFound) {
+		return err
+	}
+	return batch.Merge(key, operand, nil)
+}
+
+// peekValue retrieves the first or last value of a bucket,
+// after skipping skip values. Expired values are skipped
+// without counting them.
+func peekValue(bkt *pebbleBucket, last bool, skip uint16) (BucketValue, bool, error) {
+	done, err := bkt.beginRead(OpGet)
+	if err != nil {
+		return BucketValue{}, false, err
+	}
+	defer done()
+
+	var expired []uint16
+	defer func() { _ = bkt.store.reapExpired(bkt.id, expired) }()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	lower, upper := bkt.store.getPebbleValueKeyRange(bkt.id)
+	iter := bkt.store.db.NewIter(&pebble.IterOptions{
+		LowerBound: lower,
+		UpperBound: upper,
+	})
+
+	var value BucketValue
+	var found bool
+	if last {
+		found = iter.Last()
+	} else {
+		found = iter.First()
+	}
+
+	// Copy the value before the iterator is closed.
+	now := bkt.store.getCurrentTimestamp()
+	for ; found; found = nextValue(iter, last) {
+		value.Idx = getKeyIdx(iter.Key())
+		decoded, expires, err := bkt.store.decodeValue(value.Idx, iter.Value())
+		if err != nil {
+			_ = iter.Close()
+			return BucketValue{}, false, err
+		} else if isExpired(expires, now) {
+			if !bkt.store.isTombstone(iter.Value()) {
+				expired = append(expired, value.Idx)
+			}
+			continue
+		} else if skip > 0 {
+			skip--
+			continue
+		}
+		value.Value, value.Expires = append([]byte(nil), decoded...), expires
+		break
+	}
+	if !found {
+		value = BucketValue{}
+	}
+
+	if err := refreshTimestamp(bkt, bkt.store.db); err != nil {
+		_ = iter.Close()
+		return value, found, err
+	}
+
+	return value, found, iter.Close()
+}
+
+// fetchLastIdx returns the lastIdx in the value table for
+// a bucket.
+//
+// The lastIdx is the highest idx that currently has a
+// value, freed indices don't count. Every write that frees
+// the value at lastIdx lowers it, so appends after freeing
+// the end of a bucket reuse the freed indices at the end.
+// Freed indices before lastIdx are only reused once the
+// bucket is full.
+func fetchLastIdx(bkt *pebbleBucket) (uint16, error) {
+	bkt.store.lastIdxScans.Add(1)
+	return bkt.store.readLastIdx(bkt.store.db, bkt.id)
+}
+
+// readLastIdx returns the lastIdx of a bucket using the
+// given reader. Errors of the iterator are returned, so an
+// I/O error is not mistaken for an empty bucket.
+func (str *pebbleStore) readLastIdx(reader pebble.Reader, id BucketID) (uint16, error) {
+	opts := str.getValueIterOptions(id, 0, math.MaxUint16, true)
+	defer opts.release()
+	iter := reader.NewIter(&opts.IterOptions)
+
+	var lastIdx uint16
+	for valid := iter.Last(); valid; valid = iter.Prev() {
+		if !str.isTombstone(iter.Value()) {
+			lastIdx = getKeyIdx(iter.Key())
+			break
+		}
+	}
+	return lastIdx, iter.Close()
+}
+
+// refreshTimestamp updates the timestamp in the bucket. The
+// timestamp of buckets in a read-only store is not updated.
+//
+// When writer is a batch, the timestamp is written with the
+// sync of the batch. Otherwise the timestamp is written
+// without a sync, unless StoreOptions.SyncTimestamps is
+// set.
+func refreshTimestamp(bkt *pebbleBucket, writer pebble.Writer) error {
+	if bkt.store.opts.ReadOnly {
+		return nil
+	}
+
+	now := bkt.store.getCurrentTimestamp()
+	arr := make([]byte, 4)
+	binary.BigEndian.PutUint32(arr, now)
+
+	bkt.mtx.Lock()
+	defer bkt.mtx.Unlock()
+	if !bytes.Equal(bkt.data[:4], arr) {
+		copy(bkt.data[:4], arr)
+		return writer.Set(bkt.store.getPebbleBucketKey(bkt.id), bkt.data, bkt.store.getTimestampWriteOptions())
+	}
+	return nil
+}
+
+// getTimestamp returns the last access time of the bucket.
+func getTimestamp(bkt *pebbleBucket) uint32 {
+	bkt.mtx.Lock()
+	defer bkt.mtx.Unlock()
+	return binary.BigEndian.Uint32(bkt.data)
+}
+
+// getCreationTimestamp returns the creation time of the
+// bucket, or 0 when the bucket was created before creation
+// times were stored.
+func getCreationTimestamp(bkt *pebbleBucket) uint32 {
+	if len(bkt.data) < 8+BucketKeyLength {
+		return 0
+	}
+	return binary.BigEndian.Uint32(bkt.data[4+BucketKeyLength:])
+}
+
+// getCurrentTimestamp returns the current timestamp.
+func (str *pebbleStore) getCurrentTimestamp() uint32 {
+	return toTimestamp(str.now())
+}
+
+// now returns the current time of the store clock.
+func (str *pebbleStore) now() time.Time {
+	if str.opts.Clock != nil {
+		return str.opts.Clock()
+	}
+	return time.Now()
+}
+
+// toTimestamp converts a time to a timestamp. Timestamps
+// are stored as hours since the unix epoch.
+func toTimestamp(t time.Time) uint32 {
+	return uint32(t.Sub(time.Unix(0, 0)) / time.Hour)
+}
+
+// fromTimestamp converts a timestamp to a time.
+func fromTimestamp(ts uint32) time.Time {
+	return time.Unix(int64(ts)*int64(time.Hour/time.Second), 0)
 }
@@ -1,8 +1,18 @@
 package store
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -70,6 +80,96 @@ func TestGetBucketPermissions(t *testing.T) {
 	}
 }
 
+func TestParseBucketID(t *testing.T) {
+	info, err := ParseBucketID(TestBktID)
+	assert.NoError(t, err, "error occurred while parsing id")
+	assert.Equal(t, BucketInfo{
+		Lifetime:  255,
+		Public:    BucketPermissions{Read: true, Write: true, Append: true},
+		Protected: BucketPermissions{Read: true, Write: true, Append: true},
+	}, info, "id is not parsed correctly")
+
+	info, err = ParseBucketID(BucketID([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 7, 49}))
+	assert.NoError(t, err, "error occurred while parsing id")
+	assert.Equal(t, BucketInfo{
+		Lifetime:  7,
+		Public:    BucketPermissions{Read: true},
+		Protected: BucketPermissions{Read: true, Write: true, Append: true},
+	}, info, "id is not parsed correctly")
+
+	// Test whether invalid permission bytes are rejected.
+	for _, perms := range []byte{64, 128, 71, 2, 3, 16, 17, 26} {
+		id := BucketID([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, perms})
+		_, err := ParseBucketID(id)
+		assert.ErrorIs(t, err, ErrInvalidBucketID, "invalid permissions %d are accepted", perms)
+	}
+}
+
+func TestGetCreationTime(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+	created := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	now := created
+	str.(*pebbleStore).opts.Clock = func() time.Time { return now }
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	assert.True(t, created.Equal(bkt.GetCreationTime()), "created bucket has incorrect creation time")
+
+	// Test whether the creation time is not changed by
+	// accessing the bucket, while the access time is.
+	now = created.Add(48 * time.Hour)
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}}), "error occurred while appending value")
+	_, err = bkt.GetValues(BucketRange{Start: 0, End: 500})
+	require.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, toTimestamp(now), getTimestamp(bkt.(*pebbleBucket)), "access time is not updated")
+	assert.True(t, created.Equal(bkt.GetCreationTime()), "creation time is changed by an access")
+
+	// Test whether the creation time is persisted.
+	str.(*pebbleStore).cache.Delete(*TestBktID)
+	bkt, err = str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	assert.True(t, created.Equal(bkt.GetCreationTime()), "creation time is not persisted")
+
+	// Buckets without a creation time return the zero time.
+	old := &pebbleBucket{data: make([]byte, 4+BucketKeyLength)}
+	assert.True(t, old.GetCreationTime().IsZero(), "bucket without creation time has a creation time")
+}
+
+func TestValueSize(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: make([]byte, 1<<20)}}), "error occurred while appending value")
+
+	// Test the size of present values.
+	size, found, err := bkt.ValueSize(1)
+	assert.NoError(t, err, "error occurred while fetching value size")
+	assert.True(t, found, "present value is not found")
+	assert.Equal(t, len(ExpectedBktValues[0].Value), size, "value has an incorrect size")
+	size, found, err = bkt.ValueSize(11)
+	assert.NoError(t, err, "error occurred while fetching value size")
+	assert.True(t, found, "present value is not found")
+	assert.Equal(t, 1<<20, size, "large value has an incorrect size")
+
+	// Test whether absent values and the reserved idx 0 are
+	// not found.
+	for _, idx := range []uint16{0, 12, math.MaxUint16} {
+		size, found, err = bkt.ValueSize(idx)
+		assert.NoError(t, err, "error occurred while fetching value size")
+		assert.False(t, found, "absent value is found")
+		assert.Zero(t, size, "absent value has a size")
+	}
+
+	// Test whether the value header is excluded.
+	str.(*pebbleStore).opts.Checksums = true
+	require.NoError(t, bkt.PutValues([]BucketValue{{Idx: 20, Value: []byte("20")}}), "error occurred while putting value")
+	size, found, err = bkt.ValueSize(20)
+	assert.NoError(t, err, "error occurred while fetching value size")
+	assert.True(t, found, "present value is not found")
+	assert.Equal(t, 2, size, "value size includes the header")
+}
+
 func TestGetValues(t *testing.T) {
 	str := SetupTestStore(t, true)
 	defer str.Close()
@@ -83,6 +183,396 @@ func TestGetValues(t *testing.T) {
 	assert.Equal(t, ExpectedBktValues, values, "fetched bucket values are incorrect")
 }
 
+func TestGetValuesWithMeta(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	values, lastIdx, err := bkt.GetValuesWithMeta(BucketRange{Start: 5, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, ExpectedBktValues[4:], values, "fetched bucket values are incorrect")
+	assert.Equal(t, uint16(10), lastIdx, "lastIdx is incorrect")
+
+	// Test whether an append is reflected in both.
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("11")}}), "error occurred while appending value")
+	values, lastIdx, err = bkt.GetValuesWithMeta(BucketRange{Start: 5, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, BucketValue{Idx: 11, Value: []byte("11")}, values[len(values)-1], "appended value is not fetched")
+	assert.Equal(t, uint16(11), lastIdx, "lastIdx is not updated")
+
+	// Test whether lastIdx is returned for a range before the tail.
+	values, lastIdx, err = bkt.GetValuesWithMeta(BucketRange{Start: 1, End: 3})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Len(t, values, 2, "fetched bucket values have incorrect length")
+	assert.Equal(t, uint16(11), lastIdx, "lastIdx is incorrect")
+}
+
+func TestGetValuesReverse(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test whether values are returned in descending order.
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 500, Reverse: true})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	require.Len(t, values, len(ExpectedBktValues), "fetched bucket values have incorrect length")
+	for i, value := range values {
+		assert.Equal(t, ExpectedBktValues[len(ExpectedBktValues)-1-i], value, "values are not in descending order")
+	}
+
+	// Test whether a limit returns the highest indices.
+	values, err = bkt.GetValues(BucketRange{Start: 0, End: 500, Reverse: true, Limit: 3})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, []BucketValue{ExpectedBktValues[9], ExpectedBktValues[8], ExpectedBktValues[7]}, values, "reverse limit returned incorrect values")
+
+	// Test whether a limit without reverse returns the
+	// lowest indices.
+	values, err = bkt.GetValues(BucketRange{Start: 3, End: 500, Limit: 2})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, []BucketValue{ExpectedBktValues[2], ExpectedBktValues[3]}, values, "limit returned incorrect values")
+}
+
+func TestGetValuesFiltered(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	values := make([]BucketValue, 100)
+	for i := range values {
+		values[i].Value = []byte(strconv.Itoa(i))
+	}
+	require.NoError(t, bkt.AppendValues(values))
+	keep := func(idx uint16, val []byte) bool { return len(val) == 1 }
+
+	// Test whether only the values matching the predicate are
+	// returned.
+	filtered, err := bkt.GetValuesFiltered(BucketRange{Start: 0, End: 500}, keep)
+	assert.NoError(t, err, "error occurred while fetching filtered values")
+	require.Len(t, filtered, 10, "filtered values have incorrect length")
+	for i, value := range filtered {
+		assert.Equal(t, BucketValue{Idx: uint16(i + 1), Value: []byte(strconv.Itoa(i))}, value, "filtered value is incorrect")
+	}
+
+	// Test whether the limit only counts kept values.
+	filtered, err = bkt.GetValuesFiltered(BucketRange{Start: 0, End: 500, Reverse: true, Limit: 2}, keep)
+	assert.NoError(t, err, "error occurred while fetching filtered values")
+	assert.Equal(t, []BucketValue{{Idx: 10, Value: []byte("9")}, {Idx: 9, Value: []byte("8")}}, filtered, "limit returned incorrect values")
+
+	// Test whether filtering allocates less than fetching all
+	// values and filtering afterwards.
+	rng := BucketRange{Start: 0, End: 500}
+	filteredAllocs := testing.AllocsPerRun(10, func() {
+		_, _ = bkt.GetValuesFiltered(rng, keep)
+	})
+	fetchedAllocs := testing.AllocsPerRun(10, func() {
+		all, _ := bkt.GetValues(rng)
+		var kept []BucketValue
+		for _, value := range all {
+			if keep(value.Idx, value.Value) {
+				kept = append(kept, value)
+			}
+		}
+	})
+	assert.Less(t, filteredAllocs, fetchedAllocs, "filtering does not reduce allocations")
+}
+
+func TestGetValuesByIndices(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	values, err := bkt.GetValuesByIndices([]uint16{9, 3, 500, 1, 3, 0})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, []BucketValue{ExpectedBktValues[0], ExpectedBktValues[2], ExpectedBktValues[8]}, values, "fetched bucket values are incorrect")
+
+	values, err = bkt.GetValuesByIndices(nil)
+	assert.NoError(t, err, "error occurred while fetching no bucket values")
+	assert.Empty(t, values, "values returned without indices")
+}
+
+func TestGetValuesMap(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	require.NoError(t, bkt.DeleteValues(BucketRange{Start: 4, End: 6}), "error occurred while deleting values")
+
+	// Test whether the map only contains populated indices.
+	values, err := bkt.GetValuesMap(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	expected := make(map[uint16][]byte)
+	for _, value := range ExpectedBktValues {
+		if value.Idx != 4 && value.Idx != 5 {
+			expected[value.Idx] = value.Value
+		}
+	}
+	assert.Equal(t, expected, values, "fetched bucket values are incorrect")
+
+	// Test whether the limit is applied.
+	values, err = bkt.GetValuesMap(BucketRange{Start: 0, End: 500, Reverse: true, Limit: 2})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, map[uint16][]byte{10: []byte("10"), 9: []byte("9")}, values, "limit is not applied")
+}
+
+func TestGetValuesNoCopy(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test whether all values are passed to fn.
+	var values []BucketValue
+	err = bkt.GetValuesNoCopy(BucketRange{Start: 0, End: 500}, func(idx uint16, val []byte) bool {
+		values = append(values, BucketValue{Idx: idx, Value: append([]byte(nil), val...)})
+		return true
+	})
+	assert.NoError(t, err, "error occurred while scanning bucket values")
+	assert.Equal(t, ExpectedBktValues, values, "scanned bucket values are incorrect")
+
+	// Test whether the limit and stopping early are applied.
+	var idxs []uint16
+	err = bkt.GetValuesNoCopy(BucketRange{Start: 0, End: 500, Reverse: true, Limit: 3}, func(idx uint16, val []byte) bool {
+		idxs = append(idxs, idx)
+		return true
+	})
+	assert.NoError(t, err, "error occurred while scanning bucket values")
+	assert.Equal(t, []uint16{10, 9, 8}, idxs, "limit is not applied")
+
+	idxs = nil
+	err = bkt.GetValuesNoCopy(BucketRange{Start: 0, End: 500}, func(idx uint16, val []byte) bool {
+		idxs = append(idxs, idx)
+		return idx < 2
+	})
+	assert.NoError(t, err, "error occurred while scanning bucket values")
+	assert.Equal(t, []uint16{1, 2}, idxs, "scan did not stop when fn returned false")
+}
+
+// ExampleBucket_GetValuesNoCopy shows that values must be
+// copied when they are used after the callback returns.
+func ExampleBucket_GetValuesNoCopy() {
+	str, _ := OpenStore("", &StoreOptions{PebbleOpts: &pebble.Options{FS: vfs.NewMem()}})
+	defer str.Close()
+	bkt, _ := str.CreateBucket(TestBktID, TestBktKey)
+	_ = bkt.AppendValues([]BucketValue{{Value: []byte("a")}, {Value: []byte("b")}})
+
+	var total int
+	var kept [][]byte
+	_ = bkt.GetValuesNoCopy(BucketRange{Start: 0, End: 10}, func(idx uint16, val []byte) bool {
+		// Using val inside the callback is safe.
+		total += len(val)
+
+		// Retaining val is not, it is only valid until the
+		// callback returns. Copy values that are kept.
+		kept = append(kept, append([]byte(nil), val...))
+		return true
+	})
+	fmt.Println(total, len(kept))
+	// Output: 2 2
+}
+
+// setupBenchmarkBucket creates a bucket with 10000 values.
+func setupBenchmarkBucket(b *testing.B) (Store, Bucket) {
+	str, err := OpenStore("", &StoreOptions{PebbleOpts: &pebble.Options{FS: vfs.NewMem()}})
+	require.NoError(b, err, "could not open benchmark store")
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(b, err, "error occurred while creating bucket")
+
+	values := make([]BucketValue, 10000)
+	for i := range values {
+		values[i].Value = []byte(strconv.Itoa(i))
+	}
+	require.NoError(b, bkt.AppendValues(values), "error occurred while appending values")
+	return str, bkt
+}
+
+// Indices used by the sparse read benchmarks.
+var benchmarkIdxs = []uint16{3, 100, 512, 1000, 2500, 5000, 7500, 9999}
+
+func BenchmarkGetValues(b *testing.B) {
+	str, bkt := setupBenchmarkBucket(b)
+	defer str.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bkt.GetValues(BucketRange{Start: 0, End: math.MaxUint16}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetValuesParallel(b *testing.B) {
+	str, bkt := setupBenchmarkBucket(b)
+	defer str.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := uint16(0); pb.Next(); i++ {
+			start := i % 9990
+			if _, err := bkt.GetValues(BucketRange{Start: start, End: start + 10}); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkGetValuesNoCopy(b *testing.B) {
+	str, bkt := setupBenchmarkBucket(b)
+	defer str.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := bkt.GetValuesNoCopy(BucketRange{Start: 0, End: math.MaxUint16}, func(idx uint16, val []byte) bool {
+			return true
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetValuesByIndices(b *testing.B) {
+	str, bkt := setupBenchmarkBucket(b)
+	defer str.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bkt.GetValuesByIndices(benchmarkIdxs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetValuesByIndicesSeparateGets(b *testing.B) {
+	str, bkt := setupBenchmarkBucket(b)
+	defer str.Close()
+	db := str.(*pebbleStore).db
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, idx := range benchmarkIdxs {
+			value, closer, err := db.Get(str.(*pebbleStore).getPebbleValueKey(bkt.GetBucketID(), idx))
+			if err != nil {
+				b.Fatal(err)
+			}
+			_ = append([]byte(nil), value...)
+			_ = closer.Close()
+		}
+	}
+}
+
+func TestFirstLastValue(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Test empty bucket.
+	_, found, err := bkt.FirstValue()
+	assert.NoError(t, err, "error occurred while fetching first value")
+	assert.False(t, found, "first value found in empty bucket")
+	_, found, err = bkt.LastValue()
+	assert.NoError(t, err, "error occurred while fetching last value")
+	assert.False(t, found, "last value found in empty bucket")
+
+	// Test bucket with a single value.
+	require.NoError(t, bkt.PutValues([]BucketValue{{Idx: 5, Value: []byte("5")}}))
+	first, found, err := bkt.FirstValue()
+	assert.NoError(t, err, "error occurred while fetching first value")
+	assert.True(t, found, "first value not found")
+	last, found, err := bkt.LastValue()
+	assert.NoError(t, err, "error occurred while fetching last value")
+	assert.True(t, found, "last value not found")
+	assert.Equal(t, BucketValue{Idx: 5, Value: []byte("5")}, first, "incorrect first value")
+	assert.Equal(t, first, last, "first and last value of single value bucket are not equal")
+
+	// Test bucket with many values.
+	require.NoError(t, bkt.PutValues([]BucketValue{{Idx: 2, Value: []byte("2")}, {Idx: 400, Value: []byte("400")}}))
+	first, _, err = bkt.FirstValue()
+	assert.NoError(t, err, "error occurred while fetching first value")
+	last, _, err = bkt.LastValue()
+	assert.NoError(t, err, "error occurred while fetching last value")
+	assert.Equal(t, BucketValue{Idx: 2, Value: []byte("2")}, first, "incorrect first value")
+	assert.Equal(t, BucketValue{Idx: 400, Value: []byte("400")}, last, "incorrect last value")
+	assert.Equal(t, fetchLastIdxOf(t, bkt.(*pebbleBucket)), last.Idx, "last value does not match fetchLastIdx")
+}
+
+func TestGetValueFromEnd(t *testing.T) {
+	str := setupTombstoneStore(t)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	_, found, err := bkt.GetValueFromEnd(0)
+	assert.NoError(t, err, "error occurred while fetching value from end")
+	assert.False(t, found, "value found in empty bucket")
+
+	// Create a bucket with gaps, a tombstone at the end and
+	// a tombstone between the values.
+	require.NoError(t, bkt.PutValues([]BucketValue{
+		{Idx: 2, Value: []byte("2")},
+		{Idx: 5, Value: []byte("5")},
+		{Idx: 6, Value: []byte("6")},
+		{Idx: 9, Value: []byte("9")},
+		{Idx: 12, Value: []byte("12")},
+	}))
+	require.NoError(t, bkt.Free([]uint16{6, 12}), "error occurred while freeing values")
+
+	// Test whether offsets count present values instead of
+	// indices.
+	for offset, idx := range []uint16{9, 5, 2} {
+		value, found, err := bkt.GetValueFromEnd(uint16(offset))
+		assert.NoError(t, err, "error occurred while fetching value from end")
+		assert.True(t, found, "value at offset %d is not found", offset)
+		assert.Equal(t, idx, value.Idx, "value at offset %d has an incorrect idx", offset)
+		assert.Equal(t, strconv.Itoa(int(idx)), string(value.Value), "value at offset %d is incorrect", offset)
+	}
+	_, found, err = bkt.GetValueFromEnd(3)
+	assert.NoError(t, err, "error occurred while fetching value from end")
+	assert.False(t, found, "value found at an offset past the first value")
+
+	// Test whether the returned value is a copy.
+	value, _, err := bkt.GetValueFromEnd(0)
+	require.NoError(t, err, "error occurred while fetching value from end")
+	value.Value[0] = 'x'
+	value, _, err = bkt.GetValueFromEnd(0)
+	assert.NoError(t, err, "error occurred while fetching value from end")
+	assert.Equal(t, []byte("9"), value.Value, "returned value aliases the stored value")
+}
+
+func TestOccupiedIndices(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Create gaps at 3, 4 and 7, and add a value at 20.
+	require.NoError(t, bkt.DeleteValues(BucketRange{Start: 3, End: 5}), "error occurred while deleting values")
+	require.NoError(t, bkt.Free([]uint16{7}), "error occurred while freeing value")
+	require.NoError(t, bkt.PutValues([]BucketValue{{Idx: 20, Value: []byte("20")}}), "error occurred while putting value")
+
+	idxs, err := bkt.OccupiedIndices(BucketRange{Start: 0, End: math.MaxUint16})
+	require.NoError(t, err, "error occurred while fetching occupied indices")
+	assert.Equal(t, []uint16{1, 2, 5, 6, 8, 9, 10, 20}, idxs, "occupied indices don't match the present keys")
+
+	// Test whether the range, limit and reverse are applied.
+	idxs, err = bkt.OccupiedIndices(BucketRange{Start: 2, End: 9, Limit: 3, Reverse: true})
+	require.NoError(t, err, "error occurred while fetching occupied indices")
+	assert.Equal(t, []uint16{8, 6, 5}, idxs, "occupied indices of range are incorrect")
+
+	idxs, err = bkt.OccupiedIndices(BucketRange{Start: 11, End: 20})
+	require.NoError(t, err, "error occurred while fetching occupied indices")
+	assert.Empty(t, idxs, "empty range has occupied indices")
+}
+
 func TestPutValues(t *testing.T) {
 	str := SetupTestStore(t, false)
 	defer str.Close()
@@ -92,7 +582,7 @@ func TestPutValues(t *testing.T) {
 	// Insert new values.
 	err = bkt.PutValues(TestBktValues)
 	assert.NoError(t, err, "error occurred while putting values")
-	assert.Equal(t, uint16(len(ExpectedBktValues)), bkt.(*pebbleBucket).lastIdx, "lastIdx is not updated correctly")
+	assert.Equal(t, uint16(len(ExpectedBktValues)), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated correctly")
 
 	// Fetch new values.
 	values, err := bkt.GetValues(BucketRange{Start: 0, End: 500})
@@ -101,6 +591,35 @@ func TestPutValues(t *testing.T) {
 	assert.Equal(t, ExpectedBktValues, values, "fetched bucket values are incorrect")
 }
 
+func TestPutValuesIfAbsent(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test whether an existing idx is not overwritten.
+	err = bkt.PutValuesIfAbsent([]BucketValue{{Idx: 20, Value: []byte("20")}, {Idx: 5, Value: []byte("test")}})
+	assert.ErrorIs(t, err, ErrValueExists, "existing value is overwritten")
+	value, _, err := bkt.GetValue(5)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.Equal(t, ExpectedBktValues[4], value, "existing value is overwritten")
+	_, found, err := bkt.GetValue(20)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.False(t, found, "values of a rejected put are added")
+
+	// Test whether an idx can't be used twice.
+	err = bkt.PutValuesIfAbsent([]BucketValue{{Idx: 20, Value: []byte("a")}, {Idx: 20, Value: []byte("b")}})
+	assert.ErrorIs(t, err, ErrValueExists, "duplicate idx is accepted")
+
+	// Test whether fresh and appended indices are written.
+	values := []BucketValue{{Idx: 20, Value: []byte("20")}, {Value: []byte("21")}}
+	assert.NoError(t, bkt.PutValuesIfAbsent(values), "error occurred while putting values")
+	assert.Equal(t, uint16(21), values[1].Idx, "value is not appended")
+	fetched, err := bkt.GetValues(BucketRange{Start: 20, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, values, fetched, "values are not written")
+}
+
 func TestAppendValues(t *testing.T) {
 	str := SetupTestStore(t, false)
 	defer str.Close()
@@ -110,7 +629,7 @@ func TestAppendValues(t *testing.T) {
 	// Append new values.
 	err = bkt.AppendValues(TestBktValues)
 	assert.NoError(t, err, "error occurred while appending values")
-	assert.Equal(t, uint16(len(ExpectedBktValues)), bkt.(*pebbleBucket).lastIdx, "lastIdx is not updated correctly")
+	assert.Equal(t, uint16(len(ExpectedBktValues)), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated correctly")
 
 	// Fetch new values.
 	values, err := bkt.GetValues(BucketRange{Start: 0, End: 500})
@@ -120,21 +639,1229 @@ func TestAppendValues(t *testing.T) {
 
 	// Test whether check for invalid idx is working.
 	err = bkt.AppendValues([]BucketValue{{Idx: 5, Value: []byte("test")}})
-	assert.Equal(t, ErrInvalidAppend, err, "no error returned while doing an invalid append")
+	assert.ErrorIs(t, err, ErrInvalidAppend, "no error returned while doing an invalid append")
 }
 
-func TestDeleteValues(t *testing.T) {
+func TestAppendConflict(t *testing.T) {
 	str := SetupTestStore(t, true)
 	defer str.Close()
 	bkt, err := str.GetBucket(TestBktID)
 	require.NoError(t, err, "error occurred while fetching bucket")
 
-	err = bkt.DeleteValues(BucketRange{Start: 0, End: 500})
-	assert.NoError(t, err, "error occurred while deleting values")
-	assert.Equal(t, uint16(0), bkt.(*pebbleBucket).lastIdx, "lastIdx is not reset while deleting values")
+	// Test whether a conflicting append reports the next idx.
+	var conflict *AppendConflictError
+	err = bkt.AppendValues([]BucketValue{{Idx: 5, Value: []byte("5")}})
+	require.ErrorAs(t, err, &conflict, "conflicting append did not return an AppendConflictError")
+	assert.ErrorIs(t, err, ErrInvalidAppend, "AppendConflictError does not wrap ErrInvalidAppend")
+	assert.Equal(t, uint16(11), conflict.ExpectedIdx, "conflicting append reported an incorrect expected idx")
+
+	// Test whether the expected idx accounts for the values
+	// before the conflicting value, and whether a retry
+	// with the expected idx succeeds.
+	err = bkt.AppendValues([]BucketValue{{Value: []byte("11")}, {Idx: 20, Value: []byte("20")}})
+	require.ErrorAs(t, err, &conflict, "conflicting append did not return an AppendConflictError")
+	assert.Equal(t, uint16(12), conflict.ExpectedIdx, "expected idx ignores the preceding values")
+	assert.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("11")}, {Idx: conflict.ExpectedIdx, Value: []byte("12")}}), "retry with expected idx failed")
+}
+
+func TestAppendValuesAtomic(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}}), "error occurred while appending value")
+
+	// Third value has an invalid idx, none of the values are added.
+	err = bkt.AppendValues([]BucketValue{{Value: []byte("2")}, {Idx: 3, Value: []byte("3")}, {Idx: 10, Value: []byte("10")}})
+	assert.ErrorIs(t, err, ErrInvalidAppend, "no error returned while doing an invalid append")
+	assert.Equal(t, uint16(1), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is updated after a failed append")
 
-	// Test whether values are deleted.
 	values, err := bkt.GetValues(BucketRange{Start: 0, End: 500})
 	assert.NoError(t, err, "error occurred while fetching bucket values")
-	assert.Len(t, values, 0, "bucket values are not deleted")
+	assert.Len(t, values, 1, "values of a failed append are added")
+
+	// Next append continues after the last value.
+	values = []BucketValue{{Value: []byte("2")}}
+	assert.NoError(t, bkt.AppendValues(values), "error occurred while appending value")
+	assert.Equal(t, uint16(2), values[0].Idx, "append does not continue after the last value")
+}
+
+func TestLazyLastIdx(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	scans := &str.(*pebbleStore).lastIdxScans
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Reads don't need the lastIdx.
+	_, err = bkt.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, uint64(0), scans.Load(), "lastIdx is scanned by a read")
+
+	// The first append loads the lastIdx once.
+	values := []BucketValue{{Value: []byte("11")}}
+	assert.NoError(t, bkt.AppendValues(values), "error occurred while appending value")
+	assert.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("12")}}), "error occurred while appending value")
+	assert.Equal(t, uint16(11), values[0].Idx, "append does not continue after the last value")
+	assert.Equal(t, uint64(1), scans.Load(), "lastIdx is not scanned exactly once")
+}
+
+func TestAppendValuesMaxSize(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Test whether values within the limit are appended.
+	idxs, err := bkt.AppendValuesMaxSize([]BucketValue{{Value: []byte("1")}, {Value: []byte("22")}}, 2)
+	assert.NoError(t, err, "error occurred while appending values")
+	assert.Equal(t, []uint16{1, 2}, idxs, "appended values have incorrect idx")
+
+	// Test whether a batch with a too large value is rejected.
+	idxs, err = bkt.AppendValuesMaxSize([]BucketValue{{Value: []byte("3")}, {Value: []byte("444")}}, 2)
+	assert.Equal(t, ErrValueTooLarge, err, "too large value is appended")
+	assert.Nil(t, idxs, "idxs returned for rejected append")
+	assert.Equal(t, uint16(2), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is updated by rejected append")
+
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Len(t, values, 2, "rejected append wrote values")
+}
+func TestTryAppend(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	pebbleBkt := bkt.(*pebbleBucket)
+	require.NoError(t, bkt.PutValues([]BucketValue{{Idx: math.MaxUint16 - 5, Value: []byte("1")}}))
+
+	// Test whether a batch that doesn't fit is rejected
+	// without side effects.
+	values := make([]BucketValue, 6)
+	for i := range values {
+		values[i] = BucketValue{Value: []byte("2")}
+	}
+	_, err = bkt.TryAppend(values)
+	assert.ErrorIs(t, err, ErrBucketIsFull, "batch exceeding the capacity is appended")
+	assert.Equal(t, uint16(math.MaxUint16-5), lastIdxOf(t, pebbleBkt), "lastIdx is changed by a rejected batch")
+	idxs, err := bkt.OccupiedIndices(BucketRange{Start: 0, End: math.MaxUint16})
+	assert.NoError(t, err, "error occurred while fetching occupied indices")
+	assert.Len(t, idxs, 1, "rejected batch is written")
+
+	// Test whether a held lock returns ErrBucketBusy.
+	lock := str.(*pebbleStore).getBucketLock(TestBktID)
+	lock.RLock()
+	_, err = bkt.TryAppend([]BucketValue{{Value: []byte("2")}})
+	lock.RUnlock()
+	assert.ErrorIs(t, err, ErrBucketBusy, "append to a locked bucket is not rejected")
+
+	// Append concurrently near the capacity while sampling
+	// lastIdx, which must never decrease.
+	var stop atomic.Bool
+	var sampled sync.WaitGroup
+	sampled.Add(1)
+	go func() {
+		defer sampled.Done()
+		previous := uint16(math.MaxUint16 - 5)
+		for !stop.Load() {
+			pebbleBkt.mtx.Lock()
+			current := pebbleBkt.lastIdx
+			pebbleBkt.mtx.Unlock()
+			assert.GreaterOrEqual(t, current, previous, "lastIdx overflowed while appending")
+			previous = current
+		}
+	}()
+
+	var appended atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				idxs, err := bkt.TryAppend([]BucketValue{{Value: []byte("3")}, {Value: []byte("4")}})
+				if errors.Is(err, ErrBucketIsFull) {
+					return
+				} else if !errors.Is(err, ErrBucketBusy) {
+					assert.NoError(t, err, "error occurred while appending values")
+					assert.Len(t, idxs, 2, "incorrect amount of assigned indices")
+					appended.Add(int32(len(idxs)))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	stop.Store(true)
+	sampled.Wait()
+
+	assert.Equal(t, int32(4), appended.Load(), "incorrect amount of appended values")
+	assert.Equal(t, uint16(math.MaxUint16-1), lastIdxOf(t, pebbleBkt), "incorrect lastIdx after appending")
+}
+
+func TestMaxValueSize(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	str.(*pebbleStore).opts.MaxValueSize = 4
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test whether an oversized value rejects all values.
+	err = bkt.PutValues([]BucketValue{{Idx: 1, Value: []byte("1234")}, {Idx: 20, Value: []byte("12345")}})
+	assert.ErrorIs(t, err, ErrValueTooLarge, "oversized value is accepted")
+	var bktErr *BucketError
+	require.ErrorAs(t, err, &bktErr, "error is not a bucket error")
+	assert.Equal(t, uint16(20), bktErr.Idx, "idx of the oversized value is not reported")
+	assert.Equal(t, OpPut, bktErr.Op, "operation is incorrect")
+
+	err = bkt.AppendValues([]BucketValue{{Value: []byte("1234")}, {Value: []byte("12345")}})
+	assert.ErrorIs(t, err, ErrValueTooLarge, "oversized value is accepted")
+
+	txn := str.NewTransaction()
+	err = txn.AppendValues(TestBktID, []BucketValue{{Value: []byte("12345")}})
+	assert.ErrorIs(t, err, ErrValueTooLarge, "oversized value is accepted by a transaction")
+	assert.NoError(t, txn.Discard(), "error occurred while discarding transaction")
+
+	assert.ErrorIs(t, bkt.MergeValue(20, []byte("12345")), ErrValueTooLarge, "oversized operand is merged")
+	_, err = bkt.CompareAndSwapValue(20, nil, []byte("12345"))
+	assert.ErrorIs(t, err, ErrValueTooLarge, "oversized value is swapped in")
+
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, ExpectedBktValues, values, "values of a rejected write are written")
+	assert.Equal(t, uint16(10), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is updated by a rejected write")
+
+	// Values within the limit are written.
+	assert.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1234")}}), "error occurred while appending value")
+}
+
+func TestMaxBatchBytes(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	str.(*pebbleStore).opts.MaxBatchBytes = 1024
+
+	// The idx of appended values is assigned in place, so
+	// each write gets new values.
+	newValues := func(n int) []BucketValue {
+		values := make([]BucketValue, n)
+		for i := range values {
+			values[i] = BucketValue{Value: []byte(strconv.Itoa(i))}
+		}
+		return values
+	}
+	values := newValues(1000)
+
+	// Test whether a large write is rejected without
+	// writing any of the values.
+	assert.Equal(t, ErrBatchTooLarge, bkt.AppendValues(values), "large write is accepted")
+	assert.Equal(t, ErrBatchTooLarge, bkt.PutValues([]BucketValue{{Value: make([]byte, 2048)}}), "large value is accepted")
+	stored, err := bkt.GetValues(BucketRange{Start: 0, End: math.MaxUint16})
+	require.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, ExpectedBktValues, stored, "values of a rejected write are written")
+	assert.Equal(t, uint16(10), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is updated by a rejected write")
+	assert.NoError(t, bkt.AppendValues(newValues(10)), "error occurred while appending values within the limit")
+
+	// Test whether the values are written in multiple
+	// batches when SplitBatches is set.
+	str.(*pebbleStore).opts.SplitBatches = true
+	values = newValues(1000)
+	require.NoError(t, bkt.AppendValues(values), "error occurred while appending split values")
+	require.NoError(t, bkt.PutValues([]BucketValue{{Value: make([]byte, 2048)}}), "error occurred while putting large value")
+	stored, err = bkt.GetValues(BucketRange{Start: 21, End: math.MaxUint16})
+	require.NoError(t, err, "error occurred while fetching bucket values")
+	require.Len(t, stored, len(values)+1, "split values are not written")
+	for i, value := range values {
+		assert.Equal(t, value.Value, stored[i].Value, "split value is written incorrectly")
+	}
+	assert.Equal(t, uint16(21+len(values)), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated after split write")
+}
+
+func TestRemainingCapacity(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	assert.Equal(t, math.MaxUint16-10, bkt.RemainingCapacity(), "incorrect remaining capacity")
+	assert.False(t, bkt.IsFull(), "bucket with remaining capacity is full")
+
+	// Test a full bucket.
+	fillBucket(t, bkt)
+	assert.Equal(t, 0, bkt.RemainingCapacity(), "incorrect remaining capacity of full bucket")
+	assert.True(t, bkt.IsFull(), "full bucket is not full")
+
+	// Test whether deleted values make room in a full bucket.
+	require.NoError(t, bkt.DeleteValues(BucketRange{Start: 100, End: 102}))
+	assert.Equal(t, 2, bkt.RemainingCapacity(), "incorrect remaining capacity after delete")
+	assert.False(t, bkt.IsFull(), "bucket with deleted values is full")
+}
+
+func TestAppendValuesReuseIdx(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	fillBucket(t, bkt)
+	assert.ErrorIs(t, bkt.AppendValues([]BucketValue{{Value: []byte("new")}}), ErrBucketIsFull, "append to full bucket succeeded")
+
+	// Free indices with a delete and a tombstone.
+	require.NoError(t, bkt.DeleteValues(BucketRange{Start: 100, End: 102}))
+	require.NoError(t, bkt.PutValues([]BucketValue{{Idx: 50, Tombstone: true}, {Idx: 200, Tombstone: true}}))
+
+	// Test whether appends reuse the lowest freed indices,
+	// and skip indices that are put in the same call.
+	values := []BucketValue{{Value: []byte("a")}, {Idx: 100, Value: []byte("b")}, {Value: []byte("c")}}
+	assert.NoError(t, bkt.PutValues(values), "error occurred while putting values")
+	assert.Equal(t, []uint16{50, 100, 101}, []uint16{values[0].Idx, values[1].Idx, values[2].Idx}, "freed indices are not reused")
+	assert.Equal(t, uint16(math.MaxUint16), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is changed by reused indices")
+
+	values = []BucketValue{{Value: []byte("d")}}
+	assert.NoError(t, bkt.AppendValues(values), "error occurred while appending values")
+	assert.Equal(t, uint16(200), values[0].Idx, "freed idx is not reused by append")
+	assert.ErrorIs(t, bkt.AppendValues([]BucketValue{{Value: []byte("e")}}), ErrBucketIsFull, "append succeeded without free indices")
+
+	value, found, err := bkt.GetValue(50)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.True(t, found, "value at reused idx is not stored")
+	assert.Equal(t, []byte("a"), value.Value, "incorrect value at reused idx")
+}
+
+// fillBucket puts a value at every idx of the bucket.
+func fillBucket(t *testing.T, bkt Bucket) {
+	pebbleBkt := bkt.(*pebbleBucket)
+	batch := pebbleBkt.store.db.NewBatch()
+	for idx := 1; idx <= math.MaxUint16; idx++ {
+		require.NoError(t, batch.Set(pebbleBkt.store.getPebbleValueKey(pebbleBkt.id, uint16(idx)), []byte("fill"), nil))
+	}
+	require.NoError(t, batch.Commit(nil), "could not fill bucket")
+	pebbleBkt.lastIdx = math.MaxUint16
+}
+
+func TestDeleteValues(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	err = bkt.DeleteValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while deleting values")
+	assert.Equal(t, uint16(0), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not reset while deleting values")
+
+	// Test whether values are deleted.
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Len(t, values, 0, "bucket values are not deleted")
+}
+
+func TestFree(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test whether Free removes the values.
+	require.NoError(t, bkt.Free([]uint16{3, 5}), "error occurred while freeing values")
+	values, err := bkt.GetValuesByIndices([]uint16{3, 4, 5})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, []BucketValue{ExpectedBktValues[3]}, values, "values are not freed")
+	assert.Equal(t, uint16(10), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx changed after freeing values")
+
+	// Test whether freeing the last values updates lastIdx.
+	require.NoError(t, bkt.Free([]uint16{10, 9}), "error occurred while freeing values")
+	assert.Equal(t, uint16(8), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated after freeing the last value")
+	assert.ErrorIs(t, bkt.Free([]uint16{0}), ErrInvalidIdx, "freeing idx 0 succeeded")
+
+	// Test whether an empty value without a tombstone does
+	// not delete the existing value.
+	assert.ErrorIs(t, bkt.PutValues([]BucketValue{{Idx: 1}}), ErrEmptyValue, "empty value is accepted")
+	value, found, err := bkt.GetValue(1)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.True(t, found, "value is deleted by an empty value")
+	assert.Equal(t, ExpectedBktValues[0], value, "value is changed by an empty value")
+
+	require.NoError(t, bkt.PutValues([]BucketValue{{Idx: 1, Tombstone: true}}), "error occurred while putting tombstone")
+	_, found, err = bkt.GetValue(1)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.False(t, found, "value is not deleted by a tombstone")
+}
+
+func TestDeleteIndices(t *testing.T) {
+	str := setupValueCacheStore(t, 1<<20)
+	defer str.Close()
+	pebbleStr := str.(*pebbleStore)
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues(ExpectedBktValues))
+	require.Equal(t, uint16(10), lastIdxOf(t, bkt.(*pebbleBucket)), "incorrect lastIdx before deleting")
+	_, err = bkt.GetValues(BucketRange{Start: 0, End: 11})
+	require.NoError(t, err, "error occurred while caching values")
+	events, cancel := str.Watch(TestBktID)
+	defer cancel()
+
+	// Test whether scattered indices are deleted without
+	// reading lastIdx again.
+	scans := pebbleStr.lastIdxScans.Load()
+	require.NoError(t, bkt.DeleteIndices([]uint16{2, 5, 7, 20}), "error occurred while deleting indices")
+	occupied, err := bkt.OccupiedIndices(BucketRange{Start: 0, End: 11})
+	assert.NoError(t, err, "error occurred while fetching indices")
+	assert.Equal(t, []uint16{1, 3, 4, 6, 8, 9, 10}, occupied, "incorrect indices are deleted")
+	assert.Equal(t, scans, pebbleStr.lastIdxScans.Load(), "lastIdx is read again without deleting the last value")
+	assert.Equal(t, uint16(10), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx changed after deleting indices")
+	assert.Equal(t, BucketChangeEvent{Kind: ChangeDelete, Idx: 2}, <-events, "watcher is not notified")
+
+	// Test whether the cached values are invalidated.
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 11})
+	assert.NoError(t, err, "error occurred while fetching values")
+	assert.Len(t, values, 7, "deleted values are still cached")
+
+	// Test whether deleting the last value reads lastIdx
+	// again.
+	require.NoError(t, bkt.DeleteIndices([]uint16{10, 1, 9}), "error occurred while deleting indices")
+	assert.Equal(t, scans+1, pebbleStr.lastIdxScans.Load(), "lastIdx is not read again after deleting the last value")
+	assert.Equal(t, uint16(8), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated after deleting the last value")
+
+	assert.ErrorIs(t, bkt.DeleteIndices([]uint16{3, 0}), ErrInvalidIdx, "deleting idx 0 succeeded")
+	_, found, err := bkt.GetValue(3)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.True(t, found, "value is deleted by a rejected call")
+}
+
+func TestDeleteValue(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test deleting an existing value.
+	existed, err := bkt.DeleteValue(5)
+	assert.NoError(t, err, "error occurred while deleting value")
+	assert.True(t, existed, "existing value is reported as missing")
+	_, found, err := bkt.GetValue(5)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.False(t, found, "deleted value is found")
+	assert.Equal(t, uint16(10), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx changed after deleting a value")
+
+	// Test deleting a missing value.
+	existed, err = bkt.DeleteValue(5)
+	assert.NoError(t, err, "error occurred while deleting value")
+	assert.False(t, existed, "missing value is reported as existing")
+
+	// Test deleting the last value.
+	existed, err = bkt.DeleteValue(10)
+	assert.NoError(t, err, "error occurred while deleting value")
+	assert.True(t, existed, "existing value is reported as missing")
+	assert.Equal(t, uint16(9), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated after deleting the last value")
+}
+
+func TestDeleteValuesCount(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	tests := []struct {
+		name     string
+		rng      BucketRange
+		expected int
+	}{
+		{name: "some values", rng: BucketRange{Start: 3, End: 6}, expected: 3},
+		{name: "no values", rng: BucketRange{Start: 3, End: 6}, expected: 0},
+		{name: "range after values", rng: BucketRange{Start: 11, End: 500}, expected: 0},
+		{name: "all values", rng: BucketRange{Start: 0, End: math.MaxUint16}, expected: 7},
+	}
+
+	for _, test := range tests {
+		count, err := bkt.DeleteValuesCount(test.rng)
+		assert.NoError(t, err, "error occurred while deleting values (%s)", test.name)
+		assert.Equal(t, test.expected, count, "incorrect amount of deleted values (%s)", test.name)
+	}
+
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: math.MaxUint16})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Empty(t, values, "values are not deleted")
+}
+
+// errorFS is a filesystem of which the reads of tables fail
+// while fail is set.
+type errorFS struct {
+	vfs.FS
+	fail *atomic.Bool
+}
+
+// Open opens a file that fails its reads while fail is set.
+func (fs errorFS) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	file, err := fs.FS.Open(name, opts...)
+	if err != nil || !strings.HasSuffix(name, ".sst") {
+		return file, err
+	}
+	return errorFile{File: file, fail: fs.fail}, nil
+}
+
+// errorFile is a file of errorFS.
+type errorFile struct {
+	vfs.File
+	fail *atomic.Bool
+}
+
+// ReadAt reads from the file, or fails while fail is set.
+func (f errorFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.fail.Load() {
+		return 0, errInjected
+	}
+	return f.File.ReadAt(p, off)
+}
+
+// errInjected is returned by the reads of errorFS.
+var errInjected = errors.New("injected read error")
+
+func TestIteratorErrors(t *testing.T) {
+	var fail atomic.Bool
+	cache := pebble.NewCache(0)
+	defer cache.Unref()
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: errorFS{FS: vfs.NewMem(), fail: &fail}, Cache: cache},
+		CacheTTL:   24,
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}, {Value: []byte("2")}}))
+	require.NoError(t, str.(*pebbleStore).db.Flush(), "error occurred while flushing store")
+
+	// Test whether read errors during an iteration are
+	// returned instead of a truncated result.
+	fail.Store(true)
+	_, err = bkt.GetValues(BucketRange{Start: 0, End: 10})
+	assert.ErrorIs(t, err, errInjected, "iterator error of GetValues is not returned")
+	_, err = bkt.OccupiedIndices(BucketRange{Start: 0, End: 10})
+	assert.ErrorIs(t, err, errInjected, "iterator error of OccupiedIndices is not returned")
+
+	// Test whether an unreadable lastIdx fails an append
+	// instead of overwriting the first value.
+	bkt.(*pebbleBucket).lastIdxLoaded.Store(false)
+	err = bkt.AppendValues([]BucketValue{{Value: []byte("3")}})
+	assert.ErrorIs(t, err, errInjected, "iterator error of fetchLastIdx is not returned")
+	_, err = fetchLastIdx(bkt.(*pebbleBucket))
+	assert.ErrorIs(t, err, errInjected, "iterator error of fetchLastIdx is not returned")
+
+	fail.Store(false)
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 10})
+	assert.NoError(t, err, "error occurred while fetching values")
+	assert.Equal(t, []BucketValue{{Idx: 1, Value: []byte("1")}, {Idx: 2, Value: []byte("2")}}, values, "failed append modified the bucket")
+}
+
+func TestDeleteValuesPrune(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test whether a bucket with values left is kept.
+	pruned, err := bkt.DeleteValuesPrune(BucketRange{Start: 1, End: 10})
+	assert.NoError(t, err, "error occurred while deleting values")
+	assert.False(t, pruned, "bucket with values left is deleted")
+	exists, err := str.BucketExists(TestBktID)
+	assert.NoError(t, err, "error occurred while checking bucket")
+	assert.True(t, exists, "bucket with values left is deleted")
+
+	// Test whether deleting the last value deletes the
+	// bucket metadata.
+	pruned, err = bkt.DeleteValuesPrune(BucketRange{Start: 10, End: 11})
+	assert.NoError(t, err, "error occurred while deleting values")
+	assert.True(t, pruned, "empty bucket is not deleted")
+	_, closer, err := str.(*pebbleStore).db.Get(str.(*pebbleStore).getPebbleBucketKey(TestBktID))
+	if err == nil {
+		_ = closer.Close()
+	}
+	assert.ErrorIs(t, err, pebble.ErrNotFound, "metadata of empty bucket is not deleted")
+	_, err = str.GetBucket(TestBktID)
+	assert.ErrorIs(t, err, ErrBucketNotFound, "empty bucket is still cached")
+
+	// Test whether DeleteValues keeps empty buckets.
+	bkt, err = str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}}))
+	require.NoError(t, bkt.DeleteValues(BucketRange{Start: 0, End: math.MaxUint16}), "error occurred while deleting values")
+	exists, err = str.BucketExists(TestBktID)
+	assert.NoError(t, err, "error occurred while checking bucket")
+	assert.True(t, exists, "empty bucket is deleted without pruning")
+}
+
+func TestDeleteValuesLastIdx(t *testing.T) {
+	tests := []struct {
+		name            string
+		rng             BucketRange
+		expectedLastIdx uint16
+		expectedLen     int
+	}{
+		{name: "delete only the last value", rng: BucketRange{Start: 10, End: 11}, expectedLastIdx: 9, expectedLen: 9},
+		{name: "delete range ending at the last value", rng: BucketRange{Start: 8, End: 11}, expectedLastIdx: 7, expectedLen: 7},
+		{name: "delete range ending before the last value", rng: BucketRange{Start: 8, End: 10}, expectedLastIdx: 10, expectedLen: 8},
+		{name: "delete range past the last value", rng: BucketRange{Start: 11, End: 500}, expectedLastIdx: 10, expectedLen: 10},
+		{name: "delete gap", rng: BucketRange{Start: 2, End: 5}, expectedLastIdx: 10, expectedLen: 7},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			str := SetupTestStore(t, true)
+			defer str.Close()
+			bkt, err := str.GetBucket(TestBktID)
+			require.NoError(t, err, "error occurred while fetching bucket")
+
+			assert.NoError(t, bkt.DeleteValues(test.rng), "error occurred while deleting values")
+			assert.Equal(t, test.expectedLastIdx, lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is incorrect after delete")
+
+			values, err := bkt.GetValues(BucketRange{Start: 0, End: 500})
+			assert.NoError(t, err, "error occurred while fetching bucket values")
+			assert.Len(t, values, test.expectedLen, "incorrect amount of values deleted")
+
+			// Test whether the next append continues after lastIdx.
+			assert.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("test")}}), "error occurred while appending value")
+			assert.Equal(t, test.expectedLastIdx+1, lastIdxOf(t, bkt.(*pebbleBucket)), "append did not continue after lastIdx")
+		})
+	}
+}
+
+func TestDeleteValuesMaxIdx(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Test whether the value with the highest possible idx
+	// is found and deleted.
+	require.NoError(t, bkt.PutValues([]BucketValue{{Idx: 1, Value: []byte("1")}, {Idx: math.MaxUint16, Value: []byte("2")}}))
+	assert.Equal(t, uint16(math.MaxUint16), fetchLastIdxOf(t, bkt.(*pebbleBucket)), "value with highest idx is not found")
+	assert.NoError(t, bkt.DeleteValues(BucketRange{Start: math.MaxUint16 - 1, End: math.MaxUint16}), "error occurred while deleting values")
+	assert.Equal(t, uint16(math.MaxUint16), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is updated while last value is not deleted")
+
+	require.NoError(t, str.DeleteBucket(bkt), "error occurred while deleting bucket")
+	assert.Equal(t, uint16(0), fetchLastIdxOf(t, bkt.(*pebbleBucket)), "value with highest idx is not deleted with the bucket")
+}
+
+func TestReplaceRange(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Replace 3-5 with a single value, 3 and 5 end up deleted.
+	err = bkt.ReplaceRange(BucketRange{Start: 3, End: 6}, []BucketValue{{Idx: 4, Value: []byte("new")}})
+	assert.NoError(t, err, "error occurred while replacing range")
+	values, err := bkt.GetValues(BucketRange{Start: 2, End: 7})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, []BucketValue{ExpectedBktValues[1], {Idx: 4, Value: []byte("new")}, ExpectedBktValues[5]}, values, "range is not replaced")
+
+	// Replace the tail of the bucket.
+	err = bkt.ReplaceRange(BucketRange{Start: 9, End: 20}, []BucketValue{{Idx: 15, Value: []byte("15")}})
+	assert.NoError(t, err, "error occurred while replacing range")
+	assert.Equal(t, uint16(15), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated after replacing the tail")
+	err = bkt.ReplaceRange(BucketRange{Start: 9, End: 20}, nil)
+	assert.NoError(t, err, "error occurred while replacing range")
+	assert.Equal(t, uint16(8), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated after clearing the tail")
+
+	// Test whether values outside the range are rejected.
+	err = bkt.ReplaceRange(BucketRange{Start: 1, End: 3}, []BucketValue{{Idx: 1, Value: []byte("1")}, {Idx: 3, Value: []byte("3")}})
+	assert.ErrorIs(t, err, ErrIdxOutOfRange, "value outside the range is accepted")
+	values, err = bkt.GetValues(BucketRange{Start: 1, End: 3})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, ExpectedBktValues[:2], values, "rejected replace modified the bucket")
+}
+
+func TestCompact(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Create a sparse bucket.
+	require.NoError(t, bkt.DeleteValues(BucketRange{Start: 2, End: 5}))
+	require.NoError(t, bkt.PutValues([]BucketValue{{Idx: 7, Tombstone: true}, {Idx: 500, Value: []byte("500")}, {Idx: math.MaxUint16, Value: []byte("max")}}))
+
+	// Test whether the values are moved to contiguous
+	// indices in the same order.
+	mapping, err := bkt.Compact()
+	assert.NoError(t, err, "error occurred while compacting bucket")
+	assert.Equal(t, map[uint16]uint16{1: 1, 5: 2, 6: 3, 8: 4, 9: 5, 10: 6, 500: 7, math.MaxUint16: 8}, mapping, "incorrect idx mapping")
+	assert.Equal(t, uint16(8), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated after compacting")
+
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: math.MaxUint16})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	expected := []string{"1", "5", "6", "8", "9", "10", "500", "max"}
+	require.Len(t, values, len(expected), "old keys are not deleted")
+	for i, value := range values {
+		assert.Equal(t, BucketValue{Idx: uint16(i + 1), Value: []byte(expected[i])}, value, "values are not compacted in order")
+	}
+
+	// Test whether appends continue after the compacted values.
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("new")}}))
+	assert.Equal(t, uint16(9), lastIdxOf(t, bkt.(*pebbleBucket)), "append after compacting used an incorrect idx")
+}
+
+func TestIncrementValue(t *testing.T) {
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: vfs.NewMem(), Merger: CounterMerger},
+		CacheTTL:   24,
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Increment the counter concurrently.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, bkt.IncrementValue(1, 2), "error occurred while incrementing value")
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, bkt.IncrementValue(1, -25), "error occurred while decrementing value")
+	assert.Equal(t, uint16(1), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated correctly")
+
+	// Test whether all increments are merged.
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	require.Len(t, values, 1, "fetched bucket values have incorrect length")
+	counter, err := DecodeCounter(values[0].Value)
+	assert.NoError(t, err, "error occurred while decoding counter")
+	assert.Equal(t, int64(75), counter, "counter does not contain the sum of all increments")
+
+	// Test whether idx 0 is rejected.
+	assert.Equal(t, ErrInvalidIdx, bkt.IncrementValue(0, 1), "increment of idx 0 did not return an error")
+}
+
+func TestMergeValue(t *testing.T) {
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: vfs.NewMem(), Merger: CounterMerger},
+		CacheTTL:   24,
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Merge counter operands concurrently.
+	var wg sync.WaitGroup
+	for i := 1; i <= 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, bkt.MergeValue(3, encodeCounter(int64(i))), "error occurred while merging value")
+		}(i)
+	}
+	wg.Wait()
+
+	// Test whether GetValue resolves the merges.
+	value, found, err := bkt.GetValue(3)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.True(t, found, "merged value is not found")
+	counter, err := DecodeCounter(value.Value)
+	assert.NoError(t, err, "error occurred while decoding counter")
+	assert.Equal(t, int64(5050), counter, "merged value does not contain the sum of all operands")
+
+	// Test whether missing values are not found.
+	_, found, err = bkt.GetValue(2)
+	assert.NoError(t, err, "error occurred while fetching missing value")
+	assert.False(t, found, "missing value is found")
+
+	// Test whether merges wait for the bucket lock, and
+	// lastIdx is only raised after the merge is written.
+	pebbleBkt := bkt.(*pebbleBucket)
+	lock := str.(*pebbleStore).getBucketLock(TestBktID)
+	lock.RLock()
+	merged := make(chan error, 1)
+	go func() { merged <- bkt.IncrementValue(5, 1) }()
+	select {
+	case <-merged:
+		t.Fatal("merge does not wait for the bucket lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pebbleBkt.mtx.Lock()
+	assert.Equal(t, uint16(3), pebbleBkt.lastIdx, "lastIdx is raised before the merge is written")
+	pebbleBkt.mtx.Unlock()
+	lock.RUnlock()
+	assert.NoError(t, <-merged, "error occurred while incrementing value")
+	assert.Equal(t, uint16(5), lastIdxOf(t, pebbleBkt), "lastIdx is not raised by the merge")
+}
+
+func TestMergeValueDefaultMerger(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// The default pebble merger concatenates values.
+	assert.NoError(t, bkt.MergeValue(1, []byte("23")), "error occurred while merging value")
+	value, found, err := bkt.GetValue(1)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.True(t, found, "merged value is not found")
+	assert.Equal(t, []byte("123"), value.Value, "operand is not concatenated")
+	assert.Equal(t, ErrInvalidIdx, bkt.MergeValue(0, []byte("1")), "merge into idx 0 did not return an error")
+}
+
+func TestIncrementAudited(t *testing.T) {
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: vfs.NewMem(), Merger: CounterMerger},
+		CacheTTL:   24,
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Increment the counter and test whether the returned
+	// totals are correct.
+	for i := 1; i <= 5; i++ {
+		total, err := bkt.IncrementAudited(1, 10, []byte("audit "+strconv.Itoa(i)))
+		assert.NoError(t, err, "error occurred while incrementing value")
+		assert.Equal(t, int64(i*10), total, "incorrect total returned")
+	}
+	total, err := bkt.IncrementAudited(1, -15, []byte("audit 6"))
+	assert.NoError(t, err, "error occurred while decrementing value")
+	assert.Equal(t, int64(35), total, "incorrect total returned")
+
+	// Test whether the counter and audit values are consistent.
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	require.Len(t, values, 7, "audit values are not appended")
+	counter, err := DecodeCounter(values[0].Value)
+	assert.NoError(t, err, "error occurred while decoding counter")
+	assert.Equal(t, int64(35), counter, "counter does not contain the sum of all increments")
+	assert.Equal(t, BucketValue{Idx: 7, Value: []byte("audit 6")}, values[6], "audit value is not appended")
+	assert.Equal(t, uint16(7), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated correctly")
+
+	// Test whether idx 0 is rejected.
+	_, err = bkt.IncrementAudited(0, 1, []byte("audit"))
+	assert.Equal(t, ErrInvalidIdx, err, "increment of idx 0 did not return an error")
+}
+
+func TestIncrementValueWithoutMerger(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	err = bkt.IncrementValue(1, 1)
+	assert.Equal(t, ErrCounterMergerRequired, err, "increment without counter merger did not return an error")
+	_, err = bkt.IncrementAudited(1, 1, []byte("audit"))
+	assert.Equal(t, ErrCounterMergerRequired, err, "audited increment without counter merger did not return an error")
+}
+
+func TestCompareAndSwapValue(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test whether a mismatching value is not swapped.
+	swapped, err := bkt.CompareAndSwapValue(1, []byte("2"), []byte("test"))
+	assert.NoError(t, err, "error occurred while swapping value")
+	assert.False(t, swapped, "mismatching value is swapped")
+
+	// Test whether a missing value matches an empty value.
+	swapped, err = bkt.CompareAndSwapValue(11, nil, []byte("11"))
+	assert.NoError(t, err, "error occurred while swapping missing value")
+	assert.True(t, swapped, "missing value is not swapped")
+	assert.Equal(t, uint16(11), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated correctly")
+
+	// Test whether an empty value frees the value.
+	swapped, err = bkt.CompareAndSwapValue(11, []byte("11"), nil)
+	assert.NoError(t, err, "error occurred while freeing value")
+	assert.True(t, swapped, "value is not freed")
+	assert.Equal(t, uint16(10), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated after freeing the last value")
+
+	// Increment a value concurrently, every increment is
+	// retried until the swap succeeds.
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	successes := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				values, err := bkt.GetValues(BucketRange{Start: 1, End: 2})
+				if !assert.NoError(t, err, "error occurred while fetching value") {
+					return
+				}
+				old := append([]byte(nil), values[0].Value...)
+				n, _ := strconv.Atoi(string(old))
+
+				swapped, err := bkt.CompareAndSwapValue(1, old, []byte(strconv.Itoa(n+1)))
+				if !assert.NoError(t, err, "error occurred while swapping value") {
+					return
+				}
+				if swapped {
+					mtx.Lock()
+					successes++
+					mtx.Unlock()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	values, err := bkt.GetValues(BucketRange{Start: 1, End: 2})
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.Equal(t, 20, successes, "unexpected amount of successful swaps")
+	assert.Equal(t, []byte("21"), values[0].Value, "concurrent swaps lost an increment")
+}
+
+func TestSwapValues(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test whether two present values are swapped.
+	require.NoError(t, bkt.SwapValues(2, 5), "error occurred while swapping values")
+	values, err := bkt.GetValues(BucketRange{Start: 1, End: 6})
+	require.NoError(t, err, "error occurred while fetching values")
+	assert.Equal(t, []BucketValue{
+		{Idx: 1, Value: []byte("1")},
+		{Idx: 2, Value: []byte("5")},
+		{Idx: 3, Value: []byte("3")},
+		{Idx: 4, Value: []byte("4")},
+		{Idx: 5, Value: []byte("2")},
+	}, values, "values are not swapped")
+
+	// Test whether a value is moved to a missing idx, and
+	// whether lastIdx follows the moved value.
+	require.NoError(t, bkt.SwapValues(10, 20), "error occurred while swapping with missing value")
+	values, err = bkt.GetValues(BucketRange{Start: 10, End: 21})
+	require.NoError(t, err, "error occurred while fetching values")
+	assert.Equal(t, []BucketValue{{Idx: 20, Value: []byte("10")}}, values, "value is not moved to the missing idx")
+	assert.Equal(t, uint16(20), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not raised to the moved value")
+
+	// Test whether moving the last value down refreshes
+	// lastIdx.
+	require.NoError(t, bkt.SwapValues(20, 10), "error occurred while swapping with missing value")
+	_, found, err := bkt.GetValue(20)
+	require.NoError(t, err, "error occurred while fetching value")
+	assert.False(t, found, "moved value is not freed")
+	assert.Equal(t, uint16(10), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not refreshed after moving the last value")
+
+	// Test whether swapping two missing values or a value
+	// with itself does nothing, and whether idx 0 is
+	// rejected.
+	assert.NoError(t, bkt.SwapValues(30, 31), "error occurred while swapping missing values")
+	assert.NoError(t, bkt.SwapValues(1, 1), "error occurred while swapping value with itself")
+	assert.Equal(t, ErrInvalidIdx, bkt.SwapValues(0, 1), "idx 0 is swapped")
+	stats, err := bkt.(*pebbleBucket).Stats()
+	require.NoError(t, err, "error occurred while fetching stats")
+	assert.Equal(t, uint64(10), stats.Values, "swapping changed the amount of values")
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Interleave appends and deletes of the last values. Run
+	// with the race detector to detect unsafe access.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("test")}}), "error occurred while appending values")
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, bkt.DeleteValues(BucketRange{Start: 5, End: 500}), "error occurred while deleting values")
+		}()
+	}
+	wg.Wait()
+
+	// Test whether lastIdx is consistent with the stored values.
+	assert.Equal(t, fetchLastIdxOf(t, bkt.(*pebbleBucket)), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is inconsistent with the stored values")
+
+	// Test whether a different instance of the bucket
+	// shares the same lock.
+	id := *TestBktID
+	assert.Same(t, str.(*pebbleStore).getBucketLock(TestBktID), str.(*pebbleStore).getBucketLock(&id), "bucket lock is not keyed by BucketId")
+}
+
+func TestBucketRangeValidation(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test whether reversed ranges are rejected.
+	reversed := BucketRange{Start: 5, End: 2}
+	_, err = bkt.GetValues(reversed)
+	assert.ErrorIs(t, err, ErrInvalidRange, "reversed range is accepted by GetValues")
+	err = bkt.GetValuesNoCopy(reversed, func(idx uint16, val []byte) bool { return true })
+	assert.ErrorIs(t, err, ErrInvalidRange, "reversed range is accepted by GetValuesNoCopy")
+	assert.ErrorIs(t, bkt.DeleteValues(reversed), ErrInvalidRange, "reversed range is accepted by DeleteValues")
+	_, err = bkt.DeleteValuesCount(reversed)
+	assert.ErrorIs(t, err, ErrInvalidRange, "reversed range is accepted by DeleteValuesCount")
+	txn := str.NewTransaction()
+	assert.ErrorIs(t, txn.DeleteValues(TestBktID, reversed), ErrInvalidRange, "reversed range is accepted by the transaction")
+	require.NoError(t, txn.Discard(), "error occurred while discarding transaction")
+
+	// Test whether an equal range is empty.
+	equal := BucketRange{Start: 5, End: 5}
+	values, err := bkt.GetValues(equal)
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Empty(t, values, "empty range returned values")
+	count, err := bkt.DeleteValuesCount(equal)
+	assert.NoError(t, err, "error occurred while deleting values")
+	assert.Zero(t, count, "empty range deleted values")
+
+	// Test whether a normal range is used.
+	values, err = bkt.GetValues(BucketRange{Start: 2, End: 5})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, ExpectedBktValues[1:4], values, "incorrect values returned")
+	count, err = bkt.DeleteValuesCount(BucketRange{Start: 2, End: 5})
+	assert.NoError(t, err, "error occurred while deleting values")
+	assert.Equal(t, 3, count, "incorrect amount of values deleted")
+}
+
+func TestReadValuesDirect(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	pebbleStr := str.(*pebbleStore)
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	require.NoError(t, bkt.Free([]uint16{3}), "error occurred while freeing value")
+
+	// Test whether both paths return the same values,
+	// including absent indices, reverse ranges and limits.
+	ranges := []BucketRange{
+		{Start: 1, End: 2},
+		{Start: 2, End: 5},
+		{Start: 2, End: 6, Reverse: true},
+		{Start: 1, End: 5, Limit: 2},
+		{Start: 9, End: 13},
+		{Start: 0, End: 0},
+	}
+	for _, rng := range ranges {
+		direct, _, err := pebbleStr.readValuesDirect(pebbleStr.db, TestBktID, rng, nil)
+		assert.NoError(t, err, "error occurred while reading values directly")
+		iter, _, err := pebbleStr.readValuesIter(pebbleStr.db, TestBktID, rng, nil)
+		assert.NoError(t, err, "error occurred while reading values with iterator")
+		if len(iter) == 0 {
+			assert.Empty(t, direct, "direct read returned values for %+v", rng)
+		} else {
+			assert.Equal(t, iter, direct, "direct read differs for %+v", rng)
+		}
+	}
+}
+
+func BenchmarkReadValuesSmallRange(b *testing.B) {
+	str, _ := setupBenchmarkBucket(b)
+	defer str.Close()
+	pebbleStr := str.(*pebbleStore)
+	id := TestBktID
+
+	for _, size := range []uint16{1, 2, 4, 8, 16} {
+		rng := BucketRange{Start: 100, End: 100 + size}
+		b.Run(fmt.Sprintf("direct/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := pebbleStr.readValuesDirect(pebbleStr.db, id, rng, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("iter/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := pebbleStr.readValuesIter(pebbleStr.db, id, rng, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestIdxZeroReserved(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test whether values with idx 0 are appended instead of
+	// stored at idx 0.
+	values := []BucketValue{{Idx: 0, Value: []byte("11")}}
+	require.NoError(t, bkt.PutValues(values), "error occurred while putting values")
+	assert.Equal(t, uint16(11), values[0].Idx, "value with idx 0 is not appended")
+	_, closer, err := str.(*pebbleStore).db.Get(str.(*pebbleStore).getPebbleValueKey(TestBktID, 0))
+	if err == nil {
+		closer.Close()
+	}
+	assert.ErrorIs(t, err, pebble.ErrNotFound, "value is stored at idx 0")
+
+	// Test whether reads at idx 0 are well-defined.
+	_, ok, err := bkt.GetValue(0)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.False(t, ok, "value is found at idx 0")
+	fetched, err := bkt.GetValues(BucketRange{Start: 0, End: 2})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, ExpectedBktValues[:1], fetched, "phantom value is returned at idx 0")
+
+	// Test whether operations on an existing idx reject 0.
+	assert.ErrorIs(t, bkt.Free([]uint16{0}), ErrInvalidIdx, "idx 0 is freed")
+	assert.ErrorIs(t, bkt.MergeValue(0, []byte("x")), ErrInvalidIdx, "idx 0 is merged")
+	_, err = bkt.CompareAndSwapValue(0, nil, []byte("x"))
+	assert.ErrorIs(t, err, ErrInvalidIdx, "idx 0 is swapped")
+}
+
+func TestFreeTailAppend(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	pebbleBkt := bkt.(*pebbleBucket)
+
+	// Test whether freeing the tail lowers lastIdx, and
+	// whether the next append reuses the freed index.
+	free := []func(idx uint16) error{
+		func(idx uint16) error { return bkt.Free([]uint16{idx}) },
+		func(idx uint16) error { return bkt.PutValues([]BucketValue{{Idx: idx, Tombstone: true}}) },
+		func(idx uint16) error { _, err := bkt.DeleteValue(idx); return err },
+		func(idx uint16) error { return bkt.DeleteValues(BucketRange{Start: idx, End: idx + 1}) },
+	}
+	for i, fn := range free {
+		require.NoError(t, fn(10), "error occurred while freeing the tail (%d)", i)
+		assert.Equal(t, uint16(9), lastIdxOf(t, pebbleBkt), "lastIdx is not lowered (%d)", i)
+
+		values := []BucketValue{{Value: []byte("10")}}
+		require.NoError(t, bkt.AppendValues(values), "error occurred while appending values (%d)", i)
+		assert.Equal(t, uint16(10), values[0].Idx, "freed tail is not reused (%d)", i)
+	}
+
+	// Test whether a tombstone after lastIdx doesn't raise
+	// lastIdx, and whether freed indices before lastIdx are
+	// not reused.
+	require.NoError(t, bkt.PutValues([]BucketValue{{Idx: 500, Tombstone: true}}), "error occurred while putting tombstone")
+	require.NoError(t, bkt.Free([]uint16{5}), "error occurred while freeing value")
+	assert.Equal(t, uint16(10), lastIdxOf(t, pebbleBkt), "lastIdx is changed by tombstones")
+	values := []BucketValue{{Value: []byte("11")}}
+	require.NoError(t, bkt.AppendValues(values), "error occurred while appending values")
+	assert.Equal(t, uint16(11), values[0].Idx, "append does not continue after lastIdx")
+
+	// Test whether the cached lastIdx matches the value
+	// table.
+	assert.Equal(t, fetchLastIdxOf(t, pebbleBkt), lastIdxOf(t, pebbleBkt), "cached lastIdx differs from the value table")
+}
+
+func TestGetValuesInto(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	values, err := bkt.GetValuesInto(BucketRange{Start: 0, End: 500}, nil)
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, ExpectedBktValues, values, "incorrect values returned")
+
+	// Test whether the slice and value buffers are reused.
+	first := &values[0]
+	buf := &values[0].Value[0]
+	values, err = bkt.GetValuesInto(BucketRange{Start: 2, End: 4}, values)
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, ExpectedBktValues[1:3], values, "incorrect values returned")
+	assert.Same(t, first, &values[0], "slice is not reused")
+	assert.Same(t, buf, &values[0].Value[0], "value buffer is not reused")
+}
+
+func BenchmarkGetValuesInto(b *testing.B) {
+	str, err := OpenStore("", &StoreOptions{PebbleOpts: &pebble.Options{FS: vfs.NewMem()}})
+	require.NoError(b, err, "could not open benchmark store")
+	defer str.Close()
+
+	buckets := make([]Bucket, 64)
+	for i := range buckets {
+		bkt, err := str.(*pebbleStore).createRandomBucket(0, BucketPermissions{}, BucketPermissions{})
+		require.NoError(b, err, "could not create benchmark bucket")
+		values := make([]BucketValue, 100)
+		for j := range values {
+			values[j].Value = []byte(strconv.Itoa(j))
+		}
+		require.NoError(b, bkt.AppendValues(values), "error occurred while appending values")
+		buckets[i] = bkt
+	}
+
+	rng := BucketRange{Start: 0, End: math.MaxUint16}
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := buckets[i%len(buckets)].GetValues(rng); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("reused", func(b *testing.B) {
+		b.ReportAllocs()
+		var values []BucketValue
+		for i := 0; i < b.N; i++ {
+			if values, err = buckets[i%len(buckets)].GetValuesInto(rng, values); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestAppendOnlyBucket(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+	bkt, err := str.CreateBucketWithOptions(TestBktID, TestBktKey, BucketOptions{AppendOnly: true})
+	require.NoError(t, err, "error occurred while creating bucket")
+	assert.True(t, bkt.IsAppendOnly(), "bucket is not append-only")
+
+	// Test whether appends work.
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}, {Idx: 2, Value: []byte("2")}}), "error occurred while appending values")
+	require.NoError(t, bkt.PutValues([]BucketValue{{Value: []byte("3")}}), "error occurred while putting appended value")
+
+	// Test whether overwrites and deletes are rejected.
+	assert.ErrorIs(t, bkt.PutValues([]BucketValue{{Idx: 1, Value: []byte("x")}}), ErrAppendOnly, "value is overwritten")
+	assert.ErrorIs(t, bkt.PutValues([]BucketValue{{Idx: 3, Tombstone: true}}), ErrAppendOnly, "value is freed")
+	assert.ErrorIs(t, bkt.PutValuesIfAbsent([]BucketValue{{Idx: 10, Value: []byte("x")}}), ErrAppendOnly, "value is put at an idx")
+	appendOnly := func(idx uint16, op string) error {
+		return &BucketError{ID: TestBktID, Idx: idx, Op: op, Err: ErrAppendOnly}
+	}
+	assert.Equal(t, appendOnly(0, OpDelete), bkt.DeleteValues(BucketRange{Start: 1, End: 4}), "values are deleted")
+	_, err = bkt.DeleteValue(1)
+	assert.Equal(t, appendOnly(1, OpDelete), err, "value is deleted")
+	assert.Equal(t, appendOnly(0, OpDelete), bkt.Free([]uint16{1}), "value is freed")
+	_, err = bkt.CompareAndSwapValue(1, []byte("1"), []byte("x"))
+	assert.Equal(t, appendOnly(1, OpPut), err, "value is swapped")
+	assert.Equal(t, appendOnly(0, OpPut), bkt.SwapValues(1, 2), "values are swapped")
+	assert.Equal(t, appendOnly(1, OpMerge), bkt.MergeValue(1, []byte("x")), "value is merged into")
+	assert.Equal(t, appendOnly(0, OpReplaceRange), bkt.ReplaceRange(BucketRange{Start: 1, End: 4}, nil), "range is replaced")
+	_, err = bkt.Compact()
+	assert.Equal(t, appendOnly(0, OpCompact), err, "bucket is compacted")
+
+	txn := str.NewTransaction()
+	assert.ErrorIs(t, txn.PutValues(TestBktID, []BucketValue{{Idx: 1, Value: []byte("x")}}), ErrAppendOnly, "value is overwritten in a transaction")
+	assert.Equal(t, appendOnly(0, OpDelete), txn.DeleteValues(TestBktID, BucketRange{Start: 1, End: 4}), "values are deleted in a transaction")
+	require.NoError(t, txn.Discard())
+
+	values, err := bkt.GetValues(BucketRange{Start: 1, End: 10})
+	require.NoError(t, err, "error occurred while fetching values")
+	assert.Equal(t, []BucketValue{
+		{Idx: 1, Value: []byte("1")},
+		{Idx: 2, Value: []byte("2")},
+		{Idx: 3, Value: []byte("3")},
+	}, values, "values of append-only bucket are modified")
+
+	// Test whether the flag is kept when the bucket is
+	// loaded again, and whether other buckets are not
+	// append-only.
+	str.(*pebbleStore).cache.Delete(*TestBktID)
+	bkt, err = str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	assert.True(t, bkt.IsAppendOnly(), "append-only flag is not stored")
+	bkt2, err := str.CreateBucket(TestBktID2, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	assert.False(t, bkt2.IsAppendOnly(), "bucket without options is append-only")
 }
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"github.com/cockroachdb/pebble"
+)
+
+// bulkLoadBatchSize is the size in bytes of the values
+// after which a BulkLoad batch is applied.
+const bulkLoadBatchSize = 4 << 20
+
+// BulkLoad appends a large amount of values to the bucket.
+//
+// BulkLoad is intended for the initial population of a
+// bucket by a single writer, like an import. See
+// AppendValues, the values are validated and their idx is
+// assigned up front. They are written in large batches that
+// are not synced to disk, only the last batch is synced.
+// Unlike AppendValues the load is not atomic: when a batch
+// fails, the previous batches are already written. Other
+// writes to the bucket are blocked during the load.
+func (bkt *pebbleBucket) BulkLoad(values []BucketValue) (err error) {
+	defer bkt.store.track(OpAppend)(&err)
+	done, err := bkt.beginWrite(OpAppend)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	lastIdx, err := computeValues(bkt, values, true)
+	if err != nil {
+		return err
+	}
+	count, err := checkQuota(bkt, OpAppend, values)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(values); {
+		end, size := start, 0
+		for end < len(values) && size < bulkLoadBatchSize {
+			size += len(values[end].Value)
+			end++
+		}
+
+		if err := applyBulkLoad(bkt, values[start:end], end == len(values)); err != nil {
+			// Part of the values can be written, so lastIdx and
+			// the count are loaded again when they are needed.
+			bkt.mtx.Lock()
+			bkt.lastIdxLoaded.Store(false)
+			bkt.countLoaded = false
+			bkt.mtx.Unlock()
+			return err
+		}
+		start = end
+	}
+	bkt.setLastIdx(lastIdx)
+	bkt.setCount(count)
+	return nil
+}
+
+// applyBulkLoad writes a batch of BulkLoad values. Only the
+// last batch is synced and refreshes the timestamp.
+func applyBulkLoad(bkt *pebbleBucket, values []BucketValue, last bool) error {
+	batch := bkt.store.db.NewBatch()
+	defer batch.Close()
+	if err := bkt.store.stageValues(batch, bkt.id, values); err != nil {
+		return err
+	}
+
+	opts := pebble.NoSync
+	if last {
+		if err := refreshTimestamp(bkt, batch); err != nil {
+			return err
+		}
+		opts = pebble.Sync
+	}
+
+	if err := bkt.store.db.Apply(batch, opts); err != nil {
+		return err
+	}
+	bkt.store.notifyValues(bkt.id, values)
+	return nil
+}
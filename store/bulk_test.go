@@ -0,0 +1,94 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkLoad(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues(TestBktValues), "error occurred while appending values")
+
+	// Values larger than a batch are split over batches.
+	large := make([]byte, bulkLoadBatchSize/2+1)
+	values := []BucketValue{{Value: large}, {Value: large}, {Value: large}, {Value: []byte("14")}}
+	require.NoError(t, bkt.BulkLoad(values), "error occurred while loading values")
+	assert.Equal(t, uint16(11), values[0].Idx, "indices are not assigned after lastIdx")
+	assert.Equal(t, uint16(14), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated")
+
+	fetched, err := bkt.GetValues(BucketRange{Start: 11, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, values, fetched, "loaded values are incorrect")
+
+	// Invalid values reject the whole load.
+	err = bkt.BulkLoad([]BucketValue{{Value: []byte("15")}, {Idx: 20, Value: []byte("20")}})
+	assert.ErrorIs(t, err, ErrInvalidAppend, "invalid append is accepted")
+	assert.Equal(t, uint16(14), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is updated by a rejected load")
+}
+
+// benchmarkBulkValues is the amount of values loaded by
+// the bulk load benchmarks, a bucket holds at most
+// math.MaxUint16 values.
+const benchmarkBulkValues = 60000
+
+func setupBulkBenchmark(b *testing.B) (Store, []BucketValue) {
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: vfs.NewMem()},
+	})
+	require.NoError(b, err, "could not open benchmark store")
+
+	values := make([]BucketValue, benchmarkBulkValues)
+	for i := range values {
+		values[i].Value = []byte("benchmark value")
+	}
+	return str, values
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	str, values := setupBulkBenchmark(b)
+	defer str.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bkt, err := str.(*pebbleStore).createRandomBucket(0, BucketPermissions{}, BucketPermissions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := range values {
+			values[j].Idx = 0
+		}
+		if err := bkt.BulkLoad(values); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBulkLoadAppendValues(b *testing.B) {
+	str, values := setupBulkBenchmark(b)
+	defer str.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bkt, err := str.(*pebbleStore).createRandomBucket(0, BucketPermissions{}, BucketPermissions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := range values {
+			values[j].Idx = 0
+		}
+		for j := 0; j < len(values); j += 100 {
+			if err := bkt.AppendValues(values[j : j+100]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
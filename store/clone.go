@@ -0,0 +1,184 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// ErrIDCollision is returned when no unused BucketID is
+// generated within maxIDAttempts attempts.
+var ErrIDCollision = errors.New("store: generated bucket ids are already in use")
+
+// RandSource is a source of random bytes for generated
+// BucketIDs, BucketKeys and snapshot tokens, see
+// StoreOptions.RandSource.
+//
+// Deployments that require an approved entropy source can
+// provide a reader backed by a HSM or KMS. Read is called
+// until the buffer is filled, failing or short reads fail
+// the operation that needs the random bytes.
+type RandSource interface {
+	Read(p []byte) (int, error)
+}
+
+// maxEmptyRandomReads is the maximum amount of consecutive
+// reads without bytes from a RandSource, see readRandom.
+const maxEmptyRandomReads = 100
+
+// maxIDAttempts is the maximum amount of generated ids
+// tried when creating a bucket with a random id.
+const maxIDAttempts = 8
+
+// CloneBucket creates a new bucket with a copy of the
+// values of the source bucket.
+//
+// The new bucket gets a random BucketID with the given
+// lifetime and permissions, and a random BucketKey, both
+// read from StoreOptions.RandSource. The values are read
+// from a snapshot of the source bucket, so the clone is
+// consistent. Values keep their idx, so the clone has the
+// same lastIdx as the source. An error wrapping
+// ErrInvalidBucketID is returned when the permissions
+// can't be stored in a BucketID, see ParseBucketID.
+func (str *pebbleStore) CloneBucket(src BucketID, lifetime byte, public, protected BucketPermissions) (Bucket, error) {
+	done, err := str.beginWrite()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	snap := str.db.NewSnapshot()
+	defer snap.Close()
+	_, closer, err := snap.Get(str.getPebbleBucketKey(src))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, ErrBucketNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if err := closer.Close(); err != nil {
+		return nil, err
+	}
+
+	bkt, err := str.createRandomBucket(lifetime, public, protected)
+	if err != nil {
+		return nil, err
+	}
+	pebbleBkt := bkt.(*pebbleBucket)
+	id := bkt.GetBucketID()
+	lock := str.getBucketLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Copy the values as they are stored, the value key only
+	// differs in the BucketId.
+	lower, upper := str.getPebbleValueKeyRange(src)
+	iter := snap.NewIter(&pebble.IterOptions{
+		LowerBound: lower,
+		UpperBound: upper,
+	})
+	batch := str.db.NewBatch()
+	defer batch.Close()
+	// Tombstones are copied, but don't count for the lastIdx.
+	var lastIdx uint16
+	dst := str.getPebbleValueKey(id, 0)
+	for iter.First(); iter.Valid(); iter.Next() {
+		setKeyIdx(dst, getKeyIdx(iter.Key()))
+		if err := batch.Set(dst, iter.Value(), nil); err != nil {
+			_ = iter.Close()
+			return nil, err
+		}
+		if !str.isTombstone(iter.Value()) {
+			lastIdx = getKeyIdx(iter.Key())
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	if err := str.db.Apply(batch, nil); err != nil {
+		return nil, err
+	}
+	str.values.invalidate(bkt.GetBucketID())
+
+	pebbleBkt.setLastIdx(lastIdx)
+	return bkt, nil
+}
+
+// createRandomBucket creates a bucket with a random
+// BucketID and BucketKey.
+//
+// A new id is generated when the id is already in use.
+// Collisions are only expected with a broken RandSource,
+// so ErrIDCollision is returned after maxIDAttempts.
+func (str *pebbleStore) createRandomBucket(lifetime byte, public, protected BucketPermissions) (Bucket, error) {
+	var key BucketKey
+	for i := 0; i < maxIDAttempts; i++ {
+		id, err := str.newBucketID(lifetime, public, protected)
+		if err != nil {
+			return nil, err
+		}
+
+		// The key is read after the first id, so the random
+		// bytes start with the id.
+		if key == nil {
+			key = new([BucketKeyLength]byte)
+			if err := str.readRandom(key[:]); err != nil {
+				return nil, err
+			}
+		}
+
+		bkt, err := str.createBucket(id, key, BucketOptions{})
+		if !errors.Is(err, ErrBucketAlreadyExists) {
+			return bkt, err
+		}
+	}
+	return nil, ErrIDCollision
+}
+
+// newBucketID returns a random BucketID with the given
+// lifetime and permissions.
+func (str *pebbleStore) newBucketID(lifetime byte, public, protected BucketPermissions) (BucketID, error) {
+	id := new([BucketIDLength]byte)
+	if err := str.readRandom(id[:14]); err != nil {
+		return nil, err
+	}
+	id[14] = lifetime
+
+	// Protected bits are only set for permissions that are
+	// not already granted by the public bits, public write
+	// also grants protected append.
+	extra := BucketPermissions{
+		Read:   protected.Read && !public.Read,
+		Write:  protected.Write && !public.Write,
+		Append: protected.Append && !public.Write,
+	}
+	id[15] = permissionBits(public, permPublicRead, permPublicWrite, permPublicAppend) |
+		permissionBits(extra, permProtectedRead, permProtectedWrite, permProtectedAppend)
+
+	// Verify that the bits result in the same permissions,
+	// the protected permissions include the public ones.
+	info, err := ParseBucketID(id)
+	if err != nil {
+		return nil, err
+	} else if info.Public != public || info.Protected != protected {
+		return nil, fmt.Errorf("%w: protected permissions must include the public permissions", ErrInvalidBucketID)
+	}
+	return id, nil
+}
+
+// permissionBits returns the permission bits of the given
+// permissions.
+func permissionBits(perms BucketPermissions, read, write, appendBit byte) byte {
+	var bits byte
+	if perms.Read {
+		bits |= read
+	}
+	if perms.Write {
+		bits |= write
+	}
+	if perms.Append {
+		bits |= appendBit
+	}
+	return bits
+}
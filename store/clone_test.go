@@ -0,0 +1,211 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloneBucket(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	public := BucketPermissions{Read: true}
+	protected := BucketPermissions{Read: true, Write: true, Append: true}
+
+	// Test whether the clone has the same values but a
+	// different id and key.
+	clone, err := str.CloneBucket(TestBktID, 3, public, protected)
+	require.NoError(t, err, "error occurred while cloning bucket")
+	assert.NotEqual(t, *TestBktID, *clone.GetBucketID(), "clone has the id of the source")
+	assert.NotEqual(t, *TestBktKey, *clone.GetBucketKey(), "clone has the key of the source")
+	info, err := ParseBucketID(clone.GetBucketID())
+	require.NoError(t, err, "clone has an invalid id")
+	assert.Equal(t, BucketInfo{Lifetime: 3, Public: public, Protected: protected}, info, "clone has incorrect lifetime or permissions")
+
+	values, err := clone.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching cloned values")
+	assert.Equal(t, ExpectedBktValues, values, "cloned values are incorrect")
+	assert.Equal(t, uint16(10), lastIdxOf(t, clone.(*pebbleBucket)), "clone has incorrect lastIdx")
+
+	// Test whether the clone is independent of the source.
+	require.NoError(t, clone.AppendValues([]BucketValue{{Value: []byte("11")}}))
+	src, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	_, found, err := src.GetValue(11)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.False(t, found, "append to clone changed the source")
+
+	// Test invalid sources and permissions.
+	_, err = str.CloneBucket(&[BucketIDLength]byte{9}, 3, public, protected)
+	assert.ErrorIs(t, err, ErrBucketNotFound, "clone of missing bucket succeeded")
+	_, err = str.CloneBucket(TestBktID, 3, public, BucketPermissions{})
+	assert.ErrorIs(t, err, ErrInvalidBucketID, "clone with contradictory permissions succeeded")
+}
+
+// failingReader returns n random bytes before failing.
+type failingReader struct {
+	n int
+}
+
+// Read implements io.Reader.
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, errors.New("rng failure")
+	}
+	n := len(p)
+	if n > r.n {
+		n = r.n
+	}
+	r.n -= n
+	return n, nil
+}
+
+func TestCloneBucketRandSource(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	public := BucketPermissions{Read: true}
+	protected := BucketPermissions{Read: true, Write: true, Append: true}
+
+	// Test whether the id and key are read from the source.
+	random := make([]byte, 14+BucketKeyLength)
+	for i := range random {
+		random[i] = byte(i + 1)
+	}
+	str.(*pebbleStore).opts.RandSource = bytes.NewReader(random)
+	clone, err := str.CloneBucket(TestBktID, 3, public, protected)
+	require.NoError(t, err, "error occurred while cloning bucket")
+	assert.Equal(t, append(random[:14:14], 3, 1|16|32), clone.GetBucketID()[:], "id is not read from the source")
+	assert.Equal(t, random[14:], clone.GetBucketKey()[:], "key is not read from the source")
+
+	// Test whether a failing source returns an error, also
+	// when it fails in the middle of a read.
+	for _, n := range []int{0, 10, 14 + 10} {
+		str.(*pebbleStore).opts.RandSource = &failingReader{n: n}
+		_, err = str.CloneBucket(TestBktID, 3, public, protected)
+		assert.Error(t, err, "clone with failing source succeeded (after %d bytes)", n)
+	}
+	str.(*pebbleStore).opts.RandSource = bytes.NewReader(nil)
+	_, err = str.CloneBucket(TestBktID, 3, public, protected)
+	assert.ErrorIs(t, err, io.EOF, "clone with empty source succeeded")
+}
+
+// emptyReader returns no bytes and no error.
+type emptyReader struct{}
+
+// Read implements io.Reader.
+func (emptyReader) Read([]byte) (int, error) {
+	return 0, nil
+}
+
+func TestRandSource(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	all := BucketPermissions{Read: true, Write: true, Append: true}
+
+	// Test whether a deterministic source creates the same
+	// id and key.
+	random := make([]byte, 14+BucketKeyLength)
+	for i := range random {
+		random[i] = byte(i + 1)
+	}
+	for _, lifetime := range []byte{1, 2} {
+		str.(*pebbleStore).opts.RandSource = bytes.NewReader(random)
+		bkt, err := str.(*pebbleStore).createRandomBucket(lifetime, all, all)
+		require.NoError(t, err, "error occurred while creating bucket")
+		assert.Equal(t, append(random[:14:14], lifetime, 7), bkt.GetBucketID()[:], "id is not read from the source")
+		assert.Equal(t, random[14:], bkt.GetBucketKey()[:], "key is not read from the source")
+	}
+
+	// Test whether failing, short and empty reads fail the
+	// create and clone paths without creating a bucket.
+	for name, tc := range map[string]struct {
+		source func() RandSource
+		err    error
+	}{
+		"failing":     {func() RandSource { return &failingReader{n: 0} }, nil},
+		"failing key": {func() RandSource { return &failingReader{n: 14 + 10} }, nil},
+		"short id":    {func() RandSource { return bytes.NewReader(random[:10]) }, io.ErrUnexpectedEOF},
+		"short key":   {func() RandSource { return bytes.NewReader(random[:14+10]) }, io.ErrUnexpectedEOF},
+		"empty":       {func() RandSource { return emptyReader{} }, io.ErrNoProgress},
+	} {
+		str.(*pebbleStore).opts.RandSource = tc.source()
+		_, err := str.(*pebbleStore).createRandomBucket(3, all, all)
+		assert.Error(t, err, "%s: create with a bad source succeeded", name)
+		if tc.err != nil {
+			assert.ErrorIs(t, err, tc.err, "%s: create returned an incorrect error", name)
+		}
+
+		str.(*pebbleStore).opts.RandSource = tc.source()
+		_, err = str.CloneBucket(TestBktID, 3, all, all)
+		assert.Error(t, err, "%s: clone with a bad source succeeded", name)
+		if tc.err != nil {
+			assert.ErrorIs(t, err, tc.err, "%s: clone returned an incorrect error", name)
+		}
+	}
+	var buckets int
+	assert.NoError(t, str.ListBuckets(func(BucketID, time.Time) bool {
+		buckets++
+		return true
+	}), "error occurred while listing buckets")
+	assert.Equal(t, 3, buckets, "bucket is created with a bad source")
+}
+
+func TestCloneBucketCollision(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	all := BucketPermissions{Read: true, Write: true, Append: true}
+
+	// Test whether a new id is generated when the first id
+	// is already in use, the first id equals TestBktID.
+	random := append([]byte(nil), TestBktID[:14]...)
+	random = append(random, make([]byte, BucketKeyLength)...)
+	random = append(random, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9)
+	str.(*pebbleStore).opts.RandSource = bytes.NewReader(random)
+	clone, err := str.CloneBucket(TestBktID, 255, all, all)
+	require.NoError(t, err, "error occurred while cloning bucket")
+	assert.Equal(t, []byte{9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 255, 7}, clone.GetBucketID()[:], "clone did not retry with a new id")
+
+	src, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	assert.Equal(t, *TestBktKey, *src.GetBucketKey(), "colliding bucket is overwritten")
+
+	// Test whether a source that always collides returns an
+	// error after a bounded amount of attempts.
+	str.(*pebbleStore).opts.RandSource = &repeatReader{data: TestBktID[:14]}
+	_, err = str.CloneBucket(TestBktID, 255, all, all)
+	assert.ErrorIs(t, err, ErrIDCollision, "clone with colliding ids succeeded")
+}
+
+// repeatReader returns data for every read.
+type repeatReader struct {
+	data []byte
+}
+
+// Read implements io.Reader.
+func (r *repeatReader) Read(p []byte) (int, error) {
+	return copy(p, r.data), nil
+}
+
+func TestCloneBucketTombstones(t *testing.T) {
+	str := setupTombstoneStore(t)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}, {Value: []byte("2")}, {Value: []byte("3")}}))
+	require.NoError(t, bkt.Free([]uint16{3}), "error occurred while freeing value")
+
+	// Test whether a freed tail is not counted for the
+	// lastIdx of the clone.
+	clone, err := str.CloneBucket(TestBktID, 3, BucketPermissions{Read: true}, BucketPermissions{Read: true})
+	require.NoError(t, err, "error occurred while cloning bucket")
+	assert.Equal(t, uint16(2), lastIdxOf(t, clone.(*pebbleBucket)), "clone counts the tombstone for its lastIdx")
+	report, err := str.Verify(context.Background())
+	require.NoError(t, err, "error occurred while verifying store")
+	assert.Empty(t, report.StaleLastIdx, "clone has a stale lastIdx")
+}
@@ -0,0 +1,253 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrCoalescerClosed is returned when appending to an
+// AppendCoalescer that is closed.
+var ErrCoalescerClosed = errors.New("store: append coalescer is closed")
+
+// maxCoalescedAppends is the maximum amount of Append calls
+// written in a single batch.
+const maxCoalescedAppends = 1024
+
+// AppendCoalescer coalesces the appends of many goroutines
+// into a single batch.
+//
+// Appends that are received within a window of each other
+// are written in a single pebble batch, which is cheaper
+// than a batch for each AppendValues call under high
+// concurrency. The cost is the latency of the window.
+//
+// Each Append call blocks until its values are written, so
+// the appends of a single goroutine are written in call
+// order, and the values of a single Append get contiguous
+// indices. Appends of different goroutines are written in
+// the order they are received by the coalescer, which is
+// not necessarily the order in which Append was called.
+type AppendCoalescer struct {
+	store    *pebbleStore
+	window   time.Duration
+	requests chan *appendRequest
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// appendRequest is an Append call waiting to be written.
+type appendRequest struct {
+	bkt    *pebbleBucket
+	values []BucketValue
+	err    error
+	done   chan struct{}
+}
+
+// NewAppendCoalescer starts a coalescer that writes the
+// appends received within window in a single batch.
+//
+// The coalescer runs a goroutine until it is closed, close
+// it before closing the store.
+func (str *pebbleStore) NewAppendCoalescer(window time.Duration) *AppendCoalescer {
+	c := &AppendCoalescer{
+		store:    str,
+		window:   window,
+		requests: make(chan *appendRequest),
+		stop:     make(chan struct{}),
+	}
+	c.wg.Add(1)
+	go c.run()
+	return c
+}
+
+// Append adds values to the bucket.
+//
+// See Bucket.AppendValues, the idx of the values is
+// assigned when they are written. An append that fails
+// doesn't affect the other appends in the same batch.
+// Freed indices are not reused, when lastIdx is
+// math.MaxUint16 ErrBucketIsFull is returned. When the
+// bucket has a quota, all appends to the bucket in the
+// batch fail when they exceed it together. Appends are
+// checked against the WriteLimiter before they are queued.
+func (c *AppendCoalescer) Append(bkt Bucket, values []BucketValue) (err error) {
+	defer c.store.track(OpAppend)(&err)
+	pebbleBkt, err := unwrapBucket(bkt, func(perms BucketPermissions) bool { return perms.Append })
+	if err != nil {
+		return err
+	} else if err := checkRate(c.store.opts.WriteLimiter, pebbleBkt.id, OpAppend); err != nil {
+		return err
+	}
+
+	req := &appendRequest{bkt: pebbleBkt, values: values, done: make(chan struct{})}
+	select {
+	case c.requests <- req:
+	case <-c.stop:
+		return ErrCoalescerClosed
+	}
+	<-req.done
+	return req.err
+}
+
+// Close stops the coalescer after the received appends are
+// written. Appends started after Close return
+// ErrCoalescerClosed.
+func (c *AppendCoalescer) Close() {
+	c.stopOnce.Do(func() { close(c.stop) })
+	c.wg.Wait()
+}
+
+// run collects the appends of a window and writes them.
+func (c *AppendCoalescer) run() {
+	defer c.wg.Done()
+	for {
+		var reqs []*appendRequest
+		select {
+		case req := <-c.requests:
+			reqs = append(reqs, req)
+		case <-c.stop:
+			return
+		}
+
+		timer := time.NewTimer(c.window)
+	collect:
+		for len(reqs) < maxCoalescedAppends {
+			select {
+			case req := <-c.requests:
+				reqs = append(reqs, req)
+			case <-timer.C:
+				break collect
+			case <-c.stop:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		c.store.writeCoalesced(reqs)
+		for _, req := range reqs {
+			close(req.done)
+		}
+	}
+}
+
+// coalescedBucket contains the appends to a bucket in a
+// coalesced batch.
+type coalescedBucket struct {
+	bkt     *pebbleBucket
+	reqs    []*appendRequest
+	values  []BucketValue
+	lastIdx uint16
+	count   int
+}
+
+// writeCoalesced writes the appends in a single batch, the
+// error of each append is stored in the request.
+func (str *pebbleStore) writeCoalesced(reqs []*appendRequest) {
+	fail := func(reqs []*appendRequest, err error) {
+		for _, req := range reqs {
+			if req.err == nil {
+				req.err = err
+			}
+		}
+	}
+
+	done, err := str.beginWrite()
+	if err != nil {
+		fail(reqs, err)
+		return
+	}
+	defer done()
+
+	// Group the appends by bucket, in the order they are
+	// received.
+	var buckets []*coalescedBucket
+	byID := make(map[[BucketIDLength]byte]*coalescedBucket)
+	for _, req := range reqs {
+		cb, ok := byID[*req.bkt.id]
+		if !ok {
+			cb = &coalescedBucket{bkt: req.bkt}
+			byID[*req.bkt.id] = cb
+			buckets = append(buckets, cb)
+		}
+		cb.reqs = append(cb.reqs, req)
+	}
+
+	// Lock all buckets in a fixed order to avoid deadlocks,
+	// see Transaction.Commit.
+	shards := make([]int, 0, len(buckets))
+	seen := make(map[int]bool, len(buckets))
+	for _, cb := range buckets {
+		if shard := getBucketLockShard(cb.bkt.id); !seen[shard] {
+			seen[shard] = true
+			shards = append(shards, shard)
+		}
+	}
+	sort.Ints(shards)
+	for _, shard := range shards {
+		str.locks[shard].Lock()
+		defer str.locks[shard].Unlock()
+	}
+
+	batch := str.db.NewBatch()
+	defer batch.Close()
+	var written []*coalescedBucket
+	for _, cb := range buckets {
+		cb.bkt.mtx.Lock()
+		cb.lastIdx, err = cb.bkt.getLastIdx()
+		cb.bkt.mtx.Unlock()
+		if err != nil {
+			fail(cb.reqs, err)
+			cb.reqs = nil
+			continue
+		}
+
+		// Invalid appends fail without affecting the others.
+		var accepted []*appendRequest
+		for _, req := range cb.reqs {
+			lastIdx := cb.lastIdx
+			if err := str.checkValues(cb.bkt.id, OpAppend, req.values); err != nil {
+				req.err = err
+			} else if err := computeIdxs(cb.bkt.id, &lastIdx, nil, req.values, true); err != nil {
+				req.err = err
+			} else {
+				cb.lastIdx = lastIdx
+				cb.values = append(cb.values, req.values...)
+				accepted = append(accepted, req)
+			}
+		}
+		cb.reqs = accepted
+		if len(accepted) == 0 {
+			continue
+		}
+
+		if cb.count, err = checkQuota(cb.bkt, OpAppend, cb.values); err != nil {
+			fail(accepted, err)
+			continue
+		}
+		if err := str.stageValues(batch, cb.bkt.id, cb.values); err != nil {
+			fail(reqs, err)
+			return
+		}
+		if err := refreshTimestamp(cb.bkt, batch); err != nil {
+			fail(reqs, err)
+			return
+		}
+		written = append(written, cb)
+	}
+
+	if len(written) == 0 {
+		return
+	}
+	if err := str.db.Apply(batch, nil); err != nil {
+		fail(reqs, err)
+		return
+	}
+	for _, cb := range written {
+		cb.bkt.setLastIdx(cb.lastIdx)
+		cb.bkt.setCount(cb.count)
+		str.notifyValues(cb.bkt.id, cb.values)
+	}
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendCoalescer(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues(TestBktValues), "error occurred while appending values")
+
+	coalescer := str.NewAppendCoalescer(time.Millisecond)
+	defer coalescer.Close()
+
+	// Test whether concurrent appends each get unique
+	// contiguous indices.
+	const writers = 64
+	values := make([][]BucketValue, writers)
+	var wg sync.WaitGroup
+	for i := range values {
+		values[i] = []BucketValue{{Value: []byte{byte(i), 0}}, {Value: []byte{byte(i), 1}}}
+		wg.Add(1)
+		go func(values []BucketValue) {
+			defer wg.Done()
+			assert.NoError(t, coalescer.Append(bkt, values), "error occurred while appending values")
+		}(values[i])
+	}
+	wg.Wait()
+
+	var idxs []int
+	for _, v := range values {
+		assert.Equal(t, v[0].Idx+1, v[1].Idx, "values of an append are not contiguous")
+		idxs = append(idxs, int(v[0].Idx), int(v[1].Idx))
+	}
+	sort.Ints(idxs)
+	for i, idx := range idxs {
+		assert.Equal(t, 11+i, idx, "indices are not unique")
+	}
+	assert.Equal(t, uint16(10+2*writers), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated")
+
+	for _, v := range values {
+		fetched, err := bkt.GetValues(BucketRange{Start: v[0].Idx, End: v[1].Idx + 1})
+		assert.NoError(t, err, "error occurred while fetching bucket values")
+		assert.Equal(t, v, fetched, "appended values are incorrect")
+	}
+
+	// Test whether an invalid append fails without affecting
+	// the appends in the same batch.
+	var invalidErr, validErr error
+	valid := []BucketValue{{Value: []byte("valid")}}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		invalidErr = coalescer.Append(bkt, []BucketValue{{Idx: 1, Value: []byte("invalid")}})
+	}()
+	go func() {
+		defer wg.Done()
+		validErr = coalescer.Append(bkt, valid)
+	}()
+	wg.Wait()
+	assert.ErrorIs(t, invalidErr, ErrInvalidAppend, "invalid append is accepted")
+	assert.NoError(t, validErr, "valid append failed")
+	assert.Equal(t, uint16(11+2*writers), valid[0].Idx, "value is appended at incorrect index")
+
+	// Test whether appends fail after the coalescer is closed.
+	coalescer.Close()
+	err = coalescer.Append(bkt, []BucketValue{{Value: []byte("closed")}})
+	assert.ErrorIs(t, err, ErrCoalescerClosed, "append to closed coalescer is accepted")
+}
+
+// benchmarkCoalesceBuckets is the amount of buckets the
+// coalescer benchmarks append to, so no bucket gets full.
+const benchmarkCoalesceBuckets = 256
+
+func setupCoalesceBenchmark(b *testing.B) (Store, []Bucket) {
+	str, _ := setupBulkBenchmark(b)
+	buckets := make([]Bucket, benchmarkCoalesceBuckets)
+	for i := range buckets {
+		bkt, err := str.(*pebbleStore).createRandomBucket(0, BucketPermissions{}, BucketPermissions{})
+		require.NoError(b, err, "could not create benchmark bucket")
+		buckets[i] = bkt
+	}
+	return str, buckets
+}
+
+// benchmarkAppends runs append with 64 concurrent writers.
+func benchmarkAppends(b *testing.B, buckets []Bucket, appendValues func(Bucket, []BucketValue) error) {
+	var n atomic.Uint64
+	b.ReportAllocs()
+	// RunParallel starts parallelism*GOMAXPROCS goroutines.
+	parallelism := 64 / runtime.GOMAXPROCS(0)
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	b.SetParallelism(parallelism)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			bkt := buckets[n.Add(1)%benchmarkCoalesceBuckets]
+			if err := appendValues(bkt, []BucketValue{{Value: []byte("benchmark value")}}); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkAppendCoalescer(b *testing.B) {
+	str, buckets := setupCoalesceBenchmark(b)
+	defer str.Close()
+	coalescer := str.NewAppendCoalescer(time.Millisecond)
+	defer coalescer.Close()
+	benchmarkAppends(b, buckets, coalescer.Append)
+}
+
+func BenchmarkAppendCoalescerDirect(b *testing.B) {
+	str, buckets := setupCoalesceBenchmark(b)
+	defer str.Close()
+	benchmarkAppends(b, buckets, func(bkt Bucket, values []BucketValue) error {
+		return bkt.AppendValues(values)
+	})
+}
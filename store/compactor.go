@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// RunCompactor compacts the store every interval until the
+// context is canceled, and then returns the context error.
+//
+// Deleted and overwritten values leave tombstones behind
+// that slow down reads until pebble compacts them. Each
+// run compacts the full key span of the store, which
+// rewrites all data and costs I/O in the order of the size
+// of the store, so the interval should be long compared to
+// the time a compaction takes. Runs are maintenance jobs,
+// see runMaintenance. The amount of runs and compacted
+// bytes are reported by Stats.
+func (str *pebbleStore) RunCompactor(ctx context.Context, interval time.Duration) error {
+	if err := str.checkWritable(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-str.ctx.Done():
+			return ErrStoreClosed
+		case <-ticker.C:
+			if err := str.compact(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// compact runs compactStore as maintenance job, see
+// RunCompactor.
+func (str *pebbleStore) compact(ctx context.Context) error {
+	done, err := str.beginOp()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return str.runMaintenance(ctx, str.compactStore)
+}
+
+// compactStore compacts the full key span of the store,
+// see RunCompactor.
+func (str *pebbleStore) compactStore() error {
+	lower, upper := str.getTableKey(bucketTable, 0), str.getTableKey(requestTable+1, 0)
+	size, err := str.db.EstimateDiskUsage(lower, upper)
+	if err != nil {
+		return err
+	}
+	if err := str.db.Compact(lower, upper, true); err != nil {
+		return err
+	}
+
+	str.compactions.Add(1)
+	str.compactedBytes.Add(size)
+	return nil
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactStore(t *testing.T) {
+	// Disable automatic compactions, so deleted data is
+	// only reclaimed by compactStore.
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: vfs.NewMem(), DisableAutomaticCompactions: true},
+		CacheTTL:   24,
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+	pebbleStr := str.(*pebbleStore)
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Add and delete values.
+	values := make([]BucketValue, 1024)
+	for i := range values {
+		values[i].Value = make([]byte, 1024)
+		_, _ = rand.Read(values[i].Value)
+	}
+	require.NoError(t, bkt.AppendValues(values), "error occurred while appending values")
+	require.NoError(t, pebbleStr.db.Flush(), "error occurred while flushing store")
+	require.NoError(t, bkt.DeleteValues(BucketRange{Start: 0, End: 1000}), "error occurred while deleting values")
+	require.NoError(t, pebbleStr.db.Flush(), "error occurred while flushing store")
+
+	before, err := str.Stats(StatsOptions{})
+	require.NoError(t, err, "error occurred while fetching stats")
+	require.NoError(t, pebbleStr.compactStore(), "error occurred while compacting store")
+	after, err := str.Stats(StatsOptions{})
+	require.NoError(t, err, "error occurred while fetching stats")
+	assert.Less(t, after.DiskUsage, before.DiskUsage, "compaction did not reduce disk usage")
+	assert.Equal(t, uint64(1), after.Compactions, "compaction is not counted")
+	assert.Greater(t, after.CompactedBytes, uint64(0), "compacted bytes are not counted")
+}
+
+func TestRunCompactor(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+
+	// Test whether the compactor runs until the context is
+	// canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- str.RunCompactor(ctx, time.Millisecond) }()
+	require.Eventually(t, func() bool {
+		stats, err := str.Stats(StatsOptions{})
+		return err == nil && stats.Compactions > 0
+	}, time.Second, time.Millisecond, "compactor did not run")
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled, "compactor did not stop")
+}
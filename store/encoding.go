@@ -0,0 +1,75 @@
+package store
+
+import (
+	"encoding/base32"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidBucketID is returned when decoding a string
+	// that is not an encoded BucketID.
+	ErrInvalidBucketID = errors.New("store: invalid bucket id")
+
+	// ErrInvalidBucketKey is returned when decoding a string
+	// that is not an encoded BucketKey.
+	ErrInvalidBucketKey = errors.New("store: invalid bucket key")
+)
+
+// textEncoding is the encoding of ids and keys in text. It
+// uses the standard base32 alphabet without padding, which
+// is URL-safe.
+var textEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EncodeBucketID returns the id as a URL-safe string.
+func EncodeBucketID(id BucketID) string {
+	return textEncoding.EncodeToString(id[:])
+}
+
+// DecodeBucketID returns the id encoded by EncodeBucketID.
+// An error wrapping ErrInvalidBucketID is returned when the
+// string is malformed or has an incorrect length.
+func DecodeBucketID(s string) (BucketID, error) {
+	var id [BucketIDLength]byte
+	if err := decodeText(s, id[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBucketID, err)
+	}
+	return &id, nil
+}
+
+// EncodeBucketKey returns the key as a URL-safe string.
+func EncodeBucketKey(key BucketKey) string {
+	return textEncoding.EncodeToString(key[:])
+}
+
+// DecodeBucketKey returns the key encoded by
+// EncodeBucketKey. An error wrapping ErrInvalidBucketKey is
+// returned when the string is malformed or has an incorrect
+// length.
+func DecodeBucketKey(s string) (BucketKey, error) {
+	var key [BucketKeyLength]byte
+	if err := decodeText(s, key[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBucketKey, err)
+	}
+	return &key, nil
+}
+
+// decodeText decodes s into dst, s must decode to exactly
+// len(dst) bytes. Strings that are not the canonical
+// encoding, such as strings with newlines or unused bits
+// set, are rejected.
+func decodeText(s string, dst []byte) error {
+	if expected := textEncoding.EncodedLen(len(dst)); len(s) != expected {
+		return fmt.Errorf("expected %d characters, got %d", expected, len(s))
+	}
+
+	buf := make([]byte, textEncoding.DecodedLen(len(s)))
+	n, err := textEncoding.Decode(buf, []byte(s))
+	if err != nil {
+		return err
+	} else if n != len(dst) || textEncoding.EncodeToString(buf[:n]) != s {
+		return errors.New("not a canonical encoding")
+	}
+	copy(dst, buf)
+	return nil
+}
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeBucketID(t *testing.T) {
+	encoded := EncodeBucketID(TestBktID)
+	assert.Len(t, encoded, 26, "encoded id has incorrect length")
+
+	// Test whether the id survives a round trip.
+	id, err := DecodeBucketID(encoded)
+	require.NoError(t, err, "error occurred while decoding id")
+	assert.Equal(t, *TestBktID, *id, "decoded id is incorrect")
+
+	// Test whether invalid ids are rejected.
+	for _, s := range []string{"", encoded[:25], encoded + "A", encoded[:25] + "!", encoded[:25] + "\n", encoded[:25] + "B"} {
+		_, err := DecodeBucketID(s)
+		assert.ErrorIs(t, err, ErrInvalidBucketID, "invalid id %q is accepted", s)
+	}
+}
+
+func TestEncodeBucketKey(t *testing.T) {
+	encoded := EncodeBucketKey(TestBktKey)
+	assert.Len(t, encoded, 52, "encoded key has incorrect length")
+
+	// Test whether the key survives a round trip.
+	key, err := DecodeBucketKey(encoded)
+	require.NoError(t, err, "error occurred while decoding key")
+	assert.Equal(t, *TestBktKey, *key, "decoded key is incorrect")
+
+	// Test whether invalid keys are rejected.
+	for _, s := range []string{"", encoded[:51], encoded + "A", EncodeBucketID(TestBktID), strings.ToLower(encoded)} {
+		_, err := DecodeBucketKey(s)
+		assert.ErrorIs(t, err, ErrInvalidBucketKey, "invalid key %q is accepted", s)
+	}
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// evictCandidate is a bucket that can be evicted.
+type evictCandidate struct {
+	id        [BucketIDLength]byte
+	timestamp uint32 // Last access time of the bucket.
+}
+
+// Evict deletes the least recently accessed buckets until
+// the estimated disk usage of the store is below MaxBytes.
+//
+// Buckets with an infinite lifetime are only evicted when
+// EvictPermanent is set. The disk usage is estimated using
+// flushed data only, and the usage of each evicted bucket
+// is subtracted from the estimate because deleted data is
+// only reclaimed after compaction. Returns the ids of the
+// evicted buckets. Evict is a maintenance job, see
+// runMaintenance, and also runs during GC.
+func (str *pebbleStore) Evict(ctx context.Context) ([]BucketID, error) {
+	done, err := str.beginWrite()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	var evicted []BucketID
+	err = str.runMaintenance(ctx, func() (err error) {
+		evicted, err = str.evict(ctx)
+		return err
+	})
+	return evicted, err
+}
+
+// evict deletes buckets until the store is below MaxBytes,
+// see Evict.
+func (str *pebbleStore) evict(ctx context.Context) ([]BucketID, error) {
+	if str.opts.MaxBytes == 0 {
+		return nil, nil
+	}
+	usage, err := str.db.EstimateDiskUsage(str.getTableKey(bucketTable, 0), str.getTableKey(requestTable+1, 0))
+	if err != nil || usage <= str.opts.MaxBytes {
+		return nil, err
+	}
+
+	candidates, err := str.evictCandidates()
+	if err != nil {
+		return nil, err
+	}
+
+	var evicted []BucketID
+	for i := 0; i < len(candidates) && usage > str.opts.MaxBytes; i++ {
+		if err := ctx.Err(); err != nil {
+			return evicted, err
+		}
+
+		id := BucketID(&candidates[i].id)
+		lower, upper := str.getPebbleValueKeyRange(id)
+		size, err := str.db.EstimateDiskUsage(lower, upper)
+		if err != nil {
+			return evicted, err
+		}
+		if err := str.evictBucket(id); err != nil {
+			return evicted, err
+		}
+
+		evicted = append(evicted, id)
+		if size < usage {
+			usage -= size
+		} else {
+			usage = 0
+		}
+	}
+	return evicted, nil
+}
+
+// evictCandidates returns the buckets that can be evicted,
+// ordered by their last access time. Buckets of an unknown
+// layout are skipped.
+func (str *pebbleStore) evictCandidates() ([]evictCandidate, error) {
+	iter := str.db.NewIter(&pebble.IterOptions{
+		LowerBound: str.getTableKey(bucketTable, 0),
+		UpperBound: str.getTableKey(bucketTable+1, 0),
+	})
+
+	var candidates []evictCandidate
+	for iter.First(); iter.Valid(); iter.Next() {
+		var candidate evictCandidate
+		copy(candidate.id[:], str.getKeyID(iter.Key()))
+		if _, _, err := migrateBucketData(iter.Value()); err != nil {
+			continue
+		} else if GetBucketLifetime(&candidate.id) == 0 && !str.opts.EvictPermanent {
+			continue
+		}
+		candidate.timestamp = binary.BigEndian.Uint32(iter.Value())
+		candidates = append(candidates, candidate)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].timestamp < candidates[j].timestamp
+	})
+	return candidates, iter.Close()
+}
+
+// evictBucket deletes a bucket and all its values.
+func (str *pebbleStore) evictBucket(id BucketID) error {
+	lock := str.getBucketLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	batch := str.db.NewBatch()
+	defer batch.Close()
+	if err := str.deleteBucket(batch, id); err != nil {
+		return err
+	}
+	if err := str.db.Apply(batch, nil); err != nil {
+		return err
+	}
+	str.forgetBucket(id)
+	return nil
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvict(t *testing.T) {
+	now := time.Now()
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: vfs.NewMem()},
+		CacheTTL:   24,
+		Clock:      func() time.Time { return now },
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+	pebbleStr := str.(*pebbleStore)
+
+	// Create buckets with an increasing access time, the
+	// last bucket has an infinite lifetime.
+	value := make([]byte, 1024)
+	var ids []BucketID
+	for i := byte(1); i <= 4; i++ {
+		id := BucketID(&[BucketIDLength]byte{i, 14: 1, 15: 7})
+		if i == 4 {
+			id[14] = 0
+		}
+		bkt, err := str.CreateBucket(id, TestBktKey)
+		require.NoError(t, err, "error occurred while creating bucket")
+		values := make([]BucketValue, 64)
+		for j := range values {
+			values[j].Value = value
+		}
+		require.NoError(t, bkt.AppendValues(values), "error occurred while appending values")
+		ids = append(ids, id)
+		now = now.Add(2 * time.Hour)
+	}
+	require.NoError(t, pebbleStr.db.Flush(), "error occurred while flushing store")
+
+	// Test whether nothing is evicted when eviction is
+	// disabled.
+	evicted, err := str.Evict(context.Background())
+	require.NoError(t, err, "error occurred while evicting buckets")
+	assert.Empty(t, evicted, "buckets are evicted without MaxBytes")
+
+	// Test whether the coldest bucket is evicted first when
+	// the store exceeds the budget.
+	usage, err := pebbleStr.db.EstimateDiskUsage([]byte{bucketTable}, []byte{requestTable + 1})
+	require.NoError(t, err, "error occurred while estimating disk usage")
+	pebbleStr.opts.MaxBytes = usage - usage/8
+	evicted, err = str.Evict(context.Background())
+	require.NoError(t, err, "error occurred while evicting buckets")
+	assert.Equal(t, []BucketID{ids[0]}, evicted, "coldest bucket is not evicted")
+	_, err = str.GetBucket(ids[0])
+	assert.ErrorIs(t, err, ErrBucketNotFound, "evicted bucket is not deleted")
+
+	// Test whether buckets with an infinite lifetime are
+	// only evicted when allowed.
+	pebbleStr.opts.MaxBytes = 1
+	evicted, err = str.Evict(context.Background())
+	require.NoError(t, err, "error occurred while evicting buckets")
+	assert.Equal(t, []BucketID{ids[1], ids[2]}, evicted, "buckets are not evicted from cold to hot")
+
+	pebbleStr.opts.EvictPermanent = true
+	evicted, err = str.Evict(context.Background())
+	require.NoError(t, err, "error occurred while evicting buckets")
+	assert.Equal(t, []BucketID{ids[3]}, evicted, "permanent bucket is not evicted")
+}
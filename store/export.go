@@ -0,0 +1,271 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/cockroachdb/pebble"
+)
+
+var (
+	// ErrStoreNotEmpty is returned when importing into a
+	// store that already contains buckets or values.
+	ErrStoreNotEmpty = errors.New("store: store is not empty")
+
+	// ErrInvalidExport is returned when importing data that
+	// is not a valid export.
+	ErrInvalidExport = errors.New("store: invalid export")
+)
+
+// An export starts with exportMagic and exportVersion,
+// followed by a list of records. Each record starts with a
+// tag:
+//   - exportBucket: BucketId (16 bytes), data length (4 bytes), bucket data
+//   - exportValue: BucketId (16 bytes), idx (2 bytes), value length (4 bytes), stored value
+//   - exportEnd: marks the end of the export
+//
+// Values are exported as they are stored, including their
+// value header.
+const (
+	exportMagic   = "PTPD"
+	exportVersion = 1
+
+	exportEnd    byte = 0
+	exportBucket byte = 1
+	exportValue  byte = 2
+
+	// exportBatchSize is the size in bytes after which an
+	// import batch is applied.
+	exportBatchSize = 4 << 20
+)
+
+// Export writes all buckets and values of the store to w.
+//
+// The export reads from a snapshot, so it is consistent and
+// does not block writers while it is written. The context
+// is checked while exporting so a long running export can
+// be canceled. See Import for restoring an export.
+func (str *pebbleStore) Export(ctx context.Context, w io.Writer) error {
+	done, err := str.beginOp()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	snap := str.db.NewSnapshot()
+	defer snap.Close()
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(exportMagic); err != nil {
+		return err
+	} else if err := bw.WriteByte(exportVersion); err != nil {
+		return err
+	}
+
+	iter := snap.NewIter(&pebble.IterOptions{
+		LowerBound: str.getTableKey(bucketTable, 0),
+		UpperBound: str.getTableKey(valueTable+1, 0),
+	})
+
+	header := make([]byte, 1+BucketIDLength+2+4)
+	records := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		if records%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				_ = iter.Close()
+				return err
+			}
+		}
+		records++
+
+		// The key of a record is the pebble key without the
+		// namespace and table byte, so a value key includes
+		// the idx. Exports can be imported in any namespace.
+		key, value := iter.Key()[len(str.prefix):], iter.Value()
+		record := header[:len(key)+4]
+		if key[0] == bucketTable {
+			record[0] = exportBucket
+		} else {
+			record[0] = exportValue
+		}
+		copy(record[1:], key[1:])
+		binary.BigEndian.PutUint32(record[len(key):], uint32(len(value)))
+
+		if _, err := bw.Write(record); err != nil {
+			_ = iter.Close()
+			return err
+		} else if _, err := bw.Write(value); err != nil {
+			_ = iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	if err := bw.WriteByte(exportEnd); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ForEachValue calls fn for each value in the store.
+//
+// The values are read from a snapshot in key order, so the
+// values of a bucket are visited together in ascending idx
+// order. The id and value passed to fn are copies that can
+// be retained. Iteration stops at the first error returned
+// by fn, which is returned. Expired values are skipped and
+// the timestamps of the buckets are not refreshed.
+func (str *pebbleStore) ForEachValue(fn func(id BucketID, val BucketValue) error) error {
+	done, err := str.beginOp()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	snap := str.db.NewSnapshot()
+	defer snap.Close()
+	iter := snap.NewIter(&pebble.IterOptions{
+		LowerBound: str.getTableKey(valueTable, 0),
+		UpperBound: str.getTableKey(valueTable+1, 0),
+	})
+
+	now := str.getCurrentTimestamp()
+	for iter.First(); iter.Valid(); iter.Next() {
+		idx := getKeyIdx(iter.Key())
+		value, expires, err := str.decodeValue(idx, iter.Value())
+		if err != nil {
+			_ = iter.Close()
+			return err
+		} else if isExpired(expires, now) {
+			continue
+		}
+
+		id := BucketID(new([BucketIDLength]byte))
+		copy(id[:], str.getKeyID(iter.Key()))
+		val := BucketValue{Idx: idx, Value: append([]byte(nil), value...), Expires: expires}
+		if err := fn(id, val); err != nil {
+			_ = iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// Import restores an export created by Export.
+//
+// The store must be empty, otherwise ErrStoreNotEmpty is
+// returned. Records are written in batches, so when the
+// export is invalid or truncated ErrInvalidExport is
+// returned and the store can contain part of the export.
+// The sequence counter of the store is raised to the
+// highest sequence number of the imported values, see
+// StoreOptions.Sequences.
+func (str *pebbleStore) Import(r io.Reader) error {
+	done, err := str.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	iter := str.db.NewIter(&pebble.IterOptions{
+		LowerBound: str.getTableKey(bucketTable, 0),
+		UpperBound: str.getTableKey(valueTable+1, 0),
+	})
+	empty := !iter.First()
+	if err := iter.Close(); err != nil {
+		return err
+	} else if !empty {
+		return ErrStoreNotEmpty
+	}
+
+	br := bufio.NewReader(r)
+	header := make([]byte, len(exportMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return ErrInvalidExport
+	} else if string(header[:len(exportMagic)]) != exportMagic || header[len(exportMagic)] != exportVersion {
+		return ErrInvalidExport
+	}
+
+	batch := str.db.NewBatch()
+	defer func() { _ = batch.Close() }()
+	record := make([]byte, BucketIDLength+2+4)
+	ids := make(map[[BucketIDLength]byte]bool)
+	var seq uint64
+	for {
+		tag, err := br.ReadByte()
+		if err != nil {
+			return ErrInvalidExport
+		}
+
+		var key []byte
+		switch tag {
+		case exportEnd:
+			if err := str.applyImportBatch(batch, ids); err != nil {
+				return err
+			}
+			return str.raiseSequence(seq)
+		case exportBucket:
+			key = record[:BucketIDLength]
+		case exportValue:
+			key = record[:BucketIDLength+2]
+		default:
+			return ErrInvalidExport
+		}
+
+		if _, err := io.ReadFull(br, record[:len(key)+4]); err != nil {
+			return ErrInvalidExport
+		}
+		if tag == exportValue && getKeyIdx(key) == 0 {
+			return ErrInvalidExport
+		}
+		value := make([]byte, binary.BigEndian.Uint32(record[len(key):]))
+		if _, err := io.ReadFull(br, value); err != nil {
+			return ErrInvalidExport
+		}
+		if tag == exportValue {
+			if _, _, valueSeq, err := str.decodeValueSequence(getKeyIdx(key), value); err == nil && valueSeq > seq {
+				seq = valueSeq
+			}
+		}
+
+		table := byte(bucketTable)
+		if tag == exportValue {
+			table = valueTable
+		}
+		if err := batch.Set(append(str.getTableKey(table, len(key)), key...), value, nil); err != nil {
+			return err
+		}
+		var id [BucketIDLength]byte
+		copy(id[:], key)
+		ids[id] = true
+
+		// Apply the batch when it is full.
+		if batch.Len() >= exportBatchSize {
+			if err := str.applyImportBatch(batch, ids); err != nil {
+				return err
+			}
+			_ = batch.Close()
+			batch = str.db.NewBatch()
+		}
+	}
+}
+
+// applyImportBatch applies an import batch, and forgets the
+// imported buckets so cached values and handles are not
+// served after the import.
+func (str *pebbleStore) applyImportBatch(batch *pebble.Batch, ids map[[BucketIDLength]byte]bool) error {
+	if err := str.db.Apply(batch, nil); err != nil {
+		return err
+	}
+	for id := range ids {
+		id := id
+		str.forgetBucket(&id)
+		delete(ids, id)
+	}
+	return nil
+}
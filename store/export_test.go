@@ -0,0 +1,127 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt2, err := str.CreateBucket(TestBktID2, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt2.PutValues([]BucketValue{{Value: []byte("1")}, {Idx: 500, Value: []byte("500")}}))
+
+	var buf bytes.Buffer
+	assert.NoError(t, str.Export(context.Background(), &buf), "error occurred while exporting store")
+
+	// Import the export into a new store and test whether
+	// the buckets and values are equal.
+	imported := SetupTestStore(t, false)
+	defer imported.Close()
+	assert.NoError(t, imported.Import(bytes.NewReader(buf.Bytes())), "error occurred while importing store")
+
+	for _, id := range []BucketID{TestBktID, TestBktID2} {
+		expected, err := str.GetBucket(id)
+		require.NoError(t, err, "error occurred while fetching bucket")
+		bkt, err := imported.GetBucket(id)
+		require.NoError(t, err, "imported bucket is not found")
+		assert.Equal(t, expected.GetBucketKey(), bkt.GetBucketKey(), "imported bucket has an incorrect key")
+
+		expectedValues, err := expected.GetValues(BucketRange{Start: 0, End: 1000})
+		require.NoError(t, err, "error occurred while fetching bucket values")
+		values, err := bkt.GetValues(BucketRange{Start: 0, End: 1000})
+		assert.NoError(t, err, "error occurred while fetching imported values")
+		assert.Equal(t, expectedValues, values, "imported values are not equal")
+	}
+
+	// Test whether importing into a non-empty store and
+	// importing invalid data fails.
+	assert.Equal(t, ErrStoreNotEmpty, imported.Import(bytes.NewReader(buf.Bytes())), "import into non-empty store succeeded")
+	empty := SetupTestStore(t, false)
+	defer empty.Close()
+	assert.Equal(t, ErrInvalidExport, empty.Import(bytes.NewReader(buf.Bytes()[:buf.Len()-1])), "truncated export is imported")
+	assert.Equal(t, ErrInvalidExport, empty.Import(bytes.NewReader([]byte("invalid"))), "invalid export is imported")
+}
+
+func TestImportInvalidatesCache(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	var buf bytes.Buffer
+	require.NoError(t, str.Export(context.Background(), &buf), "error occurred while exporting store")
+
+	// Cache an empty read of the bucket, and test whether
+	// the imported values are read after the import.
+	imported := setupValueCacheStore(t, 1<<20)
+	defer imported.Close()
+	bkt, err := imported.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	_, err = bkt.GetValues(BucketRange{Start: 0, End: 4})
+	require.NoError(t, err, "error occurred while fetching values")
+	require.NoError(t, imported.(*pebbleStore).db.DeleteRange([]byte{0}, []byte{0xff, 0xff}, nil))
+
+	require.NoError(t, imported.Import(bytes.NewReader(buf.Bytes())), "error occurred while importing store")
+	bkt, err = imported.GetBucket(TestBktID)
+	require.NoError(t, err, "imported bucket is not found")
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 4})
+	assert.NoError(t, err, "error occurred while fetching imported values")
+	assert.Equal(t, ExpectedBktValues[:3], values, "import did not invalidate cached values")
+}
+
+func TestExportCanceled(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var buf bytes.Buffer
+	assert.Equal(t, context.Canceled, str.Export(ctx, &buf), "canceled export did not return the context error")
+}
+
+func TestImportIdxZero(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+
+	// Test whether a value at the reserved idx 0 is rejected.
+	export := append([]byte(exportMagic), exportVersion, exportValue)
+	export = append(export, TestBktID[:]...)
+	export = append(export, 0, 0, 0, 0, 0, 1, 'x', exportEnd)
+	assert.Equal(t, ErrInvalidExport, str.Import(bytes.NewReader(export)), "value at idx 0 is imported")
+}
+
+func TestForEachValue(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt2, err := str.CreateBucket(TestBktID2, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt2.PutValues([]BucketValue{{Value: []byte("1")}, {Idx: 500, Value: []byte("500")}}))
+
+	// Test whether every value is visited exactly once,
+	// grouped by bucket.
+	visited := make(map[[BucketIDLength]byte][]BucketValue)
+	var order []BucketID
+	require.NoError(t, str.ForEachValue(func(id BucketID, val BucketValue) error {
+		if len(order) == 0 || *order[len(order)-1] != *id {
+			order = append(order, id)
+		}
+		visited[*id] = append(visited[*id], val)
+		return nil
+	}), "error occurred while iterating values")
+	assert.Len(t, order, 2, "values are not grouped by bucket")
+	assert.Equal(t, ExpectedBktValues, visited[*TestBktID], "values of first bucket are visited incorrectly")
+	assert.Equal(t, []BucketValue{{Idx: 1, Value: []byte("1")}, {Idx: 500, Value: []byte("500")}}, visited[*TestBktID2], "values of second bucket are visited incorrectly")
+
+	// Test whether an error of fn stops the iteration.
+	calls := 0
+	errStop := errors.New("stop")
+	assert.Equal(t, errStop, str.ForEachValue(func(BucketID, BucketValue) error {
+		calls++
+		return errStop
+	}), "error of fn is not returned")
+	assert.Equal(t, 1, calls, "iteration continued after fn returned an error")
+}
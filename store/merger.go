@@ -0,0 +1,74 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// CounterLength is the length of a counter value.
+const CounterLength = 8
+
+// ErrInvalidCounter is returned when a counter is merged
+// with a value that is not a valid counter.
+var ErrInvalidCounter = errors.New("store: value is not a valid counter")
+
+// CounterMerger is a pebble merger that adds counter values.
+//
+// Counters are stored as big-endian int64 values, merging
+// two counters results in the sum of both values. The
+// merger is required by Bucket.IncrementValue and must be
+// configured using the PebbleOpts of the store. Pebble
+// stores the name of the merger on disk, so an existing
+// store created without this merger can't be opened with
+// it (and the other way around).
+var CounterMerger = &pebble.Merger{
+	Name: "ptpd.counter",
+	Merge: func(key, value []byte) (pebble.ValueMerger, error) {
+		m := &counterMerger{}
+		return m, m.MergeNewer(value)
+	},
+}
+
+// counterMerger implements the pebble.ValueMerger interface.
+type counterMerger struct {
+	sum int64
+}
+
+// MergeNewer adds a newer counter value.
+func (m *counterMerger) MergeNewer(value []byte) error {
+	if len(value) != CounterLength {
+		return ErrInvalidCounter
+	}
+	m.sum += int64(binary.BigEndian.Uint64(value))
+	return nil
+}
+
+// MergeOlder adds an older counter value, the order of
+// additions does not matter.
+func (m *counterMerger) MergeOlder(value []byte) error {
+	return m.MergeNewer(value)
+}
+
+// Finish returns the sum of all merged counter values.
+func (m *counterMerger) Finish(includesBase bool) ([]byte, io.Closer, error) {
+	return encodeCounter(m.sum), nil, nil
+}
+
+// encodeCounter encodes the given counter value.
+func encodeCounter(v int64) []byte {
+	value := make([]byte, CounterLength)
+	binary.BigEndian.PutUint64(value, uint64(v))
+	return value
+}
+
+// DecodeCounter decodes a counter value returned by
+// Bucket.GetValues.
+func DecodeCounter(value []byte) (int64, error) {
+	if len(value) != CounterLength {
+		return 0, ErrInvalidCounter
+	}
+	return int64(binary.BigEndian.Uint64(value)), nil
+}
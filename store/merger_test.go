@@ -0,0 +1,22 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterMerger(t *testing.T) {
+	m, err := CounterMerger.Merge(nil, encodeCounter(5))
+	require.NoError(t, err, "error occurred while creating counter merger")
+	assert.NoError(t, m.MergeNewer(encodeCounter(10)), "error occurred while merging newer counter")
+	assert.NoError(t, m.MergeOlder(encodeCounter(-3)), "error occurred while merging older counter")
+	assert.Equal(t, ErrInvalidCounter, m.MergeNewer([]byte("test")), "invalid counter is merged without error")
+
+	value, _, err := m.Finish(true)
+	assert.NoError(t, err, "error occurred while finishing merge")
+	counter, err := DecodeCounter(value)
+	assert.NoError(t, err, "error occurred while decoding counter")
+	assert.Equal(t, int64(12), counter, "merged counter has incorrect value")
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+// Operation names passed to MetricsCollector.ObserveOp.
+const (
+	OpGet          = "get"
+	OpPut          = "put"
+	OpAppend       = "append"
+	OpDelete       = "delete"
+	OpReplaceRange = "replace_range"
+	OpCompact      = "compact"
+	OpMerge        = "merge"
+	OpCreateBucket = "create_bucket"
+	OpDeleteBucket = "delete_bucket"
+	OpGC           = "gc"
+)
+
+// MetricsCollector receives metrics of the store, see
+// StoreOptions.Metrics. Implementations must be safe for
+// concurrent use.
+//
+// The collector maps well onto Prometheus: ObserveOp to a
+// histogram and a counter labeled by op and ErrorClass(err),
+// and ObserveGC to a counter and a gauge.
+type MetricsCollector interface {
+	// ObserveOp is called after each operation with its
+	// duration and the returned error.
+	ObserveOp(op string, dur time.Duration, err error)
+
+	// ObserveGC is called after GC with the amount of
+	// deleted expired buckets and the remaining buckets.
+	ObserveGC(reclaimed, buckets int)
+}
+
+// MetricsFuncs adapts functions to a MetricsCollector, nil
+// functions are ignored. For example, with Prometheus:
+//
+//	MetricsFuncs{
+//		Op: func(op string, dur time.Duration, err error) {
+//			latency.WithLabelValues(op, store.ErrorClass(err)).Observe(dur.Seconds())
+//		},
+//		GC: func(reclaimed, buckets int) {
+//			reclaimedTotal.Add(float64(reclaimed))
+//			bucketCount.Set(float64(buckets))
+//		},
+//	}
+type MetricsFuncs struct {
+	Op func(op string, dur time.Duration, err error)
+	GC func(reclaimed, buckets int)
+}
+
+// ObserveOp calls Op.
+func (funcs MetricsFuncs) ObserveOp(op string, dur time.Duration, err error) {
+	if funcs.Op != nil {
+		funcs.Op(op, dur, err)
+	}
+}
+
+// ObserveGC calls GC.
+func (funcs MetricsFuncs) ObserveGC(reclaimed, buckets int) {
+	if funcs.GC != nil {
+		funcs.GC(reclaimed, buckets)
+	}
+}
+
+// errorClasses are the classes returned by ErrorClass.
+var errorClasses = []struct {
+	err   error
+	class string
+}{
+	{ErrBucketNotFound, "bucket_not_found"},
+	{ErrInvalidBucketData, "invalid_bucket_data"},
+	{ErrBucketAlreadyExists, "bucket_already_exists"},
+	{ErrBucketIsFull, "bucket_full"},
+	{ErrInvalidAppend, "invalid_append"},
+	{ErrAppendOnly, "append_only"},
+	{ErrInvalidRange, "invalid_range"},
+	{ErrValueTooLarge, "value_too_large"},
+	{ErrBatchTooLarge, "batch_too_large"},
+	{ErrEmptyValue, "empty_value"},
+	{ErrValueExists, "value_exists"},
+	{ErrQuotaExceeded, "quota_exceeded"},
+	{ErrRateLimited, "rate_limited"},
+	{ErrBucketBusy, "bucket_busy"},
+	{ErrChecksumMismatch, "checksum_mismatch"},
+	{ErrReadOnly, "read_only"},
+	{ErrUnauthorized, "unauthorized"},
+	{ErrPermissionDenied, "permission_denied"},
+}
+
+// ErrorClass returns a short name for the error, usable as
+// metrics label. Returns "" for nil and "other" for errors
+// without a class.
+func ErrorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, class := range errorClasses {
+		if errors.Is(err, class.err) {
+			return class.class
+		}
+	}
+	return "other"
+}
+
+// noopTrack is returned by track when no collector is set.
+func noopTrack(*error) {}
+
+// track starts measuring an operation. The returned
+// function reports the operation with the error it points
+// to, use it as:
+//
+//	defer str.track(OpGet)(&err)
+//
+// Without a collector, track does not read the clock or
+// allocate.
+func (str *pebbleStore) track(op string) func(err *error) {
+	metrics := str.opts.Metrics
+	if metrics == nil {
+		return noopTrack
+	}
+
+	start := time.Now()
+	return func(err *error) {
+		metrics.ObserveOp(op, time.Since(start), *err)
+	}
+}
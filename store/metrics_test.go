@@ -0,0 +1,123 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCollector records the observed operations.
+type fakeCollector struct {
+	mtx sync.Mutex
+	ops []string // Observed operations as op:class.
+	gc  [][2]int // Observed GC runs.
+}
+
+// ObserveOp implements MetricsCollector.
+func (c *fakeCollector) ObserveOp(op string, dur time.Duration, err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.ops = append(c.ops, op+":"+ErrorClass(err))
+}
+
+// ObserveGC implements MetricsCollector.
+func (c *fakeCollector) ObserveGC(reclaimed, buckets int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.gc = append(c.gc, [2]int{reclaimed, buckets})
+}
+
+func TestMetrics(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	collector := &fakeCollector{}
+	str.(*pebbleStore).opts.Metrics = collector
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test whether operations and errors are observed.
+	_, _ = bkt.GetValues(BucketRange{Start: 0, End: 500})
+	_, _, _ = bkt.GetValue(1)
+	_ = bkt.AppendValues([]BucketValue{{Value: []byte("11")}})
+	_ = bkt.AppendValues([]BucketValue{{Idx: 5, Value: []byte("5")}})
+	_ = bkt.PutValues([]BucketValue{{Idx: 1}})
+	_ = bkt.DeleteValues(BucketRange{Start: 1, End: 2})
+	_, _ = str.CreateBucket(TestBktID, TestBktKey)
+	_, _ = str.CreateBucket(TestBktID2, TestBktKey)
+	require.NoError(t, str.GC(context.Background()), "error occurred while running GC")
+
+	assert.Equal(t, []string{
+		"get:",
+		"get:",
+		"append:",
+		"append:invalid_append",
+		"put:empty_value",
+		"delete:",
+		"create_bucket:bucket_already_exists",
+		"create_bucket:",
+		"gc:",
+	}, collector.ops, "incorrect observed operations")
+	assert.Equal(t, [][2]int{{0, 2}}, collector.gc, "incorrect observed GC")
+}
+
+func TestMetricsAllOps(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	collector := &fakeCollector{}
+	str.(*pebbleStore).opts.Metrics = collector
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test whether every operation is observed, errors of
+	// the operations are not relevant.
+	rng := BucketRange{Start: 0, End: 5}
+	keep := func(uint16, []byte) bool { return true }
+	_, _ = bkt.GetValuesFiltered(rng, keep)
+	_, _ = bkt.GetValuesMap(rng)
+	_ = bkt.GetValuesNoCopy(rng, keep)
+	_, _ = bkt.GetValuesByIndices([]uint16{1})
+	_, _ = bkt.OccupiedIndices(rng)
+	_, _, _ = bkt.FirstValue()
+	_, _, _ = bkt.LastValue()
+	_ = bkt.Free([]uint16{1})
+	_, _ = bkt.DeleteValuesCount(BucketRange{Start: 2, End: 3})
+	_ = bkt.ReplaceRange(BucketRange{Start: 3, End: 4}, []BucketValue{{Idx: 3, Value: []byte("3")}})
+	_, _ = bkt.Compact()
+	_ = bkt.MergeValue(1, []byte("1"))
+	_, _ = bkt.CompareAndSwapValue(1, nil, []byte("1"))
+	_, _ = bkt.AppendValuesIdempotent([RequestIDLength]byte{1}, []BucketValue{{Value: []byte("1")}})
+
+	var ops []string
+	for _, op := range collector.ops {
+		ops = append(ops, strings.SplitN(op, ":", 2)[0])
+	}
+	assert.Equal(t, []string{
+		OpGet, OpGet, OpGet, OpGet, OpGet, OpGet, OpGet,
+		OpDelete, OpDelete, OpReplaceRange, OpCompact, OpMerge, OpPut, OpAppend,
+	}, ops, "incorrect observed operations")
+}
+
+func TestErrorClass(t *testing.T) {
+	assert.Equal(t, "", ErrorClass(nil), "nil error has a class")
+	assert.Equal(t, "bucket_full", ErrorClass(ErrBucketIsFull), "incorrect class")
+	assert.Equal(t, "checksum_mismatch", ErrorClass(&ChecksumError{Idx: 1}), "wrapped error has incorrect class")
+	assert.Equal(t, "other", ErrorClass(errors.New("test")), "unknown error has incorrect class")
+}
+
+func TestTrackWithoutCollector(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+
+	// Test whether tracking is free without a collector.
+	var err error
+	allocs := testing.AllocsPerRun(100, func() {
+		str.(*pebbleStore).track(OpGet)(&err)
+	})
+	assert.Zero(t, allocs, "tracking without a collector allocates")
+}
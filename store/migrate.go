@@ -0,0 +1,132 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// The bucket data stored in the bucket table has the layout:
+//   - access timestamp (4 bytes)
+//   - bucket key (BucketKeyLength bytes)
+//   - creation timestamp (4 bytes)
+//   - flags (1 byte, see bucketFlagAppendOnly)
+//   - layout version (1 byte, bucketDataVersion)
+//
+// Older stores wrote bucket data without a version, which
+// ends after the key, the creation timestamp or the flags.
+// Those layouts are recognized by their length and upgraded
+// by migrateBucketData. Later versions keep the version at
+// the same offset and add their fields after it.
+const (
+	bucketDataVersion       byte = 1
+	bucketDataVersionOffset      = 9 + BucketKeyLength
+	bucketDataLength             = bucketDataVersionOffset + 1
+)
+
+// migrateBatchSize is the maximum amount of buckets
+// migrated in a single batch by Migrate.
+const migrateBatchSize = 256
+
+// newBucketData returns the bucket data of a new bucket in
+// the current layout.
+func newBucketData() []byte {
+	data := make([]byte, bucketDataLength)
+	data[bucketDataVersionOffset] = bucketDataVersion
+	return data
+}
+
+// migrateBucketData returns the bucket data in the current
+// layout, and whether it is changed. Missing creation times
+// are left at 0 (unknown) and missing flags are cleared.
+// An error wrapping ErrInvalidBucketData is returned for
+// data of an unknown layout or a newer version.
+func migrateBucketData(data []byte) ([]byte, bool, error) {
+	if len(data) < 4+BucketKeyLength {
+		return nil, false, ErrInvalidBucketData
+	}
+
+	switch len(data) {
+	case 4 + BucketKeyLength, 8 + BucketKeyLength, 9 + BucketKeyLength:
+		migrated := newBucketData()
+		copy(migrated, data)
+		return migrated, true, nil
+	}
+
+	if len(data) < bucketDataLength {
+		return nil, false, fmt.Errorf("%w: unknown layout of %d bytes", ErrInvalidBucketData, len(data))
+	} else if version := data[bucketDataVersionOffset]; version != bucketDataVersion {
+		return nil, false, fmt.Errorf("%w: unsupported layout version %d", ErrInvalidBucketData, version)
+	}
+	return data, false, nil
+}
+
+// Migrate upgrades the bucket data of all buckets to the
+// current layout, and returns the amount of upgraded
+// buckets.
+//
+// Buckets are also upgraded in memory when they are
+// loaded, and written in the current layout with the next
+// access timestamp. Migrate upgrades the buckets that are
+// not accessed, so older layouts can be dropped. Buckets
+// are upgraded in batches of migrateBatchSize, the context
+// is checked between the batches. Buckets of an unknown
+// layout are skipped, GetBucket returns an error for them.
+func (str *pebbleStore) Migrate(ctx context.Context) (migrated int, err error) {
+	done, err := str.beginWrite()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	iter := str.db.NewIter(&pebble.IterOptions{
+		LowerBound: str.getTableKey(bucketTable, 0),
+		UpperBound: str.getTableKey(bucketTable+1, 0),
+	})
+	defer func() {
+		if closeErr := iter.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	batch := str.db.NewBatch()
+	defer func() { _ = batch.Close() }()
+	for iter.First(); iter.Valid(); iter.Next() {
+		data, changed, err := migrateBucketData(iter.Value())
+		if err != nil || !changed {
+			continue
+		}
+
+		// Cached buckets are already upgraded in memory, and
+		// their data can contain a newer access timestamp.
+		id := new([BucketIDLength]byte)
+		copy(id[:], str.getKeyID(iter.Key()))
+		if cached, ok := str.cache.Load(*id); ok {
+			bkt := cached.(*pebbleBucket)
+			bkt.mtx.Lock()
+			data = append([]byte(nil), bkt.data...)
+			bkt.mtx.Unlock()
+		}
+		if err := batch.Set(str.getPebbleBucketKey(id), data, nil); err != nil {
+			return migrated, err
+		}
+
+		if batch.Count() >= migrateBatchSize {
+			if err := str.db.Apply(batch, nil); err != nil {
+				return migrated, err
+			}
+			migrated += int(batch.Count())
+			_ = batch.Close()
+			batch = str.db.NewBatch()
+			if err := ctx.Err(); err != nil {
+				return migrated, err
+			}
+		}
+	}
+
+	if err := str.db.Apply(batch, nil); err != nil {
+		return migrated, err
+	}
+	return migrated + int(batch.Count()), nil
+}
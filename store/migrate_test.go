@@ -0,0 +1,83 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *testing.T) {
+	db, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem()})
+	require.NoError(t, err, "could not open test db")
+	defer db.Close()
+
+	// Write buckets in the layouts without a version: only
+	// a key, with a creation time, and with flags. A bucket
+	// with a newer version can't be read.
+	withCreated := binary.BigEndian.AppendUint32(append([]byte(nil), TestBktData...), 100)
+	withFlags := append(binary.BigEndian.AppendUint32(append([]byte(nil), TestBktData...), 200), bucketFlagAppendOnly)
+	newer := newBucketData()
+	newer[bucketDataVersionOffset] = bucketDataVersion + 1
+	id3 := BucketID([]byte{3, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 255, 7})
+	id4 := BucketID([]byte{4, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 255, 7})
+	str := &pebbleStore{}
+	rows := map[BucketID][]byte{TestBktID: TestBktData, TestBktID2: withCreated, id3: withFlags, id4: newer}
+	for id, data := range rows {
+		require.NoError(t, db.Set(str.getPebbleBucketKey(id), data, nil), "could not add bucket")
+	}
+	for _, value := range ExpectedBktValues {
+		require.NoError(t, db.Set(str.getPebbleValueKey(TestBktID, value.Idx), value.Value, nil), "could not add value")
+	}
+
+	s, err := NewStore(db, nil)
+	require.NoError(t, err, "error occurred while creating store")
+	defer s.Close()
+
+	// Test whether a loaded bucket is upgraded in memory.
+	bkt, err := s.GetBucket(TestBktID2)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	assert.Len(t, bkt.(*pebbleBucket).data, bucketDataLength, "loaded bucket is not upgraded")
+	_, err = s.GetBucket(id4)
+	assert.ErrorIs(t, err, ErrInvalidBucketData, "bucket with a newer version is read")
+
+	// Test whether all buckets are upgraded on disk.
+	migrated, err := s.Migrate(context.Background())
+	assert.NoError(t, err, "error occurred while migrating store")
+	assert.Equal(t, 3, migrated, "incorrect amount of migrated buckets")
+	for id, data := range rows {
+		stored, closer, err := db.Get(str.getPebbleBucketKey(id))
+		require.NoError(t, err, "migrated bucket is not found")
+		if id == id4 {
+			assert.Equal(t, newer, stored, "bucket with a newer version is migrated")
+		} else {
+			assert.Len(t, stored, bucketDataLength, "bucket is not migrated")
+			assert.Equal(t, data, stored[:len(data)], "migration modified the existing fields")
+			assert.Equal(t, bucketDataVersion, stored[bucketDataVersionOffset], "migrated bucket has incorrect version")
+		}
+		require.NoError(t, closer.Close())
+	}
+	migrated, err = s.Migrate(context.Background())
+	assert.NoError(t, err, "error occurred while migrating store")
+	assert.Zero(t, migrated, "migrated buckets are migrated again")
+
+	// Test whether the metadata and values survived.
+	s.(*pebbleStore).forgetBucket(TestBktID2)
+	for id, created := range map[BucketID]uint32{TestBktID: 0, TestBktID2: 100, id3: 200} {
+		bkt, err := s.GetBucket(id)
+		require.NoError(t, err, "error occurred while fetching migrated bucket")
+		assert.Equal(t, created, getCreationTimestamp(bkt.(*pebbleBucket)), "migrated bucket has incorrect creation time")
+		assert.Equal(t, id == id3, bkt.IsAppendOnly(), "migrated bucket has incorrect flags")
+		assert.Equal(t, TestBktKey, bkt.GetBucketKey(), "migrated bucket has incorrect key")
+	}
+	bkt, err = s.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: math.MaxUint16})
+	assert.NoError(t, err, "error occurred while fetching values")
+	assert.Equal(t, ExpectedBktValues, values, "values are modified by the migration")
+}
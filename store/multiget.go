@@ -0,0 +1,114 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// multiGetWorkers is the maximum amount of buckets that
+// MultiGetValues reads concurrently.
+const multiGetWorkers = 8
+
+// MultiGetError is returned by MultiGetValues when one or
+// more buckets could not be read. The values of the other
+// buckets are still returned.
+type MultiGetError struct {
+	Errors map[BucketID]error // Error of each bucket that could not be read.
+}
+
+// Error returns the error message.
+func (err *MultiGetError) Error() string {
+	return fmt.Sprintf("store: %d buckets could not be read", len(err.Errors))
+}
+
+// MultiGetValues retrieves the same range of values from
+// multiple buckets.
+//
+// The buckets are read concurrently by at most
+// multiGetWorkers goroutines, each bucket is read like
+// GetValues so the returned values are copies. The result
+// is keyed by the ids passed in ids, buckets without values
+// in the range have an empty slice. When buckets could not
+// be read, for example because they don't exist, a
+// *MultiGetError is returned together with the values of
+// the other buckets.
+func (str *pebbleStore) MultiGetValues(ids []BucketID, rng BucketRange) (map[BucketID][]BucketValue, error) {
+	if err := rng.validate(); err != nil {
+		return nil, err
+	}
+	done, err := str.beginOp()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	var mtx sync.Mutex
+	results := make(map[BucketID][]BucketValue, len(ids))
+	errs := make(map[BucketID]error)
+
+	// Start the workers, each worker reads buckets until
+	// all ids are read.
+	queue := make(chan BucketID)
+	var wg sync.WaitGroup
+	for i := 0; i < multiGetWorkers && i < len(ids); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range queue {
+				values, err := str.multiGetBucket(id, rng)
+				mtx.Lock()
+				if err != nil {
+					errs[id] = err
+				} else {
+					results[id] = values
+				}
+				mtx.Unlock()
+			}
+		}()
+	}
+	for _, id := range ids {
+		queue <- id
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return results, &MultiGetError{Errors: errs}
+	}
+	return results, nil
+}
+
+// multiGetBucket reads the values of a bucket for
+// MultiGetValues.
+func (str *pebbleStore) multiGetBucket(id BucketID, rng BucketRange) ([]BucketValue, error) {
+	bkt, err := str.getBucket(id)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := bkt.GetValues(rng)
+	if err != nil {
+		return nil, err
+	} else if values == nil {
+		values = []BucketValue{}
+	}
+	return values, nil
+}
+
+// mergeMultiGet adds the values and errors of a
+// MultiGetValues call to results and errs.
+func mergeMultiGet(results map[BucketID][]BucketValue, errs map[BucketID]error, values map[BucketID][]BucketValue, err error) error {
+	for id, bktValues := range values {
+		results[id] = bktValues
+	}
+
+	var multiErr *MultiGetError
+	if errors.As(err, &multiErr) {
+		for id, bktErr := range multiErr.Errors {
+			errs[id] = bktErr
+		}
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiGetValues(t *testing.T) {
+	str := setupValueCacheStore(t, 1<<20)
+	defer str.Close()
+
+	// Create buckets with values in different parts of the
+	// range, the last bucket does not exist.
+	ids := make([]BucketID, 20)
+	for i := range ids {
+		ids[i] = BucketID(&[BucketIDLength]byte{byte(i), 14: 1, 15: 7})
+		if i == len(ids)-1 {
+			continue
+		}
+		bkt, err := str.CreateBucket(ids[i], TestBktKey)
+		require.NoError(t, err, "error occurred while creating bucket")
+		require.NoError(t, bkt.PutValues([]BucketValue{
+			{Idx: uint16(1 + i%2), Value: []byte{byte(i)}},
+			{Idx: 20, Value: []byte("20")},
+		}))
+	}
+
+	// Test whether the values of each bucket are returned,
+	// and the missing bucket is reported.
+	values, err := str.MultiGetValues(ids, BucketRange{Start: 0, End: 2})
+	var multiErr *MultiGetError
+	require.ErrorAs(t, err, &multiErr, "missing bucket is not reported")
+	assert.Len(t, multiErr.Errors, 1, "unexpected amount of failed buckets")
+	assert.ErrorIs(t, multiErr.Errors[ids[len(ids)-1]], ErrBucketNotFound, "missing bucket has an incorrect error")
+	require.Len(t, values, len(ids)-1, "values of all existing buckets are not returned")
+	for i, id := range ids[:len(ids)-1] {
+		if i%2 == 0 {
+			assert.Equal(t, []BucketValue{{Idx: 1, Value: []byte{byte(i)}}}, values[id], "bucket %d has incorrect values", i)
+		} else {
+			assert.Empty(t, values[id], "bucket %d has values outside the range", i)
+			assert.NotNil(t, values[id], "bucket %d without values in the range is missing", i)
+		}
+	}
+
+	// Test whether the returned values are copies.
+	values[ids[0]][0].Value[0] = 'x'
+	values, err = str.MultiGetValues(ids[:1], BucketRange{Start: 0, End: 2})
+	assert.NoError(t, err, "error occurred while reading values")
+	assert.Equal(t, []byte{0}, values[ids[0]][0].Value, "returned values alias the stored values")
+
+	_, err = str.MultiGetValues(ids, BucketRange{Start: 2, End: 1})
+	assert.Equal(t, ErrInvalidRange, err, "invalid range is not rejected")
+}
+
+func TestShardedMultiGetValues(t *testing.T) {
+	s := setupShardedStore(t, 3)
+	defer s.Close()
+
+	ids := make([]BucketID, 10)
+	for i := range ids {
+		ids[i] = BucketID(&[BucketIDLength]byte{byte(i), 14: 1, 15: 7})
+		bkt, err := s.CreateBucket(ids[i], TestBktKey)
+		require.NoError(t, err, "error occurred while creating bucket")
+		require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte{byte(i)}}}))
+	}
+
+	// Test whether buckets in all shards are read, and
+	// invalid ids are reported.
+	values, err := s.MultiGetValues(append(ids, nil), BucketRange{Start: 0, End: 10})
+	var multiErr *MultiGetError
+	require.ErrorAs(t, err, &multiErr, "invalid id is not reported")
+	assert.Equal(t, map[BucketID]error{nil: ErrInvalidBucketID}, multiErr.Errors, "unexpected failed buckets")
+	for i, id := range ids {
+		assert.Equal(t, []BucketValue{{Idx: 1, Value: []byte{byte(i)}}}, values[id], "bucket %d has incorrect values", i)
+	}
+}
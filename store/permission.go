@@ -0,0 +1,384 @@
+package store
+
+import (
+	"crypto/subtle"
+	"io"
+)
+
+// permissionedBucket is a bucket opened with OpenBucket.
+//
+// Reads require read permission, appends require append
+// permission and all other writes require write permission.
+// Methods that are not overridden only return metadata of
+// the bucket and are always allowed.
+type permissionedBucket struct {
+	*pebbleBucket
+	authorized bool              // Whether the bucket is opened with its key.
+	perms      BucketPermissions // Permissions of the key used to open the bucket.
+}
+
+// OpenBucket retrieves a bucket that only allows the
+// operations permitted by the given key.
+//
+// A nil key opens the bucket with its public permissions.
+// Otherwise the key is compared in constant time with the
+// BucketKey, and ErrUnauthorized is returned when it
+// doesn't match. Operations that are not permitted return
+// ErrPermissionDenied.
+func (str *pebbleStore) OpenBucket(id BucketID, key BucketKey) (Bucket, error) {
+	bkt, err := str.GetBucket(id)
+	if err != nil {
+		return nil, err
+	}
+
+	authorized := key != nil
+	if authorized && !isAuthorized(bkt, key) {
+		return nil, ErrUnauthorized
+	}
+	return &permissionedBucket{
+		pebbleBucket: bkt.(*pebbleBucket),
+		authorized:   authorized,
+		perms:        GetBucketPermissions(id, authorized),
+	}, nil
+}
+
+// isAuthorized returns whether key is the BucketKey of the
+// bucket, the keys are compared in constant time. A nil key
+// is never authorized.
+func isAuthorized(bkt Bucket, key BucketKey) bool {
+	return key != nil && subtle.ConstantTimeCompare(key[:], bkt.GetBucketKey()[:]) == 1
+}
+
+// unwrapBucket returns the pebbleBucket of a bucket. When
+// the bucket is opened with OpenBucket, ErrPermissionDenied
+// is returned unless it is permitted by allowed.
+func unwrapBucket(bkt Bucket, allowed func(perms BucketPermissions) bool) (*pebbleBucket, error) {
+	if permissioned, ok := bkt.(*permissionedBucket); ok {
+		if !allowed(permissioned.perms) {
+			return nil, ErrPermissionDenied
+		}
+		return permissioned.pebbleBucket, nil
+	}
+	return bkt.(*pebbleBucket), nil
+}
+
+// check returns ErrPermissionDenied when allowed is false.
+func (bkt *permissionedBucket) check(allowed bool) error {
+	if !allowed {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// GetBucketKey returns the bucket key, or nil when the
+// bucket is not opened with its key.
+func (bkt *permissionedBucket) GetBucketKey() BucketKey {
+	if !bkt.authorized {
+		return nil
+	}
+	return bkt.pebbleBucket.GetBucketKey()
+}
+
+// GetValue requires read permission, see Bucket.GetValue.
+func (bkt *permissionedBucket) GetValue(idx uint16) (BucketValue, bool, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return BucketValue{}, false, err
+	}
+	return bkt.pebbleBucket.GetValue(idx)
+}
+
+// ValueSize requires read permission, see Bucket.ValueSize.
+func (bkt *permissionedBucket) ValueSize(idx uint16) (int, bool, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return 0, false, err
+	}
+	return bkt.pebbleBucket.ValueSize(idx)
+}
+
+// GetValues requires read permission, see Bucket.GetValues.
+func (bkt *permissionedBucket) GetValues(rng BucketRange) ([]BucketValue, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return nil, err
+	}
+	return bkt.pebbleBucket.GetValues(rng)
+}
+
+// GetValuesInto requires read permission, see Bucket.GetValuesInto.
+func (bkt *permissionedBucket) GetValuesInto(rng BucketRange, dst []BucketValue) ([]BucketValue, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return nil, err
+	}
+	return bkt.pebbleBucket.GetValuesInto(rng, dst)
+}
+
+// GetValuesWithMeta requires read permission, see Bucket.GetValuesWithMeta.
+func (bkt *permissionedBucket) GetValuesWithMeta(rng BucketRange) ([]BucketValue, uint16, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return nil, 0, err
+	}
+	return bkt.pebbleBucket.GetValuesWithMeta(rng)
+}
+
+// GetValuesSince requires read permission, see Bucket.GetValuesSince.
+func (bkt *permissionedBucket) GetValuesSince(seq uint64) ([]BucketValue, uint64, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return nil, 0, err
+	}
+	return bkt.pebbleBucket.GetValuesSince(seq)
+}
+
+// GetValuesWithTombstones requires read permission, see Bucket.GetValuesWithTombstones.
+func (bkt *permissionedBucket) GetValuesWithTombstones(rng BucketRange) ([]BucketValue, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return nil, err
+	}
+	return bkt.pebbleBucket.GetValuesWithTombstones(rng)
+}
+
+// GetValuesFiltered requires read permission, see Bucket.GetValuesFiltered.
+func (bkt *permissionedBucket) GetValuesFiltered(rng BucketRange, keep func(idx uint16, val []byte) bool) ([]BucketValue, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return nil, err
+	}
+	return bkt.pebbleBucket.GetValuesFiltered(rng, keep)
+}
+
+// GetValuesMap requires read permission, see Bucket.GetValuesMap.
+func (bkt *permissionedBucket) GetValuesMap(rng BucketRange) (map[uint16][]byte, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return nil, err
+	}
+	return bkt.pebbleBucket.GetValuesMap(rng)
+}
+
+// GetValuesNoCopy requires read permission, see Bucket.GetValuesNoCopy.
+func (bkt *permissionedBucket) GetValuesNoCopy(rng BucketRange, fn func(idx uint16, val []byte) bool) error {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return err
+	}
+	return bkt.pebbleBucket.GetValuesNoCopy(rng, fn)
+}
+
+// WriteValues requires read permission, see Bucket.WriteValues.
+func (bkt *permissionedBucket) WriteValues(rng BucketRange, w io.Writer) (int, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return 0, err
+	}
+	return bkt.pebbleBucket.WriteValues(rng, w)
+}
+
+// GetValuesByIndices requires read permission, see Bucket.GetValuesByIndices.
+func (bkt *permissionedBucket) GetValuesByIndices(idxs []uint16) ([]BucketValue, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return nil, err
+	}
+	return bkt.pebbleBucket.GetValuesByIndices(idxs)
+}
+
+// FirstValue requires read permission, see Bucket.FirstValue.
+func (bkt *permissionedBucket) FirstValue() (BucketValue, bool, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return BucketValue{}, false, err
+	}
+	return bkt.pebbleBucket.FirstValue()
+}
+
+// LastValue requires read permission, see Bucket.LastValue.
+func (bkt *permissionedBucket) LastValue() (BucketValue, bool, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return BucketValue{}, false, err
+	}
+	return bkt.pebbleBucket.LastValue()
+}
+
+// GetValueFromEnd requires read permission, see Bucket.GetValueFromEnd.
+func (bkt *permissionedBucket) GetValueFromEnd(offset uint16) (BucketValue, bool, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return BucketValue{}, false, err
+	}
+	return bkt.pebbleBucket.GetValueFromEnd(offset)
+}
+
+// OccupiedIndices requires read permission, see Bucket.OccupiedIndices.
+func (bkt *permissionedBucket) OccupiedIndices(rng BucketRange) ([]uint16, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return nil, err
+	}
+	return bkt.pebbleBucket.OccupiedIndices(rng)
+}
+
+// Stats requires read permission, see Bucket.Stats.
+func (bkt *permissionedBucket) Stats() (BucketStats, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return BucketStats{}, err
+	}
+	return bkt.pebbleBucket.Stats()
+}
+
+// ValueSizeHistogram requires read permission, see Bucket.ValueSizeHistogram.
+func (bkt *permissionedBucket) ValueSizeHistogram(rng BucketRange) (SizeHistogram, error) {
+	if err := bkt.check(bkt.perms.Read); err != nil {
+		return SizeHistogram{}, err
+	}
+	return bkt.pebbleBucket.ValueSizeHistogram(rng)
+}
+
+// AppendValues requires append permission, see Bucket.AppendValues.
+func (bkt *permissionedBucket) AppendValues(values []BucketValue) error {
+	if err := bkt.check(bkt.perms.Append); err != nil {
+		return err
+	}
+	return bkt.pebbleBucket.AppendValues(values)
+}
+
+// AppendValuesMaxSize requires append permission, see Bucket.AppendValuesMaxSize.
+func (bkt *permissionedBucket) AppendValuesMaxSize(values []BucketValue, maxSize int) ([]uint16, error) {
+	if err := bkt.check(bkt.perms.Append); err != nil {
+		return nil, err
+	}
+	return bkt.pebbleBucket.AppendValuesMaxSize(values, maxSize)
+}
+
+// TryAppend requires append permission, see Bucket.TryAppend.
+func (bkt *permissionedBucket) TryAppend(values []BucketValue) ([]uint16, error) {
+	if err := bkt.check(bkt.perms.Append); err != nil {
+		return nil, err
+	}
+	return bkt.pebbleBucket.TryAppend(values)
+}
+
+// AppendValuesIdempotent requires append permission, see Bucket.AppendValuesIdempotent.
+func (bkt *permissionedBucket) AppendValuesIdempotent(requestID [RequestIDLength]byte, values []BucketValue) ([]uint16, error) {
+	if err := bkt.check(bkt.perms.Append); err != nil {
+		return nil, err
+	}
+	return bkt.pebbleBucket.AppendValuesIdempotent(requestID, values)
+}
+
+// BulkLoad requires append permission, see Bucket.BulkLoad.
+func (bkt *permissionedBucket) BulkLoad(values []BucketValue) error {
+	if err := bkt.check(bkt.perms.Append); err != nil {
+		return err
+	}
+	return bkt.pebbleBucket.BulkLoad(values)
+}
+
+// PutValues requires write permission, see Bucket.PutValues.
+func (bkt *permissionedBucket) PutValues(values []BucketValue) error {
+	if err := bkt.check(bkt.perms.Write); err != nil {
+		return err
+	}
+	return bkt.pebbleBucket.PutValues(values)
+}
+
+// PutValuesIfAbsent requires write permission, see Bucket.PutValuesIfAbsent.
+func (bkt *permissionedBucket) PutValuesIfAbsent(values []BucketValue) error {
+	if err := bkt.check(bkt.perms.Write); err != nil {
+		return err
+	}
+	return bkt.pebbleBucket.PutValuesIfAbsent(values)
+}
+
+// Free requires write permission, see Bucket.Free.
+func (bkt *permissionedBucket) Free(idxs []uint16) error {
+	if err := bkt.check(bkt.perms.Write); err != nil {
+		return err
+	}
+	return bkt.pebbleBucket.Free(idxs)
+}
+
+// DeleteIndices requires write permission, see Bucket.DeleteIndices.
+func (bkt *permissionedBucket) DeleteIndices(idxs []uint16) error {
+	if err := bkt.check(bkt.perms.Write); err != nil {
+		return err
+	}
+	return bkt.pebbleBucket.DeleteIndices(idxs)
+}
+
+// SwapValues requires write permission, see Bucket.SwapValues.
+func (bkt *permissionedBucket) SwapValues(a, b uint16) error {
+	if err := bkt.check(bkt.perms.Write); err != nil {
+		return err
+	}
+	return bkt.pebbleBucket.SwapValues(a, b)
+}
+
+// DeleteValue requires write permission, see Bucket.DeleteValue.
+func (bkt *permissionedBucket) DeleteValue(idx uint16) (bool, error) {
+	if err := bkt.check(bkt.perms.Write); err != nil {
+		return false, err
+	}
+	return bkt.pebbleBucket.DeleteValue(idx)
+}
+
+// DeleteValues requires write permission, see Bucket.DeleteValues.
+func (bkt *permissionedBucket) DeleteValues(rng BucketRange) error {
+	if err := bkt.check(bkt.perms.Write); err != nil {
+		return err
+	}
+	return bkt.pebbleBucket.DeleteValues(rng)
+}
+
+// DeleteValuesPrune requires write permission, see Bucket.DeleteValuesPrune.
+func (bkt *permissionedBucket) DeleteValuesPrune(rng BucketRange) (bool, error) {
+	if err := bkt.check(bkt.perms.Write); err != nil {
+		return false, err
+	}
+	return bkt.pebbleBucket.DeleteValuesPrune(rng)
+}
+
+// DeleteValuesCount requires write permission, see Bucket.DeleteValuesCount.
+func (bkt *permissionedBucket) DeleteValuesCount(rng BucketRange) (int, error) {
+	if err := bkt.check(bkt.perms.Write); err != nil {
+		return 0, err
+	}
+	return bkt.pebbleBucket.DeleteValuesCount(rng)
+}
+
+// ReplaceRange requires write permission, see Bucket.ReplaceRange.
+func (bkt *permissionedBucket) ReplaceRange(rng BucketRange, values []BucketValue) error {
+	if err := bkt.check(bkt.perms.Write); err != nil {
+		return err
+	}
+	return bkt.pebbleBucket.ReplaceRange(rng, values)
+}
+
+// Compact requires write permission, see Bucket.Compact.
+func (bkt *permissionedBucket) Compact() (map[uint16]uint16, error) {
+	if err := bkt.check(bkt.perms.Write); err != nil {
+		return nil, err
+	}
+	return bkt.pebbleBucket.Compact()
+}
+
+// IncrementValue requires write permission, see Bucket.IncrementValue.
+func (bkt *permissionedBucket) IncrementValue(idx uint16, delta int64) error {
+	if err := bkt.check(bkt.perms.Write); err != nil {
+		return err
+	}
+	return bkt.pebbleBucket.IncrementValue(idx, delta)
+}
+
+// IncrementAudited requires write permission, see Bucket.IncrementAudited.
+func (bkt *permissionedBucket) IncrementAudited(counterIdx uint16, delta int64, auditValue []byte) (int64, error) {
+	if err := bkt.check(bkt.perms.Write); err != nil {
+		return 0, err
+	}
+	return bkt.pebbleBucket.IncrementAudited(counterIdx, delta, auditValue)
+}
+
+// MergeValue requires write permission, see Bucket.MergeValue.
+func (bkt *permissionedBucket) MergeValue(idx uint16, operand []byte) error {
+	if err := bkt.check(bkt.perms.Write); err != nil {
+		return err
+	}
+	return bkt.pebbleBucket.MergeValue(idx, operand)
+}
+
+// CompareAndSwapValue requires write permission, see Bucket.CompareAndSwapValue.
+func (bkt *permissionedBucket) CompareAndSwapValue(idx uint16, old, new []byte) (bool, error) {
+	if err := bkt.check(bkt.perms.Write); err != nil {
+		return false, err
+	}
+	return bkt.pebbleBucket.CompareAndSwapValue(idx, old, new)
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenBucket(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+
+	// The bucket is publicly readable, writes and appends
+	// require the key.
+	id := BucketID([]byte{3, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 0, permPublicRead | permProtectedRead | permProtectedWrite | permProtectedAppend})
+	created, err := str.CreateBucket(id, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, created.AppendValues(TestBktValues), "error occurred while appending values")
+
+	// Test opening the bucket with the correct key.
+	bkt, err := str.OpenBucket(id, TestBktKey)
+	require.NoError(t, err, "error occurred while opening bucket with key")
+	assert.Equal(t, TestBktKey, bkt.GetBucketKey(), "key is not returned to authorized user")
+	_, err = bkt.GetValues(BucketRange{Start: 1, End: 11})
+	assert.NoError(t, err, "authorized read is denied")
+	assert.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("11")}}), "authorized append is denied")
+	assert.NoError(t, bkt.PutValues([]BucketValue{{Idx: 1, Value: []byte("1")}}), "authorized write is denied")
+
+	// Test opening the bucket with a wrong key.
+	wrongKey := BucketKey(make([]byte, BucketKeyLength))
+	_, err = str.OpenBucket(id, wrongKey)
+	assert.ErrorIs(t, err, ErrUnauthorized, "bucket is opened with wrong key")
+
+	// Test opening the bucket without a key.
+	bkt, err = str.OpenBucket(id, nil)
+	require.NoError(t, err, "error occurred while opening bucket without key")
+	assert.Nil(t, bkt.GetBucketKey(), "key is returned to unauthorized user")
+	values, err := bkt.GetValues(BucketRange{Start: 11, End: 12})
+	assert.NoError(t, err, "public read is denied")
+	assert.Equal(t, []BucketValue{{Idx: 11, Value: []byte("11")}}, values, "incorrect values returned")
+	assert.ErrorIs(t, bkt.AppendValues([]BucketValue{{Value: []byte("12")}}), ErrPermissionDenied, "unauthorized append is allowed")
+	assert.ErrorIs(t, bkt.PutValues([]BucketValue{{Idx: 1, Value: []byte("x")}}), ErrPermissionDenied, "unauthorized write is allowed")
+	assert.ErrorIs(t, bkt.DeleteValues(BucketRange{Start: 1, End: 2}), ErrPermissionDenied, "unauthorized delete is allowed")
+	assert.ErrorIs(t, str.DeleteBucket(bkt), ErrPermissionDenied, "unauthorized bucket deletion is allowed")
+
+	coalescer := str.NewAppendCoalescer(0)
+	defer coalescer.Close()
+	err = coalescer.Append(bkt, []BucketValue{{Value: []byte("12")}})
+	assert.ErrorIs(t, err, ErrPermissionDenied, "unauthorized coalesced append is allowed")
+
+	value, ok, err := created.GetValue(1)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.True(t, ok, "value is deleted")
+	assert.Equal(t, []byte("1"), value.Value, "value is modified by unauthorized user")
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// ErrQuotaExceeded is returned when a write adds values to
+// a bucket that would exceed its value quota, see
+// StoreOptions.ValueQuota.
+var ErrQuotaExceeded = errors.New("store: bucket value quota exceeded")
+
+// checkQuota returns the amount of values in the bucket
+// after the given values are written, or -1 when the
+// bucket has no quota.
+//
+// Tombstones and deleted values restore headroom, expired
+// values count until they are reaped. A write that adds
+// values past the quota returns a *BucketError wrapping
+// ErrQuotaExceeded, writes that don't add values are
+// always allowed. The idx of the values must be computed
+// and the caller must hold the bucket write lock.
+func checkQuota(bkt *pebbleBucket, op string, values []BucketValue) (int, error) {
+	quota := bkt.getQuota()
+	if quota <= 0 {
+		return -1, nil
+	}
+
+	bkt.mtx.Lock()
+	count, err := bkt.getCount()
+	if err != nil {
+		bkt.mtx.Unlock()
+		return -1, err
+	}
+	lastIdx, err := bkt.getLastIdx()
+	bkt.mtx.Unlock()
+	if err != nil {
+		return -1, err
+	}
+	return bkt.store.countQuota(bkt.store.db, bkt.id, op, quota, count, lastIdx, values)
+}
+
+// checkReplaceQuota returns the amount of values in the
+// bucket after ReplaceRange deletes the values in rng and
+// writes values, or -1 when the bucket has no quota. See
+// checkQuota.
+func checkReplaceQuota(bkt *pebbleBucket, rng BucketRange, values []BucketValue) (int, error) {
+	quota := bkt.getQuota()
+	if quota <= 0 {
+		return -1, nil
+	}
+
+	bkt.mtx.Lock()
+	count, err := bkt.getCount()
+	bkt.mtx.Unlock()
+	if err != nil {
+		return -1, err
+	}
+	deleted, err := bkt.store.countKeys(bkt.store.db, bkt.store.getPebbleValueKey(bkt.id, rng.Start), bkt.store.getPebbleValueKey(bkt.id, rng.End))
+	if err != nil {
+		return -1, err
+	}
+
+	// The range is empty after the delete, so each idx in
+	// values is new.
+	exists := make(map[uint16]bool, len(values))
+	for _, value := range values {
+		exists[value.Idx] = !value.Tombstone
+	}
+	updated := count - int(deleted)
+	for _, found := range exists {
+		if found {
+			updated++
+		}
+	}
+
+	if updated > count && updated > quota {
+		return -1, &BucketError{ID: bkt.id, Op: OpReplaceRange, Err: ErrQuotaExceeded}
+	}
+	return updated, nil
+}
+
+// countQuota returns the amount of values in a bucket after
+// the given values are written, and checks it against
+// quota. count and lastIdx are the amount of values and
+// the lastIdx of the bucket in reader. See checkQuota.
+func (str *pebbleStore) countQuota(reader pebble.Reader, id BucketID, op string, quota, count int, lastIdx uint16, values []BucketValue) (int, error) {
+	// Values after lastIdx are new, other indices are looked
+	// up. An idx can be used multiple times in values.
+	updated := count
+	exists := make(map[uint16]bool, len(values))
+	for _, value := range values {
+		found, ok := exists[value.Idx]
+		if !ok && value.Idx <= lastIdx {
+			var err error
+			if found, err = str.hasValue(reader, id, value.Idx); err != nil {
+				return -1, err
+			}
+		}
+
+		if value.Tombstone && found {
+			updated--
+		} else if !value.Tombstone && !found {
+			updated++
+		}
+		exists[value.Idx] = !value.Tombstone
+	}
+
+	if updated > count && updated > quota {
+		return -1, &BucketError{ID: id, Op: op, Err: ErrQuotaExceeded}
+	}
+	return updated, nil
+}
+
+// getQuota returns the value quota of the bucket, see
+// StoreOptions.ValueQuota. The bucket has no quota when it
+// is 0 or less.
+func (bkt *pebbleBucket) getQuota() int {
+	if bkt.store.opts.ValueQuota == nil {
+		return 0
+	}
+	return bkt.store.opts.ValueQuota(bkt.id)
+}
+
+// hasValue returns whether a value is stored at idx,
+// including expired values. Tombstones are not a value.
+func (str *pebbleStore) hasValue(reader pebble.Reader, id BucketID, idx uint16) (bool, error) {
+	stored, closer, err := reader.Get(str.getPebbleValueKey(id, idx))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	found := !str.isTombstone(stored)
+	return found, closer.Close()
+}
+
+// getCount returns the amount of values in the value table
+// of the bucket. The values are counted the first time the
+// count is needed after it is reset. The caller must hold
+// bkt.mtx.
+func (bkt *pebbleBucket) getCount() (int, error) {
+	if !bkt.countLoaded {
+		count, err := bkt.store.countValues(bkt.store.db, bkt.id)
+		if err != nil {
+			return 0, err
+		}
+		bkt.count, bkt.countLoaded = int(count), true
+	}
+	return bkt.count, nil
+}
+
+// countValues returns the amount of values in the value
+// table of a bucket in reader, tombstones are not counted.
+func (str *pebbleStore) countValues(reader pebble.Reader, id BucketID) (uint64, error) {
+	lower, upper := str.getPebbleValueKeyRange(id)
+	return str.countKeys(reader, lower, upper)
+}
+
+// setCount sets the amount of values in the bucket, a
+// negative count resets it.
+func (bkt *pebbleBucket) setCount(count int) {
+	bkt.mtx.Lock()
+	defer bkt.mtx.Unlock()
+	bkt.count, bkt.countLoaded = count, count >= 0
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueQuota(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	str.(*pebbleStore).opts.ValueQuota = func(id BucketID) int {
+		if *id == *TestBktID {
+			return 12
+		}
+		return 0
+	}
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test appending up to and past the quota.
+	assert.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("11")}, {Value: []byte("12")}}), "error occurred while appending up to the quota")
+	err = bkt.AppendValues([]BucketValue{{Value: []byte("13")}})
+	assert.ErrorIs(t, err, ErrQuotaExceeded, "append past the quota is accepted")
+	err = bkt.PutValues([]BucketValue{{Idx: 20, Value: []byte("20")}})
+	assert.ErrorIs(t, err, ErrQuotaExceeded, "put past the quota is accepted")
+	assert.Equal(t, uint16(12), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is updated by a rejected write")
+
+	// Writes that don't add values are allowed.
+	assert.NoError(t, bkt.PutValues([]BucketValue{{Idx: 5, Value: []byte("test")}}), "overwrite is rejected at the quota")
+	assert.NoError(t, bkt.PutValues([]BucketValue{{Idx: 1, Tombstone: true}, {Idx: 20, Value: []byte("20")}}), "write without new values is rejected")
+
+	// Test whether deleted values restore headroom.
+	require.NoError(t, bkt.Free([]uint16{2}), "error occurred while freeing value")
+	assert.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("21")}}), "freed value does not restore headroom")
+	require.NoError(t, bkt.DeleteValues(BucketRange{Start: 3, End: 5}), "error occurred while deleting values")
+	assert.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("22")}, {Value: []byte("23")}}), "deleted values do not restore headroom")
+	assert.ErrorIs(t, bkt.AppendValues([]BucketValue{{Value: []byte("24")}}), ErrQuotaExceeded, "append past the quota is accepted")
+
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Len(t, values, 12, "bucket has more values than its quota")
+
+	// Buckets without a quota are not limited.
+	bkt2, err := str.CreateBucket(TestBktID2, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	for i := 0; i < 13; i++ {
+		assert.NoError(t, bkt2.AppendValues([]BucketValue{{Value: []byte("v")}}), "bucket without quota is limited")
+	}
+}
+
+func TestValueQuotaAllPaths(t *testing.T) {
+	quota := 3
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: vfs.NewMem(), Merger: CounterMerger},
+		CacheTTL:   24,
+		ValueQuota: func(BucketID) int { return quota },
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}, {Value: []byte("2")}, {Value: []byte("3")}}))
+
+	// Test whether ReplaceRange counts the deleted values.
+	err = bkt.ReplaceRange(BucketRange{Start: 4, End: 10}, []BucketValue{{Idx: 4, Value: []byte("4")}})
+	assert.ErrorIs(t, err, ErrQuotaExceeded, "replace past the quota is accepted")
+	assert.NoError(t, bkt.ReplaceRange(BucketRange{Start: 1, End: 4}, []BucketValue{{Idx: 1, Value: []byte("1")}, {Idx: 2, Value: []byte("2")}}), "replace within the quota is rejected")
+
+	// Test whether the other writes are checked.
+	swapped, err := bkt.CompareAndSwapValue(3, nil, []byte("3"))
+	assert.NoError(t, err, "swap up to the quota is rejected")
+	assert.True(t, swapped, "value is not swapped")
+	_, err = bkt.CompareAndSwapValue(4, nil, []byte("4"))
+	assert.ErrorIs(t, err, ErrQuotaExceeded, "swap past the quota is accepted")
+	assert.NoError(t, bkt.SwapValues(3, 4), "swap without new values is rejected")
+	assert.ErrorIs(t, bkt.MergeValue(5, encodeCounter(1)), ErrQuotaExceeded, "merge past the quota is accepted")
+	assert.ErrorIs(t, bkt.IncrementValue(5, 1), ErrQuotaExceeded, "increment past the quota is accepted")
+	_, err = bkt.IncrementAudited(1, 1, []byte("audit"))
+	assert.ErrorIs(t, err, ErrQuotaExceeded, "audit value past the quota is accepted")
+
+	// Test whether transactions check the quota when
+	// staging and again when committing.
+	txn := str.NewTransaction()
+	assert.ErrorIs(t, txn.AppendValues(TestBktID, []BucketValue{{Value: []byte("5")}}), ErrQuotaExceeded, "staged append past the quota is accepted")
+	assert.NoError(t, txn.Discard())
+	require.NoError(t, bkt.Free([]uint16{2}), "error occurred while freeing value")
+	txn = str.NewTransaction()
+	assert.NoError(t, txn.PutValues(TestBktID, []BucketValue{{Idx: 2, Value: []byte("2")}}), "staged put within the quota is rejected")
+	quota = 2
+	assert.ErrorIs(t, txn.Commit(), ErrQuotaExceeded, "commit past the quota is accepted")
+
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 10})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Len(t, values, 2, "bucket has more values than its quota")
+}
@@ -0,0 +1,148 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// limiterPruneSize is the amount of tracked buckets after
+// which a TokenBucketLimiter forgets the buckets that have
+// a full burst again.
+const limiterPruneSize = 4096
+
+// RateLimiter limits the operations on a bucket, see
+// StoreOptions.WriteLimiter and StoreOptions.ReadLimiter.
+// Implementations must be safe for concurrent use.
+type RateLimiter interface {
+	// Allow returns whether an operation on a bucket is
+	// allowed now. The operation is one of the Op
+	// constants.
+	Allow(id BucketID, op string) bool
+}
+
+// TokenBucketLimiter is a RateLimiter with a token bucket
+// for each BucketID.
+//
+// Each bucket starts with burst tokens and regains rate
+// tokens per second, up to burst. Each allowed operation
+// takes a token. Buckets with a full burst are forgotten
+// when many buckets are tracked, so the memory usage stays
+// bounded by the amount of recently limited buckets.
+type TokenBucketLimiter struct {
+	rate  float64          // Tokens regained per second.
+	burst float64          // Maximum amount of tokens.
+	clock func() time.Time // Returns the current time.
+
+	mtx     sync.Mutex
+	buckets map[[BucketIDLength]byte]*tokenBucket
+}
+
+// tokenBucket contains the tokens of a bucket.
+type tokenBucket struct {
+	tokens  float64   // Tokens at the time of updated.
+	updated time.Time // Time the tokens were last updated.
+}
+
+// NewTokenBucketLimiter creates a limiter that allows rate
+// operations per second with bursts of burst operations for
+// each bucket. The clock returns the current time, nil uses
+// time.Now.
+func NewTokenBucketLimiter(rate float64, burst int, clock func() time.Time) *TokenBucketLimiter {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &TokenBucketLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		clock:   clock,
+		buckets: make(map[[BucketIDLength]byte]*tokenBucket),
+	}
+}
+
+// Allow takes a token of the bucket, and returns false when
+// the bucket has no tokens left. See RateLimiter.Allow.
+func (l *TokenBucketLimiter) Allow(id BucketID, op string) bool {
+	now := l.clock()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	bkt, ok := l.buckets[*id]
+	if !ok {
+		if len(l.buckets) >= limiterPruneSize {
+			l.prune(now)
+		}
+		bkt = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[*id] = bkt
+	}
+	bkt.refill(now, l.rate, l.burst)
+
+	if bkt.tokens < 1 {
+		return false
+	}
+	bkt.tokens--
+	return true
+}
+
+// prune forgets the buckets that have a full burst at now.
+// The caller must hold l.mtx.
+func (l *TokenBucketLimiter) prune(now time.Time) {
+	for id, bkt := range l.buckets {
+		if bkt.refill(now, l.rate, l.burst); bkt.tokens >= l.burst {
+			delete(l.buckets, id)
+		}
+	}
+}
+
+// refill adds the tokens regained since the last update.
+func (bkt *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if elapsed := now.Sub(bkt.updated); elapsed > 0 {
+		bkt.tokens += elapsed.Seconds() * rate
+		if bkt.tokens > burst {
+			bkt.tokens = burst
+		}
+		bkt.updated = now
+	}
+}
+
+// checkRate returns ErrRateLimited when the limiter doesn't
+// allow an operation on a bucket. A nil limiter allows all
+// operations.
+func checkRate(limiter RateLimiter, id BucketID, op string) error {
+	if limiter != nil && !limiter.Allow(id, op) {
+		return &BucketError{ID: id, Op: op, Err: ErrRateLimited}
+	}
+	return nil
+}
+
+// beginRead registers a read operation on the bucket, see
+// pebbleStore.beginOp, and checks it against the
+// ReadLimiter. All reads of bucket values start with
+// beginRead, so no read bypasses the limiter.
+func (bkt *pebbleBucket) beginRead(op string) (func(), error) {
+	return bkt.begin(bkt.store.opts.ReadLimiter, op, bkt.store.beginOp)
+}
+
+// beginWrite registers a write operation on the bucket, see
+// pebbleStore.beginWrite, and checks it against the
+// WriteLimiter. All writes to bucket values start with
+// beginWrite or, for AppendCoalescer.Append, check the
+// limiter before they are queued, so no write bypasses the
+// limiter.
+func (bkt *pebbleBucket) beginWrite(op string) (func(), error) {
+	return bkt.begin(bkt.store.opts.WriteLimiter, op, bkt.store.beginWrite)
+}
+
+// begin starts an operation with begin and checks it
+// against limiter, the operation is ended again when the
+// limiter doesn't allow it.
+func (bkt *pebbleBucket) begin(limiter RateLimiter, op string, begin func() (func(), error)) (func(), error) {
+	done, err := begin()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRate(limiter, bkt.id, op); err != nil {
+		done()
+		return nil, err
+	}
+	return done, nil
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := NewTokenBucketLimiter(2, 3, func() time.Time { return now })
+
+	// Test whether the burst is allowed, and whether other
+	// buckets have their own tokens.
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.Allow(TestBktID, OpPut), "operation within the burst is not allowed")
+	}
+	assert.False(t, limiter.Allow(TestBktID, OpPut), "operation exceeding the burst is allowed")
+	assert.True(t, limiter.Allow(TestBktID2, OpPut), "operation on another bucket is not allowed")
+
+	// Test whether tokens refill over time, up to the burst.
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, limiter.Allow(TestBktID, OpPut), "refilled token is not allowed")
+	assert.False(t, limiter.Allow(TestBktID, OpPut), "operation exceeding the refilled tokens is allowed")
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.Allow(TestBktID, OpPut), "operation within the refilled burst is not allowed")
+	}
+	assert.False(t, limiter.Allow(TestBktID, OpPut), "tokens refilled beyond the burst")
+}
+
+func TestTokenBucketLimiterPrune(t *testing.T) {
+	now := time.Now()
+	limiter := NewTokenBucketLimiter(1, 1, func() time.Time { return now })
+
+	// Test whether buckets with a full burst are forgotten
+	// and limited buckets are kept.
+	for i := 1; i < limiterPruneSize; i++ {
+		id := new([BucketIDLength]byte)
+		id[0], id[1], id[2] = byte(i>>8), byte(i), 1
+		require.True(t, limiter.Allow(id, OpPut), "first operation is not allowed")
+	}
+	now = now.Add(time.Second)
+	require.True(t, limiter.Allow(TestBktID, OpPut), "first operation is not allowed")
+	require.Len(t, limiter.buckets, limiterPruneSize, "buckets are pruned before the limit")
+
+	assert.True(t, limiter.Allow(TestBktID2, OpPut), "first operation is not allowed")
+	assert.Len(t, limiter.buckets, 2, "buckets with a full burst are not pruned")
+	assert.False(t, limiter.Allow(TestBktID, OpPut), "limited bucket is forgotten")
+}
+
+func TestRateLimitedStore(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts:   &pebble.Options{FS: vfs.NewMem()},
+		CacheTTL:     24,
+		Clock:        clock,
+		WriteLimiter: NewTokenBucketLimiter(1, 2, clock),
+		ReadLimiter:  NewTokenBucketLimiter(1, 1, clock),
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Test whether writes exceeding the rate are rejected.
+	assert.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}}), "error occurred while appending values")
+	assert.NoError(t, bkt.PutValues([]BucketValue{{Idx: 2, Value: []byte("2")}}), "error occurred while putting values")
+	err = bkt.DeleteValues(BucketRange{Start: 1, End: 2})
+	assert.ErrorIs(t, err, ErrRateLimited, "write exceeding the rate is allowed")
+	assert.Equal(t, "rate_limited", ErrorClass(err), "incorrect error class")
+
+	// Test whether reads have a separate limit.
+	_, _, err = bkt.GetValue(1)
+	assert.NoError(t, err, "read is limited by the write limit")
+	_, err = bkt.GetValues(BucketRange{Start: 0, End: 10})
+	assert.ErrorIs(t, err, ErrRateLimited, "read exceeding the rate is allowed")
+
+	// Test whether writes are allowed after the tokens are
+	// refilled.
+	now = now.Add(time.Second)
+	assert.NoError(t, bkt.DeleteValues(BucketRange{Start: 1, End: 2}), "write is limited after refilling")
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 10})
+	assert.NoError(t, err, "read is limited after refilling")
+	assert.Equal(t, []BucketValue{{Idx: 2, Value: []byte("2")}}, values, "rejected write modified the bucket")
+}
+
+// denyLimiter is a RateLimiter that doesn't allow any
+// operation.
+type denyLimiter struct{}
+
+func (denyLimiter) Allow(BucketID, string) bool { return false }
+
+func TestRateLimitedAllPaths(t *testing.T) {
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts:   &pebble.Options{FS: vfs.NewMem(), Merger: CounterMerger},
+		CacheTTL:     24,
+		WriteLimiter: denyLimiter{},
+		ReadLimiter:  denyLimiter{},
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Test whether every read and write of the bucket
+	// values is rejected by the limiter.
+	rng := BucketRange{Start: 0, End: 10}
+	values := []BucketValue{{Idx: 1, Value: []byte("1")}}
+	keep := func(uint16, []byte) bool { return true }
+	ops := map[string]func() error{
+		"GetValue":                func() error { _, _, err := bkt.GetValue(1); return err },
+		"ValueSize":               func() error { _, _, err := bkt.ValueSize(1); return err },
+		"GetValues":               func() error { _, err := bkt.GetValues(rng); return err },
+		"GetValuesInto":           func() error { _, err := bkt.GetValuesInto(rng, nil); return err },
+		"GetValuesWithMeta":       func() error { _, _, err := bkt.GetValuesWithMeta(rng); return err },
+		"GetValuesSince":          func() error { _, _, err := bkt.GetValuesSince(0); return err },
+		"GetValuesWithTombstones": func() error { _, err := bkt.GetValuesWithTombstones(rng); return err },
+		"GetValuesFiltered":       func() error { _, err := bkt.GetValuesFiltered(rng, keep); return err },
+		"GetValuesMap":            func() error { _, err := bkt.GetValuesMap(rng); return err },
+		"GetValuesNoCopy":         func() error { return bkt.GetValuesNoCopy(rng, keep) },
+		"GetValuesByIndices":      func() error { _, err := bkt.GetValuesByIndices([]uint16{1}); return err },
+		"FirstValue":              func() error { _, _, err := bkt.FirstValue(); return err },
+		"LastValue":               func() error { _, _, err := bkt.LastValue(); return err },
+		"GetValueFromEnd":         func() error { _, _, err := bkt.GetValueFromEnd(1); return err },
+		"OccupiedIndices":         func() error { _, err := bkt.OccupiedIndices(rng); return err },
+		"PutValues":               func() error { return bkt.PutValues(values) },
+		"PutValuesIfAbsent":       func() error { return bkt.PutValuesIfAbsent(values) },
+		"AppendValues":            func() error { return bkt.AppendValues(values) },
+		"TryAppend":               func() error { _, err := bkt.TryAppend(values); return err },
+		"AppendValuesIdempotent":  func() error { _, err := bkt.AppendValuesIdempotent([RequestIDLength]byte{1}, values); return err },
+		"BulkLoad":                func() error { return bkt.BulkLoad(values) },
+		"Free":                    func() error { return bkt.Free([]uint16{1}) },
+		"DeleteIndices":           func() error { return bkt.DeleteIndices([]uint16{1}) },
+		"SwapValues":              func() error { return bkt.SwapValues(1, 2) },
+		"DeleteValue":             func() error { _, err := bkt.DeleteValue(1); return err },
+		"DeleteValues":            func() error { return bkt.DeleteValues(rng) },
+		"DeleteValuesPrune":       func() error { _, err := bkt.DeleteValuesPrune(rng); return err },
+		"DeleteValuesCount":       func() error { _, err := bkt.DeleteValuesCount(rng); return err },
+		"ReplaceRange":            func() error { return bkt.ReplaceRange(rng, values) },
+		"Compact":                 func() error { _, err := bkt.Compact(); return err },
+		"IncrementValue":          func() error { return bkt.IncrementValue(1, 1) },
+		"IncrementAudited":        func() error { _, err := bkt.IncrementAudited(1, 1, []byte("a")); return err },
+		"MergeValue":              func() error { return bkt.MergeValue(1, []byte("1")) },
+		"CompareAndSwapValue":     func() error { _, err := bkt.CompareAndSwapValue(1, nil, []byte("1")); return err },
+		"AppendCoalescer": func() error {
+			c := str.NewAppendCoalescer(time.Millisecond)
+			defer c.Close()
+			return c.Append(bkt, values)
+		},
+	}
+	for name, op := range ops {
+		assert.ErrorIs(t, op(), ErrRateLimited, "%s is not rate limited", name)
+	}
+}
@@ -0,0 +1,187 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// defaultRequestTTL is the time a request id of
+// AppendValuesIdempotent is remembered when
+// StoreOptions.RequestTTL is not set.
+const defaultRequestTTL = 10 * time.Minute
+
+// RequestIDLength is the length of a request id, see
+// AppendValuesIdempotent.
+const RequestIDLength = 16
+
+// AppendValuesIdempotent adds values to the bucket and
+// returns the assigned idx of each value, see AppendValues.
+//
+// The request id is remembered for RequestTTL. When the
+// same request id is used again within this window, the
+// values are not appended again and the indices assigned
+// by the first call are returned. This allows clients to
+// safely retry appends.
+func (bkt *pebbleBucket) AppendValuesIdempotent(requestID [RequestIDLength]byte, values []BucketValue) (_ []uint16, err error) {
+	defer bkt.store.track(OpAppend)(&err)
+	done, err := bkt.beginWrite(OpAppend)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	key := bkt.store.getPebbleRequestKey(bkt.id, requestID)
+	idxs, found, err := bkt.store.readRequest(key)
+	if err != nil || found {
+		return idxs, err
+	}
+
+	lastIdx, err := computeValues(bkt, values, true)
+	if err != nil {
+		return nil, err
+	}
+	count, err := checkQuota(bkt, OpAppend, values)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := bkt.store.db.NewBatch()
+	defer batch.Close()
+	if err := bkt.store.stageValues(batch, bkt.id, values); err != nil {
+		return nil, err
+	}
+
+	// Store the request together with the values, so a
+	// request is only remembered when its values are added.
+	record := make([]byte, 8, 8+2*len(values))
+	expires := bkt.store.now().Add(bkt.store.getRequestTTL())
+	binary.BigEndian.PutUint64(record, uint64(expires.Unix()))
+	idxs = make([]uint16, len(values))
+	for i, value := range values {
+		idxs[i] = value.Idx
+		record = binary.BigEndian.AppendUint16(record, value.Idx)
+	}
+	if err := batch.Set(key, record, nil); err != nil {
+		return nil, err
+	}
+
+	if err := refreshTimestamp(bkt, batch); err != nil {
+		return nil, err
+	}
+	if err := bkt.store.db.Apply(batch, nil); err != nil {
+		return nil, err
+	}
+	bkt.setLastIdx(lastIdx)
+	bkt.setCount(count)
+	bkt.store.notifyValues(bkt.id, values)
+	return idxs, nil
+}
+
+// readRequest returns the indices stored for a request,
+// expired requests are not found.
+func (str *pebbleStore) readRequest(key []byte) ([]uint16, bool, error) {
+	record, closer, err := str.db.Get(key)
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer closer.Close()
+
+	if requestExpired(record, str.now()) {
+		return nil, false, nil
+	}
+	idxs := make([]uint16, 0, (len(record)-8)/2)
+	for i := 8; i+2 <= len(record); i += 2 {
+		idxs = append(idxs, binary.BigEndian.Uint16(record[i:]))
+	}
+	return idxs, true, nil
+}
+
+// requestExpired returns whether a stored request is
+// expired at the given time.
+func requestExpired(record []byte, now time.Time) bool {
+	return len(record) < 8 || now.Unix() >= int64(binary.BigEndian.Uint64(record))
+}
+
+// reapExpiredRequests deletes all expired requests. The
+// context is checked after each batch.
+func (str *pebbleStore) reapExpiredRequests(ctx context.Context) error {
+	iter := str.db.NewIter(&pebble.IterOptions{
+		LowerBound: str.getTableKey(requestTable, 0),
+		UpperBound: str.getTableKey(requestTable+1, 0),
+	})
+	batch, batchSize := str.db.NewBatch(), 0
+	closeAll := func() {
+		_ = batch.Close()
+		_ = iter.Close()
+	}
+
+	now := str.now()
+	for iter.First(); iter.Valid(); iter.Next() {
+		if !requestExpired(iter.Value(), now) {
+			continue
+		}
+		if err := batch.Delete(iter.Key(), nil); err != nil {
+			closeAll()
+			return err
+		}
+
+		if batchSize++; batchSize >= str.gcBatchSize() {
+			if err := str.db.Apply(batch, nil); err != nil {
+				closeAll()
+				return err
+			}
+			_ = batch.Close()
+			batch, batchSize = str.db.NewBatch(), 0
+
+			if err := ctx.Err(); err != nil {
+				closeAll()
+				return err
+			}
+		}
+	}
+
+	if batchSize > 0 {
+		if err := str.db.Apply(batch, nil); err != nil {
+			closeAll()
+			return err
+		}
+	}
+	_ = batch.Close()
+	return iter.Close()
+}
+
+// getRequestTTL returns the time a request id is
+// remembered.
+func (str *pebbleStore) getRequestTTL() time.Duration {
+	if str.opts.RequestTTL > 0 {
+		return str.opts.RequestTTL
+	}
+	return defaultRequestTTL
+}
+
+// getPebbleRequestKey returns the pebble request table key
+// for the given BucketId and request id.
+func (str *pebbleStore) getPebbleRequestKey(id BucketID, requestID [RequestIDLength]byte) []byte {
+	key := append(str.getTableKey(requestTable, BucketIDLength+RequestIDLength), id[:]...)
+	return append(key, requestID[:]...)
+}
+
+// getPebbleRequestKeyRange returns the lower and upper
+// bound of all the request table keys of a bucket.
+func (str *pebbleStore) getPebbleRequestKeyRange(id BucketID) (lower, upper []byte) {
+	var first, last [RequestIDLength]byte
+	for i := range last {
+		last[i] = 0xff
+	}
+	return str.getPebbleRequestKey(id, first), append(str.getPebbleRequestKey(id, last), 0)
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendValuesIdempotent(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	now := time.Now()
+	str.(*pebbleStore).opts.Clock = func() time.Time { return now }
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test whether a retried request does not append the
+	// values again.
+	requestID := [RequestIDLength]byte{1, 2, 3}
+	idxs, err := bkt.AppendValuesIdempotent(requestID, []BucketValue{{Value: []byte("a")}, {Value: []byte("b")}})
+	require.NoError(t, err, "error occurred while appending values")
+	assert.Equal(t, []uint16{11, 12}, idxs, "values are appended at incorrect indices")
+
+	retried, err := bkt.AppendValuesIdempotent(requestID, []BucketValue{{Value: []byte("a")}, {Value: []byte("b")}})
+	require.NoError(t, err, "error occurred while retrying append")
+	assert.Equal(t, idxs, retried, "retried append returned different indices")
+
+	values, err := bkt.GetValues(BucketRange{Start: 11, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, []BucketValue{{Idx: 11, Value: []byte("a")}, {Idx: 12, Value: []byte("b")}}, values, "retried append added values")
+
+	// Test whether another request id appends the values.
+	idxs, err = bkt.AppendValuesIdempotent([RequestIDLength]byte{4}, []BucketValue{{Value: []byte("c")}})
+	require.NoError(t, err, "error occurred while appending values")
+	assert.Equal(t, []uint16{13}, idxs, "values are appended at incorrect indices")
+
+	// Test whether a request id is forgotten after it expires,
+	// and whether GC deletes expired requests.
+	now = now.Add(defaultRequestTTL)
+	idxs, err = bkt.AppendValuesIdempotent(requestID, []BucketValue{{Value: []byte("d")}})
+	require.NoError(t, err, "error occurred while appending values")
+	assert.Equal(t, []uint16{14}, idxs, "expired request id is not forgotten")
+
+	now = now.Add(defaultRequestTTL)
+	require.NoError(t, str.GC(context.Background()), "error occurred while running GC")
+	_, _, err = str.(*pebbleStore).db.Get(str.(*pebbleStore).getPebbleRequestKey(TestBktID, requestID))
+	assert.ErrorIs(t, err, pebble.ErrNotFound, "expired request is not deleted by GC")
+}
+
+func TestDeleteBucketRequests(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	requestID := [RequestIDLength]byte{1}
+	_, err = bkt.AppendValuesIdempotent(requestID, []BucketValue{{Value: []byte("a")}})
+	require.NoError(t, err, "error occurred while appending values")
+	require.NoError(t, str.DeleteBucket(bkt), "error occurred while deleting bucket")
+
+	// Test whether the requests of a deleted bucket are
+	// deleted.
+	_, _, err = str.(*pebbleStore).db.Get(str.(*pebbleStore).getPebbleRequestKey(TestBktID, requestID))
+	assert.ErrorIs(t, err, pebble.ErrNotFound, "request of deleted bucket is not deleted")
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// sequenceReserve is the amount of sequence numbers that is
+// reserved on disk at once, see nextSequence.
+const sequenceReserve = 1024
+
+// getPebbleSequenceKey returns the pebble meta table key of
+// the reserved sequence numbers.
+func (str *pebbleStore) getPebbleSequenceKey() []byte {
+	return str.getPebbleMetaKey("seq")
+}
+
+// loadSequence loads the sequence counter of the store.
+func (str *pebbleStore) loadSequence() error {
+	data, closer, err := str.db.Get(str.getPebbleSequenceKey())
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	if len(data) != 8 {
+		return ErrInvalidValueHeader
+	}
+	str.seq = binary.BigEndian.Uint64(data)
+	str.seqLimit = str.seq
+	return nil
+}
+
+// nextSequence returns the next sequence number of the
+// store, or 0 when sequences are disabled.
+//
+// Sequence numbers are reserved on disk in blocks of
+// sequenceReserve, so the counter only has to be written
+// once per block. After reopening the store the counter
+// continues after the reserved block, so a sequence number
+// is never handed out twice.
+func (str *pebbleStore) nextSequence() (uint64, error) {
+	if !str.opts.Sequences {
+		return 0, nil
+	}
+
+	str.seqMtx.Lock()
+	defer str.seqMtx.Unlock()
+	if str.seq == str.seqLimit {
+		limit := str.seqLimit + sequenceReserve
+		if err := str.db.Set(str.getPebbleSequenceKey(), binary.BigEndian.AppendUint64(nil, limit), pebble.Sync); err != nil {
+			return 0, err
+		}
+		str.seqLimit = limit
+	}
+	str.seq++
+	return str.seq, nil
+}
+
+// raiseSequence raises the sequence counter of the store to
+// at least seq, so values written afterwards get a higher
+// sequence number than seq.
+func (str *pebbleStore) raiseSequence(seq uint64) error {
+	str.seqMtx.Lock()
+	defer str.seqMtx.Unlock()
+	if seq > str.seqLimit {
+		if err := str.db.Set(str.getPebbleSequenceKey(), binary.BigEndian.AppendUint64(nil, seq), pebble.Sync); err != nil {
+			return err
+		}
+		str.seqLimit = seq
+	}
+	if seq > str.seq {
+		str.seq = seq
+	}
+	return nil
+}
+
+// GetValuesSince retrieves the values of the bucket that
+// are written after sequence number seq.
+//
+// Sequence numbers are handed out while holding the bucket
+// lock, so the writes to a bucket get increasing sequence
+// numbers, except for transactions, see Transaction.
+// Returns the values in ascending idx order together with
+// the highest sequence number in the bucket, which can be
+// passed as seq to retrieve the next changes. Values
+// written in the same operation share a sequence number.
+// Deletions are not returned, and values without a
+// sequence (written before Sequences was enabled, or
+// merged by IncrementValue) are only returned when seq is
+// 0. Returns ErrSequencesDisabled when Sequences is not
+// enabled.
+func (bkt *pebbleBucket) GetValuesSince(seq uint64) (_ []BucketValue, _ uint64, err error) {
+	defer bkt.store.track(OpGet)(&err)
+	done, err := bkt.beginRead(OpGet)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer done()
+
+	if !bkt.store.opts.Sequences {
+		return nil, 0, ErrSequencesDisabled
+	}
+
+	var expired []uint16
+	defer func() { _ = bkt.store.reapExpired(bkt.id, expired) }()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	lower, upper := bkt.store.getPebbleValueKeyRange(bkt.id)
+	iter := bkt.store.db.NewIter(&pebble.IterOptions{
+		LowerBound: lower,
+		UpperBound: upper,
+	})
+
+	var values []BucketValue
+	highest := seq
+	now := bkt.store.getCurrentTimestamp()
+	for iter.First(); iter.Valid(); iter.Next() {
+		idx := getKeyIdx(iter.Key())
+		value, expires, valueSeq, err := bkt.store.decodeValueSequence(idx, iter.Value())
+		if err != nil {
+			_ = iter.Close()
+			return values, highest, err
+		} else if isExpired(expires, now) {
+			expired = append(expired, idx)
+			continue
+		}
+
+		if valueSeq > highest {
+			highest = valueSeq
+		}
+		if valueSeq > seq || seq == 0 {
+			values = append(values, BucketValue{Idx: idx, Value: append([]byte(nil), value...), Expires: expires})
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return values, highest, err
+	}
+	return values, highest, refreshTimestamp(bkt, bkt.store.db)
+}
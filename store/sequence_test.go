@@ -0,0 +1,126 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetValuesSince(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := &StoreOptions{PebbleOpts: &pebble.Options{FS: fs}, Sequences: true}
+	str, err := OpenStore("", opts)
+	require.NoError(t, err, "error occurred while opening store")
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues(TestBktValues), "error occurred while appending values")
+
+	values, seq, err := bkt.GetValuesSince(0)
+	require.NoError(t, err, "error occurred while fetching values")
+	assert.Equal(t, ExpectedBktValues, values, "all values are not returned")
+	assert.NotZero(t, seq, "sequence number is not returned")
+
+	// Test whether only the values written after the
+	// sequence number are returned.
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("11")}}), "error occurred while appending values")
+	require.NoError(t, bkt.PutValues([]BucketValue{{Idx: 3, Value: []byte("3")}}), "error occurred while putting values")
+	values, next, err := bkt.GetValuesSince(seq)
+	require.NoError(t, err, "error occurred while fetching values")
+	assert.Equal(t, []BucketValue{{Idx: 3, Value: []byte("3")}, {Idx: 11, Value: []byte("11")}}, values, "incorrect values returned")
+	assert.Greater(t, next, seq, "sequence number is not increased")
+
+	values, last, err := bkt.GetValuesSince(next)
+	require.NoError(t, err, "error occurred while fetching values")
+	assert.Empty(t, values, "unchanged values are returned")
+	assert.Equal(t, next, last, "sequence number changed without writes")
+
+	// Test whether sequence numbers keep increasing after
+	// reopening the store.
+	require.NoError(t, str.Close(), "error occurred while closing store")
+	str, err = OpenStore("", opts)
+	require.NoError(t, err, "error occurred while reopening store")
+	defer str.Close()
+	bkt, err = str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("12")}}), "error occurred while appending values")
+	values, _, err = bkt.GetValuesSince(next)
+	require.NoError(t, err, "error occurred while fetching values")
+	assert.Equal(t, []BucketValue{{Idx: 12, Value: []byte("12")}}, values, "sequence number is reused after reopening")
+}
+
+func TestGetValuesSinceDisabled(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	_, _, err = bkt.GetValuesSince(0)
+	assert.ErrorIs(t, err, ErrSequencesDisabled, "sequences are used while disabled")
+}
+
+func TestGetValuesSinceImport(t *testing.T) {
+	opts := func() *StoreOptions {
+		return &StoreOptions{PebbleOpts: &pebble.Options{FS: vfs.NewMem()}, Sequences: true}
+	}
+	str, err := OpenStore("", opts())
+	require.NoError(t, err, "error occurred while opening store")
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	for i := 0; i < sequenceReserve+1; i++ {
+		require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}}), "error occurred while appending values")
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, str.Export(context.Background(), &buf), "error occurred while exporting store")
+	imported, err := OpenStore("", opts())
+	require.NoError(t, err, "error occurred while opening store")
+	defer imported.Close()
+	require.NoError(t, imported.Import(&buf), "error occurred while importing store")
+
+	// Test whether values appended after the import get a
+	// higher sequence number than the imported values.
+	bkt, err = imported.GetBucket(TestBktID)
+	require.NoError(t, err, "imported bucket is not found")
+	_, seq, err := bkt.GetValuesSince(0)
+	require.NoError(t, err, "error occurred while fetching values")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("new")}}), "error occurred while appending values")
+	values, _, err := bkt.GetValuesSince(seq)
+	require.NoError(t, err, "error occurred while fetching values")
+	assert.Equal(t, []BucketValue{{Idx: sequenceReserve + 2, Value: []byte("new")}}, values, "value appended after the import is not returned")
+}
+
+func TestIncrementValueSequences(t *testing.T) {
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: vfs.NewMem(), Merger: CounterMerger},
+		Sequences:  true,
+	})
+	require.NoError(t, err, "error occurred while opening store")
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Test whether a counter without a header can be
+	// incremented, and whether increments of a value with a
+	// sequence header are rejected instead of corrupting it.
+	require.NoError(t, bkt.IncrementValue(1, 2), "error occurred while incrementing value")
+	require.NoError(t, bkt.IncrementValue(1, 3), "error occurred while incrementing value")
+	require.NoError(t, bkt.PutValues([]BucketValue{{Idx: 2, Value: encodeCounter(1)}}), "error occurred while putting values")
+	assert.ErrorIs(t, bkt.IncrementValue(2, 1), ErrMergeValueHeader, "value with a header is incremented")
+	_, err = bkt.IncrementAudited(2, 1, []byte("audit"))
+	assert.ErrorIs(t, err, ErrMergeValueHeader, "value with a header is incremented")
+
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 10})
+	require.NoError(t, err, "error occurred while fetching values")
+	require.Len(t, values, 2, "incorrect values after incrementing")
+	for i, expected := range []int64{5, 1} {
+		counter, err := DecodeCounter(values[i].Value)
+		assert.NoError(t, err, "error occurred while decoding counter")
+		assert.Equal(t, expected, counter, "incorrect counter value")
+	}
+}
@@ -0,0 +1,293 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNoShards is returned when creating a ShardedStore
+// without shards.
+var ErrNoShards = errors.New("store: sharded store has no shards")
+
+// ShardedStore distributes buckets over multiple stores.
+//
+// Each bucket is stored in a single shard, selected by a
+// hash of the random portion of its id modulo the amount of
+// shards. The routing is static, changing the shards or
+// their order routes existing buckets to the wrong shard.
+// Operations on a single bucket are routed to its shard,
+// operations on all buckets run on every shard.
+type ShardedStore struct {
+	shards []Store
+}
+
+// NewShardedStore creates a store that distributes buckets
+// over the given shards. The shards are owned by the
+// sharded store and closed by Close.
+func NewShardedStore(shards ...Store) (*ShardedStore, error) {
+	if len(shards) == 0 {
+		return nil, ErrNoShards
+	}
+	return &ShardedStore{shards: shards}, nil
+}
+
+// Shards returns the shards of the store.
+func (s *ShardedStore) Shards() []Store {
+	return s.shards
+}
+
+// ShardIndex returns the index of the shard of a bucket.
+//
+// The index is the FNV-1a hash of the random portion of the
+// id modulo the amount of shards. The lifetime and
+// permissions are excluded, so buckets with the same
+// settings are spread evenly.
+func (s *ShardedStore) ShardIndex(id BucketID) int {
+	hash := uint64(14695981039346656037)
+	for _, b := range id[:14] {
+		hash = (hash ^ uint64(b)) * 1099511628211
+	}
+	return int(hash % uint64(len(s.shards)))
+}
+
+// getShard returns the shard of a bucket.
+func (s *ShardedStore) getShard(id BucketID) (Store, error) {
+	if id == nil {
+		return nil, ErrInvalidBucketID
+	}
+	return s.shards[s.ShardIndex(id)], nil
+}
+
+// GetBucket retrieves a bucket from its shard, see
+// Store.GetBucket.
+func (s *ShardedStore) GetBucket(id BucketID) (Bucket, error) {
+	shard, err := s.getShard(id)
+	if err != nil {
+		return nil, err
+	}
+	return shard.GetBucket(id)
+}
+
+// BucketExists returns whether a bucket exists in its
+// shard, see Store.BucketExists.
+func (s *ShardedStore) BucketExists(id BucketID) (bool, error) {
+	shard, err := s.getShard(id)
+	if err != nil {
+		return false, err
+	}
+	return shard.BucketExists(id)
+}
+
+// GetBucketInfo returns the information of a bucket in its
+// shard, see Store.GetBucketInfo.
+func (s *ShardedStore) GetBucketInfo(id BucketID) (*BucketInfo, error) {
+	shard, err := s.getShard(id)
+	if err != nil {
+		return nil, err
+	}
+	return shard.GetBucketInfo(id)
+}
+
+// MultiGetValues retrieves the values of multiple buckets,
+// see Store.MultiGetValues. The ids are grouped by shard,
+// and the shards are read one after another.
+func (s *ShardedStore) MultiGetValues(ids []BucketID, rng BucketRange) (map[BucketID][]BucketValue, error) {
+	results := make(map[BucketID][]BucketValue, len(ids))
+	errs := make(map[BucketID]error)
+	shardIDs := make([][]BucketID, len(s.shards))
+	for _, id := range ids {
+		if id == nil {
+			errs[id] = ErrInvalidBucketID
+			continue
+		}
+		i := s.ShardIndex(id)
+		shardIDs[i] = append(shardIDs[i], id)
+	}
+
+	for i, ids := range shardIDs {
+		if len(ids) == 0 {
+			continue
+		}
+		values, err := s.shards[i].MultiGetValues(ids, rng)
+		if err := mergeMultiGet(results, errs, values, err); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(errs) > 0 {
+		return results, &MultiGetError{Errors: errs}
+	}
+	return results, nil
+}
+
+// CreateBucket creates a bucket in its shard, see
+// Store.CreateBucket.
+func (s *ShardedStore) CreateBucket(id BucketID, key BucketKey) (Bucket, error) {
+	shard, err := s.getShard(id)
+	if err != nil {
+		return nil, err
+	}
+	return shard.CreateBucket(id, key)
+}
+
+// CreateBucketWithOptions creates a bucket with the given
+// options in its shard, see Store.CreateBucketWithOptions.
+func (s *ShardedStore) CreateBucketWithOptions(id BucketID, key BucketKey, opts BucketOptions) (Bucket, error) {
+	shard, err := s.getShard(id)
+	if err != nil {
+		return nil, err
+	}
+	return shard.CreateBucketWithOptions(id, key, opts)
+}
+
+// OpenBucket retrieves a bucket from its shard, see
+// Store.OpenBucket.
+func (s *ShardedStore) OpenBucket(id BucketID, key BucketKey) (Bucket, error) {
+	shard, err := s.getShard(id)
+	if err != nil {
+		return nil, err
+	}
+	return shard.OpenBucket(id, key)
+}
+
+// DeleteBucket deletes a bucket from its shard, see
+// Store.DeleteBucket.
+func (s *ShardedStore) DeleteBucket(bkt Bucket) error {
+	shard, err := s.getShard(bkt.GetBucketID())
+	if err != nil {
+		return err
+	}
+	return shard.DeleteBucket(bkt)
+}
+
+// AccessInfo returns the permissions for accessing a
+// bucket, see Store.AccessInfo.
+func (s *ShardedStore) AccessInfo(id BucketID, key BucketKey) (BucketPermissions, bool, error) {
+	shard, err := s.getShard(id)
+	if err != nil {
+		return BucketPermissions{}, false, err
+	}
+	return shard.AccessInfo(id, key)
+}
+
+// Watch subscribes to the changes of a bucket in its
+// shard, see Store.Watch.
+func (s *ShardedStore) Watch(id BucketID) (<-chan BucketChangeEvent, func()) {
+	return s.shards[s.ShardIndex(id)].Watch(id)
+}
+
+// ListBuckets iterates over the buckets of all shards, see
+// Store.ListBuckets. The shards are listed one after
+// another, so the buckets are only ordered within a shard.
+func (s *ShardedStore) ListBuckets(fn func(id BucketID, lastAccess time.Time) bool) error {
+	stopped := false
+	for _, shard := range s.shards {
+		err := shard.ListBuckets(func(id BucketID, lastAccess time.Time) bool {
+			stopped = !fn(id, lastAccess)
+			return !stopped
+		})
+		if err != nil || stopped {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreatedBetween iterates over the buckets of all shards
+// created within a time window, see Store.CreatedBetween.
+// The buckets are only ordered within a shard.
+func (s *ShardedStore) CreatedBetween(start, end time.Time, fn func(id BucketID) bool) error {
+	stopped := false
+	for _, shard := range s.shards {
+		err := shard.CreatedBetween(start, end, func(id BucketID) bool {
+			stopped = !fn(id)
+			return !stopped
+		})
+		if err != nil || stopped {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteBucketsByLifetime deletes the buckets with a
+// lifetime between min and max from all shards, see
+// Store.DeleteBucketsByLifetime.
+func (s *ShardedStore) DeleteBucketsByLifetime(min, max byte) (int, error) {
+	var deleted int
+	for _, shard := range s.shards {
+		n, err := shard.DeleteBucketsByLifetime(min, max)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// Stats returns the sum of the statistics of all shards,
+// see Store.Stats.
+func (s *ShardedStore) Stats(opts StatsOptions) (StoreStats, error) {
+	var stats StoreStats
+	for _, shard := range s.shards {
+		shardStats, err := shard.Stats(opts)
+		if err != nil {
+			return stats, err
+		}
+		stats.Buckets += shardStats.Buckets
+		stats.Values += shardStats.Values
+		stats.DiskUsage += shardStats.DiskUsage
+		stats.Compactions += shardStats.Compactions
+		stats.CompactedBytes += shardStats.CompactedBytes
+	}
+	return stats, nil
+}
+
+// Sync makes the previous writes of all shards durable,
+// see Store.Sync.
+func (s *ShardedStore) Sync() error {
+	for _, shard := range s.shards {
+		if err := shard.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GC runs the garbage collector of all shards, see
+// Store.GC.
+func (s *ShardedStore) GC(ctx context.Context) error {
+	for _, shard := range s.shards {
+		if err := shard.GC(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Migrate upgrades the bucket data of all shards, see
+// Store.Migrate.
+func (s *ShardedStore) Migrate(ctx context.Context) (int, error) {
+	var migrated int
+	for _, shard := range s.shards {
+		n, err := shard.Migrate(ctx)
+		migrated += n
+		if err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
+// Close closes all shards. All shards are closed when one
+// fails, the first error is returned.
+func (s *ShardedStore) Close() error {
+	var firstErr error
+	for _, shard := range s.shards {
+		if err := shard.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupShardedStore creates a sharded store with n empty
+// test stores.
+func setupShardedStore(t *testing.T, n int) *ShardedStore {
+	shards := make([]Store, n)
+	for i := range shards {
+		shards[i] = SetupTestStore(t, false)
+	}
+	str, err := NewShardedStore(shards...)
+	require.NoError(t, err, "error occurred while creating sharded store")
+	return str
+}
+
+func TestShardedStoreRouting(t *testing.T) {
+	str := setupShardedStore(t, 4)
+	defer str.Close()
+
+	_, err := NewShardedStore()
+	assert.Equal(t, ErrNoShards, err, "sharded store without shards is created")
+
+	// Test whether a bucket is always routed to the same
+	// shard, and whether the lifetime and permissions don't
+	// affect the routing.
+	id := BucketID(make([]byte, BucketIDLength))
+	_, err = rand.Read(id[:14])
+	require.NoError(t, err, "error occurred while generating bucket id")
+	shard := str.ShardIndex(id)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, shard, str.ShardIndex(id), "bucket is routed to a different shard")
+	}
+	other := *id
+	other[14], other[15] = ^other[14], ^other[15]
+	assert.Equal(t, shard, str.ShardIndex(&other), "lifetime and permissions affect the routing")
+
+	// Test whether the bucket is only stored in its shard.
+	bkt, err := str.CreateBucket(id, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	for i, s := range str.Shards() {
+		exists, err := s.BucketExists(id)
+		require.NoError(t, err, "error occurred while checking bucket")
+		assert.Equal(t, i == shard, exists, "bucket is stored in the wrong shard")
+	}
+
+	fetched, err := str.GetBucket(id)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	assert.Equal(t, bkt.GetBucketKey(), fetched.GetBucketKey(), "fetched bucket has an incorrect key")
+	_, err = str.OpenBucket(id, TestBktKey)
+	assert.NoError(t, err, "error occurred while opening bucket")
+
+	require.NoError(t, str.DeleteBucket(bkt), "error occurred while deleting bucket")
+	exists, err := str.BucketExists(id)
+	assert.NoError(t, err, "error occurred while checking bucket")
+	assert.False(t, exists, "deleted bucket exists")
+
+	_, err = str.GetBucket(nil)
+	assert.Equal(t, ErrInvalidBucketID, err, "nil bucket id is routed")
+}
+
+func TestShardedStoreListBuckets(t *testing.T) {
+	str := setupShardedStore(t, 3)
+	defer str.Close()
+
+	// Create buckets until every shard contains a bucket.
+	created := make(map[[BucketIDLength]byte]bool)
+	used := make(map[int]bool)
+	for len(used) < len(str.Shards()) || len(created) < 16 {
+		id := BucketID(make([]byte, BucketIDLength))
+		_, err := rand.Read(id[:14])
+		require.NoError(t, err, "error occurred while generating bucket id")
+		_, err = str.CreateBucket(id, TestBktKey)
+		require.NoError(t, err, "error occurred while creating bucket")
+		created[*id] = true
+		used[str.ShardIndex(id)] = true
+	}
+
+	listed := make(map[[BucketIDLength]byte]bool)
+	require.NoError(t, str.ListBuckets(func(id BucketID, _ time.Time) bool {
+		listed[*id] = true
+		return true
+	}), "error occurred while listing buckets")
+	assert.Equal(t, created, listed, "listed buckets are not aggregated across shards")
+
+	// Test whether listing stops when fn returns false.
+	var n int
+	require.NoError(t, str.ListBuckets(func(BucketID, time.Time) bool {
+		n++
+		return false
+	}), "error occurred while listing buckets")
+	assert.Equal(t, 1, n, "listing continued after fn returned false")
+
+	stats, err := str.Stats(StatsOptions{})
+	require.NoError(t, err, "error occurred while fetching stats")
+	assert.Equal(t, uint64(len(created)), stats.Buckets, "stats are not aggregated across shards")
+}
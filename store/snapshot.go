@@ -0,0 +1,165 @@
+package store
+
+import (
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// defaultSnapshotTTL is the time to live of a snapshot when
+// StoreOptions.SnapshotTTL is not set.
+const defaultSnapshotTTL = time.Minute
+
+// storeSnapshot is a pebble snapshot that is shared between
+// calls using a token.
+type storeSnapshot struct {
+	snap    *pebble.Snapshot
+	expires time.Time // Time after which the snapshot can't be used anymore.
+}
+
+// OpenSnapshot opens a snapshot of the store.
+//
+// The returned token is opaque and can be passed to
+// GetValuesAt and CountAt to read from the same consistent
+// point in multiple calls. Snapshots keep pebble from reclaiming
+// old data, so each snapshot expires SnapshotTTL after it
+// is opened. Expired snapshots are released when a new
+// snapshot is opened and when GC runs.
+func (str *pebbleStore) OpenSnapshot() (string, error) {
+	done, err := str.beginOp()
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
+	buf := make([]byte, 16)
+	if err := str.readRandom(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	str.snapshotMtx.Lock()
+	defer str.snapshotMtx.Unlock()
+	str.releaseExpiredSnapshots()
+	if str.snapshots == nil {
+		str.snapshots = make(map[string]*storeSnapshot)
+	}
+	str.snapshots[token] = &storeSnapshot{
+		snap:    str.db.NewSnapshot(),
+		expires: str.now().Add(str.getSnapshotTTL()),
+	}
+	return token, nil
+}
+
+// GetValuesAt retrieves values from a bucket as they were
+// when the snapshot was opened.
+//
+// See Bucket.GetValues. ErrSnapshotNotFound is returned
+// when the token is unknown, closed or expired, and
+// ErrBucketNotFound when the bucket did not exist when the
+// snapshot was opened. Reading from a snapshot does not
+// refresh the timestamp of the bucket, and expired values
+// are skipped but not deleted.
+func (str *pebbleStore) GetValuesAt(token string, id BucketID, rng BucketRange) ([]BucketValue, error) {
+	done, err := str.beginOp()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	str.snapshotMtx.RLock()
+	defer str.snapshotMtx.RUnlock()
+
+	snap, err := str.getSnapshot(token, id)
+	if err != nil {
+		return nil, err
+	}
+	values, _, err := str.readValues(snap, id, rng, nil)
+	return values, err
+}
+
+// CountAt returns the amount of values in a range of a
+// bucket as it was when the snapshot was opened.
+//
+// The count is consistent with GetValuesAt, writes after
+// the snapshot was opened don't affect it. See GetValuesAt
+// for the returned errors. Expired values are not counted,
+// and rng.Limit and rng.Reverse are ignored.
+func (str *pebbleStore) CountAt(token string, id BucketID, rng BucketRange) (int, error) {
+	done, err := str.beginOp()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	str.snapshotMtx.RLock()
+	defer str.snapshotMtx.RUnlock()
+
+	snap, err := str.getSnapshot(token, id)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	_, err = str.scanValues(snap, id, rng, func(uint16, []byte, uint32) bool {
+		count++
+		return true
+	})
+	return count, err
+}
+
+// getSnapshot returns the pebble snapshot of a token, and
+// verifies that the bucket existed when it was opened. The
+// caller must hold the snapshotMtx read lock.
+func (str *pebbleStore) getSnapshot(token string, id BucketID) (*pebble.Snapshot, error) {
+	snapshot, ok := str.snapshots[token]
+	if !ok || !str.now().Before(snapshot.expires) {
+		return nil, ErrSnapshotNotFound
+	}
+
+	_, closer, err := snapshot.snap.Get(str.getPebbleBucketKey(id))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, ErrBucketNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return snapshot.snap, closer.Close()
+}
+
+// CloseSnapshot releases a snapshot.
+//
+// ErrSnapshotNotFound is returned when the token is unknown
+// or already released.
+func (str *pebbleStore) CloseSnapshot(token string) error {
+	str.snapshotMtx.Lock()
+	defer str.snapshotMtx.Unlock()
+
+	snapshot, ok := str.snapshots[token]
+	if !ok {
+		return ErrSnapshotNotFound
+	}
+	delete(str.snapshots, token)
+	return snapshot.snap.Close()
+}
+
+// releaseExpiredSnapshots releases all expired snapshots.
+// The caller must hold the snapshotMtx write lock.
+func (str *pebbleStore) releaseExpiredSnapshots() {
+	now := str.now()
+	for token, snapshot := range str.snapshots {
+		if !now.Before(snapshot.expires) {
+			delete(str.snapshots, token)
+			_ = snapshot.snap.Close()
+		}
+	}
+}
+
+// getSnapshotTTL returns the time to live of snapshots.
+func (str *pebbleStore) getSnapshotTTL() time.Duration {
+	if str.opts.SnapshotTTL > 0 {
+		return str.opts.SnapshotTTL
+	}
+	return defaultSnapshotTTL
+}
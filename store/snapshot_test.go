@@ -0,0 +1,101 @@
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	token, err := str.OpenSnapshot()
+	require.NoError(t, err, "error occurred while opening snapshot")
+
+	// Write to the bucket concurrently with snapshot reads.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			assert.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("new")}}))
+		}
+		assert.NoError(t, bkt.DeleteValues(BucketRange{Start: 1, End: 5}))
+	}()
+	for i := 0; i < 50; i++ {
+		values, err := str.GetValuesAt(token, TestBktID, BucketRange{Start: 0, End: 500})
+		assert.NoError(t, err, "error occurred while reading from snapshot")
+		assert.Equal(t, ExpectedBktValues, values, "snapshot reads are not consistent")
+	}
+	wg.Wait()
+
+	values, err := str.GetValuesAt(token, TestBktID, BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while reading from snapshot")
+	assert.Equal(t, ExpectedBktValues, values, "snapshot reads are not consistent after writes")
+
+	// Test whether buckets created after the snapshot are
+	// not visible.
+	_, err = str.CreateBucket(TestBktID2, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	_, err = str.GetValuesAt(token, TestBktID2, BucketRange{Start: 0, End: 500})
+	assert.Equal(t, ErrBucketNotFound, err, "bucket created after the snapshot is visible")
+
+	// Test whether the token can't be used after closing.
+	assert.NoError(t, str.CloseSnapshot(token), "error occurred while closing snapshot")
+	_, err = str.GetValuesAt(token, TestBktID, BucketRange{Start: 0, End: 500})
+	assert.Equal(t, ErrSnapshotNotFound, err, "closed snapshot can be read")
+	assert.Equal(t, ErrSnapshotNotFound, str.CloseSnapshot(token), "snapshot is closed twice")
+}
+
+func TestCountAt(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	token, err := str.OpenSnapshot()
+	require.NoError(t, err, "error occurred while opening snapshot")
+	defer str.CloseSnapshot(token)
+
+	// Test whether writes after the snapshot don't affect
+	// the count.
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("11")}, {Value: []byte("12")}}))
+	require.NoError(t, bkt.DeleteValues(BucketRange{Start: 1, End: 4}))
+	count, err := str.CountAt(token, TestBktID, BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while counting from snapshot")
+	assert.Equal(t, len(ExpectedBktValues), count, "snapshot count is affected by later writes")
+	count, err = str.CountAt(token, TestBktID, BucketRange{Start: 2, End: 6})
+	assert.NoError(t, err, "error occurred while counting from snapshot")
+	assert.Equal(t, 4, count, "snapshot count of range is incorrect")
+
+	_, err = str.CountAt(token, TestBktID2, BucketRange{Start: 0, End: 500})
+	assert.Equal(t, ErrBucketNotFound, err, "missing bucket is counted")
+	_, err = str.CountAt("invalid", TestBktID, BucketRange{Start: 0, End: 500})
+	assert.Equal(t, ErrSnapshotNotFound, err, "unknown snapshot is counted")
+}
+
+func TestSnapshotExpires(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	now := time.Date(2022, 11, 10, 12, 0, 0, 0, time.UTC)
+	str.(*pebbleStore).opts.Clock = func() time.Time { return now }
+	str.(*pebbleStore).opts.SnapshotTTL = time.Minute
+
+	token, err := str.OpenSnapshot()
+	require.NoError(t, err, "error occurred while opening snapshot")
+	_, err = str.GetValuesAt(token, TestBktID, BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while reading from snapshot")
+
+	// Test whether the snapshot expires and is released by
+	// opening a new snapshot.
+	now = now.Add(time.Minute)
+	_, err = str.GetValuesAt(token, TestBktID, BucketRange{Start: 0, End: 500})
+	assert.Equal(t, ErrSnapshotNotFound, err, "expired snapshot can be read")
+	_, err = str.OpenSnapshot()
+	require.NoError(t, err, "error occurred while opening snapshot")
+	assert.Len(t, str.(*pebbleStore).snapshots, 1, "expired snapshot is not released")
+}
@@ -0,0 +1,238 @@
+package store
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// StatsOptions contains the options for retrieving store
+// statistics.
+type StatsOptions struct {
+	Exact bool // Count the values with a full scan of the value table.
+}
+
+// StoreStats contains statistics of the store.
+type StoreStats struct {
+	Buckets   uint64 // Amount of buckets.
+	Values    uint64 // Amount of values, approximate unless StatsOptions.Exact is set.
+	DiskUsage uint64 // Estimated size on disk in bytes, excludes data that is not flushed.
+
+	Compactions    uint64 // Amount of compactions ran by RunCompactor.
+	CompactedBytes uint64 // Estimated size in bytes of the data compacted by RunCompactor.
+}
+
+// BucketStats contains statistics of a bucket.
+type BucketStats struct {
+	Values    uint64 // Amount of values.
+	LastIdx   uint16 // Highest idx in the bucket.
+	DiskUsage uint64 // Estimated size on disk in bytes, excludes data that is not flushed.
+}
+
+// SizeHistogram contains the size distribution of values.
+//
+// Counts[i] is the amount of values with a size in bytes
+// above 1<<(i-1) and at most 1<<i. The sum of Counts[0:i+1]
+// is the prometheus histogram bucket with upper bound
+// 1<<i. Counts is only as long as the largest value needs.
+type SizeHistogram struct {
+	Counts []uint64
+	Count  uint64 // Amount of values.
+	Min    int    // Size of the smallest value, 0 without values.
+	Max    int    // Size of the largest value.
+	Total  uint64 // Sum of the sizes of all values.
+}
+
+// UpperBound returns the largest size counted by Counts[i].
+func (h SizeHistogram) UpperBound(i int) int {
+	return 1 << i
+}
+
+// add counts a value of the given size.
+func (h *SizeHistogram) add(size int) {
+	i := 0
+	if size > 1 {
+		i = bits.Len(uint(size - 1))
+	}
+	for len(h.Counts) <= i {
+		h.Counts = append(h.Counts, 0)
+	}
+	h.Counts[i]++
+
+	if h.Count == 0 || size < h.Min {
+		h.Min = size
+	}
+	if size > h.Max {
+		h.Max = size
+	}
+	h.Count++
+	h.Total += uint64(size)
+}
+
+// Stats returns statistics of the store.
+//
+// The buckets are counted using the bucket table. Counting
+// the values exactly requires a full scan of the value
+// table, so by default the value count is approximated by
+// the sum of the highest idx of each bucket. The
+// approximation includes deleted values below the highest
+// idx.
+func (str *pebbleStore) Stats(opts StatsOptions) (StoreStats, error) {
+	done, err := str.beginOp()
+	if err != nil {
+		return StoreStats{}, err
+	}
+	defer done()
+
+	var stats StoreStats
+	iter := str.db.NewIter(&pebble.IterOptions{
+		LowerBound: str.getTableKey(bucketTable, 0),
+		UpperBound: str.getTableKey(bucketTable+1, 0),
+	})
+	for iter.First(); iter.Valid(); iter.Next() {
+		stats.Buckets++
+		if !opts.Exact {
+			lastIdx, err := str.readLastIdx(str.db, BucketID(str.getKeyID(iter.Key())))
+			if err != nil {
+				_ = iter.Close()
+				return stats, err
+			}
+			stats.Values += uint64(lastIdx)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return stats, err
+	}
+
+	if opts.Exact {
+		values, err := str.countKeys(str.db, str.getTableKey(valueTable, 0), str.getTableKey(valueTable+1, 0))
+		if err != nil {
+			return stats, err
+		}
+		stats.Values = values
+	}
+
+	diskUsage, err := str.db.EstimateDiskUsage(str.getTableKey(bucketTable, 0), str.getTableKey(valueTable+1, 0))
+	if err != nil {
+		return stats, err
+	}
+	stats.DiskUsage = diskUsage
+	stats.Compactions = str.compactions.Load()
+	stats.CompactedBytes = str.compactedBytes.Load()
+	return stats, nil
+}
+
+// Stats returns statistics of the bucket.
+//
+// The values of the bucket are always counted exactly,
+// which requires a scan of the values of the bucket.
+func (bkt *pebbleBucket) Stats() (BucketStats, error) {
+	done, err := bkt.store.beginOp()
+	if err != nil {
+		return BucketStats{}, err
+	}
+	defer done()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	lower, upper := bkt.store.getPebbleValueKeyRange(bkt.id)
+	values, err := bkt.store.countKeys(bkt.store.db, lower, upper)
+	if err != nil {
+		return BucketStats{}, err
+	}
+
+	diskUsage, err := bkt.store.db.EstimateDiskUsage(lower, upper)
+	if err != nil {
+		return BucketStats{}, err
+	}
+
+	bkt.mtx.Lock()
+	defer bkt.mtx.Unlock()
+	lastIdx, err := bkt.getLastIdx()
+	if err != nil {
+		return BucketStats{}, err
+	}
+	return BucketStats{
+		Values:    values,
+		LastIdx:   lastIdx,
+		DiskUsage: diskUsage,
+	}, nil
+}
+
+// ValueSizeHistogram returns the size distribution of the
+// values in a range of the bucket.
+//
+// The sizes exclude the value header. Values are not
+// copied, only their length is read from the iterator.
+// rng.Limit limits the amount of counted values and
+// expired values are skipped.
+func (bkt *pebbleBucket) ValueSizeHistogram(rng BucketRange) (SizeHistogram, error) {
+	var hist SizeHistogram
+	err := bkt.GetValuesNoCopy(rng, func(_ uint16, val []byte) bool {
+		hist.add(len(val))
+		return true
+	})
+	return hist, err
+}
+
+// countKeys counts the value keys between lower and upper.
+// Tombstones are not counted, they don't hold a value.
+func (str *pebbleStore) countKeys(reader pebble.Reader, lower, upper []byte) (uint64, error) {
+	iter := reader.NewIter(&pebble.IterOptions{
+		LowerBound: lower,
+		UpperBound: upper,
+	})
+
+	var count uint64
+	for iter.First(); iter.Valid(); iter.Next() {
+		if !str.isTombstone(iter.Value()) {
+			count++
+		}
+	}
+	return count, iter.Close()
+}
+
+// DebugString returns the state of the bucket decoded into
+// a human-readable form, for troubleshooting.
+//
+// The output contains the id, lifetime, permissions, access
+// and creation time, lastIdx and value count of the bucket.
+// It is read-only and doesn't refresh the access timestamp.
+// The format is not stable and should not be parsed.
+func (bkt *pebbleBucket) DebugString() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "bucket %s (%s)\n", EncodeBucketID(bkt.id), hex.EncodeToString(bkt.id[:]))
+	if lifetime := GetBucketLifetime(bkt.id); lifetime == 0 {
+		fmt.Fprintf(&b, "  lifetime:  infinite\n")
+	} else {
+		fmt.Fprintf(&b, "  lifetime:  %d days\n", lifetime)
+	}
+	fmt.Fprintf(&b, "  public:    %s\n", debugPermissions(GetBucketPermissions(bkt.id, false)))
+	fmt.Fprintf(&b, "  protected: %s\n", debugPermissions(GetBucketPermissions(bkt.id, true)))
+	fmt.Fprintf(&b, "  accessed:  %s\n", fromTimestamp(getTimestamp(bkt)).UTC().Format(time.RFC3339))
+	if created := bkt.GetCreationTime(); created.IsZero() {
+		fmt.Fprintf(&b, "  created:   unknown\n")
+	} else {
+		fmt.Fprintf(&b, "  created:   %s\n", created.UTC().Format(time.RFC3339))
+	}
+
+	stats, err := bkt.Stats()
+	if err != nil {
+		fmt.Fprintf(&b, "  error:     %v\n", err)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "  lastIdx:   %d\n", stats.LastIdx)
+	fmt.Fprintf(&b, "  values:    %d\n", stats.Values)
+	return b.String()
+}
+
+// debugPermissions formats permissions for DebugString.
+func debugPermissions(perms BucketPermissions) string {
+	return fmt.Sprintf("read=%t write=%t append=%t", perms.Read, perms.Write, perms.Append)
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	bkt2, err := str.CreateBucket(TestBktID2, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt2.AppendValues([]BucketValue{{Value: []byte("1")}, {Value: []byte("2")}}))
+	require.NoError(t, bkt.DeleteValues(BucketRange{Start: 2, End: 4}))
+
+	// Test whether the approximate value count includes the
+	// deleted values below the highest idx.
+	stats, err := str.Stats(StatsOptions{})
+	assert.NoError(t, err, "error occurred while fetching stats")
+	assert.Equal(t, uint64(2), stats.Buckets, "incorrect bucket count")
+	assert.Equal(t, uint64(12), stats.Values, "incorrect approximate value count")
+
+	stats, err = str.Stats(StatsOptions{Exact: true})
+	assert.NoError(t, err, "error occurred while fetching stats")
+	assert.Equal(t, uint64(2), stats.Buckets, "incorrect bucket count")
+	assert.Equal(t, uint64(10), stats.Values, "incorrect exact value count")
+
+	bktStats, err := bkt.Stats()
+	assert.NoError(t, err, "error occurred while fetching bucket stats")
+	assert.Equal(t, BucketStats{Values: 8, LastIdx: 10}, bktStats, "incorrect bucket stats")
+
+	// Test whether the disk usage is estimated after the
+	// data is flushed.
+	require.NoError(t, str.(*pebbleStore).db.Flush(), "error occurred while flushing store")
+	stats, err = str.Stats(StatsOptions{})
+	assert.NoError(t, err, "error occurred while fetching stats")
+	assert.Greater(t, stats.DiskUsage, uint64(0), "disk usage is not estimated")
+	bktStats, err = bkt2.Stats()
+	assert.NoError(t, err, "error occurred while fetching bucket stats")
+	assert.Greater(t, bktStats.DiskUsage, uint64(0), "bucket disk usage is not estimated")
+}
+
+func TestDebugString(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	debug := bkt.DebugString()
+	assert.Contains(t, debug, EncodeBucketID(TestBktID), "id is missing")
+	assert.Contains(t, debug, "0102030405060708090a0b0c0d0e", "hex id is missing")
+	assert.Contains(t, debug, "lifetime:  255 days", "lifetime is incorrect")
+	assert.Contains(t, debug, "public:    read=true write=true append=true", "public permissions are incorrect")
+	assert.Contains(t, debug, "protected: read=true write=true append=true", "protected permissions are incorrect")
+	assert.Contains(t, debug, "accessed:  1970-01-01T00:00:00Z", "access time is incorrect")
+	assert.Contains(t, debug, "created:   unknown", "creation time is incorrect")
+	assert.Contains(t, debug, "lastIdx:   10", "lastIdx is incorrect")
+	assert.Contains(t, debug, "values:    10", "value count is incorrect")
+	assert.Equal(t, uint32(0), getTimestamp(bkt.(*pebbleBucket)), "access timestamp is refreshed")
+}
+
+func TestValueSizeHistogram(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Add values with sizes 1, 2, 3, 4, 5 and 100.
+	var values []BucketValue
+	for _, size := range []int{1, 2, 3, 4, 5, 100} {
+		values = append(values, BucketValue{Value: make([]byte, size)})
+	}
+	require.NoError(t, bkt.AppendValues(values), "error occurred while appending values")
+
+	hist, err := bkt.ValueSizeHistogram(BucketRange{Start: 1, End: 100})
+	require.NoError(t, err, "error occurred while building histogram")
+	assert.Equal(t, []uint64{1, 1, 2, 1, 0, 0, 0, 1}, hist.Counts, "histogram has incorrect counts")
+	assert.Equal(t, uint64(6), hist.Count, "histogram has incorrect count")
+	assert.Equal(t, 1, hist.Min, "histogram has incorrect min")
+	assert.Equal(t, 100, hist.Max, "histogram has incorrect max")
+	assert.Equal(t, uint64(115), hist.Total, "histogram has incorrect total")
+	assert.Equal(t, 128, hist.UpperBound(len(hist.Counts)-1), "largest bucket has incorrect upper bound")
+
+	// Test whether the range and limit are applied.
+	hist, err = bkt.ValueSizeHistogram(BucketRange{Start: 2, End: 5, Limit: 2})
+	require.NoError(t, err, "error occurred while building histogram")
+	assert.Equal(t, []uint64{0, 1, 1}, hist.Counts, "histogram of range has incorrect counts")
+	assert.Equal(t, 2, hist.Min, "histogram of range has incorrect min")
+
+	hist, err = bkt.ValueSizeHistogram(BucketRange{Start: 200, End: 300})
+	require.NoError(t, err, "error occurred while building histogram")
+	assert.Equal(t, SizeHistogram{}, hist, "histogram of empty range is not empty")
+}
@@ -1,10 +1,15 @@
 package store
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/pebble"
@@ -16,6 +21,15 @@ var (
 	// BucketId.
 	ErrBucketNotFound = errors.New("store: bucket not found")
 
+	// ErrAppendOnly is returned when a value of an
+	// append-only bucket would be overwritten or deleted,
+	// see BucketOptions.AppendOnly.
+	ErrAppendOnly = errors.New("store: bucket is append-only")
+
+	// ErrInvalidBucketData is returned when the stored data
+	// of a bucket is too short to contain its key.
+	ErrInvalidBucketData = errors.New("store: invalid bucket data")
+
 	// ErrBucketAlreadyExists is returned when CreateBucket
 	// is called with an already existing BucketId.
 	ErrBucketAlreadyExists = errors.New("store: bucket already exists")
@@ -28,8 +42,149 @@ var (
 	// operation is attempted with a non-zero idx that is
 	// not equal to lastIdx+1.
 	ErrInvalidAppend = errors.New("store: the idx passed to Append is invalid")
+
+	// ErrTransactionConflict is returned when a
+	// transaction is committed while one of its buckets
+	// was written to after the transaction modified it.
+	ErrTransactionConflict = errors.New("store: transaction conflicts with a concurrent write")
+
+	// ErrTransactionDone is returned when a transaction is
+	// used after it is committed or discarded.
+	ErrTransactionDone = errors.New("store: transaction is already committed or discarded")
+
+	// ErrValueTooLarge is returned when a value exceeds
+	// the maximum value size.
+	ErrValueTooLarge = errors.New("store: value is too large")
+
+	// ErrIdxOutOfRange is returned when the idx of a
+	// value is outside the range of the operation.
+	ErrIdxOutOfRange = errors.New("store: idx is out of range")
+
+	// ErrUnauthorized is returned by OpenBucket when the key
+	// doesn't match the BucketKey.
+	ErrUnauthorized = errors.New("store: unauthorized")
+
+	// ErrPermissionDenied is returned when an operation on
+	// a bucket opened with OpenBucket is not permitted.
+	ErrPermissionDenied = errors.New("store: permission denied")
+
+	// ErrInvalidRange is returned when the Start of a
+	// BucketRange is after its End.
+	ErrInvalidRange = errors.New("store: range start is after end")
+
+	// ErrInvalidIdx is returned when an operation that
+	// requires an existing idx is called with idx 0, which
+	// is reserved for appends.
+	ErrInvalidIdx = errors.New("store: idx 0 is reserved for appends")
+
+	// ErrValueExists is returned by PutValuesIfAbsent when
+	// a value would overwrite an existing value.
+	ErrValueExists = errors.New("store: value already exists")
+
+	// ErrEmptyValue is returned when an empty value is
+	// written without BucketValue.Tombstone.
+	ErrEmptyValue = errors.New("store: empty value without tombstone")
+
+	// ErrChecksumMismatch is returned when a stored value
+	// does not match its checksum, see ChecksumError.
+	ErrChecksumMismatch = errors.New("store: value checksum mismatch")
+
+	// ErrInvalidValueHeader is returned when the header of
+	// a stored value is truncated.
+	ErrInvalidValueHeader = errors.New("store: invalid value header")
+
+	// ErrBatchTooLarge is returned when the values of a
+	// write exceed StoreOptions.MaxBatchBytes.
+	ErrBatchTooLarge = errors.New("store: write batch is too large")
+
+	// ErrValueTTLDisabled is returned when a value with an
+	// expiry is written to a store without ValueTTL.
+	ErrValueTTLDisabled = errors.New("store: value TTL is not enabled")
+
+	// ErrSequencesDisabled is returned by GetValuesSince
+	// when the store is opened without Sequences.
+	ErrSequencesDisabled = errors.New("store: value sequences are not enabled")
+
+	// ErrBucketBusy is returned by TryAppend when the lock
+	// of the bucket is held.
+	ErrBucketBusy = errors.New("store: bucket is busy")
+
+	// ErrRateLimited is returned when an operation exceeds
+	// the rate limit of a bucket, see RateLimiter.
+	ErrRateLimited = errors.New("store: bucket rate limit exceeded")
+
+	// ErrTombstonesDisabled is returned by
+	// GetValuesWithTombstones when the store is opened
+	// without Tombstones.
+	ErrTombstonesDisabled = errors.New("store: tombstones are not enabled")
+
+	// ErrInvalidNamespace is returned when the namespace of
+	// a store is longer than 255 bytes.
+	ErrInvalidNamespace = errors.New("store: invalid namespace")
+
+	// ErrReadOnly is returned when a write operation is
+	// used on a store that is opened in read-only mode.
+	ErrReadOnly = errors.New("store: store is opened in read-only mode")
+
+	// ErrSnapshotNotFound is returned when a snapshot
+	// token is unknown, closed or expired.
+	ErrSnapshotNotFound = errors.New("store: snapshot not found")
+
+	// ErrStoreClosed is returned when an operation is
+	// started after the store is closed.
+	ErrStoreClosed = errors.New("store: store is closed")
+
+	// ErrCounterMergerRequired is returned when a counter
+	// operation is used on a store that is not opened
+	// with the CounterMerger.
+	ErrCounterMergerRequired = errors.New("store: store is not opened with the counter merger")
+
+	// ErrMergeValueHeader is returned when merging into a
+	// value that is stored with a value header, the merger
+	// does not know the header.
+	ErrMergeValueHeader = errors.New("store: cannot merge into a value with a header")
 )
 
+// BucketError adds the bucket, idx and operation to an
+// error of a bucket operation. Use errors.Is to check the
+// underlying error.
+type BucketError struct {
+	ID  BucketID
+	Idx uint16 // Idx of the value that caused the error, 0 for appended values without an idx.
+	Op  string // Operation that failed, see OpGet.
+	Err error
+}
+
+// Error returns the error message.
+func (err *BucketError) Error() string {
+	return fmt.Sprintf("%v (%s, bucket %s, idx %d)", err.Err, err.Op, EncodeBucketID(err.ID), err.Idx)
+}
+
+// Unwrap returns the underlying error.
+func (err *BucketError) Unwrap() error {
+	return err.Err
+}
+
+// AppendConflictError is returned as the error of a
+// BucketError when an append has an idx that is not equal
+// to lastIdx+1. It wraps ErrInvalidAppend.
+type AppendConflictError struct {
+	// ExpectedIdx is the idx the value needed, which
+	// accounts for the values before it in the same call.
+	// 0 when the bucket is full.
+	ExpectedIdx uint16
+}
+
+// Error returns the error message.
+func (err *AppendConflictError) Error() string {
+	return fmt.Sprintf("%v, expected idx %d", ErrInvalidAppend, err.ExpectedIdx)
+}
+
+// Unwrap returns ErrInvalidAppend.
+func (err *AppendConflictError) Unwrap() error {
+	return ErrInvalidAppend
+}
+
 // Store manages and keeps track of buckets.
 //
 // Each of these buckets contain a list with bucket values.
@@ -45,14 +200,110 @@ type Store interface {
 	// GetBucket retrieves a bucket.
 	GetBucket(id BucketID) (Bucket, error)
 
+	// BucketExists returns whether a bucket exists.
+	BucketExists(id BucketID) (bool, error)
+
+	// GetBucketInfo returns the information and state of
+	// a bucket.
+	GetBucketInfo(id BucketID) (*BucketInfo, error)
+
+	// MultiGetValues retrieves the same range of values
+	// from multiple buckets.
+	MultiGetValues(ids []BucketID, rng BucketRange) (map[BucketID][]BucketValue, error)
+
 	// CreateBucket creates a new bucket.
 	CreateBucket(id BucketID, key BucketKey) (Bucket, error)
 
+	// CreateBucketWithOptions creates a new bucket with the
+	// given options.
+	CreateBucketWithOptions(id BucketID, key BucketKey, opts BucketOptions) (Bucket, error)
+
+	// OpenBucket retrieves a bucket that only allows the
+	// operations permitted by the given key.
+	OpenBucket(id BucketID, key BucketKey) (Bucket, error)
+
 	// DeleteBucket deletes a bucket.
 	DeleteBucket(bkt Bucket) error
 
+	// CloneBucket creates a new bucket with a copy of the
+	// values of a bucket.
+	CloneBucket(src BucketID, lifetime byte, public, protected BucketPermissions) (Bucket, error)
+
+	// NewTransaction creates a new transaction.
+	NewTransaction() Transaction
+
+	// NewAppendCoalescer starts a coalescer that writes the
+	// appends of many goroutines in a single batch.
+	NewAppendCoalescer(window time.Duration) *AppendCoalescer
+
+	// OpenSnapshot opens a snapshot of the store.
+	OpenSnapshot() (string, error)
+
+	// GetValuesAt retrieves values from a bucket as they
+	// were when the snapshot was opened.
+	GetValuesAt(token string, id BucketID, rng BucketRange) ([]BucketValue, error)
+
+	// CountAt returns the amount of values in a range of a
+	// bucket as it was when the snapshot was opened.
+	CountAt(token string, id BucketID, rng BucketRange) (int, error)
+
+	// CloseSnapshot releases a snapshot.
+	CloseSnapshot(token string) error
+
+	// Watch subscribes to the changes of a bucket.
+	Watch(id BucketID) (<-chan BucketChangeEvent, func())
+
+	// ListBuckets iterates over all buckets in the store.
+	ListBuckets(fn func(id BucketID, lastAccess time.Time) bool) error
+
+	// CreatedBetween iterates over the buckets created
+	// within a time window.
+	CreatedBetween(start, end time.Time, fn func(id BucketID) bool) error
+
+	// AccessInfo returns the permissions for accessing a
+	// bucket with the given key.
+	AccessInfo(id BucketID, key BucketKey) (perms BucketPermissions, authorized bool, err error)
+
+	// Stats returns statistics of the store.
+	Stats(opts StatsOptions) (StoreStats, error)
+
+	// Sync makes all previous writes durable.
+	Sync() error
+
+	// Verify checks the consistency of the store.
+	Verify(ctx context.Context) (VerifyReport, error)
+
+	// Repair fixes the problems found by Verify.
+	Repair(ctx context.Context) (VerifyReport, error)
+
+	// Migrate upgrades the bucket data of all buckets to
+	// the current layout.
+	Migrate(ctx context.Context) (int, error)
+
+	// Export writes all buckets and values of the store to
+	// a writer.
+	Export(ctx context.Context, w io.Writer) error
+
+	// ForEachValue calls fn for each value in the store.
+	ForEachValue(fn func(id BucketID, val BucketValue) error) error
+
+	// Import restores an export into an empty store.
+	Import(r io.Reader) error
+
+	// RunCompactor compacts the store periodically until the
+	// context is canceled.
+	RunCompactor(ctx context.Context, interval time.Duration) error
+
+	// DeleteBucketsByLifetime deletes all buckets with a
+	// lifetime between min and max.
+	DeleteBucketsByLifetime(min, max byte) (int, error)
+
+	// Evict removes the least recently accessed buckets when
+	// the store exceeds StoreOptions.MaxBytes.
+	Evict(ctx context.Context) ([]BucketID, error)
+
 	// GC cleans up the cache and removes expired buckets.
-	GC() error
+	GC(ctx context.Context) error
 
 	// Close closes the store.
 	Close() error
@@ -60,55 +311,224 @@ type Store interface {
 
 // pebbleStore implements the Store interface.
 type pebbleStore struct {
-	opts     *StoreOptions // Options for the underlying Pebble store.
-	db       *pebble.DB    // Underlying Pebble store.
-	gcTicker *time.Ticker  // GC ticker.
-	cache    sync.Map      // Cache with buckets.
+	opts     *StoreOptions      // Options for the underlying Pebble store.
+	db       *pebble.DB         // Underlying Pebble store.
+	counters bool               // Whether db is opened with the CounterMerger, see StoreOptions.Merger.
+	ownsDB   bool               // Whether db is closed by Close, see NewStore.
+	prefix   []byte             // Prefix of all keys, see StoreOptions.Namespace.
+	gcTicker *time.Ticker       // GC ticker.
+	cache    sync.Map           // Cache with buckets.
+	ctx      context.Context    // Context that is canceled when the store is closed.
+	cancel   context.CancelFunc // Cancels ctx.
+
+	locks [bucketLockShards]sync.RWMutex // Bucket locks, see getBucketLock.
+
+	watchMtx sync.RWMutex                        // Mutex guarding the watchers field.
+	watchers map[[BucketIDLength]byte][]*watcher // Watchers of each bucket.
+
+	snapshotMtx sync.RWMutex              // Mutex guarding the snapshots field.
+	snapshots   map[string]*storeSnapshot // Open snapshots by token.
+
+	maintenance chan struct{} // Semaphore limiting concurrent maintenance jobs, see runMaintenance.
+
+	gcBatchHook func(size int) // Called after each applied GC batch, used for testing.
+
+	closeMtx   sync.RWMutex   // Mutex guarding the closed field, see beginOp.
+	closed     bool           // Whether Close is called.
+	ops        sync.WaitGroup // Operations that are in progress, drained by Close.
+	background sync.WaitGroup // Background goroutines, stopped by Close.
+
+	compactions    atomic.Uint64 // Amount of compactions ran by RunCompactor.
+	compactedBytes atomic.Uint64 // Estimated bytes compacted by RunCompactor.
+	lastIdxScans   atomic.Uint64 // Amount of lastIdx scans, used for testing.
+
+	seqMtx   sync.Mutex // Mutex guarding the seq and seqLimit fields.
+	seq      uint64     // Last handed out sequence number, see nextSequence.
+	seqLimit uint64     // Highest sequence number reserved on disk.
+
+	values *valueCache // Cache of recently read values, nil when disabled.
 }
 
 // StoreOptions contains the configuration options for the
 // store.
 type StoreOptions struct {
-	PebbleOpts *pebble.Options // Options for the underlying Pebble store.
-	CacheTTL   uint32          // Time to live for cached buckets in hours. (default: 24)
-	GCInterval uint32          // Interval for triggering the GC function in hours. (default: 6)
+	PebbleOpts      *pebble.Options       // Options for the underlying Pebble store.
+	CacheTTL        uint32                // Time to live for cached buckets in hours. (default: 24)
+	GCInterval      uint32                // Interval for triggering the GC function in hours. (default: 6)
+	GCBatchSize     uint32                // Maximum amount of expired buckets deleted in a single batch. (default: 64)
+	Clock           func() time.Time      // Returns the current time. (default: time.Now)
+	SnapshotTTL     time.Duration         // Time to live of snapshots opened with OpenSnapshot. (default: 1 minute)
+	MaintenanceJobs uint32                // Maximum amount of maintenance jobs running at the same time. (default: 1)
+	PreallocLimit   uint32                // Maximum amount of values preallocated by GetValues. (default: 2048)
+	CacheSize       int64                 // Size of the Pebble block cache in bytes, 0 uses the cache of PebbleOpts.
+	WALDir          string                // Directory of the Pebble write-ahead log, empty uses the store path.
+	ReadOnly        bool                  // Open the store in read-only mode, write operations return ErrReadOnly.
+	Checksums       bool                  // Store values with a CRC32C checksum that is verified on read, merging into checksummed values returns ErrMergeValueHeader.
+	ValueTTL        bool                  // Allow values with an expiry, see BucketValue.Expires.
+	RequestTTL      time.Duration         // Time a request id of AppendValuesIdempotent is remembered. (default: 10 minutes)
+	MaxBytes        uint64                // Estimated disk usage after which buckets are evicted, 0 disables eviction.
+	EvictPermanent  bool                  // Allow eviction of buckets with an infinite lifetime.
+	RandSource      RandSource            // Source of random bytes for generated ids, keys and tokens. (default: crypto/rand.Reader)
+	Metrics         MetricsCollector      // Receives metrics of operations and GC, nil disables metrics.
+	MaxValueSize    int                   // Maximum size of a value in bytes, larger values return ErrValueTooLarge. 0 disables the limit.
+	ValueQuota      func(id BucketID) int // Returns the maximum amount of values in a bucket for PutValues and AppendValues, 0 for no quota. nil disables quotas.
+	Sequences       bool                  // Store values with a store-wide sequence number, see Bucket.GetValuesSince.
+	Namespace       string                // Isolates the keys of the store from other namespaces in the same Pebble store, empty uses no namespace.
+	SyncTimestamps  bool                  // Sync the timestamp refreshes of reads, so GC never sees an older access time after a crash.
+	MaxBatchBytes   int                   // Maximum estimated size of the batch of a PutValues or AppendValues call in bytes, larger writes return ErrBatchTooLarge. 0 disables the limit.
+	SplitBatches    bool                  // Write values exceeding MaxBatchBytes in multiple batches instead of returning ErrBatchTooLarge, which makes the write not atomic.
+	ValueCacheBytes int64                 // Size in bytes of the cache of values read by GetValue and GetValues, 0 disables the cache.
+	Tombstones      bool                  // Store freed values as tombstones instead of deleting them, see Bucket.GetValuesWithTombstones.
+	WriteLimiter    RateLimiter           // Limits PutValues, AppendValues and DeleteValues of a bucket, see NewTokenBucketLimiter. nil disables the limit.
+	ReadLimiter     RateLimiter           // Limits GetValue and GetValues of a bucket, see NewTokenBucketLimiter. nil disables the limit.
+	Merger          *pebble.Merger        // Merger of the Pebble store passed to NewStore, which can't be read from the Pebble store. OpenStore uses the merger of PebbleOpts.
 }
 
+// defaultPreallocLimit is the maximum amount of values
+// preallocated by GetValues when StoreOptions.PreallocLimit
+// is not set.
+const defaultPreallocLimit = 2048
+
 // OpenStore opens a new store instance using the given
 // options.
+//
+// CacheSize, WALDir and ReadOnly are applied to a copy of
+// PebbleOpts, the options of the caller are not modified.
 func OpenStore(path string, opts *StoreOptions) (str Store, err error) {
 	if opts == nil {
-		opts = &StoreOptions{
-			PebbleOpts: &pebble.Options{},
-			CacheTTL:   24,
-			GCInterval: 6,
-		}
+		opts = defaultStoreOptions()
+	}
+
+	storeOpts := *opts
+	opts = &storeOpts
+	if opts.PebbleOpts == nil {
+		opts.PebbleOpts = &pebble.Options{}
+	} else {
+		opts.PebbleOpts = opts.PebbleOpts.Clone()
 	}
 
+	// Pebble takes its own reference to the cache, so our
+	// reference is released after opening the store.
+	if opts.CacheSize > 0 {
+		cache := pebble.NewCache(opts.CacheSize)
+		defer cache.Unref()
+		opts.PebbleOpts.Cache = cache
+	}
+	if opts.WALDir != "" {
+		opts.PebbleOpts.WALDir = opts.WALDir
+	}
+	if opts.ReadOnly {
+		opts.PebbleOpts.ReadOnly = true
+	}
+	opts.Merger = opts.PebbleOpts.Merger
+
 	db, err := pebble.Open(path, opts.PebbleOpts)
 	if err != nil {
 		return nil, err
 	}
 
+	pebbleStr, err := newStore(db, opts)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	pebbleStr.ownsDB = true
+	return pebbleStr, nil
+}
+
+// NewStore creates a store using an open Pebble store.
+//
+// Stores with different namespaces can share a Pebble
+// store, see StoreOptions.Namespace. The Pebble store is
+// not closed by Close, and PebbleOpts, CacheSize and WALDir
+// are ignored. Merger must be the merger the Pebble store
+// is opened with, so counters can be used.
+func NewStore(db *pebble.DB, opts *StoreOptions) (Store, error) {
+	if opts == nil {
+		opts = defaultStoreOptions()
+	}
+	storeOpts := *opts
+	return newStore(db, &storeOpts)
+}
+
+// defaultStoreOptions returns the options used when no
+// options are given.
+func defaultStoreOptions() *StoreOptions {
+	return &StoreOptions{
+		PebbleOpts:      &pebble.Options{},
+		CacheTTL:        24,
+		GCInterval:      6,
+		GCBatchSize:     defaultGCBatchSize,
+		MaintenanceJobs: 1,
+	}
+}
+
+// defaultGCBatchSize is the default of
+// StoreOptions.GCBatchSize.
+const defaultGCBatchSize = 64
+
+// gcBatchSize returns the amount of buckets or requests
+// deleted in a single batch, a GCBatchSize of 0 uses
+// defaultGCBatchSize.
+func (str *pebbleStore) gcBatchSize() int {
+	if str.opts.GCBatchSize == 0 {
+		return defaultGCBatchSize
+	}
+	return int(str.opts.GCBatchSize)
+}
+
+// newStore creates a store using an open Pebble store and
+// starts its background jobs.
+func newStore(db *pebble.DB, opts *StoreOptions) (*pebbleStore, error) {
+	prefix, err := getNamespacePrefix(opts.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	maintenanceJobs := opts.MaintenanceJobs
+	if maintenanceJobs == 0 {
+		maintenanceJobs = 1
+	}
+
+	pebbleStr := &pebbleStore{
+		opts:        opts,
+		db:          db,
+		ctx:         ctx,
+		cancel:      cancel,
+		maintenance: make(chan struct{}, maintenanceJobs),
+		prefix:      prefix,
+		values:      newValueCache(opts.ValueCacheBytes),
+		counters:    opts.Merger != nil && opts.Merger.Name == CounterMerger.Name,
+	}
+	if opts.Sequences {
+		if err := pebbleStr.loadSequence(); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
 	// Start the GC ticker, the ticker will call GC
 	// periodically and is stopped when the store is closed.
-	var gcTicker *time.Ticker
 	if opts.GCInterval > 0 {
-		gcTicker = time.NewTicker(time.Duration(opts.GCInterval) * time.Hour)
+		pebbleStr.gcTicker = time.NewTicker(time.Duration(opts.GCInterval) * time.Hour)
+		pebbleStr.background.Add(1)
 		go func() {
-			for range gcTicker.C {
-				if err := str.GC(); err != nil {
-					panic(err)
+			defer pebbleStr.background.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-pebbleStr.gcTicker.C:
+					if err := pebbleStr.GC(ctx); err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, ErrStoreClosed) {
+						panic(err)
+					}
 				}
 			}
 		}()
 	}
 
-	return &pebbleStore{
-		opts:     opts,
-		db:       db,
-		gcTicker: gcTicker,
-	}, nil
+	return pebbleStr, nil
 }
 
 // GetBucket retrieves a bucket.
@@ -118,13 +538,48 @@ func OpenStore(path string, opts *StoreOptions) (str Store, err error) {
 // store. If the bucket is not found in the store,
 // ErrBucketNotFound is returned.
 func (str *pebbleStore) GetBucket(id BucketID) (Bucket, error) {
-	if bkt, ok := str.cache.Load(id); ok {
+	if id == nil {
+		return nil, ErrInvalidBucketID
+	} else if bkt, ok := str.cache.Load(*id); ok {
 		return bkt.(*pebbleBucket), nil
 	}
 
-	data, closer, err := str.db.Get(getPebbleBucketKey(id))
+	done, err := str.beginOp()
 	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return str.getBucket(id)
+}
+
+// getBucket retrieves a bucket, see GetBucket. The caller
+// must have registered an operation, see beginOp.
+func (str *pebbleStore) getBucket(id BucketID) (Bucket, error) {
+	if id == nil {
+		return nil, ErrInvalidBucketID
+	} else if bkt, ok := str.cache.Load(*id); ok {
+		return bkt.(*pebbleBucket), nil
+	}
+
+	stored, closer, err := str.db.Get(str.getPebbleBucketKey(id))
+	if errors.Is(err, pebble.ErrNotFound) {
 		return nil, ErrBucketNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	// The stored data is only valid until the closer is
+	// closed, so it must be copied.
+	data := append([]byte(nil), stored...)
+	if err := closer.Close(); err != nil {
+		return nil, err
+	}
+
+	// Older layouts are upgraded in memory, and written in
+	// the current layout with the next access timestamp.
+	data, _, err = migrateBucketData(data)
+	if err != nil {
+		return nil, err
 	}
 
 	bkt := &pebbleBucket{
@@ -132,25 +587,164 @@ func (str *pebbleStore) GetBucket(id BucketID) (Bucket, error) {
 		data:  data,
 		store: str,
 	}
-	bkt.lastIdx = fetchLastIdx(bkt)
 
 	// Use LoadOrStore to avoid race conditions.
-	cache, _ := str.cache.LoadOrStore(id, bkt)
-	return cache.(*pebbleBucket), closer.Close()
+	cache, _ := str.cache.LoadOrStore(*id, bkt)
+	return cache.(*pebbleBucket), nil
+}
+
+// BucketExists returns whether a bucket exists.
+//
+// Unlike GetBucket, the bucket is not loaded into the cache
+// and its access timestamp is not refreshed, so checking
+// whether a bucket exists doesn't keep it from expiring.
+func (str *pebbleStore) BucketExists(id BucketID) (bool, error) {
+	if id == nil {
+		return false, ErrInvalidBucketID
+	} else if _, ok := str.cache.Load(*id); ok {
+		return true, nil
+	}
+
+	done, err := str.beginOp()
+	if err != nil {
+		return false, err
+	}
+	defer done()
+
+	_, closer, err := str.db.Get(str.getPebbleBucketKey(id))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, closer.Close()
+}
+
+// GetBucketInfo returns the information and state of a
+// bucket.
+//
+// Like BucketExists, the bucket is not loaded into the
+// cache and its access timestamp is not refreshed. When the
+// bucket is not found, ErrBucketNotFound is returned.
+func (str *pebbleStore) GetBucketInfo(id BucketID) (*BucketInfo, error) {
+	if id == nil {
+		return nil, ErrInvalidBucketID
+	}
+	done, err := str.beginOp()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	lock := str.getBucketLock(id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	// Use the cached bucket when available, otherwise read
+	// the bucket data without caching it.
+	var bkt *pebbleBucket
+	if cached, ok := str.cache.Load(*id); ok {
+		bkt = cached.(*pebbleBucket)
+	} else {
+		stored, closer, err := str.db.Get(str.getPebbleBucketKey(id))
+		if errors.Is(err, pebble.ErrNotFound) {
+			return nil, ErrBucketNotFound
+		} else if err != nil {
+			return nil, err
+		}
+		data := append([]byte(nil), stored...)
+		if err := closer.Close(); err != nil {
+			return nil, err
+		}
+		if data, _, err = migrateBucketData(data); err != nil {
+			return nil, err
+		}
+		bkt = &pebbleBucket{id: id, data: data, store: str}
+	}
+
+	info := &BucketInfo{
+		ID:         EncodeBucketID(id),
+		Lifetime:   GetBucketLifetime(id),
+		Public:     GetBucketPermissions(id, false),
+		Protected:  GetBucketPermissions(id, true),
+		LastAccess: fromTimestamp(getTimestamp(bkt)),
+		Created:    bkt.GetCreationTime(),
+	}
+
+	bkt.mtx.Lock()
+	info.LastIdx, err = bkt.getLastIdx()
+	bkt.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = str.scanValues(str.db, id, BucketRange{Start: 0, End: math.MaxUint16}, func(uint16, []byte, uint32) bool {
+		info.Count++
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
 }
 
 // CreateBucket creates a new bucket.
 //
 // When a bucket for the given BucketId already exists,
-// ErrBucketAlreadyExists is returned.
-func (str *pebbleStore) CreateBucket(id BucketID, key BucketKey) (Bucket, error) {
-	if bkt, err := str.GetBucket(id); !errors.Is(err, ErrBucketNotFound) {
+// ErrBucketAlreadyExists is returned. The bucket lock is
+// held while checking and writing the bucket, so an
+// existing bucket is never overwritten.
+func (str *pebbleStore) CreateBucket(id BucketID, key BucketKey) (_ Bucket, err error) {
+	defer str.track(OpCreateBucket)(&err)
+	done, err := str.beginWrite()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return str.createBucket(id, key, BucketOptions{})
+}
+
+// BucketOptions contains the options of a bucket. The
+// options are stored with the bucket and can't be changed
+// after the bucket is created.
+type BucketOptions struct {
+	// AppendOnly rejects all writes that overwrite or
+	// delete values with ErrAppendOnly. Values can only be
+	// appended, and are only removed when they expire or
+	// the bucket is deleted.
+	AppendOnly bool
+}
+
+// CreateBucketWithOptions creates a new bucket with the
+// given options, see CreateBucket.
+func (str *pebbleStore) CreateBucketWithOptions(id BucketID, key BucketKey, opts BucketOptions) (_ Bucket, err error) {
+	defer str.track(OpCreateBucket)(&err)
+	done, err := str.beginWrite()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return str.createBucket(id, key, opts)
+}
+
+// createBucket creates a new bucket, see CreateBucket. The
+// caller must have registered a write, see beginWrite.
+func (str *pebbleStore) createBucket(id BucketID, key BucketKey, opts BucketOptions) (Bucket, error) {
+	lock := str.getBucketLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+	if bkt, err := str.getBucket(id); !errors.Is(err, ErrBucketNotFound) {
 		return bkt, ErrBucketAlreadyExists
 	}
 
-	data := make([]byte, 4+BucketKeyLength)
-	binary.BigEndian.PutUint32(data[:4], getCurrentTimestamp())
+	now := str.getCurrentTimestamp()
+	data := newBucketData()
+	binary.BigEndian.PutUint32(data[:4], now)
 	copy(data[4:], key[:])
+	binary.BigEndian.PutUint32(data[4+BucketKeyLength:], now)
+	if opts.AppendOnly {
+		data[8+BucketKeyLength] |= bucketFlagAppendOnly
+	}
 	bkt := &pebbleBucket{
 		store: str,
 		id:    id,
@@ -159,34 +753,264 @@ func (str *pebbleStore) CreateBucket(id BucketID, key BucketKey) (Bucket, error)
 
 	// Check whether bucket does not exist to avoid
 	// race conditions.
-	if cache, loaded := str.cache.LoadOrStore(id, bkt); loaded {
+	if cache, loaded := str.cache.LoadOrStore(*id, bkt); loaded {
 		return cache.(*pebbleBucket), ErrBucketAlreadyExists
 	}
 
-	return bkt, str.db.Set(getPebbleBucketKey(bkt.id), bkt.data, nil)
+	if err := str.db.Set(str.getPebbleBucketKey(bkt.id), bkt.data, nil); err != nil {
+		str.cache.Delete(*id)
+		return nil, err
+	}
+	return bkt, nil
 }
 
 // DeleteBucket deletes a bucket.
 //
 // Deleting a bucket removes the bucket from the cache and
 // underlying pebble store, this includes all the related
-// bucket values.
-func (str *pebbleStore) DeleteBucket(bkt Bucket) error {
-	if err := bkt.DeleteValues(BucketRange{Start: 0, End: math.MaxUint16}); err != nil {
+// bucket values. A bucket opened with OpenBucket requires
+// write permission.
+func (str *pebbleStore) DeleteBucket(bkt Bucket) (err error) {
+	defer str.track(OpDeleteBucket)(&err)
+	pebbleBkt, err := unwrapBucket(bkt, func(perms BucketPermissions) bool { return perms.Write })
+	if err != nil {
+		return err
+	}
+	done, err := str.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	lock := str.getBucketLock(bkt.GetBucketID())
+	lock.Lock()
+	defer lock.Unlock()
+
+	batch := str.db.NewBatch()
+	defer batch.Close()
+	if err := str.deleteBucket(batch, bkt.GetBucketID()); err != nil {
+		return err
+	}
+
+	if err := str.db.Apply(batch, nil); err != nil {
 		return err
 	}
 
-	str.cache.Delete(bkt.GetBucketID())
-	return str.db.Delete(getPebbleBucketKey(bkt.(*pebbleBucket).id), nil)
+	pebbleBkt.mtx.Lock()
+	pebbleBkt.lastIdx = 0
+	pebbleBkt.countLoaded = false
+	pebbleBkt.mtx.Unlock()
+	str.cache.Delete(*bkt.GetBucketID())
+	str.values.invalidate(bkt.GetBucketID())
+	return nil
+}
+
+// DeleteBucketsByLifetime deletes all buckets with a
+// lifetime between min and max, inclusive, and returns the
+// amount of deleted buckets.
+//
+// Buckets with an infinite lifetime have a lifetime of 0,
+// so these are only deleted when min is 0. Buckets are
+// deleted in batches of GCBatchSize buckets.
+func (str *pebbleStore) DeleteBucketsByLifetime(min, max byte) (int, error) {
+	done, err := str.beginWrite()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	iter := str.db.NewIter(&pebble.IterOptions{
+		LowerBound: str.getTableKey(bucketTable, 0),
+		UpperBound: str.getTableKey(bucketTable+1, 0),
+	})
+	batch := str.db.NewBatch()
+	closeAll := func() {
+		_ = batch.Close()
+		_ = iter.Close()
+	}
+
+	var deleted int
+	var ids []BucketID
+	for iter.First(); iter.Valid(); iter.Next() {
+		id := new([BucketIDLength]byte)
+		copy(id[:], str.getKeyID(iter.Key()))
+		if lifetime := GetBucketLifetime(id); lifetime < min || lifetime > max {
+			continue
+		}
+
+		if err := str.deleteBucket(batch, id); err != nil {
+			closeAll()
+			return deleted, err
+		}
+		ids = append(ids, id)
+
+		// Apply the batch when it is full.
+		if len(ids) >= str.gcBatchSize() {
+			if err := str.applyDeletedBuckets(batch, ids); err != nil {
+				closeAll()
+				return deleted, err
+			}
+			deleted, ids = deleted+len(ids), ids[:0]
+			_ = batch.Close()
+			batch = str.db.NewBatch()
+		}
+	}
+
+	if len(ids) > 0 {
+		if err := str.applyDeletedBuckets(batch, ids); err != nil {
+			closeAll()
+			return deleted, err
+		}
+		deleted += len(ids)
+	}
+	_ = batch.Close()
+	return deleted, iter.Close()
+}
+
+// applyDeletedBuckets applies a batch that deletes the
+// given buckets, and forgets the deleted buckets.
+func (str *pebbleStore) applyDeletedBuckets(batch *pebble.Batch, ids []BucketID) error {
+	if err := str.db.Apply(batch, nil); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		str.forgetBucket(id)
+	}
+	return nil
+}
+
+// forgetBucket removes a deleted bucket from the cache, and
+// resets the lastIdx of handles that are still in use.
+func (str *pebbleStore) forgetBucket(id BucketID) {
+	str.values.invalidate(id)
+	if cached, ok := str.cache.LoadAndDelete(*id); ok {
+		bkt := cached.(*pebbleBucket)
+		bkt.mtx.Lock()
+		bkt.lastIdx = 0
+		bkt.countLoaded = false
+		bkt.mtx.Unlock()
+	}
+}
+
+// AccessInfo returns the permissions for accessing a
+// bucket with the given key.
+//
+// The key is authorized when it is equal to the BucketKey of
+// the bucket, the keys are compared in constant time. A nil
+// key is never authorized. The returned permissions are the
+// effective permissions for the (un)authorized key.
+func (str *pebbleStore) AccessInfo(id BucketID, key BucketKey) (BucketPermissions, bool, error) {
+	bkt, err := str.GetBucket(id)
+	if err != nil {
+		return BucketPermissions{}, false, err
+	}
+
+	authorized := isAuthorized(bkt, key)
+	return GetBucketPermissions(id, authorized), authorized, nil
+}
+
+// ListBuckets iterates over all buckets in the store.
+//
+// Only the bucket table is scanned, the values of the
+// buckets are not read. fn receives a copy of the BucketId
+// and the last access time of the bucket, which has a
+// precision of one hour. Together with GetBucketLifetime
+// this tells when a bucket expires. Iteration stops when fn
+// returns false. Buckets of an unknown layout are skipped,
+// see Migrate.
+func (str *pebbleStore) ListBuckets(fn func(id BucketID, lastAccess time.Time) bool) error {
+	done, err := str.beginOp()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	iter := str.db.NewIter(&pebble.IterOptions{
+		LowerBound: str.getTableKey(bucketTable, 0),
+		UpperBound: str.getTableKey(bucketTable+1, 0),
+	})
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		if _, _, err := migrateBucketData(iter.Value()); err != nil {
+			continue
+		}
+		id := new([BucketIDLength]byte)
+		copy(id[:], str.getKeyID(iter.Key()))
+		lastAccess := fromTimestamp(binary.BigEndian.Uint32(iter.Value()))
+		if !fn(id, lastAccess) {
+			break
+		}
+	}
+	return iter.Close()
+}
+
+// CreatedBetween iterates over the buckets created within a
+// time window.
+//
+// The window includes start and excludes end, creation
+// times have a precision of one hour. Buckets created
+// before creation times were stored are skipped. Iteration
+// stops when fn returns false.
+func (str *pebbleStore) CreatedBetween(start, end time.Time, fn func(id BucketID) bool) error {
+	done, err := str.beginOp()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	startTs, endTs := toTimestamp(start), toTimestamp(end)
+	iter := str.db.NewIter(&pebble.IterOptions{
+		LowerBound: str.getTableKey(bucketTable, 0),
+		UpperBound: str.getTableKey(bucketTable+1, 0),
+	})
+
+	bkt := &pebbleBucket{store: str}
+	for iter.First(); iter.Valid(); iter.Next() {
+		bkt.data = iter.Value()
+		created := getCreationTimestamp(bkt)
+		if created == 0 || created < startTs || created >= endTs {
+			continue
+		}
+
+		id := new([BucketIDLength]byte)
+		copy(id[:], str.getKeyID(iter.Key()))
+		if !fn(id) {
+			break
+		}
+	}
+	return iter.Close()
 }
 
 // GC cleans up the cache and removes expired buckets.
 //
 // This function is called periodically by the GC ticker and
-// is normally not called manually.
-func (str *pebbleStore) GC() error {
+// is normally not called manually. Expired buckets are
+// deleted in batches of GCBatchSize buckets, the context is
+// checked between batches so a long running GC can be
+// canceled. Expired request ids are deleted, buckets are
+// evicted when MaxBytes is set, see Evict, and when
+// ValueTTL is enabled, expired values are deleted as well.
+// GC is a maintenance job, so it waits
+// until it can run within the MaintenanceJobs limit.
+func (str *pebbleStore) GC(ctx context.Context) (err error) {
+	defer str.track(OpGC)(&err)
+	done, err := str.beginOp()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return str.runMaintenance(ctx, func() error {
+		return str.gc(ctx)
+	})
+}
+
+// gc cleans up the cache and removes expired buckets, see
+// GC. Buckets of an unknown layout are skipped, so a single
+// bad bucket can't stop the GC.
+func (str *pebbleStore) gc(ctx context.Context) error {
 	// Delete all items from cache that are expired.
-	now := getCurrentTimestamp()
+	now := str.getCurrentTimestamp()
 	str.cache.Range(func(key, val any) bool {
 		if now-getTimestamp(val.(*pebbleBucket)) >= str.opts.CacheTTL {
 			str.cache.Delete(key)
@@ -194,15 +1018,36 @@ func (str *pebbleStore) GC() error {
 		return true
 	})
 
-	// Delete all expired buckets.
+	// Release all expired snapshots.
+	str.snapshotMtx.Lock()
+	str.releaseExpiredSnapshots()
+	str.snapshotMtx.Unlock()
+
+	// Delete all expired buckets, buckets of a read-only
+	// store are kept.
+	if str.opts.ReadOnly {
+		return nil
+	}
 	iter := str.db.NewIter(&pebble.IterOptions{
-		LowerBound: []byte{bucketTable},
-		UpperBound: []byte{bucketTable + 1},
+		LowerBound: str.getTableKey(bucketTable, 0),
+		UpperBound: str.getTableKey(bucketTable+1, 0),
 	})
+	batch := str.db.NewBatch()
+	closeAll := func() {
+		_ = batch.Close()
+		_ = iter.Close()
+	}
+
+	var buckets, reclaimed int
+	var ids []BucketID
 	bkt := &pebbleBucket{store: str}
 	for iter.First(); iter.Valid(); iter.Next() {
-		bkt.id = BucketID(iter.Key()[1:])
+		if _, _, err := migrateBucketData(iter.Value()); err != nil {
+			continue
+		}
+		bkt.id = BucketID(str.getKeyID(iter.Key()))
 		bkt.data = iter.Value()
+		buckets++
 
 		// Buckets with a lifetime of 0 are permanent and
 		// are never garbage collected.
@@ -211,55 +1056,444 @@ func (str *pebbleStore) GC() error {
 		}
 
 		gcOn := getTimestamp(bkt) + (uint32(GetBucketLifetime(bkt.id)) * 24)
-		if now >= gcOn {
-			if err := str.DeleteBucket(bkt); err != nil {
-				_ = iter.Close()
+		if now < gcOn {
+			continue
+		}
+
+		if err := str.deleteBucket(batch, bkt.id); err != nil {
+			closeAll()
+			return err
+		}
+		id := new([BucketIDLength]byte)
+		copy(id[:], bkt.id[:])
+		ids = append(ids, id)
+		reclaimed++
+
+		// Apply the batch when it is full, and stop when the
+		// context is canceled.
+		if len(ids) >= str.gcBatchSize() {
+			if err := str.applyGCBatch(batch, ids); err != nil {
+				closeAll()
+				return err
+			}
+			_ = batch.Close()
+			batch, ids = str.db.NewBatch(), ids[:0]
+
+			if err := ctx.Err(); err != nil {
+				closeAll()
 				return err
 			}
 		}
 	}
 
-	return iter.Close()
+	if len(ids) > 0 {
+		if err := str.applyGCBatch(batch, ids); err != nil {
+			closeAll()
+			return err
+		}
+	}
+
+	_ = batch.Close()
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if str.opts.Metrics != nil {
+		str.opts.Metrics.ObserveGC(reclaimed, buckets-reclaimed)
+	}
+
+	// Evict buckets when the store is too large.
+	if _, err := str.evict(ctx); err != nil {
+		return err
+	}
+
+	// Delete all expired requests and values.
+	if err := str.reapExpiredRequests(ctx); err != nil {
+		return err
+	}
+	if str.opts.ValueTTL {
+		return str.reapAllExpired(ctx)
+	}
+	return nil
+}
+
+// runMaintenance runs a maintenance job.
+//
+// At most MaintenanceJobs maintenance jobs run at the same
+// time, so background work can't starve foreground reads.
+// Pebble compactions are limited separately by the
+// MaxConcurrentCompactions option of PebbleOpts.
+// The job waits until a slot is available, or returns the
+// error of the context when it is done before that.
+func (str *pebbleStore) runMaintenance(ctx context.Context, job func() error) error {
+	// Take a free slot without checking the context first,
+	// so a job with a free slot always runs.
+	select {
+	case str.maintenance <- struct{}{}:
+	default:
+		select {
+		case str.maintenance <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer func() { <-str.maintenance }()
+	return job()
+}
+
+// Sync makes all previous writes durable.
+//
+// Write operations apply their batch with a synced write,
+// except for the access timestamps of buckets that are
+// updated by reads. These are written without waiting for
+// the write-ahead log to sync, since a lost timestamp only
+// shortens the lifetime of a bucket by a few hours. Sync
+// syncs the write-ahead log, so everything written before
+// it survives a crash. Syncing is expensive, so call it
+// after a burst of writes instead of after each write.
+func (str *pebbleStore) Sync() error {
+	done, err := str.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return str.db.LogData(nil, pebble.Sync)
+}
+
+// getTimestampWriteOptions returns the write options of
+// timestamp refreshes, see StoreOptions.SyncTimestamps.
+func (str *pebbleStore) getTimestampWriteOptions() *pebble.WriteOptions {
+	if str.opts.SyncTimestamps {
+		return pebble.Sync
+	}
+	return pebble.NoSync
+}
+
+// beginOp registers an operation, so Close waits until it
+// is done before closing the underlying pebble database.
+// ErrStoreClosed is returned after Close is called. The
+// returned function must be called when the operation is
+// done.
+func (str *pebbleStore) beginOp() (func(), error) {
+	str.closeMtx.RLock()
+	defer str.closeMtx.RUnlock()
+	if str.closed {
+		return nil, ErrStoreClosed
+	}
+	str.ops.Add(1)
+	return str.ops.Done, nil
+}
+
+// beginWrite registers a write operation, see beginOp and
+// checkWritable.
+func (str *pebbleStore) beginWrite() (func(), error) {
+	if err := str.checkWritable(); err != nil {
+		return nil, err
+	}
+	return str.beginOp()
+}
+
+// checkWritable returns ErrReadOnly when the store is
+// opened in read-only mode.
+func (str *pebbleStore) checkWritable() error {
+	if str.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// readRandom fills buf with random bytes from the
+// RandSource of the store.
+//
+// Errors of the source are returned, and a source that
+// ends before buf is filled returns io.EOF or
+// io.ErrUnexpectedEOF like io.ReadFull. A source that keeps
+// returning no bytes without an error returns
+// io.ErrNoProgress, so a partially filled buf is never
+// used.
+func (str *pebbleStore) readRandom(buf []byte) error {
+	source := str.opts.RandSource
+	if source == nil {
+		source = rand.Reader
+	}
+
+	var n, empty int
+	for n < len(buf) {
+		read, err := source.Read(buf[n:])
+		n += read
+		if n >= len(buf) {
+			return nil
+		} else if errors.Is(err, io.EOF) && n == 0 {
+			return io.EOF
+		} else if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+
+		if read > 0 {
+			empty = 0
+		} else if empty++; empty >= maxEmptyRandomReads {
+			return io.ErrNoProgress
+		}
+	}
+	return nil
+}
+
+// getPreallocLimit returns the maximum amount of values
+// preallocated by GetValues.
+func (str *pebbleStore) getPreallocLimit() int {
+	if str.opts.PreallocLimit > 0 {
+		return int(str.opts.PreallocLimit)
+	}
+	return defaultPreallocLimit
+}
+
+// applyGCBatch applies a batch with deleted buckets, and
+// forgets the deleted buckets. The buckets are forgotten
+// after the batch is applied, so reads in between can't
+// cache the deleted values again.
+func (str *pebbleStore) applyGCBatch(batch *pebble.Batch, ids []BucketID) error {
+	if err := str.applyDeletedBuckets(batch, ids); err != nil {
+		return err
+	}
+
+	if str.gcBatchHook != nil {
+		str.gcBatchHook(len(ids))
+	}
+	return nil
 }
 
 // Close closes the store.
 //
-// Close the underlying pebble database, clean the
-// cache and stop the GC ticker.
+// Operations started after Close return ErrStoreClosed.
+// Close cancels a running GC and stops the GC ticker and
+// RunCompactor, then waits until the operations in progress
+// are done. Then it cleans the cache, releases all
+// snapshots, closes the channels of all watchers and closes
+// the underlying pebble database. Buckets retrieved before
+// Close must not be read after Close.
 func (str *pebbleStore) Close() error {
+	str.closeMtx.Lock()
+	if str.closed {
+		str.closeMtx.Unlock()
+		return ErrStoreClosed
+	}
+	str.closed = true
+	str.closeMtx.Unlock()
+
+	str.cancel()
 	if str.gcTicker != nil {
 		str.gcTicker.Stop()
 	}
+	str.background.Wait()
+	str.ops.Wait()
 
 	str.cache.Range(func(key, val any) bool {
 		str.cache.Delete(key)
 		return true
 	})
 
+	str.snapshotMtx.Lock()
+	for _, snapshot := range str.snapshots {
+		_ = snapshot.snap.Close()
+	}
+	str.snapshots = nil
+	str.snapshotMtx.Unlock()
+
+	str.watchMtx.Lock()
+	for _, watchers := range str.watchers {
+		for _, w := range watchers {
+			w.once.Do(func() { close(w.ch) })
+		}
+	}
+	str.watchers = nil
+	str.watchMtx.Unlock()
+
+	if !str.ownsDB {
+		return nil
+	}
 	return str.db.Close()
 }
 
+// bucketLockShards is the amount of locks that are shared
+// by the buckets in the store.
+const bucketLockShards = 256
+
+// getBucketLock returns the lock of a bucket.
+//
+// Operations that read and modify a bucket take the write
+// lock, so they are serialized with other writes on the
+// same bucket. Read operations take the read lock. The lock
+// is keyed by the BucketId instead of the bucket instance,
+// so different instances of the same bucket share the same
+// lock. Buckets are spread over bucketLockShards locks
+// using the FNV-1a hash of the BucketId.
+func (str *pebbleStore) getBucketLock(id BucketID) *sync.RWMutex {
+	return &str.locks[getBucketLockShard(id)]
+}
+
+// getBucketLockShard returns the index of the lock of a
+// bucket.
+func getBucketLockShard(id BucketID) int {
+	hash := uint32(2166136261)
+	for _, b := range id {
+		hash = (hash ^ uint32(b)) * 16777619
+	}
+	return int(hash % bucketLockShards)
+}
+
 // First byte of the underlying pebble db key, this byte is
 // prepended before the actual key. This allows store.GC to
 // iterate over all the buckets in the store without having
 // to iterate over the bucket values.
+//
+// Each key family has its own table, so the bounds of a
+// table never overlap with another table. New key families
+// are added as a new table before tableCount, the tables
+// must stay below namespacePrefix. Small store-wide records
+// are stored in the meta table, see getPebbleMetaKey.
 const (
-	bucketTable = iota
-	valueTable
+	bucketTable  byte = iota // Bucket data by BucketID.
+	valueTable               // Values by BucketID and idx.
+	requestTable             // Request ids by BucketID, see AppendValuesIdempotent.
+	metaTable                // Store metadata by name.
+
+	tableCount // Amount of tables.
 )
 
+// namespacePrefix is the first byte of the keys of a
+// namespaced store. The keys of a namespace start with
+// namespacePrefix, the length of the namespace and the
+// namespace, followed by the table byte. The length keeps
+// a namespace from being a prefix of another namespace.
+const namespacePrefix = 0xff
+
+// getNamespacePrefix returns the prefix of the keys of a
+// namespace, an empty namespace has no prefix.
+func getNamespacePrefix(namespace string) ([]byte, error) {
+	if namespace == "" {
+		return nil, nil
+	} else if len(namespace) > math.MaxUint8 {
+		return nil, ErrInvalidNamespace
+	}
+	return append([]byte{namespacePrefix, byte(len(namespace))}, namespace...), nil
+}
+
+// getTableKey returns a key of a table with room for size
+// more bytes.
+func (str *pebbleStore) getTableKey(table byte, size int) []byte {
+	key := make([]byte, 0, len(str.prefix)+1+size)
+	key = append(key, str.prefix...)
+	return append(key, table)
+}
+
+// getPebbleMetaKey returns the pebble meta table key of a
+// store-wide record. Each record has its own name.
+func (str *pebbleStore) getPebbleMetaKey(name string) []byte {
+	return append(str.getTableKey(metaTable, len(name)), name...)
+}
+
+// getKeyID returns the BucketID of a bucket, value or
+// request key. The id shares its memory with the key.
+func (str *pebbleStore) getKeyID(key []byte) []byte {
+	return key[len(str.prefix)+1 : len(str.prefix)+1+BucketIDLength]
+}
+
+// getKeyIdx returns the idx of a value key.
+func getKeyIdx(key []byte) uint16 {
+	return binary.BigEndian.Uint16(key[len(key)-2:])
+}
+
 // getPebbleBucketKey returns the pebble bucket table key
 // for the given BucketId.
-func getPebbleBucketKey(id BucketID) []byte {
-	return append([]byte{bucketTable}, id[:]...)
+func (str *pebbleStore) getPebbleBucketKey(id BucketID) []byte {
+	return append(str.getTableKey(bucketTable, BucketIDLength), id[:]...)
+}
+
+// deleteBucket adds the deletion of a bucket, all its
+// values and requests to the given batch.
+func (str *pebbleStore) deleteBucket(batch *pebble.Batch, id BucketID) error {
+	lower, upper := str.getPebbleValueKeyRange(id)
+	if err := batch.DeleteRange(lower, upper, nil); err != nil {
+		return err
+	}
+	lower, upper = str.getPebbleRequestKeyRange(id)
+	if err := batch.DeleteRange(lower, upper, nil); err != nil {
+		return err
+	}
+	return batch.Delete(str.getPebbleBucketKey(id), nil)
 }
 
 // getPebbleValueKey returns the pebble value table key for
 // the given BucketId and idx.
-func getPebbleValueKey(id BucketID, idx uint16) []byte {
-	key := make([]byte, 19)
-	key[0] = valueTable
-	copy(key[1:], id[:])
-	binary.BigEndian.PutUint16(key[1+BucketIDLength:], idx)
-	return key
+//
+// Idx 0 is reserved for appends and is never stored: writes
+// assign an idx to values with idx 0 (see computeIdxs),
+// operations on an existing idx reject it and Import
+// rejects it. The key with idx 0 is therefore the lower
+// bound of the values of a bucket, and is used as a buffer
+// for the keys of other indices. Value keys are in another
+// table than the bucket data, so they never collide.
+func (str *pebbleStore) getPebbleValueKey(id BucketID, idx uint16) []byte {
+	key := append(str.getTableKey(valueTable, BucketIDLength+2), id[:]...)
+	return binary.BigEndian.AppendUint16(key, idx)
+}
+
+// setKeyIdx sets the idx of a value key.
+func setKeyIdx(key []byte, idx uint16) {
+	binary.BigEndian.PutUint16(key[len(key)-2:], idx)
+}
+
+// valueIterOptions contains the options of an iterator
+// over the value table, including the buffers of its
+// bounds. The options are pooled to avoid allocating them
+// on every read, see getValueIterOptions.
+type valueIterOptions struct {
+	pebble.IterOptions
+	lower []byte
+	upper []byte
+}
+
+// valueIterOptionsPool contains unused valueIterOptions.
+var valueIterOptionsPool = sync.Pool{
+	New: func() any { return new(valueIterOptions) },
+}
+
+// getValueIterOptions returns pooled iterator options for
+// the values of a bucket between start and end. When
+// inclusive is set, the value at end is included.
+//
+// The bounds are used by the iterator until it is closed,
+// so the options must only be released after the iterator
+// is closed. Keys and values read from the iterator don't
+// share memory with the bounds.
+func (str *pebbleStore) getValueIterOptions(id BucketID, start, end uint16, inclusive bool) *valueIterOptions {
+	opts := valueIterOptionsPool.Get().(*valueIterOptions)
+	opts.lower = append(append(opts.lower[:0], str.prefix...), valueTable)
+	opts.lower = binary.BigEndian.AppendUint16(append(opts.lower, id[:]...), start)
+	opts.upper = append(append(opts.upper[:0], str.prefix...), valueTable)
+	opts.upper = binary.BigEndian.AppendUint16(append(opts.upper, id[:]...), end)
+
+	opts.LowerBound = opts.lower
+	opts.UpperBound = opts.upper
+	if inclusive {
+		opts.upper = append(opts.upper, 0)
+		opts.UpperBound = opts.upper
+	}
+	return opts
+}
+
+// release returns the options to the pool.
+func (opts *valueIterOptions) release() {
+	opts.IterOptions = pebble.IterOptions{}
+	valueIterOptionsPool.Put(opts)
+}
+
+// getPebbleValueKeyRange returns the lower and upper bound
+// of all the value table keys of a bucket. Unlike
+// str.getPebbleValueKey(id, math.MaxUint16), the upper bound
+// includes the value with idx math.MaxUint16.
+func (str *pebbleStore) getPebbleValueKeyRange(id BucketID) (lower, upper []byte) {
+	return str.getPebbleValueKey(id, 0), append(str.getPebbleValueKey(id, math.MaxUint16), 0)
 }
@@ -1,9 +1,18 @@
 package store
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
 	"math"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/cockroachdb/pebble/vfs"
@@ -17,6 +26,7 @@ import (
 // so the bucket should be garbage collected when running GC.
 var (
 	TestBktID     = BucketID([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 255, 7})
+	TestBktID2    = BucketID([]byte{2, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 255, 7})
 	TestBktKey    = BucketKey([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32})
 	TestBktData   = append([]byte{0, 0, 0, 0}, TestBktKey[:]...)
 	TestBktValues = []BucketValue{
@@ -86,6 +96,196 @@ func SetupTestStore(t *testing.T, addValues bool) Store {
 	return str
 }
 
+// lastIdxOf returns the lastIdx of a bucket, see getLastIdx.
+func lastIdxOf(t *testing.T, bkt *pebbleBucket) uint16 {
+	lastIdx, err := bkt.getLastIdx()
+	require.NoError(t, err, "error occurred while loading lastIdx")
+	return lastIdx
+}
+
+// fetchLastIdxOf returns the lastIdx of a bucket in the
+// value table, see fetchLastIdx.
+func fetchLastIdxOf(t *testing.T, bkt *pebbleBucket) uint16 {
+	lastIdx, err := fetchLastIdx(bkt)
+	require.NoError(t, err, "error occurred while fetching lastIdx")
+	return lastIdx
+}
+
+func TestOpenStoreReadOnly(t *testing.T) {
+	fs := vfs.NewMem()
+	str, err := OpenStore("", &StoreOptions{PebbleOpts: &pebble.Options{FS: fs}})
+	require.NoError(t, err, "could not open test store")
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}}))
+	require.NoError(t, str.Close(), "error occurred while closing store")
+
+	// Reopen the store in read-only mode.
+	str, err = OpenStore("", &StoreOptions{PebbleOpts: &pebble.Options{FS: fs}, ReadOnly: true})
+	require.NoError(t, err, "could not open read-only store")
+	defer str.Close()
+	bkt, err = str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test whether reads succeed and writes are rejected.
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, []BucketValue{{Idx: 1, Value: []byte("1")}}, values, "incorrect values in read-only store")
+	assert.Equal(t, ErrReadOnly, bkt.PutValues([]BucketValue{{Value: []byte("2")}}), "put in read-only store succeeded")
+	assert.Equal(t, ErrReadOnly, bkt.DeleteValues(BucketRange{Start: 0, End: 500}), "delete in read-only store succeeded")
+	assert.Equal(t, ErrReadOnly, str.DeleteBucket(bkt), "bucket deleted in read-only store")
+	_, err = str.CreateBucket(TestBktID2, TestBktKey)
+	assert.Equal(t, ErrReadOnly, err, "bucket created in read-only store")
+	assert.NoError(t, str.GC(context.Background()), "error occurred while running GC in read-only store")
+}
+
+func TestOpenStoreCacheSize(t *testing.T) {
+	pebbleOpts := &pebble.Options{FS: vfs.NewMem()}
+	str, err := OpenStore("", &StoreOptions{PebbleOpts: pebbleOpts, CacheSize: 1 << 20, WALDir: "wal"})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+
+	// Test whether the options are applied without
+	// modifying the options of the caller.
+	opts := str.(*pebbleStore).opts.PebbleOpts
+	require.NotNil(t, opts.Cache, "cache is not applied")
+	assert.Equal(t, int64(1<<20), opts.Cache.MaxSize(), "incorrect cache size")
+	assert.Equal(t, "wal", opts.WALDir, "WAL directory is not applied")
+	assert.Nil(t, pebbleOpts.Cache, "options of the caller are modified")
+}
+
+// blockingReader is a RandSource that blocks until it is
+// released.
+type blockingReader struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	r.once.Do(func() { close(r.started) })
+	<-r.release
+	return rand.Read(p)
+}
+
+func TestClose(t *testing.T) {
+	str := SetupTestStore(t, true)
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Block a clone while it reads its BucketID.
+	reader := &blockingReader{started: make(chan struct{}), release: make(chan struct{})}
+	str.(*pebbleStore).opts.RandSource = reader
+	cloned := make(chan error, 1)
+	go func() {
+		_, err := str.CloneBucket(TestBktID, 0, BucketPermissions{Read: true}, BucketPermissions{Read: true})
+		cloned <- err
+	}()
+	<-reader.started
+
+	closed := make(chan error, 1)
+	go func() { closed <- str.Close() }()
+	require.Eventually(t, func() bool {
+		str.(*pebbleStore).closeMtx.RLock()
+		defer str.(*pebbleStore).closeMtx.RUnlock()
+		return str.(*pebbleStore).closed
+	}, time.Second, time.Millisecond, "store is not closing")
+
+	// Test whether new operations fail while closing.
+	assert.ErrorIs(t, bkt.AppendValues([]BucketValue{{Value: []byte("11")}}), ErrStoreClosed, "write is started after close")
+	_, err = str.GetBucket(TestBktID2)
+	assert.ErrorIs(t, err, ErrStoreClosed, "bucket is fetched after close")
+	_, err = str.CreateBucket(TestBktID2, TestBktKey)
+	assert.ErrorIs(t, err, ErrStoreClosed, "bucket is created after close")
+
+	// Test whether close waits for the in-flight write.
+	select {
+	case <-closed:
+		t.Fatal("store is closed before the in-flight write is done")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(reader.release)
+	assert.NoError(t, <-cloned, "in-flight write failed")
+	assert.NoError(t, <-closed, "error occurred while closing store")
+	assert.ErrorIs(t, str.Close(), ErrStoreClosed, "store is closed twice")
+}
+
+func TestClosedStore(t *testing.T) {
+	str := SetupTestStore(t, true)
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	token, err := str.OpenSnapshot()
+	require.NoError(t, err, "error occurred while opening snapshot")
+	require.NoError(t, str.Close(), "error occurred while closing store")
+
+	// Test whether every entry point returns ErrStoreClosed
+	// instead of using the closed pebble store.
+	rng := BucketRange{Start: 0, End: 5}
+	keep := func(uint16, []byte) bool { return true }
+	for name, fn := range map[string]func() error{
+		"GetValue":                func() error { _, _, err := bkt.GetValue(1); return err },
+		"ValueSize":               func() error { _, _, err := bkt.ValueSize(1); return err },
+		"GetValues":               func() error { _, err := bkt.GetValues(rng); return err },
+		"GetValuesInto":           func() error { _, err := bkt.GetValuesInto(rng, nil); return err },
+		"GetValuesWithMeta":       func() error { _, _, err := bkt.GetValuesWithMeta(rng); return err },
+		"GetValuesFiltered":       func() error { _, err := bkt.GetValuesFiltered(rng, keep); return err },
+		"GetValuesMap":            func() error { _, err := bkt.GetValuesMap(rng); return err },
+		"GetValuesNoCopy":         func() error { return bkt.GetValuesNoCopy(rng, keep) },
+		"GetValuesByIndices":      func() error { _, err := bkt.GetValuesByIndices([]uint16{1}); return err },
+		"GetValuesSince":          func() error { _, _, err := bkt.GetValuesSince(0); return err },
+		"GetValuesWithTombstones": func() error { _, err := bkt.GetValuesWithTombstones(rng); return err },
+		"FirstValue":              func() error { _, _, err := bkt.FirstValue(); return err },
+		"LastValue":               func() error { _, _, err := bkt.LastValue(); return err },
+		"GetValueFromEnd":         func() error { _, _, err := bkt.GetValueFromEnd(1); return err },
+		"OccupiedIndices":         func() error { _, err := bkt.OccupiedIndices(rng); return err },
+		"WriteValues":             func() error { _, err := bkt.WriteValues(rng, io.Discard); return err },
+		"ValueSizeHistogram":      func() error { _, err := bkt.ValueSizeHistogram(rng); return err },
+		"Bucket.Stats":            func() error { _, err := bkt.Stats(); return err },
+		"Store.Stats":             func() error { _, err := str.Stats(StatsOptions{Exact: true}); return err },
+		"ListBuckets":             func() error { return str.ListBuckets(func(BucketID, time.Time) bool { return true }) },
+		"CreatedBetween":          func() error { return str.CreatedBetween(time.Time{}, time.Now(), func(BucketID) bool { return true }) },
+		"OpenSnapshot":            func() error { _, err := str.OpenSnapshot(); return err },
+		"GetValuesAt":             func() error { _, err := str.GetValuesAt(token, TestBktID, rng); return err },
+		"CountAt":                 func() error { _, err := str.CountAt(token, TestBktID, rng); return err },
+		"Export":                  func() error { return str.Export(context.Background(), io.Discard) },
+		"Verify":                  func() error { _, err := str.Verify(context.Background()); return err },
+		"NewTransaction":          func() error { return str.NewTransaction().PutValues(TestBktID, ExpectedBktValues[:1]) },
+		"Transaction.Commit":      func() error { return str.NewTransaction().Commit() },
+	} {
+		assert.NotPanics(t, func() {
+			assert.ErrorIs(t, fn(), ErrStoreClosed, "%s does not return ErrStoreClosed", name)
+		}, "%s panics after close", name)
+	}
+	assert.Zero(t, bkt.RemainingCapacity(), "closed store has remaining capacity")
+
+	events, cancel := str.Watch(TestBktID)
+	_, open := <-events
+	assert.False(t, open, "watch of a closed store is not closed")
+	cancel()
+}
+
+func TestBucketError(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Second value has an idx that can't be appended.
+	err = bkt.AppendValues([]BucketValue{{Value: []byte("1")}, {Idx: 20, Value: []byte("2")}})
+	assert.ErrorIs(t, err, ErrInvalidAppend, "underlying error is not unwrapped")
+
+	var bktErr *BucketError
+	require.ErrorAs(t, err, &bktErr, "error is not a bucket error")
+	assert.Equal(t, TestBktID, bktErr.ID, "bucket id is incorrect")
+	assert.Equal(t, uint16(20), bktErr.Idx, "idx is incorrect")
+	assert.Equal(t, OpAppend, bktErr.Op, "operation is incorrect")
+	assert.Contains(t, err.Error(), EncodeBucketID(TestBktID), "error message does not contain the bucket id")
+
+	// Errors without bucket context are not wrapped.
+	_, err = str.GetBucket(BucketID(make([]byte, 16)))
+	assert.False(t, errors.As(err, &bktErr), "bucket not found is wrapped")
+}
+
 func TestGetBucket(t *testing.T) {
 	str := SetupTestStore(t, true)
 	defer str.Close()
@@ -94,8 +294,11 @@ func TestGetBucket(t *testing.T) {
 	bkt, err := str.GetBucket(TestBktID)
 	assert.NoError(t, err, "error occurred while fetching bucket")
 	assert.Equal(t, TestBktID, bkt.(*pebbleBucket).id, "fetched bucket has incorrect ID")
-	assert.Equal(t, TestBktData, bkt.(*pebbleBucket).data[:], "fetched bucket has incorrect bucket data")
-	assert.Equal(t, uint16(len(ExpectedBktValues)), bkt.(*pebbleBucket).lastIdx, "fetched bucket has incorrect lastIdx")
+	assert.Equal(t, TestBktData, bkt.(*pebbleBucket).data[:len(TestBktData)], "fetched bucket has incorrect bucket data")
+	assert.Len(t, bkt.(*pebbleBucket).data, bucketDataLength, "fetched bucket data is not migrated")
+	assert.Equal(t, bucketDataVersion, bkt.(*pebbleBucket).data[bucketDataVersionOffset], "fetched bucket data has incorrect version")
+	assert.False(t, bkt.(*pebbleBucket).lastIdxLoaded.Load(), "lastIdx is loaded before it is needed")
+	assert.Equal(t, uint16(len(ExpectedBktValues)), lastIdxOf(t, bkt.(*pebbleBucket)), "fetched bucket has incorrect lastIdx")
 	assert.Same(t, str, bkt.(*pebbleBucket).store, "fetched bucket does not belong to the right store")
 
 	// Test whether the cache is working correctly.
@@ -108,6 +311,149 @@ func TestGetBucket(t *testing.T) {
 	assert.Equal(t, err, ErrBucketNotFound, "bucket not found but no error / invalid error returned")
 }
 
+func TestGetBucketMissing(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+
+	// Test whether a random id that doesn't exist returns
+	// ErrBucketNotFound.
+	id := BucketID(make([]byte, BucketIDLength))
+	_, err := rand.Read(id[:])
+	require.NoError(t, err, "error occurred while generating bucket id")
+	_, err = str.GetBucket(id)
+	assert.Equal(t, ErrBucketNotFound, err, "missing bucket did not return ErrBucketNotFound")
+	_, err = str.OpenBucket(id, nil)
+	assert.Equal(t, ErrBucketNotFound, err, "opening missing bucket did not return ErrBucketNotFound")
+	_, cached := str.(*pebbleStore).cache.Load(*id)
+	assert.False(t, cached, "missing bucket is cached")
+
+	// Test whether a nil id is rejected.
+	_, err = str.GetBucket(nil)
+	assert.Equal(t, ErrInvalidBucketID, err, "nil bucket id did not return ErrInvalidBucketID")
+	assert.Equal(t, byte(0), GetBucketLifetime(nil), "nil bucket id has a lifetime")
+	assert.Equal(t, BucketPermissions{}, GetBucketPermissions(nil, true), "nil bucket id has permissions")
+
+	// Test whether bucket data that is too short to contain
+	// the key is rejected.
+	require.NoError(t, str.(*pebbleStore).db.Set(str.(*pebbleStore).getPebbleBucketKey(id), []byte{0, 0, 0, 1}, nil))
+	_, err = str.GetBucket(id)
+	assert.Equal(t, ErrInvalidBucketData, err, "short bucket data did not return ErrInvalidBucketData")
+	assert.Nil(t, (&pebbleBucket{id: id, data: []byte{0, 0, 0, 1}}).GetBucketKey(), "short bucket data returned a key")
+
+	// Test whether scans of the bucket table skip bucket
+	// data that can't be parsed.
+	require.NoError(t, str.(*pebbleStore).db.Set(str.(*pebbleStore).getPebbleBucketKey(id), []byte{0, 1}, nil))
+	assert.NoError(t, str.ListBuckets(func(listed BucketID, _ time.Time) bool {
+		assert.NotEqual(t, *id, *listed, "bucket with invalid data is listed")
+		return true
+	}), "error occurred while listing buckets")
+	assert.NoError(t, str.GC(context.Background()), "error occurred while collecting garbage")
+	candidates, err := str.(*pebbleStore).evictCandidates()
+	assert.NoError(t, err, "error occurred while finding eviction candidates")
+	for _, candidate := range candidates {
+		assert.NotEqual(t, *id, candidate.id, "bucket with invalid data is an eviction candidate")
+	}
+}
+
+func TestGetBucketInfo(t *testing.T) {
+	now := time.Unix(1e9, 0)
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: vfs.NewMem()},
+		CacheTTL:   24,
+		ValueTTL:   true,
+		Clock:      func() time.Time { return now },
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+
+	_, err = str.GetBucketInfo(TestBktID)
+	assert.ErrorIs(t, err, ErrBucketNotFound, "info of a missing bucket is returned")
+
+	// Create a bucket with a gap and a value that expires
+	// before the info is requested.
+	created := toTimestamp(now)
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.PutValues([]BucketValue{
+		{Idx: 1, Value: []byte("1")},
+		{Idx: 2, Value: []byte("2"), Expires: created + 1},
+		{Idx: 10, Value: []byte("10")},
+	}))
+
+	// Test whether the info of a bucket that is not cached
+	// is returned without loading it or refreshing its
+	// timestamp.
+	str.(*pebbleStore).cache.Delete(*TestBktID)
+	now = now.Add(48 * time.Hour)
+	info, err := str.GetBucketInfo(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket info")
+	perms := BucketPermissions{Read: true, Write: true, Append: true}
+	assert.Equal(t, &BucketInfo{
+		ID:         EncodeBucketID(TestBktID),
+		Lifetime:   255,
+		Public:     perms,
+		Protected:  perms,
+		LastAccess: fromTimestamp(created),
+		Created:    fromTimestamp(created),
+		LastIdx:    10,
+		Count:      2,
+	}, info, "bucket info is incorrect")
+	_, cached := str.(*pebbleStore).cache.Load(*TestBktID)
+	assert.False(t, cached, "bucket is loaded into the cache")
+	data, closer, err := str.(*pebbleStore).db.Get(str.(*pebbleStore).getPebbleBucketKey(TestBktID))
+	require.NoError(t, err, "error occurred while reading bucket data")
+	assert.Equal(t, created, binary.BigEndian.Uint32(data), "access timestamp is refreshed")
+	require.NoError(t, closer.Close())
+
+	// Test whether the info marshals to the expected JSON.
+	ts, err := fromTimestamp(created).MarshalJSON()
+	require.NoError(t, err, "error occurred while marshaling timestamp")
+	expected := `{"id":"` + EncodeBucketID(TestBktID) + `","lifetime":255,` +
+		`"public":{"read":true,"write":true,"append":true},` +
+		`"protected":{"read":true,"write":true,"append":true},` +
+		`"lastAccess":` + string(ts) + `,"created":` + string(ts) + `,"lastIdx":10,"count":2}`
+	encoded, err := json.Marshal(info)
+	assert.NoError(t, err, "error occurred while marshaling bucket info")
+	assert.JSONEq(t, expected, string(encoded), "bucket info marshals to incorrect JSON")
+}
+
+func TestBucketExists(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+
+	exists, err := str.BucketExists(TestBktID)
+	assert.NoError(t, err, "error occurred while checking bucket")
+	assert.False(t, exists, "bucket exists before it is created")
+	_, err = str.BucketExists(nil)
+	assert.Equal(t, ErrInvalidBucketID, err, "nil bucket id is not rejected")
+
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	exists, err = str.BucketExists(TestBktID)
+	assert.NoError(t, err, "error occurred while checking bucket")
+	assert.True(t, exists, "created bucket does not exist")
+
+	// Test whether a bucket that is not cached is found
+	// without loading it or refreshing its timestamp.
+	str.(*pebbleStore).cache.Delete(*TestBktID)
+	timestamp := getTimestamp(bkt.(*pebbleBucket))
+	str.(*pebbleStore).opts.Clock = func() time.Time { return time.Now().Add(48 * time.Hour) }
+	exists, err = str.BucketExists(TestBktID)
+	assert.NoError(t, err, "error occurred while checking bucket")
+	assert.True(t, exists, "bucket that is not cached does not exist")
+	_, cached := str.(*pebbleStore).cache.Load(*TestBktID)
+	assert.False(t, cached, "bucket is loaded into the cache")
+	data, closer, err := str.(*pebbleStore).db.Get(str.(*pebbleStore).getPebbleBucketKey(TestBktID))
+	require.NoError(t, err, "error occurred while reading bucket data")
+	assert.Equal(t, timestamp, binary.BigEndian.Uint32(data), "access timestamp is refreshed")
+	require.NoError(t, closer.Close())
+
+	require.NoError(t, str.DeleteBucket(bkt), "error occurred while deleting bucket")
+	exists, err = str.BucketExists(TestBktID)
+	assert.NoError(t, err, "error occurred while checking bucket")
+	assert.False(t, exists, "deleted bucket exists")
+}
+
 func TestCreateBucket(t *testing.T) {
 	str := SetupTestStore(t, false)
 	defer str.Close()
@@ -116,7 +462,8 @@ func TestCreateBucket(t *testing.T) {
 	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
 	assert.NoError(t, err, "error occurred while creating bucket")
 	assert.Equal(t, TestBktID, bkt.GetBucketID(), "created bucket has incorrect ID")
-	assert.Equal(t, getCurrentTimestamp(), getTimestamp(bkt.(*pebbleBucket)), "created bucket has incorrect timestamp")
+	assert.Equal(t, str.(*pebbleStore).getCurrentTimestamp(), getTimestamp(bkt.(*pebbleBucket)), "created bucket has incorrect timestamp")
+	assert.Equal(t, str.(*pebbleStore).getCurrentTimestamp(), getCreationTimestamp(bkt.(*pebbleBucket)), "created bucket has incorrect creation timestamp")
 	assert.Equal(t, TestBktKey, bkt.GetBucketKey(), "created bucket has incorrect bucket key")
 	assert.Equal(t, uint16(0), bkt.(*pebbleBucket).lastIdx, "created bucket has incorrect lastIdx")
 	assert.Same(t, str, bkt.(*pebbleBucket).store, "created bucket does not belong to the right store")
@@ -127,7 +474,7 @@ func TestCreateBucket(t *testing.T) {
 	assert.Same(t, bkt, bkt2, "bucket cache is not working correctly, fetching the created bucket returned a new instance")
 
 	// Test whether bucket is persisted to the underlying pebble store.
-	str.(*pebbleStore).cache.Delete(TestBktID) // Remove bucket from cache.
+	str.(*pebbleStore).cache.Delete(*TestBktID) // Remove bucket from cache.
 	fetchedBucket, _ := str.GetBucket(TestBktID)
 	assert.Equal(t, bkt, fetchedBucket, "error occurred while fetching created bucket without cache")
 
@@ -158,6 +505,151 @@ func TestDeleteBucket(t *testing.T) {
 	assert.Empty(t, values, "bucket values of deleted bucket still exist")
 }
 
+func TestDeleteBucketsByLifetime(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+
+	// Create buckets with lifetimes 0 to 4.
+	var bkts []Bucket
+	for lifetime := byte(0); lifetime <= 4; lifetime++ {
+		bkt, err := str.CreateBucket(&[BucketIDLength]byte{lifetime, 14: lifetime, 15: 7}, TestBktKey)
+		require.NoError(t, err, "error occurred while creating bucket")
+		require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}}))
+		bkts = append(bkts, bkt)
+	}
+
+	// Test whether only buckets in the range are deleted.
+	deleted, err := str.DeleteBucketsByLifetime(1, 2)
+	assert.NoError(t, err, "error occurred while deleting buckets")
+	assert.Equal(t, 2, deleted, "incorrect amount of deleted buckets")
+	for lifetime, bkt := range bkts {
+		_, err := str.GetBucket(bkt.GetBucketID())
+		if lifetime == 1 || lifetime == 2 {
+			assert.ErrorIs(t, err, ErrBucketNotFound, "bucket with lifetime %d is not deleted", lifetime)
+			assert.Equal(t, uint16(0), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx of deleted bucket is not reset")
+		} else {
+			assert.NoError(t, err, "bucket with lifetime %d is deleted", lifetime)
+		}
+	}
+
+	// Test whether buckets with an infinite lifetime are
+	// deleted when min is 0.
+	deleted, err = str.DeleteBucketsByLifetime(0, 0)
+	assert.NoError(t, err, "error occurred while deleting buckets")
+	assert.Equal(t, 1, deleted, "incorrect amount of deleted buckets")
+	_, err = str.GetBucket(bkts[0].GetBucketID())
+	assert.ErrorIs(t, err, ErrBucketNotFound, "bucket with an infinite lifetime is not deleted")
+}
+
+func TestAccessInfo(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+
+	// Bucket with public read and protected write/append.
+	id := BucketID([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 255, 49})
+	_, err := str.CreateBucket(id, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Test access with the bucket key.
+	perms, authorized, err := str.AccessInfo(id, TestBktKey)
+	assert.NoError(t, err, "error occurred while fetching access info")
+	assert.True(t, authorized, "bucket key is not authorized")
+	assert.Equal(t, BucketPermissions{Read: true, Write: true, Append: true}, perms, "incorrect permissions for authorized access")
+
+	// Test access with an invalid key.
+	perms, authorized, err = str.AccessInfo(id, BucketKey(make([]byte, BucketKeyLength)))
+	assert.NoError(t, err, "error occurred while fetching access info")
+	assert.False(t, authorized, "invalid key is authorized")
+	assert.Equal(t, BucketPermissions{Read: true}, perms, "incorrect permissions for unauthorized access")
+
+	// Test access without key.
+	_, authorized, err = str.AccessInfo(id, nil)
+	assert.NoError(t, err, "error occurred while fetching access info")
+	assert.False(t, authorized, "nil key is authorized")
+
+	// Test access to a missing bucket.
+	_, _, err = str.AccessInfo(TestBktID, TestBktKey)
+	assert.Equal(t, ErrBucketNotFound, err, "access info of missing bucket did not return an error")
+}
+
+func TestListBuckets(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+
+	// Create buckets and add values to them, values should
+	// not show up as buckets.
+	now := time.Date(2022, 11, 10, 12, 0, 0, 0, time.UTC)
+	str.(*pebbleStore).opts.Clock = func() time.Time { return now }
+	for i := 2; i < 5; i++ {
+		id := BucketID(make([]byte, BucketIDLength))
+		id[0] = byte(i)
+		bkt, err := str.CreateBucket(id, TestBktKey)
+		require.NoError(t, err, "error occurred while creating bucket")
+		require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("test")}}), "error occurred while appending value")
+	}
+
+	// Test whether exactly the created buckets are listed.
+	var ids []byte
+	lastAccess := make(map[byte]time.Time)
+	err := str.ListBuckets(func(id BucketID, accessed time.Time) bool {
+		ids = append(ids, id[0])
+		lastAccess[id[0]] = accessed
+		return true
+	})
+	assert.NoError(t, err, "error occurred while listing buckets")
+	assert.Equal(t, []byte{1, 2, 3, 4}, ids, "incorrect buckets listed")
+	assert.Equal(t, time.Unix(0, 0), lastAccess[1], "incorrect last access time of the test bucket")
+	assert.True(t, now.Equal(lastAccess[2]), "incorrect last access time of a created bucket")
+
+	// Test whether iteration stops when fn returns false.
+	ids = nil
+	err = str.ListBuckets(func(id BucketID, _ time.Time) bool {
+		ids = append(ids, id[0])
+		return false
+	})
+	assert.NoError(t, err, "error occurred while listing buckets")
+	assert.Len(t, ids, 1, "iteration did not stop")
+}
+
+func TestCreatedBetween(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+
+	// Create buckets at different times.
+	now := time.Date(2022, 11, 10, 12, 0, 0, 0, time.UTC)
+	str.(*pebbleStore).opts.Clock = func() time.Time { return now }
+	for i := 0; i < 5; i++ {
+		id := BucketID(make([]byte, BucketIDLength))
+		id[0] = byte(i)
+		_, err := str.CreateBucket(id, TestBktKey)
+		require.NoError(t, err, "error occurred while creating bucket")
+		now = now.Add(24 * time.Hour)
+	}
+
+	// Test whether only the buckets within the window are
+	// returned, the test bucket has no creation time.
+	var ids []byte
+	err := str.CreatedBetween(
+		time.Date(2022, 11, 11, 0, 0, 0, 0, time.UTC),
+		time.Date(2022, 11, 13, 12, 0, 0, 0, time.UTC),
+		func(id BucketID) bool {
+			ids = append(ids, id[0])
+			return true
+		},
+	)
+	assert.NoError(t, err, "error occurred while iterating buckets")
+	assert.Equal(t, []byte{1, 2}, ids, "incorrect buckets returned for time window")
+
+	// Test whether iteration stops when fn returns false.
+	ids = nil
+	err = str.CreatedBetween(time.Unix(0, 0), now, func(id BucketID) bool {
+		ids = append(ids, id[0])
+		return false
+	})
+	assert.NoError(t, err, "error occurred while iterating buckets")
+	assert.Len(t, ids, 1, "iteration did not stop")
+}
+
 func TestGC(t *testing.T) {
 	str := SetupTestStore(t, true)
 	defer str.Close()
@@ -165,8 +657,8 @@ func TestGC(t *testing.T) {
 
 	// Run first GC, testBucket has a timestamp of 0
 	// so should be deleted from cache and backend store.
-	assert.NoError(t, str.GC())
-	_, ok := str.(*pebbleStore).cache.Load(TestBktID)
+	assert.NoError(t, str.GC(context.Background()))
+	_, ok := str.(*pebbleStore).cache.Load(*TestBktID)
 	_, err := str.GetBucket(TestBktID)
 
 	// Test whether bucket is deleted.
@@ -176,12 +668,433 @@ func TestGC(t *testing.T) {
 	// Now recreate bucket with a valid timestamp.
 	_, err = str.CreateBucket(TestBktID, BucketKey(TestBktData))
 	assert.NoError(t, err, "error occurred while creating bucket")
-	assert.NoError(t, str.GC())
+	assert.NoError(t, str.GC(context.Background()))
 
 	// Test whether bucket is still in the cache and backend store.
-	_, ok = str.(*pebbleStore).cache.Load(TestBktID)
-	str.(*pebbleStore).cache.Delete(TestBktID) // Remove bucket from cache.
+	_, ok = str.(*pebbleStore).cache.Load(*TestBktID)
+	str.(*pebbleStore).cache.Delete(*TestBktID) // Remove bucket from cache.
 	_, err = str.GetBucket(TestBktID)
 	assert.True(t, ok, "bucket is garbage collected from cache while not expired")
 	assert.NoError(t, err, "bucket is garbage collected from store while not expired")
 }
+
+func TestReadYourWrites(t *testing.T) {
+	rng := BucketRange{Start: 0, End: math.MaxUint16}
+	for name, str := range map[string]Store{
+		"plain":  SetupTestStore(t, false),
+		"cached": setupValueCacheStore(t, 1<<20),
+	} {
+		defer str.Close()
+		bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+		require.NoError(t, err, "error occurred while creating bucket")
+
+		// Read the bucket before every write, so the cached
+		// path serves the reads from the value cache.
+		for i, value := range []string{"1", "2", "3"} {
+			_, err := bkt.GetValues(rng)
+			require.NoError(t, err, "error occurred while fetching values")
+			require.NoError(t, bkt.PutValues([]BucketValue{{Idx: 1, Value: []byte(value)}}))
+
+			got, found, err := bkt.GetValue(1)
+			assert.NoError(t, err, "error occurred while fetching value")
+			assert.True(t, found, "%s: written value is not found", name)
+			assert.Equal(t, value, string(got.Value), "%s: read %d did not observe the write", name, i)
+			values, err := bkt.GetValues(rng)
+			assert.NoError(t, err, "error occurred while fetching values")
+			assert.Equal(t, []BucketValue{{Idx: 1, Value: []byte(value)}}, values, "%s: range read %d did not observe the write", name, i)
+		}
+
+		// Test whether a snapshot opened after the write
+		// observes the write.
+		_, err = bkt.DeleteValue(1)
+		require.NoError(t, err, "error occurred while deleting value")
+		token, err := str.OpenSnapshot()
+		require.NoError(t, err, "error occurred while opening snapshot")
+		values, err := str.GetValuesAt(token, TestBktID, rng)
+		assert.NoError(t, err, "error occurred while fetching values from snapshot")
+		assert.Empty(t, values, "%s: snapshot did not observe the delete", name)
+		assert.NoError(t, str.CloseSnapshot(token))
+	}
+}
+
+func TestReadYourWritesGC(t *testing.T) {
+	now := time.Unix(1e9, 0)
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts:      &pebble.Options{FS: vfs.NewMem()},
+		CacheTTL:        24,
+		ValueCacheBytes: 1 << 20,
+		Clock:           func() time.Time { return now },
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+
+	// Create a bucket with a lifetime of 1 day and cache
+	// its values.
+	id := BucketID(&[BucketIDLength]byte{14: 1, 15: 7})
+	bkt, err := str.CreateBucket(id, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("old")}}))
+	_, err = bkt.GetValues(BucketRange{Start: 0, End: 10})
+	require.NoError(t, err, "error occurred while fetching values")
+
+	// Test whether a bucket recreated after GC doesn't see
+	// the cached values of the collected bucket.
+	now = now.Add(48 * time.Hour)
+	require.NoError(t, str.GC(context.Background()), "error occurred while running GC")
+	bkt, err = str.CreateBucket(id, TestBktKey)
+	require.NoError(t, err, "error occurred while recreating bucket")
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 10})
+	assert.NoError(t, err, "error occurred while fetching values")
+	assert.Empty(t, values, "values of the collected bucket are still cached")
+}
+
+func TestGCBatches(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+	str.(*pebbleStore).opts.GCBatchSize = 8
+
+	// Create 50 expired buckets.
+	db := str.(*pebbleStore).db
+	for i := 0; i < 50; i++ {
+		id := BucketID(make([]byte, BucketIDLength))
+		id[0], id[14] = byte(i), 1
+		require.NoError(t, db.Set(str.(*pebbleStore).getPebbleBucketKey(id), TestBktData, nil), "could not add bucket to test store")
+	}
+
+	// Test whether the expired buckets are deleted in
+	// bounded batches.
+	var batches, deleted int
+	str.(*pebbleStore).gcBatchHook = func(size int) {
+		assert.LessOrEqual(t, size, 8, "GC batch is larger than GCBatchSize")
+		batches++
+		deleted += size
+	}
+	assert.NoError(t, str.GC(context.Background()), "error occurred while running GC")
+	assert.Equal(t, 7, batches, "GC applied an unexpected amount of batches")
+	assert.Equal(t, 50, deleted, "GC did not delete all expired buckets")
+
+	iter := db.NewIter(&pebble.IterOptions{LowerBound: []byte{bucketTable}, UpperBound: []byte{bucketTable + 1}})
+	assert.False(t, iter.First(), "expired buckets still exist after GC")
+	require.NoError(t, iter.Close())
+
+	// Test whether a GCBatchSize of 0 uses the default
+	// instead of deleting every bucket in its own batch.
+	str.(*pebbleStore).opts.GCBatchSize = 0
+	for i := 0; i < 70; i++ {
+		id := BucketID(make([]byte, BucketIDLength))
+		id[0], id[14] = byte(i), 1
+		require.NoError(t, db.Set(str.(*pebbleStore).getPebbleBucketKey(id), TestBktData, nil), "could not add bucket to test store")
+	}
+	batches, deleted = 0, 0
+	str.(*pebbleStore).gcBatchHook = func(size int) {
+		batches++
+		deleted += size
+	}
+	assert.NoError(t, str.GC(context.Background()), "error occurred while running GC")
+	assert.Equal(t, 2, batches, "GC did not use the default batch size")
+	assert.Equal(t, 70, deleted, "GC did not delete all expired buckets")
+}
+
+func TestGCCanceled(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+	str.(*pebbleStore).opts.GCBatchSize = 1
+
+	db := str.(*pebbleStore).db
+	for i := 0; i < 5; i++ {
+		id := BucketID(make([]byte, BucketIDLength))
+		id[0], id[14] = byte(i), 1
+		require.NoError(t, db.Set(str.(*pebbleStore).getPebbleBucketKey(id), TestBktData, nil), "could not add bucket to test store")
+	}
+
+	// Test whether GC stops after the first batch when the
+	// context is canceled.
+	batches := 0
+	str.(*pebbleStore).gcBatchHook = func(int) { batches++ }
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, str.GC(ctx), "canceled GC did not return the context error")
+	assert.Equal(t, 1, batches, "canceled GC applied more than one batch")
+}
+
+func TestRunMaintenance(t *testing.T) {
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts:      &pebble.Options{FS: vfs.NewMem()},
+		CacheTTL:        24,
+		MaintenanceJobs: 2,
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+
+	// Schedule several jobs and count the jobs that are
+	// running at the same time.
+	var mtx sync.Mutex
+	var running, maxRunning int
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, str.(*pebbleStore).runMaintenance(context.Background(), func() error {
+				mtx.Lock()
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				mtx.Unlock()
+
+				time.Sleep(5 * time.Millisecond)
+				mtx.Lock()
+				running--
+				mtx.Unlock()
+				return nil
+			}))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 2, maxRunning, "incorrect amount of concurrent maintenance jobs")
+
+	// Test whether a waiting job stops when its context is
+	// canceled.
+	str.(*pebbleStore).maintenance <- struct{}{}
+	str.(*pebbleStore).maintenance <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, str.GC(ctx), "GC did not stop while waiting for a slot")
+}
+
+func TestSync(t *testing.T) {
+	fs := vfs.NewStrictMem()
+	now := time.Date(2022, 11, 10, 12, 0, 0, 0, time.UTC)
+	opts := &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: fs},
+		Clock:      func() time.Time { return now },
+	}
+	str, err := OpenStore("", opts)
+	require.NoError(t, err, "could not open test store")
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Refresh the timestamp, which is written without a
+	// sync, and sync the store.
+	now = now.Add(48 * time.Hour)
+	_, err = bkt.GetValues(BucketRange{Start: 0, End: 500})
+	require.NoError(t, err, "error occurred while fetching bucket values")
+	assert.NoError(t, str.Sync(), "error occurred while syncing store")
+
+	// Simulate a crash by dropping all unsynced writes.
+	fs.SetIgnoreSyncs(true)
+	require.NoError(t, str.Close(), "error occurred while closing store")
+	fs.ResetToSyncedState()
+	fs.SetIgnoreSyncs(false)
+
+	// Test whether the synced timestamp survived the crash.
+	str, err = OpenStore("", opts)
+	require.NoError(t, err, "could not reopen test store")
+	defer str.Close()
+	var lastAccess time.Time
+	require.NoError(t, str.ListBuckets(func(id BucketID, accessed time.Time) bool {
+		lastAccess = accessed
+		return true
+	}))
+	assert.True(t, now.Equal(lastAccess), "synced write is lost after a crash")
+}
+
+func TestSyncTimestamps(t *testing.T) {
+	for _, syncTimestamps := range []bool{false, true} {
+		fs := vfs.NewStrictMem()
+		created := time.Date(2022, 11, 10, 12, 0, 0, 0, time.UTC)
+		now := created
+		opts := &StoreOptions{
+			PebbleOpts:     &pebble.Options{FS: fs},
+			Clock:          func() time.Time { return now },
+			SyncTimestamps: syncTimestamps,
+		}
+		str, err := OpenStore("", opts)
+		require.NoError(t, err, "could not open test store")
+		bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+		require.NoError(t, err, "error occurred while creating bucket")
+
+		// Refresh the timestamp and simulate a crash by
+		// dropping all unsynced writes.
+		now = now.Add(48 * time.Hour)
+		_, err = bkt.GetValues(BucketRange{Start: 0, End: 500})
+		require.NoError(t, err, "error occurred while fetching bucket values")
+		fs.SetIgnoreSyncs(true)
+		require.NoError(t, str.Close(), "error occurred while closing store")
+		fs.ResetToSyncedState()
+		fs.SetIgnoreSyncs(false)
+
+		// Test whether the refreshed timestamp survived the
+		// crash only when timestamps are synced.
+		str, err = OpenStore("", opts)
+		require.NoError(t, err, "could not reopen test store")
+		var lastAccess time.Time
+		require.NoError(t, str.ListBuckets(func(id BucketID, accessed time.Time) bool {
+			lastAccess = accessed
+			return true
+		}))
+		if syncTimestamps {
+			assert.True(t, now.Equal(lastAccess), "synced timestamp is lost after a crash")
+		} else {
+			assert.True(t, created.Equal(lastAccess), "unsynced timestamp survived a crash")
+		}
+		require.NoError(t, str.Close(), "error occurred while closing store")
+	}
+}
+
+func TestGetValueIterOptions(t *testing.T) {
+	prefix, err := getNamespacePrefix("namespace")
+	require.NoError(t, err, "error occurred while creating namespace prefix")
+
+	// Test whether pooled bounds match the value keys, with
+	// and without a namespace.
+	for _, str := range []*pebbleStore{{}, {prefix: prefix}} {
+		opts := str.getValueIterOptions(TestBktID, 3, 10, false)
+		assert.Equal(t, str.getPebbleValueKey(TestBktID, 3), opts.LowerBound, "incorrect lower bound")
+		assert.Equal(t, str.getPebbleValueKey(TestBktID, 10), opts.UpperBound, "incorrect upper bound")
+		opts.release()
+
+		lower, upper := str.getPebbleValueKeyRange(TestBktID)
+		opts = str.getValueIterOptions(TestBktID, 0, math.MaxUint16, true)
+		assert.Equal(t, lower, opts.LowerBound, "incorrect lower bound")
+		assert.Equal(t, upper, opts.UpperBound, "incorrect inclusive upper bound")
+		opts.release()
+	}
+}
+
+func TestTableKeys(t *testing.T) {
+	prefix, err := getNamespacePrefix("namespace")
+	require.NoError(t, err, "error occurred while creating namespace prefix")
+	require.Less(t, int(tableCount), namespacePrefix, "tables overlap with the namespace prefix")
+
+	// Test whether the bounds of each table contain only the
+	// keys of that table, with and without a namespace.
+	for _, str := range []*pebbleStore{{}, {prefix: prefix}} {
+		bounds := func(table byte) ([]byte, []byte) {
+			return str.getTableKey(table, 0), str.getTableKey(table+1, 0)
+		}
+		for table := byte(0); table+1 < tableCount; table++ {
+			_, upper := bounds(table)
+			lower, _ := bounds(table + 1)
+			assert.LessOrEqual(t, bytes.Compare(upper, lower), 0, "bounds of table %d overlap with the next table", table)
+		}
+
+		keys := map[byte][]byte{
+			bucketTable:  str.getPebbleBucketKey(TestBktID),
+			valueTable:   str.getPebbleValueKey(TestBktID, math.MaxUint16),
+			requestTable: str.getPebbleRequestKey(TestBktID, [RequestIDLength]byte{0xff}),
+			metaTable:    str.getPebbleMetaKey("seq"),
+		}
+		assert.Len(t, keys, int(tableCount), "not every table is tested")
+		for table, key := range keys {
+			for other := byte(0); other < tableCount; other++ {
+				lower, upper := bounds(other)
+				within := bytes.Compare(key, lower) >= 0 && bytes.Compare(key, upper) < 0
+				assert.Equal(t, table == other, within, "key of table %d is within the bounds of table %d", table, other)
+			}
+		}
+	}
+}
+
+func TestNewStoreMerger(t *testing.T) {
+	db, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem(), Merger: CounterMerger})
+	require.NoError(t, err, "could not open test db")
+	defer db.Close()
+
+	// Test whether counters are rejected without the merger
+	// option instead of panicking.
+	plain, err := NewStore(db, &StoreOptions{Namespace: "a"})
+	require.NoError(t, err, "error occurred while creating store")
+	defer plain.Close()
+	bkt, err := plain.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	assert.Equal(t, ErrCounterMergerRequired, bkt.IncrementValue(1, 1), "counter is accepted without the merger")
+	_, err = bkt.IncrementAudited(1, 1, []byte("audit"))
+	assert.Equal(t, ErrCounterMergerRequired, err, "audited counter is accepted without the merger")
+
+	// Test whether a namespaced store uses the merger of
+	// the Pebble store.
+	counters, err := NewStore(db, &StoreOptions{Namespace: "b", Merger: CounterMerger})
+	require.NoError(t, err, "error occurred while creating store")
+	defer counters.Close()
+	bkt, err = counters.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.IncrementValue(1, 2), "error occurred while incrementing value")
+	require.NoError(t, bkt.IncrementValue(1, 3), "error occurred while incrementing value")
+	value, _, err := bkt.GetValue(1)
+	require.NoError(t, err, "error occurred while fetching value")
+	counter, err := DecodeCounter(value.Value)
+	assert.NoError(t, err, "error occurred while decoding counter")
+	assert.Equal(t, int64(5), counter, "increments are not merged")
+}
+
+func TestNamespace(t *testing.T) {
+	db, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem()})
+	require.NoError(t, err, "could not open test db")
+	defer db.Close()
+
+	now := time.Now()
+	strA, err := NewStore(db, &StoreOptions{Namespace: "a"})
+	require.NoError(t, err, "error occurred while creating store a")
+	defer strA.Close()
+	strB, err := NewStore(db, &StoreOptions{Namespace: "b", Clock: func() time.Time { return now }})
+	require.NoError(t, err, "error occurred while creating store b")
+	defer strB.Close()
+	strDefault, err := NewStore(db, nil)
+	require.NoError(t, err, "error occurred while creating default store")
+	defer strDefault.Close()
+
+	bkt, err := strA.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues(TestBktValues), "error occurred while appending values")
+
+	// Test whether the bucket of namespace a is invisible to
+	// the other namespaces.
+	for _, str := range []Store{strB, strDefault} {
+		_, err = str.GetBucket(TestBktID)
+		assert.ErrorIs(t, err, ErrBucketNotFound, "bucket of another namespace is found")
+		exists, err := str.BucketExists(TestBktID)
+		assert.NoError(t, err, "error occurred while checking bucket")
+		assert.False(t, exists, "bucket of another namespace exists")
+		assert.NoError(t, str.ListBuckets(func(id BucketID, lastAccess time.Time) bool {
+			t.Errorf("bucket %v of another namespace is listed", id)
+			return true
+		}), "error occurred while listing buckets")
+		report, err := str.Verify(context.Background())
+		assert.NoError(t, err, "error occurred while verifying store")
+		assert.Zero(t, report.Values, "values of another namespace are verified")
+	}
+
+	// Test whether the same bucket id can be used in
+	// another namespace, and whether GC only deletes the
+	// buckets of its namespace.
+	bktB, err := strB.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket in namespace b")
+	require.NoError(t, bktB.AppendValues([]BucketValue{{Value: []byte("b")}}), "error occurred while appending values")
+	now = now.Add(256 * 24 * time.Hour)
+	require.NoError(t, strB.GC(context.Background()), "error occurred while running GC")
+	_, err = strB.GetBucket(TestBktID)
+	assert.ErrorIs(t, err, ErrBucketNotFound, "expired bucket is not deleted by GC")
+
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: math.MaxUint16})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, ExpectedBktValues, values, "values are modified by another namespace")
+
+	// Test whether an export can be imported in another
+	// namespace.
+	var buf bytes.Buffer
+	require.NoError(t, strA.Export(context.Background(), &buf), "error occurred while exporting store")
+	strC, err := NewStore(db, &StoreOptions{Namespace: "c"})
+	require.NoError(t, err, "error occurred while creating store c")
+	defer strC.Close()
+	require.NoError(t, strC.Import(&buf), "error occurred while importing store")
+	imported, err := strC.GetBucket(TestBktID)
+	require.NoError(t, err, "imported bucket is not found")
+	values, err = imported.GetValues(BucketRange{Start: 0, End: math.MaxUint16})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, ExpectedBktValues, values, "imported values are incorrect")
+
+	_, err = NewStore(db, &StoreOptions{Namespace: strings.Repeat("a", 256)})
+	assert.ErrorIs(t, err, ErrInvalidNamespace, "too long namespace is accepted")
+}
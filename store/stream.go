@@ -0,0 +1,65 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrInvalidFrame is returned when reading a value frame
+// that is truncated.
+var ErrInvalidFrame = errors.New("store: invalid value frame")
+
+// frameHeaderLength is the length of the header of a value
+// frame, see WriteValues.
+const frameHeaderLength = 2 + 4
+
+// WriteValues writes the values in a range of the bucket to
+// w, and returns the amount of written values.
+//
+// Each value is written as a frame: idx (2 bytes), value
+// length (4 bytes) and the value. Values are written while
+// iterating the range, so a range is streamed without
+// loading it in memory. See GetValuesNoCopy, the bucket is
+// read locked while writing, so w should not block for a
+// long time. Use ReadValue to read the frames.
+func (bkt *pebbleBucket) WriteValues(rng BucketRange, w io.Writer) (int, error) {
+	var written int
+	var writeErr error
+	header := make([]byte, frameHeaderLength)
+	err := bkt.GetValuesNoCopy(rng, func(idx uint16, val []byte) bool {
+		binary.BigEndian.PutUint16(header, idx)
+		binary.BigEndian.PutUint32(header[2:], uint32(len(val)))
+		if _, writeErr = w.Write(header); writeErr != nil {
+			return false
+		} else if _, writeErr = w.Write(val); writeErr != nil {
+			return false
+		}
+		written++
+		return true
+	})
+	if writeErr != nil {
+		return written, writeErr
+	}
+	return written, err
+}
+
+// ReadValue reads a single value frame written by
+// WriteValues from r.
+//
+// When r has no frames left, io.EOF is returned. A
+// truncated frame returns ErrInvalidFrame.
+func ReadValue(r io.Reader) (BucketValue, error) {
+	header := make([]byte, frameHeaderLength)
+	if _, err := io.ReadFull(r, header); err == io.EOF {
+		return BucketValue{}, io.EOF
+	} else if err != nil {
+		return BucketValue{}, ErrInvalidFrame
+	}
+
+	value := make([]byte, binary.BigEndian.Uint32(header[2:]))
+	if _, err := io.ReadFull(r, value); err != nil {
+		return BucketValue{}, ErrInvalidFrame
+	}
+	return BucketValue{Idx: binary.BigEndian.Uint16(header), Value: value}, nil
+}
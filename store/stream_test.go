@@ -0,0 +1,64 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteValues(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Test whether the frames round-trip into the values.
+	var buf bytes.Buffer
+	written, err := bkt.WriteValues(BucketRange{Start: 0, End: 500}, &buf)
+	require.NoError(t, err, "error occurred while writing values")
+	assert.Equal(t, len(ExpectedBktValues), written, "incorrect amount of values written")
+
+	var values []BucketValue
+	for {
+		value, err := ReadValue(&buf)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err, "error occurred while reading value")
+		values = append(values, value)
+	}
+	assert.Equal(t, ExpectedBktValues, values, "read values are incorrect")
+
+	// Test whether the range limit is used.
+	buf.Reset()
+	written, err = bkt.WriteValues(BucketRange{Start: 0, End: 500, Limit: 3}, &buf)
+	require.NoError(t, err, "error occurred while writing values")
+	assert.Equal(t, 3, written, "limit is not used")
+
+	// Test whether a truncated frame is detected.
+	_, err = ReadValue(bytes.NewReader(buf.Bytes()[:frameHeaderLength]))
+	assert.ErrorIs(t, err, ErrInvalidFrame, "truncated frame is accepted")
+	_, err = ReadValue(bytes.NewReader(buf.Bytes()[:1]))
+	assert.ErrorIs(t, err, ErrInvalidFrame, "truncated header is accepted")
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestWriteValuesError(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	written, err := bkt.WriteValues(BucketRange{Start: 0, End: 500}, failingWriter{})
+	assert.EqualError(t, err, "write failed", "write error is not returned")
+	assert.Equal(t, 0, written, "failed value is counted")
+}
@@ -0,0 +1,422 @@
+package store
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Transaction writes to multiple buckets atomically.
+//
+// A transaction can be retrieved from the store. Operations
+// are staged in a single pebble batch and are only visible
+// after Commit is called. Indices of staged appends are
+// reserved by the transaction, the lastIdx of the buckets
+// is only updated when the transaction is committed.
+//
+// Staged values get their sequence number when they are
+// staged, see StoreOptions.Sequences. Writes applied to the
+// same buckets while the transaction is open can get a
+// higher sequence number, so GetValuesSince can miss the
+// values of the transaction.
+//
+// The transaction interface is not thread-safe.
+type Transaction interface {
+	// PutValues stages values to be put into a bucket.
+	PutValues(id BucketID, values []BucketValue) error
+
+	// AppendValues stages values to be added to a bucket.
+	AppendValues(id BucketID, values []BucketValue) error
+
+	// DeleteValues stages the deletion of values from a
+	// bucket.
+	DeleteValues(id BucketID, rng BucketRange) error
+
+	// Commit applies all staged operations.
+	Commit() error
+
+	// Discard discards all staged operations.
+	Discard() error
+}
+
+// pebbleTransaction implements the Transaction interface.
+type pebbleTransaction struct {
+	store   *pebbleStore
+	batch   *pebble.Batch                               // Indexed batch with the staged operations.
+	buckets map[[BucketIDLength]byte]*transactionBucket // Buckets modified by the transaction.
+	done    bool                                        // Whether the transaction is committed or discarded.
+	err     error                                       // Error returned by all operations, set when the store is closed.
+}
+
+// transactionBucket keeps track of the lastIdx of a bucket
+// that is modified by a transaction.
+type transactionBucket struct {
+	bkt     *pebbleBucket
+	baseIdx uint16                   // lastIdx of the bucket when it was first modified.
+	lastIdx uint16                   // lastIdx including the staged operations.
+	count   int                      // Amount of values after the commit, -1 without a quota.
+	events  []BucketChangeEvent      // Change events of the staged operations.
+	changes <-chan BucketChangeEvent // Writes to the bucket since it was first modified, see Watch.
+	unwatch func()                   // Unsubscribes changes.
+}
+
+// NewTransaction creates a new transaction.
+//
+// When the store is closed, all operations of the returned
+// transaction return ErrStoreClosed.
+func (str *pebbleStore) NewTransaction() Transaction {
+	done, err := str.beginOp()
+	if err != nil {
+		return &pebbleTransaction{store: str, err: err}
+	}
+	defer done()
+
+	return &pebbleTransaction{
+		store:   str,
+		batch:   str.db.NewIndexedBatch(),
+		buckets: make(map[[BucketIDLength]byte]*transactionBucket),
+	}
+}
+
+// PutValues stages values to be put into a bucket.
+//
+// See Bucket.PutValues, the idx of values with an idx of 0
+// is assigned when the values are staged. Freed indices are
+// not reused by transactions.
+func (txn *pebbleTransaction) PutValues(id BucketID, values []BucketValue) error {
+	done, err := txn.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	tb, err := txn.getBucket(id)
+	if err != nil {
+		return err
+	}
+
+	if err := checkAppendOnly(tb.bkt, values); err != nil {
+		return err
+	} else if err := txn.store.checkValues(id, OpPut, values); err != nil {
+		return err
+	}
+	lastIdx := tb.lastIdx
+	if err := computeIdxs(id, &lastIdx, nil, values, false); err != nil {
+		return err
+	} else if err := txn.checkQuota(tb, OpPut, values); err != nil {
+		return err
+	}
+
+	if err := txn.store.stageValues(txn.batch, id, values); err != nil {
+		return err
+	}
+	if freesIdx(values, lastIdx) {
+		if lastIdx, err = txn.store.readLastIdx(txn.batch, id); err != nil {
+			return err
+		}
+	}
+	tb.lastIdx = lastIdx
+	tb.stageEvents(values)
+	return nil
+}
+
+// AppendValues stages values to be added to a bucket.
+//
+// See Bucket.AppendValues, the idx of values with an idx of
+// 0 is assigned when the values are staged. Freed indices
+// are not reused by transactions.
+func (txn *pebbleTransaction) AppendValues(id BucketID, values []BucketValue) error {
+	done, err := txn.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	tb, err := txn.getBucket(id)
+	if err != nil {
+		return err
+	}
+
+	if err := txn.store.checkValues(id, OpAppend, values); err != nil {
+		return err
+	}
+	lastIdx := tb.lastIdx
+	if err := computeIdxs(id, &lastIdx, nil, values, true); err != nil {
+		return err
+	} else if err := txn.checkQuota(tb, OpAppend, values); err != nil {
+		return err
+	}
+
+	if err := txn.store.stageValues(txn.batch, id, values); err != nil {
+		return err
+	}
+	tb.lastIdx = lastIdx
+	tb.stageEvents(values)
+	return nil
+}
+
+// DeleteValues stages the deletion of values from a bucket.
+//
+// The range includes Start and excludes End.
+func (txn *pebbleTransaction) DeleteValues(id BucketID, rng BucketRange) error {
+	if err := rng.validate(); err != nil {
+		return err
+	}
+	done, err := txn.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	tb, err := txn.getBucket(id)
+	if err != nil {
+		return err
+	} else if tb.bkt.IsAppendOnly() {
+		return &BucketError{ID: id, Op: OpDelete, Err: ErrAppendOnly}
+	}
+
+	if err := txn.batch.DeleteRange(
+		txn.store.getPebbleValueKey(id, rng.Start),
+		txn.store.getPebbleValueKey(id, rng.End),
+		nil,
+	); err != nil {
+		return err
+	}
+	tb.events = append(tb.events, BucketChangeEvent{Kind: ChangeDeleteRange, Range: rng})
+
+	// Recompute lastIdx using the indexed batch when the
+	// last value is deleted.
+	if tb.lastIdx != 0 && rng.Start <= tb.lastIdx && tb.lastIdx < rng.End {
+		lastIdx, err := txn.store.readLastIdx(txn.batch, id)
+		if err != nil {
+			return err
+		}
+		tb.lastIdx = lastIdx
+	}
+	return nil
+}
+
+// Commit applies all staged operations.
+//
+// When one of the buckets is written to after it was first
+// modified by the transaction, ErrTransactionConflict is
+// returned and nothing is written. This includes writes
+// that overwrite or delete existing values. When one of the
+// buckets is deleted, ErrBucketNotFound is returned. The value quota
+// of each bucket is checked again, including the writes to
+// the bucket since the values were staged. The staged
+// operations are always written in a single batch, so a
+// batch exceeding StoreOptions.MaxBatchBytes returns
+// ErrBatchTooLarge even with SplitBatches. The transaction
+// can't be used after it is committed.
+func (txn *pebbleTransaction) Commit() error {
+	if txn.err != nil {
+		return txn.err
+	} else if txn.done {
+		return ErrTransactionDone
+	}
+	txn.done = true
+	defer txn.batch.Close()
+	defer txn.unwatch()
+	done, err := txn.store.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	for _, tb := range txn.buckets {
+		if err := checkRate(txn.store.opts.WriteLimiter, tb.bkt.id, OpPut); err != nil {
+			return err
+		}
+	}
+	if maxBytes := txn.store.opts.MaxBatchBytes; maxBytes > 0 && len(txn.batch.Repr()) > maxBytes {
+		return ErrBatchTooLarge
+	}
+
+	// Lock all buckets in a fixed order to avoid deadlocks.
+	// Buckets can share the same lock, so each lock is only
+	// taken once.
+	shards := make([]int, 0, len(txn.buckets))
+	seen := make(map[int]bool, len(txn.buckets))
+	for _, tb := range txn.buckets {
+		if shard := getBucketLockShard(tb.bkt.id); !seen[shard] {
+			seen[shard] = true
+			shards = append(shards, shard)
+		}
+	}
+	sort.Ints(shards)
+	for _, shard := range shards {
+		txn.store.locks[shard].Lock()
+		defer txn.store.locks[shard].Unlock()
+	}
+
+	for _, tb := range txn.buckets {
+		tb.bkt.mtx.Lock()
+		conflict := tb.bkt.lastIdx != tb.baseIdx || len(tb.changes) > 0
+		tb.bkt.mtx.Unlock()
+		if conflict {
+			return ErrTransactionConflict
+		}
+
+		// Deleting a bucket doesn't notify its watchers, so
+		// check whether the bucket still exists.
+		if _, closer, err := txn.store.db.Get(txn.store.getPebbleBucketKey(tb.bkt.id)); errors.Is(err, pebble.ErrNotFound) {
+			return ErrBucketNotFound
+		} else if err != nil {
+			return err
+		} else if err := closer.Close(); err != nil {
+			return err
+		}
+		if tb.count, err = txn.countCommit(tb); err != nil {
+			return err
+		}
+
+		if err := refreshTimestamp(tb.bkt, txn.batch); err != nil {
+			return err
+		}
+	}
+
+	if err := txn.store.db.Apply(txn.batch, nil); err != nil {
+		return err
+	}
+
+	for _, tb := range txn.buckets {
+		tb.bkt.mtx.Lock()
+		tb.bkt.lastIdx = tb.lastIdx
+		tb.bkt.count, tb.bkt.countLoaded = tb.count, tb.count >= 0
+		tb.bkt.mtx.Unlock()
+		txn.store.notify(tb.bkt.id, tb.events...)
+	}
+	return nil
+}
+
+// Discard discards all staged operations.
+//
+// The transaction can't be used after it is discarded.
+func (txn *pebbleTransaction) Discard() error {
+	if txn.err != nil {
+		return txn.err
+	} else if txn.done {
+		return ErrTransactionDone
+	}
+	txn.done = true
+	txn.unwatch()
+	return txn.batch.Close()
+}
+
+// begin registers a staging operation of the transaction,
+// see beginOp.
+func (txn *pebbleTransaction) begin() (func(), error) {
+	if txn.err != nil {
+		return nil, txn.err
+	} else if txn.done {
+		return nil, ErrTransactionDone
+	}
+	return txn.store.beginOp()
+}
+
+// unwatch unsubscribes the changes of all buckets that are
+// modified by the transaction.
+func (txn *pebbleTransaction) unwatch() {
+	for _, tb := range txn.buckets {
+		tb.unwatch()
+	}
+}
+
+// checkQuota checks whether staging values exceeds the value
+// quota of a bucket, the values staged before are included.
+// See checkQuota.
+func (txn *pebbleTransaction) checkQuota(tb *transactionBucket, op string, values []BucketValue) error {
+	quota := tb.bkt.getQuota()
+	if quota <= 0 {
+		return nil
+	}
+	count, err := txn.store.countValues(txn.batch, tb.bkt.id)
+	if err != nil {
+		return err
+	}
+	_, err = txn.store.countQuota(txn.batch, tb.bkt.id, op, quota, int(count), tb.lastIdx, values)
+	return err
+}
+
+// countCommit returns the amount of values in a bucket after
+// the transaction is committed, or -1 when the bucket has
+// no quota. A commit that adds values past the quota
+// returns ErrQuotaExceeded. The caller must hold the bucket
+// write lock.
+func (txn *pebbleTransaction) countCommit(tb *transactionBucket) (int, error) {
+	quota := tb.bkt.getQuota()
+	if quota <= 0 {
+		return -1, nil
+	}
+
+	tb.bkt.mtx.Lock()
+	count, err := tb.bkt.getCount()
+	tb.bkt.mtx.Unlock()
+	if err != nil {
+		return -1, err
+	}
+	updated, err := txn.store.countValues(txn.batch, tb.bkt.id)
+	if err != nil {
+		return -1, err
+	}
+
+	if int(updated) > count && int(updated) > quota {
+		return -1, &BucketError{ID: tb.bkt.id, Op: OpPut, Err: ErrQuotaExceeded}
+	}
+	return int(updated), nil
+}
+
+// getBucket returns the transaction state of a bucket.
+//
+// The bucket is retrieved from the store when it is first
+// modified by the transaction.
+func (txn *pebbleTransaction) getBucket(id BucketID) (*transactionBucket, error) {
+	if txn.done {
+		return nil, ErrTransactionDone
+	}
+
+	if tb, ok := txn.buckets[*id]; ok {
+		return tb, nil
+	}
+
+	bkt, err := txn.store.GetBucket(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Watch the bucket before reading lastIdx, so each
+	// write after lastIdx is read is a conflict.
+	changes, unwatch := txn.store.Watch(id)
+	pebbleBkt := bkt.(*pebbleBucket)
+	pebbleBkt.mtx.Lock()
+	lastIdx, err := pebbleBkt.getLastIdx()
+	if err != nil {
+		pebbleBkt.mtx.Unlock()
+		unwatch()
+		return nil, err
+	}
+	tb := &transactionBucket{
+		bkt:     pebbleBkt,
+		baseIdx: lastIdx,
+		lastIdx: lastIdx,
+		changes: changes,
+		unwatch: unwatch,
+	}
+	pebbleBkt.mtx.Unlock()
+
+	txn.buckets[*id] = tb
+	return tb, nil
+}
+
+// stageEvents adds the change events of the given values.
+func (tb *transactionBucket) stageEvents(values []BucketValue) {
+	for _, value := range values {
+		event := BucketChangeEvent{Kind: ChangeSet, Idx: value.Idx}
+		if value.Tombstone {
+			event.Kind = ChangeDelete
+		}
+		tb.events = append(tb.events, event)
+	}
+}
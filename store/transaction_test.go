@@ -0,0 +1,160 @@
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionCommit(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	bkt2, err := str.CreateBucket(TestBktID2, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Stage operations on both buckets.
+	txn := str.NewTransaction()
+	assert.NoError(t, txn.AppendValues(TestBktID, []BucketValue{{Value: []byte("11")}}), "error occurred while staging append")
+	assert.NoError(t, txn.DeleteValues(TestBktID, BucketRange{Start: 1, End: 3}), "error occurred while staging delete")
+	assert.NoError(t, txn.PutValues(TestBktID2, []BucketValue{{Value: []byte("1")}, {Idx: 5, Value: []byte("5")}}), "error occurred while staging put")
+	assert.NoError(t, txn.DeleteValues(TestBktID2, BucketRange{Start: 5, End: 6}), "error occurred while staging delete")
+	assert.NoError(t, txn.AppendValues(TestBktID2, []BucketValue{{Idx: 2, Value: []byte("2")}}), "error occurred while staging append")
+
+	// Test whether nothing is visible before commit.
+	assert.Equal(t, uint16(10), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is updated before commit")
+	values, err := bkt2.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Empty(t, values, "staged values are visible before commit")
+
+	// Commit and test whether all operations are applied.
+	assert.NoError(t, txn.Commit(), "error occurred while committing transaction")
+	assert.Equal(t, uint16(11), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated after commit")
+	assert.Equal(t, uint16(2), lastIdxOf(t, bkt2.(*pebbleBucket)), "lastIdx is not updated after commit")
+
+	values, err = bkt.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Len(t, values, 9, "committed values are not applied")
+	assert.Equal(t, BucketValue{Idx: 11, Value: []byte("11")}, values[len(values)-1], "committed append is not applied")
+
+	values, err = bkt2.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, []BucketValue{{Idx: 1, Value: []byte("1")}, {Idx: 2, Value: []byte("2")}}, values, "committed values are not applied")
+
+	// Test whether the transaction can't be reused.
+	assert.Equal(t, ErrTransactionDone, txn.Commit(), "transaction is committed twice")
+	assert.Equal(t, ErrTransactionDone, txn.PutValues(TestBktID, TestBktValues), "committed transaction accepted a new operation")
+}
+
+func TestTransactionDiscard(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	txn := str.NewTransaction()
+	assert.NoError(t, txn.AppendValues(TestBktID, []BucketValue{{Value: []byte("11")}}), "error occurred while staging append")
+	assert.NoError(t, txn.DeleteValues(TestBktID, BucketRange{Start: 0, End: 500}), "error occurred while staging delete")
+	assert.NoError(t, txn.Discard(), "error occurred while discarding transaction")
+
+	// Test whether nothing is written.
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, ExpectedBktValues, values, "discarded transaction modified the bucket")
+	assert.Equal(t, uint16(10), lastIdxOf(t, bkt.(*pebbleBucket)), "discarded transaction modified lastIdx")
+	assert.Equal(t, ErrTransactionDone, txn.Commit(), "discarded transaction is committed")
+}
+
+func TestTransactionConflict(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	// Append to the bucket after the transaction reserved
+	// the next idx.
+	txn := str.NewTransaction()
+	assert.NoError(t, txn.AppendValues(TestBktID, []BucketValue{{Value: []byte("txn")}}), "error occurred while staging append")
+	assert.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("11")}}), "error occurred while appending value")
+	assert.Equal(t, ErrTransactionConflict, txn.Commit(), "conflicting transaction is committed")
+
+	// Test whether the concurrent append is preserved.
+	value, found, err := bkt.GetValue(11)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.True(t, found, "concurrent append is lost")
+	assert.Equal(t, []byte("11"), value.Value, "concurrent append is overwritten")
+
+	// Test whether writes that don't change lastIdx are
+	// conflicts too.
+	txn = str.NewTransaction()
+	assert.NoError(t, txn.PutValues(TestBktID, []BucketValue{{Idx: 3, Value: []byte("txn")}}), "error occurred while staging put")
+	assert.NoError(t, bkt.PutValues([]BucketValue{{Idx: 3, Value: []byte("3")}}), "error occurred while overwriting value")
+	assert.Equal(t, ErrTransactionConflict, txn.Commit(), "transaction conflicting with an overwrite is committed")
+	txn = str.NewTransaction()
+	assert.NoError(t, txn.AppendValues(TestBktID, []BucketValue{{Value: []byte("txn")}}), "error occurred while staging append")
+	_, err = bkt.DeleteValue(4)
+	assert.NoError(t, err, "error occurred while deleting value")
+	assert.Equal(t, ErrTransactionConflict, txn.Commit(), "transaction conflicting with a delete is committed")
+	value, found, err = bkt.GetValue(3)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.True(t, found, "concurrent overwrite is lost")
+	assert.Equal(t, []byte("3"), value.Value, "concurrent overwrite is overwritten")
+
+	// Test whether missing buckets are rejected.
+	txn = str.NewTransaction()
+	assert.Equal(t, ErrBucketNotFound, txn.PutValues(TestBktID2, TestBktValues), "missing bucket is accepted")
+	assert.NoError(t, txn.Discard())
+}
+
+func TestTransactionCommitLimits(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	pebbleStr := str.(*pebbleStore)
+
+	// Test whether a batch exceeding MaxBatchBytes is
+	// rejected, even when batches may be split.
+	pebbleStr.opts.MaxBatchBytes, pebbleStr.opts.SplitBatches = 64, true
+	txn := str.NewTransaction()
+	assert.NoError(t, txn.AppendValues(TestBktID, []BucketValue{{Value: make([]byte, 100)}}), "error occurred while staging append")
+	assert.ErrorIs(t, txn.Commit(), ErrBatchTooLarge, "batch exceeding MaxBatchBytes is committed")
+	pebbleStr.opts.MaxBatchBytes = 0
+
+	// Test whether the commit is rate limited.
+	pebbleStr.opts.WriteLimiter = denyLimiter{}
+	txn = str.NewTransaction()
+	assert.NoError(t, txn.AppendValues(TestBktID, []BucketValue{{Value: []byte("11")}}), "error occurred while staging append")
+	assert.ErrorIs(t, txn.Commit(), ErrRateLimited, "rate limited commit is written")
+	pebbleStr.opts.WriteLimiter = nil
+
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, ExpectedBktValues, values, "rejected transaction modified the bucket")
+
+	// Test whether rejected transactions stop watching.
+	pebbleStr.watchMtx.RLock()
+	assert.Empty(t, pebbleStr.watchers, "transaction watchers are not removed")
+	pebbleStr.watchMtx.RUnlock()
+}
+
+func TestTransactionDeletedBucket(t *testing.T) {
+	str := SetupTestStore(t, false)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	// Test whether a bucket that is deleted after the
+	// transaction staged values into it is not written.
+	txn := str.NewTransaction()
+	assert.NoError(t, txn.AppendValues(TestBktID, []BucketValue{{Value: []byte("1")}}), "error occurred while staging append")
+	require.NoError(t, str.DeleteBucket(bkt), "error occurred while deleting bucket")
+	assert.Equal(t, ErrBucketNotFound, txn.Commit(), "transaction into a deleted bucket is committed")
+
+	report, err := str.Verify(context.Background())
+	assert.NoError(t, err, "error occurred while verifying store")
+	assert.Empty(t, report.Orphans, "transaction wrote orphaned values")
+}
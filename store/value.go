@@ -0,0 +1,355 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Stored values can start with a header that contains
+// metadata of the value. The header is only written and read
+// when one of the header options of the store is enabled,
+// see valueHeaders. Values without a header are read as is,
+// so existing values keep working after enabling an option.
+//
+// The header layout is:
+//   - magic byte (valueHeaderMagic)
+//   - flags (1 byte)
+//   - CRC32C of the value (4 bytes, when valueFlagChecksum is set)
+//   - expiry timestamp (4 bytes, when valueFlagExpires is set)
+//   - sequence number (8 bytes, when valueFlagSequence is set)
+//
+// A tombstone (valueFlagTombstone) is a header without a
+// value, it records a freed idx when StoreOptions.Tombstones
+// is enabled. Tombstones are decoded with tombstoneExpires,
+// so reads skip them like expired values.
+//
+// A value written without a header that starts with the
+// magic byte is ambiguous. With checksums enabled, such a
+// value fails the checksum instead of being misread.
+const (
+	valueHeaderMagic   byte = 0xfe
+	valueFlagChecksum  byte = 1 << 0
+	valueFlagExpires   byte = 1 << 1
+	valueFlagSequence  byte = 1 << 2
+	valueFlagTombstone byte = 1 << 3
+)
+
+// tombstoneExpires is the expiry timestamp of a decoded
+// tombstone, it is always in the past.
+const tombstoneExpires uint32 = 1
+
+// castagnoli is the CRC32C table used for value checksums.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumError is returned when the checksum of a stored
+// value does not match the value. It matches
+// ErrChecksumMismatch using errors.Is.
+type ChecksumError struct {
+	Idx uint16 // Idx of the corrupted value.
+}
+
+// Error returns the error message.
+func (err *ChecksumError) Error() string {
+	return fmt.Sprintf("%v (idx %d)", ErrChecksumMismatch, err.Idx)
+}
+
+// Unwrap returns ErrChecksumMismatch.
+func (err *ChecksumError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
+// valueHeaders returns whether values are stored with a
+// header.
+func (str *pebbleStore) valueHeaders() bool {
+	return str.opts.Checksums || str.opts.ValueTTL || str.opts.Sequences || str.opts.Tombstones
+}
+
+// encodeValue returns the value as it is stored, including
+// the header when value headers are enabled. A seq of 0 is
+// not stored.
+func (str *pebbleStore) encodeValue(value []byte, expires uint32, seq uint64) []byte {
+	if !str.valueHeaders() {
+		return value
+	}
+
+	var flags byte
+	size := 2
+	if str.opts.Checksums {
+		flags |= valueFlagChecksum
+		size += 4
+	}
+	if expires != 0 {
+		flags |= valueFlagExpires
+		size += 4
+	}
+	if seq != 0 {
+		flags |= valueFlagSequence
+		size += 8
+	}
+
+	encoded := make([]byte, 2, size+len(value))
+	encoded[0], encoded[1] = valueHeaderMagic, flags
+	if flags&valueFlagChecksum != 0 {
+		encoded = binary.BigEndian.AppendUint32(encoded, crc32.Checksum(value, castagnoli))
+	}
+	if flags&valueFlagExpires != 0 {
+		encoded = binary.BigEndian.AppendUint32(encoded, expires)
+	}
+	if flags&valueFlagSequence != 0 {
+		encoded = binary.BigEndian.AppendUint64(encoded, seq)
+	}
+	return append(encoded, value...)
+}
+
+// encodeTombstone returns the tombstone of a freed value as
+// it is stored. Value headers must be enabled.
+func (str *pebbleStore) encodeTombstone(seq uint64) []byte {
+	encoded := str.encodeValue(nil, 0, seq)
+	encoded[1] |= valueFlagTombstone
+	return encoded
+}
+
+// isTombstone returns whether a stored value is a
+// tombstone, see StoreOptions.Tombstones.
+func (str *pebbleStore) isTombstone(stored []byte) bool {
+	return str.opts.Tombstones && len(stored) >= 2 &&
+		stored[0] == valueHeaderMagic && stored[1]&valueFlagTombstone != 0
+}
+
+// freeValue frees the value at key, it is deleted or
+// replaced with a tombstone when StoreOptions.Tombstones is
+// enabled.
+func (str *pebbleStore) freeValue(writer pebble.Writer, key []byte, seq uint64) error {
+	if str.opts.Tombstones {
+		return writer.Set(key, str.encodeTombstone(seq), nil)
+	}
+	return writer.Delete(key, nil)
+}
+
+// decodeValue returns the value without the header and its
+// expiry timestamp, and verifies the checksum of the value.
+// The returned value shares its memory with the stored
+// value.
+func (str *pebbleStore) decodeValue(idx uint16, stored []byte) ([]byte, uint32, error) {
+	value, expires, _, err := str.decodeValueSequence(idx, stored)
+	return value, expires, err
+}
+
+// decodeValueSequence decodes a stored value like
+// decodeValue, and also returns its sequence number. The
+// sequence number is 0 when the value has none.
+func (str *pebbleStore) decodeValueSequence(idx uint16, stored []byte) ([]byte, uint32, uint64, error) {
+	if !str.valueHeaders() || len(stored) < 2 || stored[0] != valueHeaderMagic {
+		return stored, 0, 0, nil
+	}
+
+	flags, value := stored[1], stored[2:]
+	var checksum, expires uint32
+	var seq uint64
+	if flags&valueFlagChecksum != 0 {
+		if len(value) < 4 {
+			return nil, 0, 0, &ChecksumError{Idx: idx}
+		}
+		checksum, value = binary.BigEndian.Uint32(value), value[4:]
+	}
+	if flags&valueFlagExpires != 0 {
+		if len(value) < 4 {
+			return nil, 0, 0, ErrInvalidValueHeader
+		}
+		expires, value = binary.BigEndian.Uint32(value), value[4:]
+	}
+	if flags&valueFlagSequence != 0 {
+		if len(value) < 8 {
+			return nil, 0, 0, ErrInvalidValueHeader
+		}
+		seq, value = binary.BigEndian.Uint64(value), value[8:]
+	}
+
+	if flags&valueFlagChecksum != 0 && checksum != crc32.Checksum(value, castagnoli) {
+		return nil, 0, 0, &ChecksumError{Idx: idx}
+	}
+	if flags&valueFlagTombstone != 0 {
+		expires = tombstoneExpires
+	}
+	return value, expires, seq, nil
+}
+
+// isExpired returns whether a value with the given expiry
+// timestamp is expired at timestamp now.
+func isExpired(expires, now uint32) bool {
+	return expires != 0 && now >= expires
+}
+
+// reapExpired deletes the values at the given indices of a
+// bucket that are expired.
+//
+// Each value is read again while holding the write lock of
+// the bucket, so values that are overwritten since they
+// were found expired are kept. Nothing is deleted when the
+// store is read-only.
+func (str *pebbleStore) reapExpired(id BucketID, idxs []uint16) error {
+	if len(idxs) == 0 || str.opts.ReadOnly {
+		return nil
+	}
+
+	lock := str.getBucketLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	now := str.getCurrentTimestamp()
+	batch := str.db.NewBatch()
+	defer batch.Close()
+	var reaped []BucketValue
+	for _, idx := range idxs {
+		key := str.getPebbleValueKey(id, idx)
+		stored, closer, err := str.db.Get(key)
+		if errors.Is(err, pebble.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		_, expires, decodeErr := str.decodeValue(idx, stored)
+		if err := closer.Close(); err != nil {
+			return err
+		}
+		if decodeErr != nil || !isExpired(expires, now) || str.isTombstone(stored) {
+			continue
+		}
+
+		if err := batch.Delete(key, nil); err != nil {
+			return err
+		}
+		reaped = append(reaped, BucketValue{Idx: idx, Tombstone: true})
+	}
+
+	if len(reaped) == 0 {
+		return nil
+	}
+	if err := str.db.Apply(batch, nil); err != nil {
+		return err
+	}
+	str.notifyValues(id, reaped)
+
+	// Update lastIdx when the last value is deleted.
+	if cached, ok := str.cache.Load(*id); ok {
+		bkt := cached.(*pebbleBucket)
+		bkt.mtx.Lock()
+		bkt.countLoaded = false
+		for _, value := range reaped {
+			if value.Idx == bkt.lastIdx {
+				bkt.refreshLastIdx()
+				break
+			}
+		}
+		bkt.mtx.Unlock()
+	}
+	return nil
+}
+
+// reapAllExpired deletes all expired values in the store.
+// The context is checked for each bucket.
+func (str *pebbleStore) reapAllExpired(ctx context.Context) error {
+	iter := str.db.NewIter(&pebble.IterOptions{
+		LowerBound: str.getTableKey(valueTable, 0),
+		UpperBound: str.getTableKey(valueTable+1, 0),
+	})
+
+	now := str.getCurrentTimestamp()
+	var id [BucketIDLength]byte
+	var expired []uint16
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if !bytes.Equal(str.getKeyID(key), id[:]) {
+			if err := str.reapExpired(&id, expired); err != nil {
+				_ = iter.Close()
+				return err
+			} else if err := ctx.Err(); err != nil {
+				_ = iter.Close()
+				return err
+			}
+			copy(id[:], str.getKeyID(key))
+			expired = expired[:0]
+		}
+
+		idx := getKeyIdx(key)
+		if _, expires, err := str.decodeValue(idx, iter.Value()); err == nil && isExpired(expires, now) && !str.isTombstone(iter.Value()) {
+			expired = append(expired, idx)
+		}
+	}
+
+	if err := str.reapExpired(&id, expired); err != nil {
+		_ = iter.Close()
+		return err
+	}
+	return iter.Close()
+}
+
+// GetValuesWithTombstones retrieves the values in a range of
+// the bucket, including the tombstones of freed values.
+//
+// Tombstones are returned with Tombstone set and without a
+// value, so a follower can distinguish a freed idx from an
+// idx that never had a value. Only values freed by
+// PutValues, Free and DeleteValue leave a tombstone, other
+// deletes remove the value. Tombstones are kept until the
+// idx is written again or the bucket is deleted. Expired
+// values are skipped, rng.Limit includes the tombstones.
+// Returns ErrTombstonesDisabled when Tombstones is not
+// enabled.
+func (bkt *pebbleBucket) GetValuesWithTombstones(rng BucketRange) (_ []BucketValue, err error) {
+	defer bkt.store.track(OpGet)(&err)
+	done, err := bkt.beginRead(OpGet)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if !bkt.store.opts.Tombstones {
+		return nil, ErrTombstonesDisabled
+	} else if err := rng.validate(); err != nil {
+		return nil, err
+	}
+
+	var expired []uint16
+	defer func() { _ = bkt.store.reapExpired(bkt.id, expired) }()
+
+	lock := bkt.store.getBucketLock(bkt.id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	opts := bkt.store.getValueIterOptions(bkt.id, rng.Start, rng.End, false)
+	defer opts.release()
+	iter := bkt.store.db.NewIter(&opts.IterOptions)
+
+	var values []BucketValue
+	now := bkt.store.getCurrentTimestamp()
+	valid := iter.First()
+	if rng.Reverse {
+		valid = iter.Last()
+	}
+	for ; valid && (rng.Limit == 0 || len(values) < int(rng.Limit)); valid = nextValue(iter, rng.Reverse) {
+		idx := getKeyIdx(iter.Key())
+		value, expires, err := bkt.store.decodeValue(idx, iter.Value())
+		if err != nil {
+			_ = iter.Close()
+			return values, err
+		} else if bkt.store.isTombstone(iter.Value()) {
+			values = append(values, BucketValue{Idx: idx, Tombstone: true})
+		} else if isExpired(expires, now) {
+			expired = append(expired, idx)
+		} else {
+			values = append(values, BucketValue{Idx: idx, Value: append([]byte(nil), value...), Expires: expires})
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return values, err
+	}
+	return values, refreshTimestamp(bkt, bkt.store.db)
+}
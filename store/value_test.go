@@ -0,0 +1,317 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksums(t *testing.T) {
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: vfs.NewMem()},
+		CacheTTL:   24,
+		Checksums:  true,
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}, {Value: []byte("2")}, {Value: []byte("3")}}))
+
+	// Add a value without a header, as written before
+	// checksums were enabled.
+	db := str.(*pebbleStore).db
+	require.NoError(t, db.Set(str.(*pebbleStore).getPebbleValueKey(TestBktID, 4), []byte("legacy"), nil))
+
+	// Test whether values are stored with a checksum and
+	// read without it.
+	stored, closer, err := db.Get(str.(*pebbleStore).getPebbleValueKey(TestBktID, 2))
+	require.NoError(t, err, "error occurred while reading stored value")
+	assert.Len(t, stored, 7, "value is not stored with a header")
+	require.NoError(t, closer.Close())
+
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, []BucketValue{
+		{Idx: 1, Value: []byte("1")},
+		{Idx: 2, Value: []byte("2")},
+		{Idx: 3, Value: []byte("3")},
+		{Idx: 4, Value: []byte("legacy")},
+	}, values, "values are not decoded correctly")
+
+	// Corrupt a stored value and test whether reads return a
+	// checksum error.
+	corrupted := append([]byte(nil), stored...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	require.NoError(t, db.Set(str.(*pebbleStore).getPebbleValueKey(TestBktID, 2), corrupted, nil))
+
+	_, err = bkt.GetValues(BucketRange{Start: 0, End: 500})
+	assert.True(t, errors.Is(err, ErrChecksumMismatch), "corrupted value did not return a checksum error")
+	var checksumErr *ChecksumError
+	require.True(t, errors.As(err, &checksumErr), "checksum error has an incorrect type")
+	assert.Equal(t, uint16(2), checksumErr.Idx, "checksum error has an incorrect idx")
+
+	_, _, err = bkt.GetValue(2)
+	assert.True(t, errors.Is(err, ErrChecksumMismatch), "corrupted value did not return a checksum error")
+	_, err = bkt.GetValuesByIndices([]uint16{1, 2})
+	assert.True(t, errors.Is(err, ErrChecksumMismatch), "corrupted value did not return a checksum error")
+	value, found, err := bkt.GetValue(3)
+	assert.NoError(t, err, "error occurred while fetching intact value")
+	assert.True(t, found, "intact value is not found")
+	assert.Equal(t, []byte("3"), value.Value, "intact value is not decoded correctly")
+
+	// Test whether merging into a checksummed value is
+	// rejected instead of breaking its checksum.
+	assert.ErrorIs(t, bkt.MergeValue(3, []byte("b")), ErrMergeValueHeader, "checksummed value is merged into")
+	value, _, err = bkt.GetValue(3)
+	assert.NoError(t, err, "error occurred while fetching value after rejected merge")
+	assert.Equal(t, []byte("3"), value.Value, "rejected merge changed the value")
+}
+
+func TestValueTTL(t *testing.T) {
+	now := time.Now()
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: vfs.NewMem()},
+		CacheTTL:   24,
+		ValueTTL:   true,
+		Clock:      func() time.Time { return now },
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	expires := toTimestamp(now) + 1
+	require.NoError(t, bkt.AppendValues([]BucketValue{
+		{Value: []byte("1")},
+		{Value: []byte("2"), Expires: expires},
+		{Value: []byte("3")},
+		{Value: []byte("4"), Expires: expires},
+	}))
+
+	// Test whether values are returned before they expire.
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, []BucketValue{
+		{Idx: 1, Value: []byte("1")},
+		{Idx: 2, Value: []byte("2"), Expires: expires},
+		{Idx: 3, Value: []byte("3")},
+		{Idx: 4, Value: []byte("4"), Expires: expires},
+	}, values, "values are not returned before they expire")
+
+	// Advance the clock and test whether expired values are
+	// absent while their neighbors survive.
+	now = now.Add(2 * time.Hour)
+	values, err = bkt.GetValues(BucketRange{Start: 0, End: 500})
+	assert.NoError(t, err, "error occurred while fetching bucket values")
+	assert.Equal(t, []BucketValue{
+		{Idx: 1, Value: []byte("1")},
+		{Idx: 3, Value: []byte("3")},
+	}, values, "expired values are returned")
+
+	_, found, err := bkt.GetValue(4)
+	assert.NoError(t, err, "error occurred while fetching bucket value")
+	assert.False(t, found, "expired value is found")
+	value, found, err := bkt.LastValue()
+	assert.NoError(t, err, "error occurred while fetching last value")
+	assert.True(t, found, "last value is not found")
+	assert.Equal(t, uint16(3), value.Idx, "expired last value is returned")
+
+	// Test whether expired values are deleted lazily.
+	db := str.(*pebbleStore).db
+	_, _, err = db.Get(str.(*pebbleStore).getPebbleValueKey(TestBktID, 2))
+	assert.ErrorIs(t, err, pebble.ErrNotFound, "expired value is not deleted")
+	assert.Equal(t, uint16(3), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not updated")
+
+	// Test whether GC reaps expired values that are not read.
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("5"), Expires: toTimestamp(now) + 1}}))
+	now = now.Add(2 * time.Hour)
+	require.NoError(t, str.GC(context.Background()), "error occurred while running GC")
+	_, _, err = db.Get(str.(*pebbleStore).getPebbleValueKey(TestBktID, 4))
+	assert.ErrorIs(t, err, pebble.ErrNotFound, "expired value is not reaped by GC")
+	_, _, err = db.Get(str.(*pebbleStore).getPebbleValueKey(TestBktID, 1))
+	assert.NoError(t, err, "value without expiry is reaped by GC")
+}
+
+func TestValueTTLDisabled(t *testing.T) {
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: vfs.NewMem()},
+		CacheTTL:   24,
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	err = bkt.AppendValues([]BucketValue{{Value: []byte("1"), Expires: 1}})
+	assert.ErrorIs(t, err, ErrValueTTLDisabled, "value with an expiry is accepted")
+	err = bkt.PutValues([]BucketValue{{Idx: 1, Value: []byte("1"), Expires: 1}})
+	assert.ErrorIs(t, err, ErrValueTTLDisabled, "value with an expiry is accepted")
+}
+
+func setupTombstoneStore(t *testing.T) Store {
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: vfs.NewMem()},
+		CacheTTL:   24,
+		Tombstones: true,
+	})
+	require.NoError(t, err, "could not open test store")
+	return str
+}
+
+func TestTombstones(t *testing.T) {
+	str := setupTombstoneStore(t)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}, {Value: []byte("2")}, {Value: []byte("3")}, {Value: []byte("4")}}))
+
+	// Test whether freed indices show up as tombstones in
+	// the tombstone-aware read only.
+	require.NoError(t, bkt.Free([]uint16{2, 4}), "error occurred while freeing values")
+	existed, err := bkt.DeleteValue(3)
+	require.NoError(t, err, "error occurred while deleting value")
+	assert.True(t, existed, "deleted value did not exist")
+	values, err := bkt.GetValuesWithTombstones(BucketRange{Start: 0, End: 10})
+	assert.NoError(t, err, "error occurred while fetching values with tombstones")
+	assert.Equal(t, []BucketValue{
+		{Idx: 1, Value: []byte("1")},
+		{Idx: 2, Tombstone: true},
+		{Idx: 3, Tombstone: true},
+		{Idx: 4, Tombstone: true},
+	}, values, "freed indices are not returned as tombstones")
+	values, err = bkt.GetValuesWithTombstones(BucketRange{Start: 0, End: 10, Reverse: true, Limit: 2})
+	assert.NoError(t, err, "error occurred while fetching values with tombstones")
+	assert.Equal(t, []BucketValue{{Idx: 4, Tombstone: true}, {Idx: 3, Tombstone: true}}, values, "incorrect reverse range with tombstones")
+
+	values, err = bkt.GetValues(BucketRange{Start: 0, End: 10})
+	assert.NoError(t, err, "error occurred while fetching values")
+	assert.Equal(t, []BucketValue{{Idx: 1, Value: []byte("1")}}, values, "tombstones are returned as values")
+	_, found, err := bkt.GetValue(2)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.False(t, found, "tombstone is found as a value")
+	idxs, err := bkt.OccupiedIndices(BucketRange{Start: 0, End: 10})
+	assert.NoError(t, err, "error occurred while fetching occupied indices")
+	assert.Equal(t, []uint16{1}, idxs, "tombstones occupy their idx")
+
+	// Test whether tombstones survive reads and don't count
+	// as the last value, so appends reuse the freed end.
+	values, err = bkt.GetValuesWithTombstones(BucketRange{Start: 0, End: 10})
+	assert.NoError(t, err, "error occurred while fetching values with tombstones")
+	assert.Len(t, values, 4, "tombstones are reaped by reads")
+	str.(*pebbleStore).forgetBucket(TestBktID)
+	bkt, err = str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("5")}}))
+	values, err = bkt.GetValuesWithTombstones(BucketRange{Start: 0, End: 10})
+	assert.NoError(t, err, "error occurred while fetching values with tombstones")
+	assert.Equal(t, []BucketValue{
+		{Idx: 1, Value: []byte("1")},
+		{Idx: 2, Value: []byte("5")},
+		{Idx: 3, Tombstone: true},
+		{Idx: 4, Tombstone: true},
+	}, values, "append did not overwrite the first tombstone after the last value")
+
+	// Test whether the read is rejected without tombstones.
+	plain := SetupTestStore(t, true)
+	defer plain.Close()
+	plainBkt, err := plain.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	_, err = plainBkt.GetValuesWithTombstones(BucketRange{Start: 0, End: 10})
+	assert.ErrorIs(t, err, ErrTombstonesDisabled, "tombstones are read from a store without tombstones")
+}
+
+func TestTombstonesNotCounted(t *testing.T) {
+	str := setupTombstoneStore(t)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}, {Value: []byte("2")}, {Value: []byte("3")}}))
+	require.NoError(t, bkt.Free([]uint16{1, 2}), "error occurred while freeing values")
+
+	// Test whether tombstones are not counted as values.
+	stats, err := bkt.Stats()
+	assert.NoError(t, err, "error occurred while fetching bucket stats")
+	assert.Equal(t, uint64(1), stats.Values, "tombstones are counted by the bucket stats")
+	storeStats, err := str.Stats(StatsOptions{Exact: true})
+	assert.NoError(t, err, "error occurred while fetching store stats")
+	assert.Equal(t, uint64(1), storeStats.Values, "tombstones are counted by the store stats")
+	assert.Equal(t, math.MaxUint16-1, bkt.RemainingCapacity(), "tombstones take capacity")
+
+	// Test whether Compact only moves values.
+	mapping, err := bkt.Compact()
+	assert.NoError(t, err, "error occurred while compacting bucket")
+	assert.Equal(t, map[uint16]uint16{3: 1}, mapping, "tombstones are moved")
+	assert.Equal(t, uint16(1), lastIdxOf(t, bkt.(*pebbleBucket)), "tombstones are counted in lastIdx")
+	values, err := bkt.GetValuesWithTombstones(BucketRange{Start: 0, End: 10})
+	assert.NoError(t, err, "error occurred while fetching values with tombstones")
+	assert.Equal(t, []BucketValue{{Idx: 1, Value: []byte("3")}}, values, "incorrect values after compacting")
+
+	// Test whether CompareAndSwapValue frees a value with
+	// a tombstone and reports it as a delete.
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("4")}}))
+	events, cancel := str.Watch(TestBktID)
+	defer cancel()
+	swapped, err := bkt.CompareAndSwapValue(2, []byte("4"), nil)
+	assert.NoError(t, err, "error occurred while swapping value")
+	require.True(t, swapped, "value is not swapped")
+	assert.Equal(t, BucketChangeEvent{Kind: ChangeDelete, Idx: 2}, <-events, "free is not reported as a delete")
+	values, err = bkt.GetValuesWithTombstones(BucketRange{Start: 0, End: 10})
+	assert.NoError(t, err, "error occurred while fetching values with tombstones")
+	assert.Equal(t, []BucketValue{{Idx: 1, Value: []byte("3")}, {Idx: 2, Tombstone: true}}, values, "freed value has no tombstone")
+
+	// Test whether SwapValues leaves a tombstone at the
+	// idx of a missing value.
+	require.NoError(t, bkt.SwapValues(1, 3), "error occurred while swapping values")
+	values, err = bkt.GetValuesWithTombstones(BucketRange{Start: 0, End: 10})
+	assert.NoError(t, err, "error occurred while fetching values with tombstones")
+	assert.Equal(t, []BucketValue{
+		{Idx: 1, Tombstone: true},
+		{Idx: 2, Tombstone: true},
+		{Idx: 3, Value: []byte("3")},
+	}, values, "swapped value has no tombstone")
+
+	// Test whether DeleteValuesCount only counts values.
+	count, err := bkt.DeleteValuesCount(BucketRange{Start: 0, End: 10})
+	assert.NoError(t, err, "error occurred while deleting values")
+	assert.Equal(t, 1, count, "tombstones are counted as deleted values")
+}
+
+func TestMergeTombstone(t *testing.T) {
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: vfs.NewMem(), Merger: CounterMerger},
+		CacheTTL:   24,
+		Tombstones: true,
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}, {Value: []byte("2")}, {Value: []byte("3")}}))
+	require.NoError(t, bkt.Free([]uint16{1, 2}), "error occurred while freeing values")
+
+	// Test whether increments of freed indices start a new
+	// counter instead of merging into the tombstone.
+	require.NoError(t, bkt.IncrementValue(1, 5), "error occurred while incrementing value")
+	require.NoError(t, bkt.IncrementValue(1, 2), "error occurred while incrementing value")
+	total, err := bkt.IncrementAudited(2, 3, []byte("audit"))
+	require.NoError(t, err, "error occurred while incrementing audited value")
+	assert.Equal(t, int64(3), total, "audited counter includes the tombstone")
+
+	value, found, err := bkt.GetValue(1)
+	require.NoError(t, err, "error occurred while fetching value")
+	assert.True(t, found, "counter is not found")
+	counter, err := DecodeCounter(value.Value)
+	assert.NoError(t, err, "error occurred while decoding counter")
+	assert.Equal(t, int64(7), counter, "counter includes the tombstone")
+	values, err := bkt.GetValues(BucketRange{Start: 0, End: 10})
+	assert.NoError(t, err, "error occurred while fetching values")
+	assert.Len(t, values, 4, "incorrect values after incrementing freed indices")
+}
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+)
+
+// valueCacheRange is the maximum amount of indices in a
+// range for GetValues to use the value cache.
+const valueCacheRange = 16
+
+// valueCacheOverhead is the estimated memory usage in bytes
+// of a cached value, excluding the value itself.
+const valueCacheOverhead = 96
+
+// valueCache is a LRU cache of bucket values, see
+// StoreOptions.ValueCacheBytes.
+//
+// Writes invalidate all cached values of a bucket after
+// they are applied. A read that races with a write could
+// otherwise cache the value from before the write, so a
+// read takes a version with begin before it reads the
+// value, and put only caches the value when the bucket was
+// not invalidated since. A nil cache caches nothing.
+type valueCache struct {
+	mtx      sync.Mutex
+	maxBytes int64
+	bytes    int64
+	lru      *list.List // Cached values, the most recently used first.
+	buckets  map[[BucketIDLength]byte]*cachedBucket
+
+	// clock is incremented by each invalidation, and
+	// invalidated is the clock of the last invalidation.
+	// Buckets without cached values don't keep a version,
+	// so the last invalidation of any bucket is used.
+	clock       uint64
+	invalidated uint64
+}
+
+// cachedBucket contains the cached values of a bucket.
+type cachedBucket struct {
+	since  uint64 // Version of the first cached value.
+	values map[uint16]*list.Element
+}
+
+// cachedValue is a value in the cache, a value that is not
+// found is cached with found set to false.
+type cachedValue struct {
+	id    [BucketIDLength]byte
+	value BucketValue
+	found bool
+}
+
+// newValueCache creates a value cache that uses at most
+// maxBytes, or returns nil when maxBytes is not positive.
+func newValueCache(maxBytes int64) *valueCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &valueCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		buckets:  make(map[[BucketIDLength]byte]*cachedBucket),
+	}
+}
+
+// begin returns the version to pass to put for a read that
+// starts now.
+func (c *valueCache) begin() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.clock
+}
+
+// get returns a copy of a cached value and whether it was
+// found, ok is false when the value is not cached.
+func (c *valueCache) get(id BucketID, idx uint16) (_ BucketValue, found, ok bool) {
+	if c == nil {
+		return BucketValue{}, false, false
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	bkt, ok := c.buckets[*id]
+	if !ok {
+		return BucketValue{}, false, false
+	}
+	elem, ok := bkt.values[idx]
+	if !ok {
+		return BucketValue{}, false, false
+	}
+	c.lru.MoveToFront(elem)
+
+	cached := elem.Value.(*cachedValue)
+	value := cached.value
+	value.Value = append([]byte(nil), value.Value...)
+	return value, cached.found, true
+}
+
+// put caches a copy of a value that is read after version
+// was returned by begin. The value is not cached when the
+// bucket is invalidated since.
+func (c *valueCache) put(id BucketID, version uint64, value BucketValue, found bool) {
+	if c == nil {
+		return
+	}
+	size := int64(len(value.Value)) + valueCacheOverhead
+	if size > c.maxBytes {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	bkt, ok := c.buckets[*id]
+	if !ok {
+		if version < c.invalidated {
+			return
+		}
+		bkt = &cachedBucket{since: version, values: make(map[uint16]*list.Element)}
+		c.buckets[*id] = bkt
+	} else if version < bkt.since {
+		return
+	}
+
+	value.Value = append([]byte(nil), value.Value...)
+	if elem, ok := bkt.values[value.Idx]; ok {
+		cached := elem.Value.(*cachedValue)
+		c.bytes -= int64(len(cached.value.Value)) + valueCacheOverhead
+		cached.value, cached.found = value, found
+		c.lru.MoveToFront(elem)
+	} else {
+		bkt.values[value.Idx] = c.lru.PushFront(&cachedValue{id: *id, value: value, found: found})
+	}
+	c.bytes += size
+
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate removes the cached values of a bucket. It must
+// be called after a write to the bucket is applied.
+func (c *valueCache) invalidate(id BucketID) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.clock++
+	c.invalidated = c.clock
+	if bkt, ok := c.buckets[*id]; ok {
+		for _, elem := range bkt.values {
+			c.remove(elem)
+		}
+	}
+}
+
+// remove removes a value from the cache, and the bucket
+// when it has no values left. The caller must hold c.mtx.
+func (c *valueCache) remove(elem *list.Element) {
+	cached := c.lru.Remove(elem).(*cachedValue)
+	c.bytes -= int64(len(cached.value.Value)) + valueCacheOverhead
+
+	bkt := c.buckets[cached.id]
+	delete(bkt.values, cached.value.Idx)
+	if len(bkt.values) == 0 {
+		delete(c.buckets, cached.id)
+	}
+}
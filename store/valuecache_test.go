@@ -0,0 +1,156 @@
+package store
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupValueCacheStore creates a test store with a value
+// cache of the given size.
+func setupValueCacheStore(t *testing.T, size int64) Store {
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts:      &pebble.Options{FS: vfs.NewMem()},
+		CacheTTL:        24,
+		ValueCacheBytes: size,
+	})
+	require.NoError(t, err, "could not open test store")
+	return str
+}
+
+func TestValueCache(t *testing.T) {
+	str := setupValueCacheStore(t, 1<<20)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}, {Value: []byte("2")}}))
+
+	// Read the value, and change it in pebble without the
+	// store to test whether the next read is a cache hit.
+	value, found, err := bkt.GetValue(1)
+	require.NoError(t, err, "error occurred while fetching value")
+	require.True(t, found, "value is not found")
+	db := str.(*pebbleStore).db
+	require.NoError(t, db.Set(str.(*pebbleStore).getPebbleValueKey(TestBktID, 1), []byte("bypass"), nil))
+	value, found, err = bkt.GetValue(1)
+	assert.NoError(t, err, "error occurred while fetching cached value")
+	assert.True(t, found, "cached value is not found")
+	assert.Equal(t, []byte("1"), value.Value, "value is not read from the cache")
+
+	// Test whether the cached value is a copy.
+	value.Value[0] = 'x'
+	value, _, err = bkt.GetValue(1)
+	assert.NoError(t, err, "error occurred while fetching cached value")
+	assert.Equal(t, []byte("1"), value.Value, "cached value is modified through a returned value")
+
+	// Test whether an overwrite is visible to the next read.
+	require.NoError(t, bkt.PutValues([]BucketValue{{Idx: 1, Value: []byte("new")}}))
+	value, found, err = bkt.GetValue(1)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.True(t, found, "overwritten value is not found")
+	assert.Equal(t, []byte("new"), value.Value, "read returned a stale value after an overwrite")
+
+	// Test whether values that are not found are cached and
+	// invalidated by appends.
+	_, found, err = bkt.GetValue(3)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.False(t, found, "missing value is found")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("3")}}))
+	value, found, err = bkt.GetValue(3)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.True(t, found, "appended value is not found")
+	assert.Equal(t, []byte("3"), value.Value, "read returned a stale value after an append")
+
+	// Test whether GetValues uses the cache and is
+	// invalidated by deletes.
+	values, err := bkt.GetValues(BucketRange{Start: 1, End: 5})
+	require.NoError(t, err, "error occurred while fetching values")
+	require.NoError(t, db.Set(str.(*pebbleStore).getPebbleValueKey(TestBktID, 4), []byte("bypass"), nil))
+	cached, err := bkt.GetValues(BucketRange{Start: 1, End: 5})
+	assert.NoError(t, err, "error occurred while fetching cached values")
+	assert.Equal(t, values, cached, "values are not read from the cache")
+	cached, err = bkt.GetValues(BucketRange{Start: 1, End: 5, Reverse: true, Limit: 2})
+	assert.NoError(t, err, "error occurred while fetching cached values")
+	assert.Equal(t, []BucketValue{values[2], values[1]}, cached, "cached values ignore reverse and limit")
+
+	require.NoError(t, bkt.DeleteValues(BucketRange{Start: 1, End: 3}))
+	values, err = bkt.GetValues(BucketRange{Start: 1, End: 5})
+	assert.NoError(t, err, "error occurred while fetching values")
+	assert.Equal(t, []BucketValue{{Idx: 3, Value: []byte("3")}, {Idx: 4, Value: []byte("bypass")}}, values, "read returned stale values after a delete")
+
+	// Test whether a recreated bucket doesn't return the
+	// cached values of the deleted bucket.
+	_, _, err = bkt.GetValue(3)
+	require.NoError(t, err, "error occurred while fetching value")
+	require.NoError(t, str.DeleteBucket(bkt))
+	bkt, err = str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	_, found, err = bkt.GetValue(3)
+	assert.NoError(t, err, "error occurred while fetching value")
+	assert.False(t, found, "value of deleted bucket is returned")
+}
+
+func TestValueCacheEviction(t *testing.T) {
+	str := setupValueCacheStore(t, 4*(valueCacheOverhead+10))
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+
+	values := make([]BucketValue, 10)
+	for i := range values {
+		values[i] = BucketValue{Value: make([]byte, 10)}
+	}
+	require.NoError(t, bkt.AppendValues(values))
+	for idx := uint16(1); idx <= 10; idx++ {
+		_, _, err := bkt.GetValue(idx)
+		require.NoError(t, err, "error occurred while fetching value")
+	}
+
+	// Only the most recently read values are cached.
+	cache := str.(*pebbleStore).values
+	assert.LessOrEqual(t, cache.bytes, cache.maxBytes, "cache exceeds its size")
+	assert.Equal(t, 4, cache.lru.Len(), "cache has an incorrect amount of values")
+	_, _, ok := cache.get(TestBktID, 10)
+	assert.True(t, ok, "most recently read value is not cached")
+	_, _, ok = cache.get(TestBktID, 1)
+	assert.False(t, ok, "least recently read value is cached")
+}
+
+func TestValueCacheConcurrent(t *testing.T) {
+	str := setupValueCacheStore(t, 1<<20)
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("0")}}))
+
+	// Readers fill the cache while the writer overwrites the
+	// value, each read of the writer after its write must
+	// return the new value.
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				_, _, err := bkt.GetValue(1)
+				assert.NoError(t, err, "error occurred while fetching value")
+			}
+		}()
+	}
+	for i := 1; i <= 500; i++ {
+		expected := []byte(strconv.Itoa(i))
+		require.NoError(t, bkt.PutValues([]BucketValue{{Idx: 1, Value: expected}}))
+		value, _, err := bkt.GetValue(1)
+		require.NoError(t, err, "error occurred while fetching value")
+		require.Equal(t, expected, value.Value, "read returned a stale value after a write")
+	}
+	stop.Store(true)
+	wg.Wait()
+}
@@ -0,0 +1,205 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// VerifyReport contains the problems found by Verify.
+type VerifyReport struct {
+	Buckets        int          // Amount of buckets.
+	Values         int          // Amount of values, including orphaned values.
+	Orphans        []BucketID   // Buckets with values but without bucket data.
+	OrphanedValues int          // Amount of values of the orphaned buckets.
+	StaleLastIdx   []BucketID   // Cached buckets with an incorrect lastIdx.
+	Corrupted      []ValueError // Values that fail the checksum, see StoreOptions.Checksums.
+}
+
+// ValueError identifies a value that could not be read.
+type ValueError struct {
+	ID  BucketID
+	Idx uint16
+}
+
+// Ok returns whether no problems are found.
+func (report VerifyReport) Ok() bool {
+	return len(report.Orphans) == 0 && len(report.StaleLastIdx) == 0 && len(report.Corrupted) == 0
+}
+
+// Verify checks the consistency of the store.
+//
+// Both tables are scanned using a snapshot, so concurrent
+// writes don't show up as problems. Values whose bucket
+// data is missing are reported as orphans, cached buckets
+// are checked against the lastIdx in the value table.
+// Verify is a maintenance job, see runMaintenance.
+func (str *pebbleStore) Verify(ctx context.Context) (VerifyReport, error) {
+	done, err := str.beginOp()
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	defer done()
+
+	var report VerifyReport
+	err = str.runMaintenance(ctx, func() (err error) {
+		report, err = str.verify(ctx)
+		return err
+	})
+	return report, err
+}
+
+// Repair fixes the problems found by Verify.
+//
+// Orphaned values are deleted and the lastIdx of stale
+// buckets is corrected. Corrupted values are reported but
+// not modified, these can only be fixed by overwriting or
+// deleting them. Returns the report of the problems found
+// before repairing.
+func (str *pebbleStore) Repair(ctx context.Context) (VerifyReport, error) {
+	done, err := str.beginWrite()
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	defer done()
+
+	var report VerifyReport
+	err = str.runMaintenance(ctx, func() (err error) {
+		if report, err = str.verify(ctx); err != nil {
+			return err
+		}
+
+		batch := str.db.NewBatch()
+		defer batch.Close()
+		for _, id := range report.Orphans {
+			lower, upper := str.getPebbleValueKeyRange(id)
+			if err := batch.DeleteRange(lower, upper, nil); err != nil {
+				return err
+			}
+		}
+		if err := str.db.Apply(batch, nil); err != nil {
+			return err
+		}
+		for _, id := range report.Orphans {
+			str.values.invalidate(id)
+		}
+
+		for _, id := range report.StaleLastIdx {
+			if bkt, ok := str.cache.Load(*id); ok {
+				if err := str.repairLastIdx(bkt.(*pebbleBucket)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return report, err
+}
+
+// verify checks the consistency of the store, see Verify.
+func (str *pebbleStore) verify(ctx context.Context) (VerifyReport, error) {
+	var report VerifyReport
+	snap := str.db.NewSnapshot()
+	defer snap.Close()
+
+	// Collect the ids of all buckets.
+	buckets := make(map[[BucketIDLength]byte]bool)
+	iter := snap.NewIter(&pebble.IterOptions{
+		LowerBound: str.getTableKey(bucketTable, 0),
+		UpperBound: str.getTableKey(bucketTable+1, 0),
+	})
+	for iter.First(); iter.Valid(); iter.Next() {
+		var id [BucketIDLength]byte
+		copy(id[:], str.getKeyID(iter.Key()))
+		buckets[id] = true
+	}
+	if err := iter.Close(); err != nil {
+		return report, err
+	}
+	report.Buckets = len(buckets)
+
+	// Check all values, the context is checked for each
+	// bucket so a long running verification can be canceled.
+	iter = snap.NewIter(&pebble.IterOptions{
+		LowerBound: str.getTableKey(valueTable, 0),
+		UpperBound: str.getTableKey(valueTable+1, 0),
+	})
+	var current [BucketIDLength]byte
+	for iter.First(); iter.Valid(); iter.Next() {
+		report.Values++
+		key := iter.Key()
+		if report.Values == 1 || !bytes.Equal(str.getKeyID(key), current[:]) {
+			if err := ctx.Err(); err != nil {
+				_ = iter.Close()
+				return report, err
+			}
+
+			copy(current[:], str.getKeyID(key))
+			if !buckets[current] {
+				id := current
+				report.Orphans = append(report.Orphans, &id)
+			}
+		}
+
+		if !buckets[current] {
+			report.OrphanedValues++
+			continue
+		}
+
+		idx := getKeyIdx(key)
+		if _, _, err := str.decodeValue(idx, iter.Value()); errors.Is(err, ErrChecksumMismatch) {
+			id := current
+			report.Corrupted = append(report.Corrupted, ValueError{ID: &id, Idx: idx})
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return report, err
+	}
+
+	// Compare the lastIdx of the cached buckets with the
+	// value table.
+	var err error
+	str.cache.Range(func(key, val any) bool {
+		bkt := val.(*pebbleBucket)
+		lock := str.getBucketLock(bkt.id)
+		lock.RLock()
+		bkt.mtx.Lock()
+		var stale bool
+		if bkt.lastIdxLoaded.Load() {
+			var lastIdx uint16
+			lastIdx, err = fetchLastIdx(bkt)
+			stale = bkt.lastIdx != lastIdx
+		}
+		bkt.mtx.Unlock()
+		lock.RUnlock()
+
+		if err != nil {
+			return false
+		} else if stale {
+			id := key.([BucketIDLength]byte)
+			report.StaleLastIdx = append(report.StaleLastIdx, &id)
+		}
+		return true
+	})
+	return report, err
+}
+
+// repairLastIdx sets the lastIdx of a bucket to the highest
+// idx in the value table.
+func (str *pebbleStore) repairLastIdx(bkt *pebbleBucket) error {
+	lock := str.getBucketLock(bkt.id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	bkt.mtx.Lock()
+	defer bkt.mtx.Unlock()
+	lastIdx, err := fetchLastIdx(bkt)
+	if err != nil {
+		return err
+	}
+	bkt.lastIdx = lastIdx
+	bkt.lastIdxLoaded.Store(true)
+	return nil
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+
+	report, err := str.Verify(context.Background())
+	assert.NoError(t, err, "error occurred while verifying store")
+	assert.True(t, report.Ok(), "consistent store has problems")
+	assert.Equal(t, 1, report.Buckets, "incorrect bucket count")
+	assert.Equal(t, 10, report.Values, "incorrect value count")
+
+	// Corrupt the store by adding values without bucket
+	// data, and by changing the cached lastIdx.
+	db := str.(*pebbleStore).db
+	require.NoError(t, db.Set(str.(*pebbleStore).getPebbleValueKey(TestBktID2, 1), []byte("1"), nil))
+	require.NoError(t, db.Set(str.(*pebbleStore).getPebbleValueKey(TestBktID2, 2), []byte("2"), nil))
+	bkt.(*pebbleBucket).setLastIdx(3)
+
+	report, err = str.Verify(context.Background())
+	assert.NoError(t, err, "error occurred while verifying store")
+	assert.False(t, report.Ok(), "corrupted store has no problems")
+	assert.Equal(t, []BucketID{TestBktID2}, report.Orphans, "orphaned values are not reported")
+	assert.Equal(t, 2, report.OrphanedValues, "incorrect orphaned value count")
+	assert.Equal(t, []BucketID{TestBktID}, report.StaleLastIdx, "stale lastIdx is not reported")
+
+	// Test whether repair fixes the problems.
+	_, err = str.Repair(context.Background())
+	assert.NoError(t, err, "error occurred while repairing store")
+	assert.Equal(t, uint16(10), lastIdxOf(t, bkt.(*pebbleBucket)), "lastIdx is not repaired")
+	report, err = str.Verify(context.Background())
+	assert.NoError(t, err, "error occurred while verifying store")
+	assert.True(t, report.Ok(), "repaired store has problems")
+	assert.Equal(t, 10, report.Values, "orphaned values are not deleted")
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	str, err := OpenStore("", &StoreOptions{
+		PebbleOpts: &pebble.Options{FS: vfs.NewMem()},
+		CacheTTL:   24,
+		Checksums:  true,
+	})
+	require.NoError(t, err, "could not open test store")
+	defer str.Close()
+	bkt, err := str.CreateBucket(TestBktID, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("1")}, {Value: []byte("2")}}))
+
+	// Corrupt a value and test whether it is reported.
+	db := str.(*pebbleStore).db
+	require.NoError(t, db.Set(str.(*pebbleStore).getPebbleValueKey(TestBktID, 2), []byte{valueHeaderMagic, valueFlagChecksum, 0, 0, 0, 0, '2'}, nil))
+	report, err := str.Verify(context.Background())
+	assert.NoError(t, err, "error occurred while verifying store")
+	assert.Equal(t, []ValueError{{ID: TestBktID, Idx: 2}}, report.Corrupted, "corrupted value is not reported")
+}
@@ -0,0 +1,115 @@
+package store
+
+import "sync"
+
+// watchBufferSize is the amount of events buffered for each
+// watcher.
+const watchBufferSize = 64
+
+// BucketChangeKind is the kind of a bucket change.
+type BucketChangeKind uint8
+
+const (
+	ChangeSet         BucketChangeKind = iota // Value at Idx is set.
+	ChangeDelete                              // Value at Idx is deleted.
+	ChangeDeleteRange                         // Values in Range are deleted.
+)
+
+// BucketChangeEvent describes a change of the values in a
+// bucket.
+type BucketChangeEvent struct {
+	Kind  BucketChangeKind
+	Idx   uint16      // Changed idx, used by ChangeSet and ChangeDelete.
+	Range BucketRange // Deleted range, used by ChangeDeleteRange.
+}
+
+// watcher receives the changes of a bucket.
+type watcher struct {
+	ch   chan BucketChangeEvent
+	once sync.Once
+}
+
+// Watch subscribes to the changes of a bucket.
+//
+// Events are sent after the change is applied to the
+// store. Each watcher buffers watchBufferSize events, when
+// the buffer is full new events are dropped so slow
+// watchers never block writers. The returned function
+// unsubscribes the watcher and closes the channel. When the
+// store is closed, the returned channel is closed.
+func (str *pebbleStore) Watch(id BucketID) (<-chan BucketChangeEvent, func()) {
+	w := &watcher{ch: make(chan BucketChangeEvent, watchBufferSize)}
+	done, err := str.beginOp()
+	if err != nil {
+		w.once.Do(func() { close(w.ch) })
+		return w.ch, func() {}
+	}
+	defer done()
+
+	str.watchMtx.Lock()
+	if str.watchers == nil {
+		str.watchers = make(map[[BucketIDLength]byte][]*watcher)
+	}
+	str.watchers[*id] = append(str.watchers[*id], w)
+	str.watchMtx.Unlock()
+
+	return w.ch, func() {
+		w.once.Do(func() {
+			str.watchMtx.Lock()
+			defer str.watchMtx.Unlock()
+
+			watchers := str.watchers[*id]
+			for i := range watchers {
+				if watchers[i] == w {
+					watchers = append(watchers[:i], watchers[i+1:]...)
+					break
+				}
+			}
+
+			if len(watchers) == 0 {
+				delete(str.watchers, *id)
+			} else {
+				str.watchers[*id] = watchers
+			}
+			close(w.ch)
+		})
+	}
+}
+
+// notify sends events to the watchers of a bucket. Every
+// write calls notify or notifyValues after it is applied,
+// so the cached values of the bucket are invalidated here.
+func (str *pebbleStore) notify(id BucketID, events ...BucketChangeEvent) {
+	str.values.invalidate(id)
+	str.watchMtx.RLock()
+	defer str.watchMtx.RUnlock()
+	for _, w := range str.watchers[*id] {
+		for _, event := range events {
+			select {
+			case w.ch <- event:
+			default: // Drop event when the buffer is full.
+			}
+		}
+	}
+}
+
+// notifyValues sends the change events of the given values
+// to the watchers of a bucket, see notify.
+func (str *pebbleStore) notifyValues(id BucketID, values []BucketValue) {
+	str.values.invalidate(id)
+	str.watchMtx.RLock()
+	defer str.watchMtx.RUnlock()
+	for _, w := range str.watchers[*id] {
+		for _, value := range values {
+			event := BucketChangeEvent{Kind: ChangeSet, Idx: value.Idx}
+			if value.Tombstone {
+				event.Kind = ChangeDelete
+			}
+
+			select {
+			case w.ch <- event:
+			default: // Drop event when the buffer is full.
+			}
+		}
+	}
+}
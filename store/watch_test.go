@@ -0,0 +1,54 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	events, cancel := str.Watch(TestBktID)
+
+	// Test whether appends and deletes are received.
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("11")}}))
+	require.NoError(t, bkt.PutValues([]BucketValue{{Idx: 2, Tombstone: true}}))
+	require.NoError(t, bkt.DeleteValues(BucketRange{Start: 5, End: 7}))
+	assert.Equal(t, BucketChangeEvent{Kind: ChangeSet, Idx: 11}, <-events, "incorrect event for append")
+	assert.Equal(t, BucketChangeEvent{Kind: ChangeDelete, Idx: 2}, <-events, "incorrect event for freed value")
+	assert.Equal(t, BucketChangeEvent{Kind: ChangeDeleteRange, Range: BucketRange{Start: 5, End: 7}}, <-events, "incorrect event for delete")
+
+	// Test whether changes of other buckets are not received.
+	bkt2, err := str.CreateBucket(TestBktID2, TestBktKey)
+	require.NoError(t, err, "error occurred while creating bucket")
+	require.NoError(t, bkt2.AppendValues([]BucketValue{{Value: []byte("1")}}))
+	assert.Empty(t, events, "event received for another bucket")
+
+	// Test whether the channel is closed after cancel.
+	cancel()
+	cancel()
+	require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("12")}}))
+	_, ok := <-events
+	assert.False(t, ok, "channel is not closed after cancel")
+}
+
+func TestWatchSlowConsumer(t *testing.T) {
+	str := SetupTestStore(t, true)
+	defer str.Close()
+	bkt, err := str.GetBucket(TestBktID)
+	require.NoError(t, err, "error occurred while fetching bucket")
+	events, cancel := str.Watch(TestBktID)
+	defer cancel()
+
+	// Test whether writers are not blocked when the buffer
+	// is full.
+	for i := 0; i < watchBufferSize+10; i++ {
+		require.NoError(t, bkt.AppendValues([]BucketValue{{Value: []byte("test")}}))
+	}
+	assert.Len(t, events, watchBufferSize, "buffered events are not dropped")
+	assert.Equal(t, BucketChangeEvent{Kind: ChangeSet, Idx: 11}, <-events, "first event is not kept")
+}